@@ -1,14 +1,33 @@
 package main
 
 import (
+	"context"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"homework/internal/auth"
 	"homework/internal/config"
+	"homework/internal/domain"
+	"homework/internal/grpcserver"
 	"homework/internal/handlers"
+	"homework/internal/health"
+	"homework/internal/lifecycle"
+	"homework/internal/logging"
+	"homework/internal/metrics"
+	"homework/internal/rbac"
 	"homework/internal/repository"
+	"homework/internal/usecase"
 	"homework/internal/usecase/impl"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -16,17 +35,160 @@ func main() {
 	// запуск http сервера
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal(err)
+		fatal("load .env", err)
 	}
 	c, err := config.Read()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal("read config", err)
 	}
+	logger, err := logging.New(os.Stderr, c.LogFormat, c.LogLevel)
+	if err != nil {
+		fatal("set up logging", err)
+	}
+	slog.SetDefault(logger)
 	router := mux.NewRouter()
-	repo := repository.New()
-	deviceUC := impl.New(repo)
-	handler := handlers.NewHandler(deviceUC)
+	repo, err := newRepository(c)
+	if err != nil {
+		fatal("open repository", err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if counter, ok := repo.(metrics.ModelCounter); ok {
+		reg.MustRegister(metrics.NewModelCollector(counter))
+	}
+	deviceService := impl.New(metrics.NewDeviceRepository(repo, reg))
+	if c.PolicyFile != "" && !c.AuthDisabled {
+		if deviceService.Policy, err = rbac.Load(c.PolicyFile); err != nil {
+			fatal("load policy", err)
+		}
+	}
+	deviceUC := metrics.NewDeviceUseCase(deviceService, reg)
+	life := lifecycle.New(c.DrainDelay, c.ShutdownTimeout)
+	checks := health.New()
+	checks.Ready("lifecycle", 0, life.CheckReady)
+	if pinger, ok := repo.(interface{ Ping(context.Context) error }); ok {
+		checks.Ready("repository", c.HealthCheckTimeout, pinger.Ping)
+	}
+	if closer, ok := repo.(io.Closer); ok {
+		life.OnShutdown("repository", func(context.Context) error { return closer.Close() })
+	}
+	life.Go("purge trash", func(ctx context.Context) { purgeTrash(ctx, deviceUC, c.PurgeInterval, c.TrashRetention) })
+
+	handlerOpts := []handlers.Option{
+		handlers.WithRequireIfMatch(c.RequireIfMatch),
+		handlers.WithShutdown(life.Stopping()),
+	}
+	grpcOpts := append(grpcserver.Log(logger), grpcserver.Drain(life.Stopping()))
+	if !c.AuthDisabled {
+		authenticator, err := newAuthenticator(c)
+		if err != nil {
+			fatal("set up authentication", err)
+		}
+		handlerOpts = append(handlerOpts, handlers.WithAuthenticator(authenticator))
+		grpcOpts = append(grpcOpts, grpcserver.Authenticate(authenticator)...)
+	}
+	handler := handlers.NewHandler(deviceUC, handlerOpts...)
 	handler.RegisterHandlers(router)
 
-	log.Fatal(http.ListenAndServe(c.ServerAddress(), router))
+	lis, err := net.Listen("tcp", c.GRPCAddress())
+	if err != nil {
+		fatal("listen for grpc", err)
+	}
+	grpcServer := grpcserver.NewServer(deviceUC, grpcOpts...)
+	life.Serve("grpc", func() error { return grpcServer.Serve(lis) },
+		func(ctx context.Context) error { return grpcserver.Shutdown(ctx, grpcServer) })
+
+	// Probes and metrics are answered outside the router, without
+	// authentication.
+	probes := http.NewServeMux()
+	probes.Handle("/healthz", checks.LivenessHandler())
+	probes.Handle("/readyz", checks.ReadinessHandler())
+	probes.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))
+	probes.Handle("/", logging.Middleware(logger)(metrics.NewHTTP(reg).Instrument(router)))
+	httpServer := &http.Server{
+		Addr:              c.ServerAddress(),
+		Handler:           probes,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	life.Serve("http", httpServer.ListenAndServe, httpServer.Shutdown)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		// A second signal kills the process instead of waiting for the
+		// shutdown to finish.
+		<-ctx.Done()
+		stop()
+	}()
+	if err := life.Run(ctx); err != nil {
+		fatal("shut down", err)
+	}
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// purgeTrash periodically removes devices that outlived the trash retention,
+// until ctx is done.
+func purgeTrash(ctx context.Context, uc usecase.DeviceUseCase, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	ctx = auth.WithPrincipal(domain.WithActor(ctx, "purge"),
+		auth.Principal{Subject: "purge", Method: auth.MethodInternal})
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := uc.PurgeTrash(ctx, retention)
+		if err != nil {
+			slog.Error("purge trash failed", "error", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("purged trash", "devices", n)
+		}
+	}
+}
+
+func newAuthenticator(c *config.Config) (*auth.Authenticator, error) {
+	opts := []auth.Option{
+		auth.WithAPIKeys(c.APIKeys),
+		auth.WithAPIKeyTenants(c.APIKeyTenants),
+		auth.WithIssuer(c.JWTIssuer),
+		auth.WithAudience(c.JWTAudience),
+	}
+	if c.JWKSFile != "" {
+		keys, err := auth.LoadJWKS(c.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, auth.WithJWKS(keys))
+	}
+	return auth.New(opts...)
+}
+
+func newRepository(c *config.Config) (repository.Device, error) {
+	quotas := repository.WithQuotas(repository.Quotas{Default: c.DefaultTenantQuota, Tenants: c.TenantQuotas})
+	switch c.Storage {
+	case config.StorageFile:
+		repo, err := repository.NewFile(c.DataDir, c.SnapshotEvery, quotas)
+		if err != nil {
+			return nil, err
+		}
+		if n := repo.Truncated(); n > 0 {
+			slog.Warn("discarded torn WAL tail", "bytes", n, "dir", c.DataDir)
+		}
+		return repo, nil
+	case config.StorageSQLite:
+		return repository.NewSQLite(c.SQLitePath, quotas)
+	default:
+		return repository.New(quotas), nil
+	}
 }
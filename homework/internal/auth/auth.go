@@ -0,0 +1,260 @@
+// Package auth authenticates API clients, either by a static API key or by
+// a JWT bearer token signed with a key from a local JWKS file.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"homework/internal/domain"
+	"strings"
+	"time"
+)
+
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+	// MethodInternal marks work the service does on its own, like purging
+	// the trash. No request ever authenticates with it.
+	MethodInternal = "internal"
+
+	// rolesClaim is the token claim listing the roles of its subject, as
+	// an array or a space-separated string.
+	rolesClaim = "roles"
+	// tenantClaim is the token claim naming the tenant of its subject.
+	tenantClaim = "tenant"
+)
+
+// ErrNoCredentials is returned when a request carries neither an API key nor
+// a bearer token. It matches domain.ErrUnauthenticated with errors.Is.
+var ErrNoCredentials = fmt.Errorf("%w: no credentials", domain.ErrUnauthenticated)
+
+// Principal is who a request was authenticated as.
+type Principal struct {
+	// Subject is the name of the API key or the sub claim of the token.
+	Subject string
+	// Method is MethodAPIKey, MethodJWT or MethodInternal.
+	Method string
+	// Roles are the roles claim of the token; nil for API keys.
+	Roles []string
+	// Tenant is the tenant whose devices the principal works with: the
+	// tenant claim of the token or the tenant of the API key, and
+	// domain.DefaultTenant without either.
+	Tenant string
+	// Claims are the claims of the token; nil for API keys.
+	Claims map[string]any
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying p.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal set by WithPrincipal.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Credentials are what a request presents; at most one of them is used,
+// the API key first.
+type Credentials struct {
+	APIKey      string
+	BearerToken string
+}
+
+// Authenticator verifies credentials. The zero value rejects everything.
+type Authenticator struct {
+	// apiKeys maps the SHA-256 of a key to its name.
+	apiKeys map[[sha256.Size]byte]string
+	// apiKeyTenants maps the name of a key to its tenant.
+	apiKeyTenants map[string]string
+	keys          *KeySet
+	issuer        string
+	audience      string
+	now           func() time.Time
+}
+
+type Option func(*Authenticator) error
+
+// WithAPIKeys accepts the keys whose hex-encoded SHA-256 digests are the
+// values of keys; the map keys name them. Only digests are kept, so a leaked
+// configuration does not leak the keys.
+func WithAPIKeys(keys map[string]string) Option {
+	return func(a *Authenticator) error {
+		for name, digest := range keys {
+			b, err := hex.DecodeString(strings.TrimSpace(digest))
+			if err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("api key %q: want a hex-encoded SHA-256 digest", name)
+			}
+			a.apiKeys[[sha256.Size]byte(b)] = name
+		}
+		return nil
+	}
+}
+
+// WithAPIKeyTenants gives API keys, by name, a tenant other than
+// domain.DefaultTenant.
+func WithAPIKeyTenants(tenants map[string]string) Option {
+	return func(a *Authenticator) error {
+		for name, tenant := range tenants {
+			if !domain.ValidTenant(tenant) {
+				return fmt.Errorf("api key %q: invalid tenant %q", name, tenant)
+			}
+			a.apiKeyTenants[name] = tenant
+		}
+		return nil
+	}
+}
+
+// WithJWKS accepts HS256 and RS256 tokens signed with a key of keys.
+func WithJWKS(keys *KeySet) Option {
+	return func(a *Authenticator) error {
+		a.keys = keys
+		return nil
+	}
+}
+
+// WithIssuer requires tokens to carry iss; an empty issuer is not checked.
+func WithIssuer(issuer string) Option {
+	return func(a *Authenticator) error {
+		a.issuer = issuer
+		return nil
+	}
+}
+
+// WithAudience requires aud of tokens to include audience; an empty
+// audience is not checked.
+func WithAudience(audience string) Option {
+	return func(a *Authenticator) error {
+		a.audience = audience
+		return nil
+	}
+}
+
+// WithClock replaces time.Now when checking token lifetimes.
+func WithClock(now func() time.Time) Option {
+	return func(a *Authenticator) error {
+		a.now = now
+		return nil
+	}
+}
+
+func New(opts ...Option) (*Authenticator, error) {
+	a := &Authenticator{
+		apiKeys:       make(map[[sha256.Size]byte]string),
+		apiKeyTenants: make(map[string]string),
+		now:           time.Now,
+	}
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// HashAPIKey returns the digest WithAPIKeys expects for key.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the principal c belongs to. Every error matches
+// domain.ErrUnauthenticated; ErrNoCredentials means c is empty.
+func (a *Authenticator) Authenticate(c Credentials) (Principal, error) {
+	switch {
+	case c.APIKey != "":
+		return a.apiKey(c.APIKey)
+	case c.BearerToken != "":
+		return a.token(c.BearerToken)
+	default:
+		return Principal{}, ErrNoCredentials
+	}
+}
+
+func (a *Authenticator) apiKey(key string) (Principal, error) {
+	// The keys are random, so comparing their digests in a map does not
+	// leak anything a timing attack could use.
+	name, ok := a.apiKeys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return Principal{}, fmt.Errorf("%w: unknown API key", domain.ErrUnauthenticated)
+	}
+	return Principal{Subject: name, Method: MethodAPIKey, Tenant: tenantOr(a.apiKeyTenants[name])}, nil
+}
+
+func (a *Authenticator) token(raw string) (Principal, error) {
+	if a.keys == nil {
+		return Principal{}, fmt.Errorf("%w: bearer tokens are not accepted", domain.ErrUnauthenticated)
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(a.now),
+	}
+	if a.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		opts = append(opts, jwt.WithAudience(a.audience))
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(raw, claims, a.keys.keyFunc, opts...); err != nil {
+		return Principal{}, fmt.Errorf("%w: %w", domain.ErrUnauthenticated, tokenError(err))
+	}
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return Principal{}, fmt.Errorf("%w: token has no subject", domain.ErrUnauthenticated)
+	}
+	tenant, _ := claims[tenantClaim].(string)
+	if tenant != "" && !domain.ValidTenant(tenant) {
+		return Principal{}, fmt.Errorf("%w: token has an invalid tenant", domain.ErrUnauthenticated)
+	}
+	return Principal{
+		Subject: sub,
+		Method:  MethodJWT,
+		Roles:   roles(claims[rolesClaim]),
+		Tenant:  tenantOr(tenant),
+		Claims:  claims,
+	}, nil
+}
+
+func tenantOr(tenant string) string {
+	if tenant == "" {
+		return domain.DefaultTenant
+	}
+	return tenant
+}
+
+func roles(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var out []string
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// tokenError drops the "token is unverifiable" style prefixes jwt joins to
+// the reason, which read badly in a problem detail.
+func tokenError(err error) error {
+	var unwrapped interface{ Unwrap() []error }
+	if errors.As(err, &unwrapped) {
+		if errs := unwrapped.Unwrap(); len(errs) > 0 {
+			return errs[len(errs)-1]
+		}
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"homework/internal/auth"
+	"homework/internal/domain"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func jwks(t *testing.T, keys ...map[string]string) *auth.KeySet {
+	b, err := json.Marshal(map[string]any{"keys": keys})
+	require.NoError(t, err)
+	set, err := auth.ParseJWKS(b)
+	require.NoError(t, err)
+	return set
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return s
+}
+
+func TestAuthenticator(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	keys := jwks(t,
+		map[string]string{"kty": "oct", "kid": "hmac", "k": b64(secret)},
+		map[string]string{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig",
+			"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256"},
+	)
+	a, err := auth.New(
+		auth.WithAPIKeys(map[string]string{"ci": auth.HashAPIKey("ci-key"), "acme-ci": auth.HashAPIKey("acme-key")}),
+		auth.WithAPIKeyTenants(map[string]string{"acme-ci": "acme"}),
+		auth.WithJWKS(keys),
+		auth.WithIssuer("https://id.example.com"),
+		auth.WithAudience("homework"),
+		auth.WithClock(func() time.Time { return now }),
+	)
+	require.NoError(t, err)
+
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub": "alice",
+			"iss": "https://id.example.com",
+			"aud": "homework",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	testTable := []struct {
+		name        string
+		credentials auth.Credentials
+		subject     string
+		method      string
+		roles       []string
+		tenant      string
+		wantErr     string
+	}{
+		{
+			name:        "api key",
+			credentials: auth.Credentials{APIKey: "ci-key"},
+			subject:     "ci",
+			method:      auth.MethodAPIKey,
+			tenant:      domain.DefaultTenant,
+		},
+		{
+			name:        "api key of a tenant",
+			credentials: auth.Credentials{APIKey: "acme-key"},
+			subject:     "acme-ci",
+			method:      auth.MethodAPIKey,
+			tenant:      "acme",
+		},
+		{
+			name:        "unknown api key",
+			credentials: auth.Credentials{APIKey: "guess"},
+			wantErr:     "unauthenticated: unknown API key",
+		},
+		{
+			name:    "no credentials",
+			wantErr: "unauthenticated: no credentials",
+		},
+		{
+			name:        "hs256",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(nil))},
+			subject:     "alice",
+			method:      auth.MethodJWT,
+			tenant:      domain.DefaultTenant,
+		},
+		{
+			name:        "tenant claim",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(jwt.MapClaims{"tenant": "globex"}))},
+			subject:     "alice",
+			method:      auth.MethodJWT,
+			tenant:      "globex",
+		},
+		{
+			name:        "invalid tenant claim",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(jwt.MapClaims{"tenant": "../acme"}))},
+			wantErr:     "unauthenticated: token has an invalid tenant",
+		},
+		{
+			name:        "roles as array",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(jwt.MapClaims{"roles": []string{"admin", "technician"}}))},
+			subject:     "alice",
+			method:      auth.MethodJWT,
+			roles:       []string{"admin", "technician"},
+		},
+		{
+			name:        "roles as string",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(jwt.MapClaims{"roles": "admin technician"}))},
+			subject:     "alice",
+			method:      auth.MethodJWT,
+			roles:       []string{"admin", "technician"},
+		},
+		{
+			name:        "rs256 without kid",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodRS256, "", rsaKey, claims(nil))},
+			subject:     "alice",
+			method:      auth.MethodJWT,
+		},
+		{
+			name:        "wrong signature",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", []byte("other"), claims(nil))},
+			wantErr:     "unauthenticated: signature is invalid",
+		},
+		{
+			name:        "unknown kid",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "gone", secret, claims(nil))},
+			wantErr:     `unauthenticated: no HS256 key "gone"`,
+		},
+		{
+			name:        "public key used as hmac secret",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "rsa", rsaKey.N.Bytes(), claims(nil))},
+			wantErr:     `unauthenticated: no HS256 key "rsa"`,
+		},
+		{
+			name:        "alg none",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, claims(nil))},
+			wantErr:     "unauthenticated: token signature is invalid: signing method none is invalid",
+		},
+		{
+			name:        "expired",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}))},
+			wantErr:     "unauthenticated: token is expired",
+		},
+		{
+			name:        "no expiry",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(jwt.MapClaims{"exp": nil}))},
+			wantErr:     "unauthenticated: token is missing required claim: exp claim is required",
+		},
+		{
+			name:        "wrong audience",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(jwt.MapClaims{"aud": "billing"}))},
+			wantErr:     "unauthenticated: token has invalid audience",
+		},
+		{
+			name:        "no subject",
+			credentials: auth.Credentials{BearerToken: sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(jwt.MapClaims{"sub": nil}))},
+			wantErr:     "unauthenticated: token has no subject",
+		},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := a.Authenticate(tc.credentials)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				assert.True(t, errors.Is(err, domain.ErrUnauthenticated))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.subject, p.Subject)
+			assert.Equal(t, tc.method, p.Method)
+			assert.Equal(t, tc.roles, p.Roles)
+			if tc.tenant != "" {
+				assert.Equal(t, tc.tenant, p.Tenant)
+			}
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	testTable := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{name: "not json", doc: "keys", wantErr: "parse jwks: invalid character 'k' looking for beginning of value"},
+		{name: "no usable keys", doc: `{"keys":[{"kty":"oct","use":"enc","k":"c2VjcmV0"}]}`, wantErr: "parse jwks: no HS256 or RS256 signing keys"},
+		{name: "bad secret", doc: `{"keys":[{"kty":"oct","k":"!"}]}`, wantErr: "parse jwks: key 0: k must be a non-empty base64url string"},
+		{name: "unsupported alg", doc: `{"keys":[{"kty":"RSA","alg":"PS256","n":"AQAB","e":"AQAB"}]}`, wantErr: `parse jwks: key 0: unsupported alg "PS256" for an RSA key`},
+		{name: "valid", doc: `{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := auth.ParseJWKS([]byte(tc.doc))
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestWithAPIKeys(t *testing.T) {
+	_, err := auth.New(auth.WithAPIKeys(map[string]string{"ci": "plaintext"}))
+	assert.EqualError(t, err, `api key "ci": want a hex-encoded SHA-256 digest`)
+}
+
+func TestWithAPIKeyTenants(t *testing.T) {
+	_, err := auth.New(auth.WithAPIKeyTenants(map[string]string{"ci": "Acme Corp"}))
+	assert.EqualError(t, err, `api key "ci": invalid tenant "Acme Corp"`)
+}
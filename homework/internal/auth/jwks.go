@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"os"
+)
+
+// KeySet holds the verification keys of a JSON Web Key Set (RFC 7517).
+// Only "oct" keys, used for HS256, and "RSA" keys, used for RS256, are
+// kept; keys of other types or meant for encryption are skipped.
+type KeySet struct {
+	keys []verificationKey
+}
+
+type verificationKey struct {
+	kid string
+	alg string
+	key any
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// LoadJWKS reads a key set from path.
+func LoadJWKS(path string) (*KeySet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read jwks: %w", err)
+	}
+	keys, err := ParseJWKS(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// ParseJWKS parses a key set. A set without a single usable key is an
+// error, since no token could ever be verified against it.
+func ParseJWKS(b []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+	set := &KeySet{}
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key verificationKey
+		var err error
+		switch k.Kty {
+		case "oct":
+			key, err = octKey(k)
+		case "RSA":
+			key, err = rsaKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse jwks: key %d: %w", i, err)
+		}
+		set.keys = append(set.keys, key)
+	}
+	if len(set.keys) == 0 {
+		return nil, errors.New("parse jwks: no HS256 or RS256 signing keys")
+	}
+	return set, nil
+}
+
+func octKey(k jsonWebKey) (verificationKey, error) {
+	if k.Alg != "" && k.Alg != jwt.SigningMethodHS256.Alg() {
+		return verificationKey{}, fmt.Errorf("unsupported alg %q for an oct key", k.Alg)
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(k.K)
+	if err != nil || len(secret) == 0 {
+		return verificationKey{}, errors.New("k must be a non-empty base64url string")
+	}
+	return verificationKey{kid: k.Kid, alg: jwt.SigningMethodHS256.Alg(), key: secret}, nil
+}
+
+func rsaKey(k jsonWebKey) (verificationKey, error) {
+	if k.Alg != "" && k.Alg != jwt.SigningMethodRS256.Alg() {
+		return verificationKey{}, fmt.Errorf("unsupported alg %q for an RSA key", k.Alg)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil || len(n) == 0 {
+		return verificationKey{}, errors.New("n must be a non-empty base64url string")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return verificationKey{}, errors.New("e must be a base64url integer of at most 32 bits")
+	}
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	return verificationKey{kid: k.Kid, alg: jwt.SigningMethodRS256.Alg(), key: pub}, nil
+}
+
+// keyFunc picks the key named by the kid of the token, or, for a token
+// without one, the only key for its alg. The key has to be meant for that
+// alg, so a token cannot be HMAC-signed with a public RSA key.
+func (s *KeySet) keyFunc(t *jwt.Token) (any, error) {
+	alg := t.Method.Alg()
+	kid, _ := t.Header["kid"].(string)
+	var found *verificationKey
+	for i, k := range s.keys {
+		if k.alg != alg || (kid != "" && k.kid != kid) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("more than one %s key %q; the token has to name one with kid", alg, kid)
+		}
+		found = &s.keys[i]
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no %s key %q", alg, kid)
+	}
+	return found.key, nil
+}
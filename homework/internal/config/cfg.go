@@ -3,23 +3,134 @@ package config
 import (
 	"fmt"
 	"github.com/caarlos0/env/v9"
+	"homework/internal/logging"
+	"log/slog"
 	"net"
+	"time"
+)
+
+const (
+	StorageMemory = "memory"
+	StorageFile   = "file"
+	StorageSQLite = "sqlite"
 )
 
 type Config struct {
 	Host string `env:"HOST"`
 	Port string `env:"PORT"`
+	// GRPCPort is where DeviceService listens, on the same Host.
+	GRPCPort string `env:"GRPC_PORT" envDefault:"9090"`
+
+	// The HTTP server gives up on a client that is slower than these.
+	// Event streams are exempt from WriteTimeout.
+	ReadHeaderTimeout time.Duration `env:"READ_HEADER_TIMEOUT" envDefault:"5s"`
+	ReadTimeout       time.Duration `env:"READ_TIMEOUT" envDefault:"30s"`
+	WriteTimeout      time.Duration `env:"WRITE_TIMEOUT" envDefault:"60s"`
+	IdleTimeout       time.Duration `env:"IDLE_TIMEOUT" envDefault:"120s"`
+	// DrainDelay is how long readiness fails after SIGTERM before the
+	// servers stop taking connections, for load balancers to notice.
+	// ShutdownTimeout then bounds finishing requests and flushing state.
+	DrainDelay      time.Duration `env:"DRAIN_DELAY" envDefault:"5s"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	// HealthCheckTimeout bounds each dependency check behind /readyz.
+	HealthCheckTimeout time.Duration `env:"HEALTH_CHECK_TIMEOUT" envDefault:"2s"`
+
+	// LogLevel is the least severe level logged: "debug", "info", "warn"
+	// or "error". LogFormat is "json" or "text".
+	LogLevel  slog.Level `env:"LOG_LEVEL" envDefault:"info"`
+	LogFormat string     `env:"LOG_FORMAT" envDefault:"json"`
+
+	// Storage selects the repository backend: "memory", "file" or "sqlite".
+	Storage       string `env:"STORAGE" envDefault:"memory"`
+	DataDir       string `env:"DATA_DIR" envDefault:"data"`
+	SnapshotEvery int    `env:"SNAPSHOT_EVERY" envDefault:"1000"`
+	SQLitePath    string `env:"SQLITE_PATH" envDefault:"data/devices.db"`
+
+	// TrashRetention is how long deleted devices can be restored before the
+	// purge, which runs every PurgeInterval, removes them for good.
+	TrashRetention time.Duration `env:"TRASH_RETENTION" envDefault:"720h"`
+	PurgeInterval  time.Duration `env:"PURGE_INTERVAL" envDefault:"1h"`
+
+	// RequireIfMatch rejects PUT/DELETE without an If-Match header (428).
+	RequireIfMatch bool `env:"REQUIRE_IF_MATCH" envDefault:"false"`
+
+	// APIKeys maps the name of each API key to the hex-encoded SHA-256 of
+	// the key, as name:digest pairs separated by commas.
+	APIKeys map[string]string `env:"API_KEYS"`
+	// APIKeyTenants maps the name of an API key to its tenant, as
+	// name:tenant pairs; other keys belong to the default tenant. Tokens
+	// name theirs in the tenant claim.
+	APIKeyTenants map[string]string `env:"API_KEY_TENANTS"`
+	// JWKSFile holds the keys HS256 and RS256 bearer tokens are verified
+	// with; tokens are only accepted when it is set.
+	JWKSFile    string `env:"JWKS_FILE"`
+	JWTIssuer   string `env:"JWT_ISSUER"`
+	JWTAudience string `env:"JWT_AUDIENCE"`
+	// PolicyFile holds the roles and permissions of authenticated
+	// principals; without one every principal may do everything.
+	PolicyFile string `env:"POLICY_FILE"`
+	// AuthDisabled serves the API to anyone; only for local development.
+	AuthDisabled bool `env:"AUTH_DISABLED" envDefault:"false"`
+
+	// DefaultTenantQuota is how many devices a tenant may have unless
+	// TenantQuotas, as tenant:limit pairs, says otherwise. 0 means no
+	// limit.
+	DefaultTenantQuota int            `env:"DEFAULT_TENANT_QUOTA" envDefault:"0"`
+	TenantQuotas       map[string]int `env:"TENANT_QUOTAS"`
 }
 
 func (c *Config) ServerAddress() string {
 	return net.JoinHostPort(c.Host, c.Port)
 }
 
+func (c *Config) GRPCAddress() string {
+	return net.JoinHostPort(c.Host, c.GRPCPort)
+}
+
 func Read() (*Config, error) {
 	var config Config
 
 	if err := env.Parse(&config); err != nil {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
+	switch config.Storage {
+	case StorageMemory, StorageFile, StorageSQLite:
+	default:
+		return nil, fmt.Errorf("parse config: unknown STORAGE %q", config.Storage)
+	}
+	switch config.LogFormat {
+	case logging.FormatJSON, logging.FormatText:
+	default:
+		return nil, fmt.Errorf("parse config: unknown LOG_FORMAT %q", config.LogFormat)
+	}
+	if config.PurgeInterval <= 0 {
+		return nil, fmt.Errorf("parse config: PURGE_INTERVAL must be positive")
+	}
+	for name, d := range map[string]time.Duration{
+		"READ_HEADER_TIMEOUT":  config.ReadHeaderTimeout,
+		"READ_TIMEOUT":         config.ReadTimeout,
+		"WRITE_TIMEOUT":        config.WriteTimeout,
+		"IDLE_TIMEOUT":         config.IdleTimeout,
+		"DRAIN_DELAY":          config.DrainDelay,
+		"HEALTH_CHECK_TIMEOUT": config.HealthCheckTimeout,
+	} {
+		if d < 0 {
+			return nil, fmt.Errorf("parse config: %s must not be negative", name)
+		}
+	}
+	if config.ShutdownTimeout <= 0 {
+		return nil, fmt.Errorf("parse config: SHUTDOWN_TIMEOUT must be positive")
+	}
+	if config.DefaultTenantQuota < 0 {
+		return nil, fmt.Errorf("parse config: DEFAULT_TENANT_QUOTA must not be negative")
+	}
+	for tenant, limit := range config.TenantQuotas {
+		if limit < 0 {
+			return nil, fmt.Errorf("parse config: TENANT_QUOTAS: quota of %s must not be negative", tenant)
+		}
+	}
+	if !config.AuthDisabled && len(config.APIKeys) == 0 && config.JWKSFile == "" {
+		return nil, fmt.Errorf("parse config: set API_KEYS or JWKS_FILE, or AUTH_DISABLED=true")
+	}
 	return &config, nil
 }
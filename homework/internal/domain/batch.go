@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrAborted marks the operations of an atomic batch that were not applied
+// because another operation of the batch failed.
+var ErrAborted = errors.New("aborted")
+
+// BatchOperation is one item of a batch. Create and update carry the
+// device; delete names it by SerialNum. A non-zero Revision must match the
+// stored revision of an updated or deleted device.
+type BatchOperation struct {
+	Op        Operation
+	Device    Device
+	SerialNum string
+	Revision  uint64
+}
+
+// BatchResult is the outcome of the BatchOperation at the same index: the
+// stored device after a create or update, or the reason it failed.
+type BatchResult struct {
+	Device *Device
+	Err    error
+}
+
+// BatchFailed reports whether any operation of the batch failed.
+func BatchFailed(results []BatchResult) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// AbortBatch is the outcome of an atomic batch of n operations in which the
+// one at index failed with err: that error, and ErrAborted for all others.
+func AbortBatch(n, failed int, err error) []BatchResult {
+	results := make([]BatchResult, n)
+	for i := range results {
+		results[i].Err = fmt.Errorf("%w: operation %d failed", ErrAborted, failed)
+	}
+	results[failed].Err = err
+	return results
+}
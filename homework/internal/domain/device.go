@@ -1,7 +1,110 @@
 package domain
 
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
 type Device struct {
-	SerialNum string
-	Model     string
-	IP        string
+	SerialNum       string            `json:"serial_num"`
+	Model           string            `json:"model"`
+	IP              string            `json:"ip"`
+	FirmwareVersion string            `json:"firmware_version,omitempty"`
+	MAC             string            `json:"mac,omitempty"`
+	Hostname        string            `json:"hostname,omitempty"`
+	Site            string            `json:"site,omitempty"`
+	Location        string            `json:"location,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Status          Status            `json:"status,omitempty"`
+	// Transitions is the status history, oldest first. It is maintained by
+	// the use case layer; values sent by clients are ignored.
+	Transitions []Transition `json:"transitions,omitempty"`
+	// Revision is assigned by the repository: 1 on create, incremented on
+	// every update. When passed to an update it is the revision the caller
+	// expects to replace; 0 means unconditional.
+	Revision uint64 `json:"revision"`
+	// CreatedAt and UpdatedAt are maintained by the repository; values sent
+	// by clients are ignored.
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is set while the device is in the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+const (
+	maxHostnameLength = 253
+	maxLabelKeyLength = 63
+)
+
+// Validate checks the fields a client controls and reports every problem at once.
+func (d Device) Validate() error {
+	var fields []FieldError
+	if d.SerialNum == "" {
+		fields = append(fields, FieldError{Field: "serial_num", Message: "must not be empty"})
+	}
+	if net.ParseIP(d.IP).To4() == nil {
+		fields = append(fields, FieldError{Field: "ip", Message: "must be a valid IPv4 address"})
+	}
+	if d.MAC != "" {
+		if _, err := net.ParseMAC(d.MAC); err != nil {
+			fields = append(fields, FieldError{Field: "mac", Message: "must be a valid MAC address"})
+		}
+	}
+	if d.Hostname != "" && !validHostname(d.Hostname) {
+		fields = append(fields, FieldError{Field: "hostname", Message: "must be a valid RFC 1123 hostname"})
+	}
+	if d.Status != "" && !d.Status.Valid() {
+		fields = append(fields, FieldError{Field: "status", Message: fmt.Sprintf("unknown status %q", d.Status)})
+	}
+	for k := range d.Labels {
+		if k == "" || len(k) > maxLabelKeyLength {
+			fields = append(fields, FieldError{
+				Field:   "labels",
+				Message: fmt.Sprintf("keys must be 1-%d characters long", maxLabelKeyLength),
+			})
+			break
+		}
+	}
+	if len(fields) > 0 {
+		return NewValidationError(fields...)
+	}
+	return nil
+}
+
+func validHostname(h string) bool {
+	if len(h) > maxHostnameLength {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(h, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Clone returns a copy of d that shares no mutable state with it.
+func (d Device) Clone() Device {
+	if d.Labels != nil {
+		labels := make(map[string]string, len(d.Labels))
+		for k, v := range d.Labels {
+			labels[k] = v
+		}
+		d.Labels = labels
+	}
+	if d.DeletedAt != nil {
+		deletedAt := *d.DeletedAt
+		d.DeletedAt = &deletedAt
+	}
+	if d.Transitions != nil {
+		d.Transitions = append([]Transition(nil), d.Transitions...)
+	}
+	return d
 }
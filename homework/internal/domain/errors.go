@@ -1,5 +1,81 @@
 package domain
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
-var ErrNotFound = errors.New("not found")
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrValidation    = errors.New("validation failed")
+	ErrConflict      = errors.New("conflict")
+	ErrUnavailable   = errors.New("unavailable")
+	// ErrPreconditionFailed means the caller's expected revision is stale.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrGone means the requested point in the change stream is no longer
+	// retained; the caller has to start over from the current state.
+	ErrGone = errors.New("gone")
+	// ErrUnauthenticated means the caller sent no credentials, or ones that
+	// could not be verified.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden means the caller is known but lacks a permission.
+	ErrForbidden = errors.New("forbidden")
+	// ErrQuotaExceeded means the tenant already has as many devices as it
+	// may.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrTooLarge means a request carries more data than is accepted in
+	// one go.
+	ErrTooLarge = errors.New("too large")
+)
+
+// FieldError describes why a single input field was rejected.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError carries per-field details and matches ErrValidation with
+// errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func NewValidationError(fields ...FieldError) *ValidationError {
+	return &ValidationError{Fields: fields}
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		parts = append(parts, f.Field+": "+f.Message)
+	}
+	if len(parts) == 0 {
+		return ErrValidation.Error()
+	}
+	return ErrValidation.Error() + ": " + strings.Join(parts, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+// PermissionError names the permission the caller lacks and, for a
+// permission granted only for some devices, the device it does not cover.
+// It matches ErrForbidden with errors.Is.
+type PermissionError struct {
+	Permission string
+	SerialNum  string
+}
+
+func (e *PermissionError) Error() string {
+	msg := ErrForbidden.Error() + ": missing permission " + e.Permission
+	if e.SerialNum != "" {
+		msg += " on device " + e.SerialNum
+	}
+	return msg
+}
+
+func (e *PermissionError) Unwrap() error {
+	return ErrForbidden
+}
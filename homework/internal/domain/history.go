@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// Operation is the kind of change a HistoryEntry records.
+type Operation string
+
+const (
+	OpCreate Operation = "create"
+	OpUpdate Operation = "update"
+	OpDelete Operation = "delete"
+	// OpRestore takes a device out of the trash.
+	OpRestore Operation = "restore"
+	// OpPurge removes a device from the trash for good.
+	OpPurge Operation = "purge"
+)
+
+// HistoryEntry is one change of a device. Before is nil for a create and
+// After is nil for a delete or purge.
+type HistoryEntry struct {
+	// ResourceVersion orders every change of the repository, across all
+	// devices. It only ever grows.
+	ResourceVersion uint64    `json:"resource_version"`
+	SerialNum       string    `json:"serial_num"`
+	Op              Operation `json:"op"`
+	// Revision is the device revision the change produced, or for a delete
+	// the revision that was removed.
+	Revision uint64 `json:"revision"`
+	Actor    string `json:"actor,omitempty"`
+	// Tenant owns the device. Clients only ever see their own tenant's
+	// changes, so it is not encoded.
+	Tenant string    `json:"-"`
+	At     time.Time `json:"at"`
+	Before *Device   `json:"before,omitempty"`
+	After  *Device   `json:"after,omitempty"`
+}
+
+type actorKey struct{}
+
+// WithActor returns a context that attributes changes made with it to actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set by WithActor, or "".
+func ActorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
@@ -0,0 +1,55 @@
+package domain
+
+// OnConflict says what an import does with a serial number that already
+// exists.
+type OnConflict string
+
+const (
+	// ConflictFail reports the row and writes nothing at all if any row
+	// fails.
+	ConflictFail OnConflict = "fail"
+	// ConflictSkip keeps the stored device.
+	ConflictSkip OnConflict = "skip"
+	// ConflictOverwrite replaces the stored device like an update would.
+	ConflictOverwrite OnConflict = "overwrite"
+)
+
+func (c OnConflict) Valid() bool {
+	switch c {
+	case ConflictFail, ConflictSkip, ConflictOverwrite:
+		return true
+	}
+	return false
+}
+
+type ImportOptions struct {
+	OnConflict OnConflict
+	// DryRun checks every row and reports what would be written without
+	// writing anything.
+	DryRun bool
+}
+
+// ImportRow is a device read from row Row of an import file, or Err if the
+// row could not be read.
+type ImportRow struct {
+	Row    int
+	Device Device
+	Err    error
+}
+
+// ImportError is why row Row was not imported.
+type ImportError struct {
+	Row       int
+	SerialNum string
+	Err       error
+}
+
+// ImportReport counts what an import wrote, or would have written in a dry
+// run, and lists the rows it rejected.
+type ImportReport struct {
+	DryRun  bool
+	Created int
+	Updated int
+	Skipped int
+	Errors  []ImportError
+}
@@ -0,0 +1,76 @@
+package domain
+
+import (
+	"net/netip"
+	"strings"
+)
+
+var ErrInvalidCursor error = NewValidationError(FieldError{Field: "cursor", Message: "invalid cursor"})
+
+type SortField string
+
+const (
+	SortBySerialNum SortField = "serial_num"
+	SortByModel     SortField = "model"
+	SortByIP        SortField = "ip"
+)
+
+func (f SortField) Valid() bool {
+	switch f {
+	case SortBySerialNum, SortByModel, SortByIP:
+		return true
+	}
+	return false
+}
+
+// DeviceFilter describes which devices ListDevices returns and in which order.
+// Zero values mean "no filter"; Network matches both single addresses (/32)
+// and whole subnets.
+type DeviceFilter struct {
+	Model   string
+	Network netip.Prefix
+	SortBy  SortField
+	Desc    bool
+	Limit   int
+	Cursor  string
+}
+
+func (f DeviceFilter) Match(d Device) bool {
+	if f.Model != "" && d.Model != f.Model {
+		return false
+	}
+	if f.Network.IsValid() {
+		addr, err := netip.ParseAddr(d.IP)
+		if err != nil || !f.Network.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+	return true
+}
+
+type DevicePage struct {
+	Devices    []Device `json:"devices"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+	// ResourceVersion is the version of the last change the page reflects.
+	// Watching from it delivers exactly the changes made after the page was
+	// read.
+	ResourceVersion uint64 `json:"resource_version,omitempty"`
+}
+
+// ParseNetwork reads an address as a single-address prefix, or a CIDR
+// subnet, as DeviceFilter.Network expects.
+func ParseNetwork(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,17 @@
+package domain
+
+// PatchType is the media type of a partial update document.
+type PatchType string
+
+const (
+	// MergePatch is an RFC 7396 JSON Merge Patch.
+	MergePatch PatchType = "application/merge-patch+json"
+	// JSONPatch is an RFC 6902 JSON Patch, including "test" operations.
+	JSONPatch PatchType = "application/json-patch+json"
+)
+
+// Patch is a partial update applied to the JSON representation of a Device.
+type Patch struct {
+	Type     PatchType
+	Document []byte
+}
@@ -0,0 +1,24 @@
+package domain
+
+// Status is the lifecycle state of a device.
+type Status string
+
+const (
+	StatusOrdered        Status = "ordered"
+	StatusProvisioned    Status = "provisioned"
+	StatusActive         Status = "active"
+	StatusMaintenance    Status = "maintenance"
+	StatusDecommissioned Status = "decommissioned"
+	StatusDisposed       Status = "disposed"
+)
+
+// DefaultStatus is assigned to devices created without a status.
+const DefaultStatus = StatusOrdered
+
+func (s Status) Valid() bool {
+	switch s {
+	case StatusOrdered, StatusProvisioned, StatusActive, StatusMaintenance, StatusDecommissioned, StatusDisposed:
+		return true
+	}
+	return false
+}
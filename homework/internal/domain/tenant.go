@@ -0,0 +1,33 @@
+package domain
+
+import (
+	"context"
+	"regexp"
+)
+
+// DefaultTenant owns the devices of requests that name no tenant, and every
+// device stored before tenants existed.
+const DefaultTenant = "default"
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidTenant reports whether name can name a tenant: a DNS label of lower
+// case letters, digits and dashes.
+func ValidTenant(name string) bool {
+	return tenantPattern.MatchString(name)
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose devices are those of tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom returns the tenant set by WithTenant, or DefaultTenant.
+func TenantFrom(ctx context.Context) string {
+	if tenant, _ := ctx.Value(tenantKey{}).(string); tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
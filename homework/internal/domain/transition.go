@@ -0,0 +1,42 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Transition records one change of a device's lifecycle status.
+type Transition struct {
+	From Status `json:"from"`
+	To   Status `json:"to"`
+	// Actor is who requested the transition; it may be empty for status
+	// changes made through a plain update by an anonymous client.
+	Actor  string    `json:"actor,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// TransitionError is returned when a device cannot move from one status to
+// another. It matches ErrConflict with errors.Is.
+type TransitionError struct {
+	From    Status
+	To      Status
+	Allowed []Status
+}
+
+func (e *TransitionError) Error() string {
+	msg := fmt.Sprintf("cannot move device from %q to %q", e.From, e.To)
+	if len(e.Allowed) == 0 {
+		return msg + ": " + string(e.From) + " is final"
+	}
+	allowed := make([]string, 0, len(e.Allowed))
+	for _, s := range e.Allowed {
+		allowed = append(allowed, string(s))
+	}
+	return msg + "; allowed: " + strings.Join(allowed, ", ")
+}
+
+func (e *TransitionError) Unwrap() error {
+	return ErrConflict
+}
@@ -0,0 +1,174 @@
+// Package events fans device changes out to in-process subscribers such as
+// repository watches and the HTTP streaming endpoints.
+package events
+
+import (
+	"fmt"
+	"homework/internal/domain"
+	"sync"
+)
+
+const (
+	// DefaultReplay is how many recent changes are kept for resuming.
+	DefaultReplay = 1024
+
+	// subscriberBuffer is how many changes a subscriber may fall behind
+	// before it is dropped.
+	subscriberBuffer = 64
+)
+
+// Filter selects changes by the device they concern. The zero Filter
+// matches everything.
+type Filter struct {
+	Model  string
+	Labels map[string]string
+}
+
+// Match checks the device after the change, or before it for deletes.
+func (f Filter) Match(e domain.HistoryEntry) bool {
+	d := e.After
+	if d == nil {
+		d = e.Before
+	}
+	if d == nil {
+		return false
+	}
+	if f.Model != "" && d.Model != f.Model {
+		return false
+	}
+	for k, v := range f.Labels {
+		if d.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Broadcaster delivers changes, identified by their resource version, to
+// every subscriber. The last changes are kept in a ring buffer so a
+// subscriber that reconnects can resume where it left off.
+//
+// Notify never blocks on subscribers: one that falls too far behind has its
+// channel closed and must resume.
+type Broadcaster struct {
+	mu    sync.Mutex
+	ring  []domain.HistoryEntry
+	start int
+	size  int
+	// compacted is the newest version that can no longer be replayed.
+	compacted uint64
+	last      uint64
+	subs      map[*Subscription]struct{}
+}
+
+// NewBroadcaster keeps the last replay changes. Changes up to and including
+// version since happened before the broadcaster existed and cannot be
+// replayed.
+func NewBroadcaster(replay int, since uint64) *Broadcaster {
+	if replay <= 0 {
+		replay = DefaultReplay
+	}
+	return &Broadcaster{
+		ring:      make([]domain.HistoryEntry, replay),
+		compacted: since,
+		last:      since,
+		subs:      make(map[*Subscription]struct{}),
+	}
+}
+
+// Notify publishes a change. Changes must be published in increasing
+// resource version order.
+func (b *Broadcaster) Notify(e domain.HistoryEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.size == len(b.ring) {
+		b.compacted = b.ring[b.start].ResourceVersion
+		b.start = (b.start + 1) % len(b.ring)
+		b.size--
+	}
+	b.ring[(b.start+b.size)%len(b.ring)] = e
+	b.size++
+	b.last = e.ResourceVersion
+	for s := range b.subs {
+		select {
+		case s.ch <- e:
+		default:
+			b.dropLocked(s)
+		}
+	}
+}
+
+// Subscribe delivers changes published from now on.
+func (b *Broadcaster) Subscribe() *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribeLocked(nil)
+}
+
+// Resume delivers the retained changes after version and then everything
+// published from now on. It fails with domain.ErrGone if changes after
+// version have already left the replay buffer.
+func (b *Broadcaster) Resume(version uint64) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if version < b.compacted {
+		return nil, fmt.Errorf("%w: resource version %d is compacted, the oldest available is %d",
+			domain.ErrGone, version, b.compacted)
+	}
+	var replay []domain.HistoryEntry
+	for i := 0; i < b.size; i++ {
+		if e := b.ring[(b.start+i)%len(b.ring)]; e.ResourceVersion > version {
+			replay = append(replay, e)
+		}
+	}
+	return b.subscribeLocked(replay), nil
+}
+
+// Version returns the resource version of the newest change.
+func (b *Broadcaster) Version() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last
+}
+
+func (b *Broadcaster) subscribeLocked(replay []domain.HistoryEntry) *Subscription {
+	s := &Subscription{
+		b:    b,
+		ch:   make(chan domain.HistoryEntry, subscriberBuffer+len(replay)),
+		done: make(chan struct{}),
+	}
+	for _, e := range replay {
+		s.ch <- e
+	}
+	s.C = s.ch
+	b.subs[s] = struct{}{}
+	return s
+}
+
+func (b *Broadcaster) dropLocked(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+		close(s.done)
+	}
+}
+
+// Subscription is a stream of changes. C is closed when the subscriber is
+// dropped for falling behind or after Close.
+type Subscription struct {
+	C    <-chan domain.HistoryEntry
+	b    *Broadcaster
+	ch   chan domain.HistoryEntry
+	done chan struct{}
+}
+
+// Done is closed together with C, without consuming from it.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) Close() {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	s.b.dropLocked(s)
+}
@@ -0,0 +1,121 @@
+package events_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"homework/internal/domain"
+	"homework/internal/events"
+	"testing"
+)
+
+func entry(version uint64) domain.HistoryEntry {
+	d := domain.Device{SerialNum: "1"}
+	return domain.HistoryEntry{ResourceVersion: version, SerialNum: "1", Op: domain.OpCreate, After: &d}
+}
+
+func receive(t *testing.T, sub *events.Subscription) []uint64 {
+	t.Helper()
+	var versions []uint64
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return versions
+			}
+			versions = append(versions, e.ResourceVersion)
+		default:
+			return versions
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	device := &domain.Device{SerialNum: "1", Model: "a", Labels: map[string]string{"site": "msk", "role": "edge"}}
+
+	testTable := []struct {
+		name     string
+		filter   events.Filter
+		entry    domain.HistoryEntry
+		expected bool
+	}{
+		{name: "everything", entry: domain.HistoryEntry{After: device}, expected: true},
+		{name: "model", filter: events.Filter{Model: "a"}, entry: domain.HistoryEntry{After: device}, expected: true},
+		{name: "other model", filter: events.Filter{Model: "b"}, entry: domain.HistoryEntry{After: device}},
+		{
+			name:     "labels",
+			filter:   events.Filter{Labels: map[string]string{"site": "msk", "role": "edge"}},
+			entry:    domain.HistoryEntry{After: device},
+			expected: true,
+		},
+		{
+			name:   "other label value",
+			filter: events.Filter{Labels: map[string]string{"site": "spb"}},
+			entry:  domain.HistoryEntry{After: device},
+		},
+		{
+			name:     "delete matches the last state",
+			filter:   events.Filter{Model: "a"},
+			entry:    domain.HistoryEntry{Op: domain.OpDelete, Before: device},
+			expected: true,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.filter.Match(test.entry))
+		})
+	}
+}
+
+func TestBroadcasterResume(t *testing.T) {
+	b := events.NewBroadcaster(3, 0)
+	for v := uint64(1); v <= 5; v++ {
+		b.Notify(entry(v))
+	}
+	assert.Equal(t, uint64(5), b.Version())
+
+	sub, err := b.Resume(2)
+	require.NoError(t, err)
+	b.Notify(entry(6))
+	assert.Equal(t, []uint64{3, 4, 5, 6}, receive(t, sub))
+	sub.Close()
+
+	sub, err = b.Resume(6)
+	require.NoError(t, err)
+	assert.Empty(t, receive(t, sub))
+	sub.Close()
+
+	_, err = b.Resume(1)
+	assert.ErrorIs(t, err, domain.ErrGone)
+}
+
+func TestBroadcasterStartsAfterSince(t *testing.T) {
+	b := events.NewBroadcaster(3, 10)
+	assert.Equal(t, uint64(10), b.Version())
+
+	_, err := b.Resume(9)
+	assert.ErrorIs(t, err, domain.ErrGone)
+
+	sub, err := b.Resume(10)
+	require.NoError(t, err)
+	defer sub.Close()
+	b.Notify(entry(11))
+	assert.Equal(t, []uint64{11}, receive(t, sub))
+}
+
+func TestBroadcasterDropsSlowSubscribers(t *testing.T) {
+	b := events.NewBroadcaster(0, 0)
+	slow := b.Subscribe()
+	for v := uint64(1); v <= 1000; v++ {
+		b.Notify(entry(v))
+	}
+
+	versions := receive(t, slow)
+	assert.NotEmpty(t, versions)
+	assert.Less(t, len(versions), 1000)
+	_, open := <-slow.C
+	assert.False(t, open)
+	<-slow.Done()
+	// Closing a dropped subscription is harmless.
+	slow.Close()
+}
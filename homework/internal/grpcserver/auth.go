@@ -0,0 +1,53 @@
+package grpcserver
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"homework/internal/auth"
+	"homework/internal/domain"
+	"strings"
+)
+
+// apiKeyKey is the metadata key of an API key, like the X-API-Key header of
+// the HTTP API. Bearer tokens come in "authorization".
+const apiKeyKey = "x-api-key"
+
+// Authenticate returns the options for NewServer that reject calls without
+// valid credentials with Unauthenticated. The principal becomes the actor
+// of the changes made, in place of x-actor.
+func Authenticate(a *auth.Authenticator) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, err := authenticate(ctx, a)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := authenticate(ss.Context(), a)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &actorStream{ServerStream: ss, ctx: ctx})
+		}),
+	}
+}
+
+func authenticate(ctx context.Context, a *auth.Authenticator) (context.Context, error) {
+	var c auth.Credentials
+	if key := metadata.ValueFromIncomingContext(ctx, apiKeyKey); len(key) > 0 {
+		c.APIKey = key[0]
+	}
+	if authz := metadata.ValueFromIncomingContext(ctx, "authorization"); len(authz) > 0 {
+		if scheme, token, ok := strings.Cut(authz[0], " "); ok && strings.EqualFold(scheme, "Bearer") {
+			c.BearerToken = strings.TrimSpace(token)
+		}
+	}
+	p, err := a.Authenticate(c)
+	if err != nil {
+		return ctx, statusFromError(err)
+	}
+	return auth.WithPrincipal(domain.WithActor(ctx, p.Subject), p), nil
+}
@@ -0,0 +1,81 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"homework/internal/domain"
+)
+
+// codeFromError is the gRPC counterpart of the HTTP statusFromError.
+// Anything it does not recognise is an internal error.
+func codeFromError(err error) codes.Code {
+	switch {
+	case errors.Is(err, domain.ErrValidation):
+		return codes.InvalidArgument
+	case errors.Is(err, domain.ErrUnauthenticated):
+		return codes.Unauthenticated
+	case errors.Is(err, domain.ErrForbidden):
+		return codes.PermissionDenied
+	case errors.Is(err, domain.ErrQuotaExceeded), errors.Is(err, domain.ErrTooLarge):
+		return codes.ResourceExhausted
+	case errors.Is(err, domain.ErrNotFound):
+		return codes.NotFound
+	case errors.Is(err, domain.ErrAlreadyExists):
+		return codes.AlreadyExists
+	case errors.Is(err, domain.ErrConflict):
+		// The device is in the wrong state for the request, e.g. a
+		// transition its status does not allow.
+		return codes.FailedPrecondition
+	case errors.Is(err, domain.ErrPreconditionFailed), errors.Is(err, domain.ErrAborted):
+		// Lost a race with another write; reading the device again and
+		// retrying can succeed.
+		return codes.Aborted
+	case errors.Is(err, domain.ErrGone):
+		return codes.OutOfRange
+	case errors.Is(err, domain.ErrUnavailable):
+		return codes.Unavailable
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
+
+// statusFromError turns err into a status error. Validation errors carry
+// their fields as a BadRequest detail; server-side failures get a generic
+// message so internals never reach the client. err stays behind the status
+// for the log.
+func statusFromError(err error) error {
+	code := codeFromError(err)
+	if code == codes.Internal || code == codes.Unavailable {
+		return &causedStatus{st: status.New(code, code.String()), cause: err}
+	}
+	st := status.New(code, err.Error())
+	var verr *domain.ValidationError
+	if errors.As(err, &verr) {
+		br := &errdetails.BadRequest{}
+		for _, f := range verr.Fields {
+			br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Message})
+		}
+		if detailed, derr := st.WithDetails(br); derr == nil {
+			st = detailed
+		}
+	}
+	return &causedStatus{st: st, cause: err}
+}
+
+// causedStatus is a status error that remembers the error it was made
+// from. Only the status is sent to the client.
+type causedStatus struct {
+	st    *status.Status
+	cause error
+}
+
+func (e *causedStatus) Error() string              { return e.st.Err().Error() }
+func (e *causedStatus) GRPCStatus() *status.Status { return e.st }
+func (e *causedStatus) Unwrap() error              { return e.cause }
@@ -0,0 +1,83 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"homework/internal/logging"
+	"log/slog"
+	"time"
+)
+
+// requestIDKey is the metadata key of the request ID, like the
+// X-Request-ID header of the HTTP API. It is sent back in the header.
+const requestIDKey = "x-request-id"
+
+// Log returns the options for NewServer that give every call a request ID
+// and a logger tagged with it, log every call once it is done and log the
+// error of a failed one. Pass them first so that calls rejected by later
+// options are logged too.
+func Log(logger *slog.Logger) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, l, id := withLogger(ctx, logger)
+			_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+			start := time.Now()
+			resp, err := handler(ctx, req)
+			logCall(ctx, l, info.FullMethod, start, err)
+			return resp, err
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, l, id := withLogger(ss.Context(), logger)
+			_ = ss.SetHeader(metadata.Pairs(requestIDKey, id))
+			start := time.Now()
+			err := handler(srv, &actorStream{ServerStream: ss, ctx: ctx})
+			logCall(ctx, l, info.FullMethod, start, err)
+			return err
+		}),
+	}
+}
+
+// withLogger puts a logger tagged with the request ID of the call into ctx.
+func withLogger(ctx context.Context, logger *slog.Logger) (context.Context, *slog.Logger, string) {
+	var id string
+	if v := metadata.ValueFromIncomingContext(ctx, requestIDKey); len(v) > 0 {
+		id = v[0]
+	}
+	id = logging.RequestID(id)
+	l := logger.With(logging.RequestIDKey, id)
+	return logging.WithLogger(ctx, l), l, id
+}
+
+// logCall writes the access log line of a call and, when it failed, the
+// error it failed with, which the client may not have been told.
+func logCall(ctx context.Context, l *slog.Logger, method string, start time.Time, err error) {
+	code := status.Code(err)
+	if err != nil {
+		level := slog.LevelInfo
+		switch code {
+		case codes.Internal, codes.Unknown, codes.DataLoss:
+			level = slog.LevelError
+		case codes.Unavailable:
+			level = slog.LevelWarn
+		}
+		cause := err
+		var cs *causedStatus
+		if errors.As(err, &cs) {
+			cause = cs.cause
+		}
+		l.LogAttrs(ctx, level, "call failed",
+			slog.String("method", method),
+			slog.String("code", code.String()),
+			slog.String("error", cause.Error()),
+		)
+	}
+	l.LogAttrs(ctx, slog.LevelInfo, "call",
+		slog.String("method", method),
+		slog.String("code", code.String()),
+		slog.Duration("duration", time.Since(start)),
+	)
+}
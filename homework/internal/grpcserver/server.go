@@ -0,0 +1,204 @@
+// Package grpcserver serves the device use cases over gRPC, as
+// homework.devices.v1.DeviceService.
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"homework/internal/auth"
+	"homework/internal/domain"
+	"homework/internal/events"
+	"homework/internal/handlers/pb"
+	"homework/internal/usecase"
+	"strings"
+)
+
+const (
+	// actorKey is the metadata key naming who makes a change, like the
+	// X-Actor header of the HTTP API.
+	actorKey = "x-actor"
+	// tenantKey is the metadata key naming the tenant a call works on, like
+	// the /api/v1/tenants/{tenant} routes of the HTTP API.
+	tenantKey = "x-tenant"
+)
+
+// Server implements DeviceService on top of the device use cases.
+type Server struct {
+	pb.UnimplementedDeviceServiceServer
+	deviceUC usecase.DeviceUseCase
+}
+
+// NewServer returns a gRPC server with DeviceService registered on top of
+// deviceUC.
+func NewServer(deviceUC usecase.DeviceUseCase, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(unaryCaller),
+		grpc.ChainStreamInterceptor(streamCaller),
+	)
+	s := grpc.NewServer(opts...)
+	pb.RegisterDeviceServiceServer(s, &Server{deviceUC: deviceUC})
+	return s
+}
+
+func (s *Server) GetDevice(ctx context.Context, req *pb.GetDeviceRequest) (*pb.Device, error) {
+	device, err := s.deviceUC.GetDevice(ctx, req.GetSerialNum())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return pb.FromDevice(&device), nil
+}
+
+func (s *Server) CreateDevice(ctx context.Context, req *pb.CreateDeviceRequest) (*pb.Device, error) {
+	device, err := s.deviceUC.CreateDevice(ctx, pb.ToDevice(req.GetDevice()))
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return pb.FromDevice(&device), nil
+}
+
+func (s *Server) UpdateDevice(ctx context.Context, req *pb.UpdateDeviceRequest) (*pb.Device, error) {
+	device, err := s.deviceUC.UpdateDevice(ctx, pb.ToDevice(req.GetDevice()))
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return pb.FromDevice(&device), nil
+}
+
+func (s *Server) DeleteDevice(ctx context.Context, req *pb.DeleteDeviceRequest) (*emptypb.Empty, error) {
+	if err := s.deviceUC.DeleteDevice(ctx, req.GetSerialNum(), req.GetRevision()); err != nil {
+		return nil, statusFromError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) ListDevices(ctx context.Context, req *pb.ListDevicesRequest) (*pb.DevicePage, error) {
+	filter, err := deviceFilter(req)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	page, err := s.deviceUC.ListDevices(ctx, filter)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return pb.FromDevicePage(page), nil
+}
+
+func deviceFilter(req *pb.ListDevicesRequest) (domain.DeviceFilter, error) {
+	filter := domain.DeviceFilter{
+		Model:  req.GetModel(),
+		Cursor: req.GetCursor(),
+		Limit:  int(req.GetLimit()),
+	}
+	if req.GetLimit() < 0 {
+		return filter, domain.NewValidationError(domain.FieldError{Field: "limit", Message: "must not be negative"})
+	}
+	if ip := req.GetIp(); ip != "" {
+		prefix, err := domain.ParseNetwork(ip)
+		if err != nil {
+			return filter, domain.NewValidationError(domain.FieldError{Field: "ip", Message: fmt.Sprintf("invalid address or CIDR %q", ip)})
+		}
+		filter.Network = prefix
+	}
+	if sortBy := req.GetSort(); sortBy != "" {
+		sortBy, filter.Desc = strings.CutPrefix(sortBy, "-")
+		filter.SortBy = domain.SortField(sortBy)
+		if !filter.SortBy.Valid() {
+			return filter, domain.NewValidationError(domain.FieldError{Field: "sort", Message: fmt.Sprintf("unknown field %q", sortBy)})
+		}
+	}
+	return filter, nil
+}
+
+func (s *Server) WatchDevices(req *pb.WatchDevicesRequest, stream pb.DeviceService_WatchDevicesServer) error {
+	// Stop watching when the stream ends, not only when the client leaves.
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	changes, err := s.deviceUC.WatchDevices(ctx, req.GetSinceVersion())
+	if err != nil {
+		return statusFromError(err)
+	}
+	filter := events.Filter{Model: req.GetModel(), Labels: req.GetLabels()}
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case e, ok := <-changes:
+			if !ok {
+				return status.Error(codes.Unavailable, "subscriber fell behind; resume from the last resource_version")
+			}
+			if !filter.Match(e) {
+				continue
+			}
+			if err := stream.Send(pb.FromHistoryEntry(e)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func withActor(ctx context.Context) context.Context {
+	if _, ok := auth.PrincipalFrom(ctx); ok {
+		return ctx
+	}
+	if actor := metadata.ValueFromIncomingContext(ctx, actorKey); len(actor) > 0 {
+		return domain.WithActor(ctx, actor[0])
+	}
+	return ctx
+}
+
+// withTenant sets the tenant of the call: the one in x-tenant, or else the
+// tenant of the principal, which may only name its own.
+func withTenant(ctx context.Context) (context.Context, error) {
+	var tenant string
+	if t := metadata.ValueFromIncomingContext(ctx, tenantKey); len(t) > 0 {
+		tenant = t[0]
+		if !domain.ValidTenant(tenant) {
+			return ctx, statusFromError(domain.NewValidationError(domain.FieldError{Field: tenantKey, Message: fmt.Sprintf("invalid tenant %q", tenant)}))
+		}
+	}
+	if p, ok := auth.PrincipalFrom(ctx); ok {
+		if tenant != "" && tenant != p.Tenant {
+			return ctx, statusFromError(fmt.Errorf("%w: %s may not access tenant %s", domain.ErrForbidden, p.Subject, tenant))
+		}
+		tenant = p.Tenant
+	}
+	if tenant == "" {
+		return ctx, nil
+	}
+	return domain.WithTenant(ctx, tenant), nil
+}
+
+// caller sets who makes the call and for which tenant.
+func caller(ctx context.Context) (context.Context, error) {
+	return withTenant(withActor(ctx))
+}
+
+func unaryCaller(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func streamCaller(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := caller(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &actorStream{ServerStream: ss, ctx: ctx})
+}
+
+type actorStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *actorStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,380 @@
+package grpcserver_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"homework/internal/auth"
+	"homework/internal/domain"
+	"homework/internal/grpcserver"
+	"homework/internal/handlers/mocks"
+	"homework/internal/handlers/pb"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newClient serves uc over an in-memory connection.
+func newClient(t *testing.T, uc *mocks.DeviceUseCase, opts ...grpc.ServerOption) pb.DeviceServiceClient {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpcserver.NewServer(uc, opts...)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return pb.NewDeviceServiceClient(conn)
+}
+
+func hasActor(actor string) any {
+	return mock.MatchedBy(func(ctx context.Context) bool { return domain.ActorFrom(ctx) == actor })
+}
+
+func TestServer_Errors(t *testing.T) {
+	testTable := []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: domain.NewValidationError(domain.FieldError{Field: "ip", Message: "bad"}), code: codes.InvalidArgument},
+		{err: auth.ErrNoCredentials, code: codes.Unauthenticated},
+		{err: &domain.PermissionError{Permission: "devices.delete"}, code: codes.PermissionDenied},
+		{err: domain.ErrQuotaExceeded, code: codes.ResourceExhausted},
+		{err: fmt.Errorf("%w: device 1", domain.ErrNotFound), code: codes.NotFound},
+		{err: domain.ErrAlreadyExists, code: codes.AlreadyExists},
+		{err: domain.ErrConflict, code: codes.FailedPrecondition},
+		{err: domain.ErrPreconditionFailed, code: codes.Aborted},
+		{err: domain.ErrGone, code: codes.OutOfRange},
+		{err: fmt.Errorf("%w: disk full", domain.ErrUnavailable), code: codes.Unavailable},
+		{err: errors.New("boom"), code: codes.Internal},
+	}
+	for _, test := range testTable {
+		t.Run(test.code.String(), func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			mockDeviceUC.On("GetDevice", mock.Anything, "1").Return(domain.Device{}, test.err)
+			client := newClient(t, mockDeviceUC)
+
+			_, err := client.GetDevice(context.Background(), &pb.GetDeviceRequest{SerialNum: "1"})
+			st := status.Convert(err)
+			assert.Equal(t, test.code, st.Code())
+			if test.code == codes.Internal || test.code == codes.Unavailable {
+				assert.NotContains(t, st.Message(), test.err.Error())
+			}
+		})
+	}
+
+	t.Run("field violations", func(t *testing.T) {
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("CreateDevice", mock.Anything, mock.Anything).
+			Return(domain.Device{}, domain.NewValidationError(domain.FieldError{Field: "ip", Message: "must be an IP address"}))
+		client := newClient(t, mockDeviceUC)
+
+		_, err := client.CreateDevice(context.Background(), &pb.CreateDeviceRequest{Device: &pb.Device{SerialNum: "1", Ip: "x"}})
+		st := status.Convert(err)
+		require.Equal(t, codes.InvalidArgument, st.Code())
+		require.Len(t, st.Details(), 1)
+		br, ok := st.Details()[0].(*errdetails.BadRequest)
+		require.True(t, ok)
+		assert.Equal(t, "ip", br.FieldViolations[0].Field)
+		assert.Equal(t, "must be an IP address", br.FieldViolations[0].Description)
+	})
+}
+
+func TestServer_WriteDevices(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	stored := domain.Device{SerialNum: "1", Model: "a", IP: "0.9.9.0", Labels: map[string]string{"role": "edge"},
+		Status: domain.StatusActive, Revision: 1, CreatedAt: at, UpdatedAt: at}
+	mockDeviceUC := new(mocks.DeviceUseCase)
+	mockDeviceUC.On("CreateDevice", hasActor("alice"),
+		domain.Device{SerialNum: "1", Model: "a", IP: "0.9.9.0", Labels: map[string]string{"role": "edge"}}).Return(stored, nil)
+	updated := stored
+	updated.Model, updated.Revision = "b", 2
+	mockDeviceUC.On("UpdateDevice", hasActor("alice"), domain.Device{SerialNum: "1", Model: "b", IP: "0.9.9.0", Revision: 1}).Return(updated, nil)
+	mockDeviceUC.On("DeleteDevice", hasActor("alice"), "1", uint64(2)).Return(nil)
+	// Writes answer with the device the use case stored, without reading it
+	// back, so callers allowed to write but not read get it too.
+	client := newClient(t, mockDeviceUC)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-actor", "alice")
+
+	created, err := client.CreateDevice(ctx, &pb.CreateDeviceRequest{Device: &pb.Device{
+		SerialNum: "1", Model: "a", Ip: "0.9.9.0", Labels: map[string]string{"role": "edge"},
+		// Server-managed fields are ignored.
+		CreatedAt: pb.FromDevice(&domain.Device{CreatedAt: at.Add(time.Hour)}).CreatedAt,
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), created.Revision)
+	assert.Equal(t, at, created.CreatedAt.AsTime())
+	assert.Equal(t, "active", created.Status)
+
+	got, err := client.UpdateDevice(ctx, &pb.UpdateDeviceRequest{Device: &pb.Device{SerialNum: "1", Model: "b", Ip: "0.9.9.0", Revision: 1}})
+	require.NoError(t, err)
+	assert.Equal(t, "b", got.Model)
+	assert.Equal(t, uint64(2), got.Revision)
+
+	_, err = client.DeleteDevice(ctx, &pb.DeleteDeviceRequest{SerialNum: "1", Revision: 2})
+	require.NoError(t, err)
+	mockDeviceUC.AssertExpectations(t)
+}
+
+func TestServer_ListDevices(t *testing.T) {
+	testTable := []struct {
+		name           string
+		req            *pb.ListDevicesRequest
+		expectedFilter domain.DeviceFilter
+		expectedCode   codes.Code
+	}{
+		{
+			name: "all",
+			req:  &pb.ListDevicesRequest{},
+		},
+		{
+			name: "filtered",
+			req:  &pb.ListDevicesRequest{Model: "a", Ip: "10.0.0.0/8", Sort: "-ip", Limit: 2, Cursor: "c"},
+			expectedFilter: domain.DeviceFilter{Model: "a", Network: netip.MustParsePrefix("10.0.0.0/8"),
+				SortBy: domain.SortByIP, Desc: true, Limit: 2, Cursor: "c"},
+		},
+		{name: "bad ip", req: &pb.ListDevicesRequest{Ip: "10.0.0"}, expectedCode: codes.InvalidArgument},
+		{name: "bad sort", req: &pb.ListDevicesRequest{Sort: "hostname"}, expectedCode: codes.InvalidArgument},
+		{name: "bad limit", req: &pb.ListDevicesRequest{Limit: -1}, expectedCode: codes.InvalidArgument},
+	}
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			if test.expectedCode == codes.OK {
+				mockDeviceUC.On("ListDevices", mock.Anything, test.expectedFilter).
+					Return(domain.DevicePage{Devices: []domain.Device{{SerialNum: "1"}, {SerialNum: "2"}}, NextCursor: "n", ResourceVersion: 7}, nil)
+			}
+			client := newClient(t, mockDeviceUC)
+
+			page, err := client.ListDevices(context.Background(), test.req)
+			assert.Equal(t, test.expectedCode, status.Code(err))
+			if test.expectedCode == codes.OK {
+				require.Len(t, page.Devices, 2)
+				assert.Equal(t, "2", page.Devices[1].SerialNum)
+				assert.Equal(t, "n", page.NextCursor)
+				assert.Equal(t, uint64(7), page.ResourceVersion)
+			}
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestServer_WatchDevices(t *testing.T) {
+	edge := &domain.Device{SerialNum: "1", Model: "a", Labels: map[string]string{"role": "edge"}}
+	core := &domain.Device{SerialNum: "2", Model: "a", Labels: map[string]string{"role": "core"}}
+
+	t.Run("filtered", func(t *testing.T) {
+		changes := make(chan domain.HistoryEntry, 3)
+		changes <- domain.HistoryEntry{ResourceVersion: 5, SerialNum: "1", Op: domain.OpCreate, After: edge}
+		changes <- domain.HistoryEntry{ResourceVersion: 6, SerialNum: "2", Op: domain.OpCreate, After: core}
+		changes <- domain.HistoryEntry{ResourceVersion: 7, SerialNum: "1", Op: domain.OpDelete, Before: edge}
+		close(changes)
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("WatchDevices", mock.Anything, uint64(4)).Return((<-chan domain.HistoryEntry)(changes), nil)
+		client := newClient(t, mockDeviceUC)
+
+		stream, err := client.WatchDevices(context.Background(),
+			&pb.WatchDevicesRequest{SinceVersion: 4, Labels: map[string]string{"role": "edge"}})
+		require.NoError(t, err)
+		var versions []uint64
+		for {
+			e, err := stream.Recv()
+			if err != nil {
+				// The closed channel means the subscriber fell behind.
+				assert.Equal(t, codes.Unavailable, status.Code(err))
+				break
+			}
+			versions = append(versions, e.ResourceVersion)
+		}
+		assert.Equal(t, []uint64{5, 7}, versions)
+	})
+
+	t.Run("gone", func(t *testing.T) {
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("WatchDevices", mock.Anything, uint64(1)).Return(nil, domain.ErrGone)
+		client := newClient(t, mockDeviceUC)
+
+		stream, err := client.WatchDevices(context.Background(), &pb.WatchDevicesRequest{SinceVersion: 1})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.OutOfRange, status.Code(err))
+	})
+
+	t.Run("client cancels", func(t *testing.T) {
+		changes := make(chan domain.HistoryEntry)
+		started, stopped := make(chan struct{}), make(chan struct{})
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("WatchDevices", mock.Anything, uint64(0)).
+			Run(func(args mock.Arguments) {
+				ctx := args.Get(0).(context.Context)
+				close(started)
+				go func() {
+					<-ctx.Done()
+					close(stopped)
+				}()
+			}).
+			Return((<-chan domain.HistoryEntry)(changes), nil)
+		client := newClient(t, mockDeviceUC)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := client.WatchDevices(ctx, &pb.WatchDevicesRequest{})
+		require.NoError(t, err)
+		<-started
+		cancel()
+		_, err = stream.Recv()
+		assert.NotErrorIs(t, err, io.EOF)
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("watch was not stopped")
+		}
+	})
+
+	t.Run("server drains", func(t *testing.T) {
+		changes := make(chan domain.HistoryEntry)
+		started := make(chan struct{})
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("WatchDevices", mock.Anything, uint64(0)).
+			Run(func(mock.Arguments) { close(started) }).
+			Return((<-chan domain.HistoryEntry)(changes), nil)
+		stopping := make(chan struct{})
+		client := newClient(t, mockDeviceUC, grpcserver.Drain(stopping))
+
+		stream, err := client.WatchDevices(context.Background(), &pb.WatchDevicesRequest{})
+		require.NoError(t, err)
+		<-started
+		close(stopping)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+func TestServer_Authentication(t *testing.T) {
+	authenticator, err := auth.New(auth.WithAPIKeys(map[string]string{"ci": auth.HashAPIKey("secret")}))
+	require.NoError(t, err)
+	uc := new(mocks.DeviceUseCase)
+	uc.On("GetDevice", hasActor("ci"), "1").Return(domain.Device{SerialNum: "1"}, nil)
+	uc.On("WatchDevices", mock.Anything, uint64(0)).Return(nil, domain.ErrGone)
+	client := newClient(t, uc, grpcserver.Authenticate(authenticator)...)
+	ctx := context.Background()
+
+	_, err = client.GetDevice(ctx, &pb.GetDeviceRequest{SerialNum: "1"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	bad := metadata.AppendToOutgoingContext(ctx, "x-api-key", "guess")
+	_, err = client.GetDevice(bad, &pb.GetDeviceRequest{SerialNum: "1"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	stream, err := client.WatchDevices(ctx, &pb.WatchDevicesRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	uc.AssertNotCalled(t, "WatchDevices", mock.Anything, mock.Anything)
+
+	// The principal is the actor, whatever x-actor says.
+	good := metadata.AppendToOutgoingContext(ctx, "x-api-key", "secret", "x-actor", "mallory")
+	device, err := client.GetDevice(good, &pb.GetDeviceRequest{SerialNum: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, "1", device.GetSerialNum())
+}
+
+func TestServer_Tenants(t *testing.T) {
+	authenticator, err := auth.New(
+		auth.WithAPIKeys(map[string]string{"acme-ci": auth.HashAPIKey("acme-key")}),
+		auth.WithAPIKeyTenants(map[string]string{"acme-ci": "acme"}),
+	)
+	require.NoError(t, err)
+	inTenant := func(tenant string) any {
+		return mock.MatchedBy(func(ctx context.Context) bool { return domain.TenantFrom(ctx) == tenant })
+	}
+	uc := new(mocks.DeviceUseCase)
+	uc.On("GetDevice", inTenant("acme"), "1").Return(domain.Device{SerialNum: "1"}, nil)
+	uc.On("GetDevice", inTenant("globex"), "1").Return(domain.Device{SerialNum: "1", Model: "g"}, nil)
+	uc.On("GetDevice", inTenant(domain.DefaultTenant), "1").Return(domain.Device{SerialNum: "1", Model: "d"}, nil)
+	ctx := context.Background()
+
+	t.Run("Without authentication", func(t *testing.T) {
+		client := newClient(t, uc)
+		device, err := client.GetDevice(ctx, &pb.GetDeviceRequest{SerialNum: "1"})
+		require.NoError(t, err)
+		assert.Equal(t, "d", device.GetModel())
+		device, err = client.GetDevice(metadata.AppendToOutgoingContext(ctx, "x-tenant", "globex"), &pb.GetDeviceRequest{SerialNum: "1"})
+		require.NoError(t, err)
+		assert.Equal(t, "g", device.GetModel())
+		_, err = client.GetDevice(metadata.AppendToOutgoingContext(ctx, "x-tenant", "Globex"), &pb.GetDeviceRequest{SerialNum: "1"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("With authentication", func(t *testing.T) {
+		client := newClient(t, uc, grpcserver.Authenticate(authenticator)...)
+		acme := metadata.AppendToOutgoingContext(ctx, "x-api-key", "acme-key")
+		device, err := client.GetDevice(acme, &pb.GetDeviceRequest{SerialNum: "1"})
+		require.NoError(t, err)
+		assert.Empty(t, device.GetModel())
+		_, err = client.GetDevice(metadata.AppendToOutgoingContext(acme, "x-tenant", "acme"), &pb.GetDeviceRequest{SerialNum: "1"})
+		assert.NoError(t, err)
+		_, err = client.GetDevice(metadata.AppendToOutgoingContext(acme, "x-tenant", "globex"), &pb.GetDeviceRequest{SerialNum: "1"})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+}
+
+func TestServer_Logging(t *testing.T) {
+	uc := new(mocks.DeviceUseCase)
+	uc.On("GetDevice", mock.Anything, "1").Return(domain.Device{}, errors.New("disk on fire"))
+	uc.On("GetDevice", mock.Anything, "2").Return(domain.Device{SerialNum: "2"}, nil)
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	client := newClient(t, uc, grpcserver.Log(logger)...)
+	entries := func() []map[string]any {
+		var out []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var entry map[string]any
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			out = append(out, entry)
+		}
+		logs.Reset()
+		return out
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "req-1")
+	var header metadata.MD
+	_, err := client.GetDevice(ctx, &pb.GetDeviceRequest{SerialNum: "1"}, grpc.Header(&header))
+	st := status.Convert(err)
+	assert.Equal(t, codes.Internal, st.Code())
+	assert.NotContains(t, st.Message(), "disk on fire")
+	assert.Equal(t, []string{"req-1"}, header.Get("x-request-id"))
+	logged := entries()
+	require.Len(t, logged, 2)
+	assert.Equal(t, "call failed", logged[0]["msg"])
+	assert.Equal(t, "ERROR", logged[0]["level"])
+	assert.Equal(t, "disk on fire", logged[0]["error"])
+	assert.Equal(t, "req-1", logged[0]["request_id"])
+	assert.Equal(t, "call", logged[1]["msg"])
+	assert.Equal(t, "/homework.devices.v1.DeviceService/GetDevice", logged[1]["method"])
+	assert.Equal(t, "req-1", logged[1]["request_id"])
+
+	// Without one, the call gets a fresh ID.
+	_, err = client.GetDevice(context.Background(), &pb.GetDeviceRequest{SerialNum: "2"}, grpc.Header(&header))
+	require.NoError(t, err)
+	logged = entries()
+	require.Len(t, logged, 1)
+	assert.Equal(t, "OK", logged[0]["code"])
+	assert.Len(t, logged[0]["request_id"], 32)
+	assert.Equal(t, []string{logged[0]["request_id"].(string)}, header.Get("x-request-id"))
+}
@@ -0,0 +1,50 @@
+package grpcserver
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Drain returns the option for NewServer that ends streams once stopping
+// is closed, so that a graceful stop does not wait for watchers that never
+// leave. They get Unavailable and resume elsewhere.
+func Drain(stopping <-chan struct{}) grpc.ServerOption {
+	return grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := context.WithCancel(ss.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-stopping:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := handler(srv, &actorStream{ServerStream: ss, ctx: ctx})
+		select {
+		case <-stopping:
+			return status.Error(codes.Unavailable, "server is shutting down; resume from the last resource_version")
+		default:
+			return err
+		}
+	})
+}
+
+// Shutdown stops s gracefully, letting the calls in flight finish, and
+// cuts them off when ctx is done first.
+func Shutdown(ctx context.Context, s *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"errors"
+	"homework/internal/auth"
+	"homework/internal/domain"
+	"net/http"
+	"strings"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	authRealm    = "homework"
+)
+
+// WithAuthenticator requires every request but those for the OpenAPI
+// document and its viewer to authenticate with an API key in X-API-Key or
+// a bearer token. The principal becomes the actor of the changes made, in
+// place of X-Actor.
+func WithAuthenticator(a *auth.Authenticator) Option {
+	return func(h *Handler) {
+		h.authenticator = a
+	}
+}
+
+func (h *Handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.authenticator == nil || isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := h.authenticator.Authenticate(credentials(r))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", challenge(err))
+			writeError(w, r, err)
+			return
+		}
+		ctx := auth.WithPrincipal(domain.WithActor(r.Context(), p.Subject), p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func isPublic(path string) bool {
+	return path == openAPIPath || strings.HasPrefix(path, strings.TrimSuffix(docsPath, "/"))
+}
+
+func credentials(r *http.Request) auth.Credentials {
+	c := auth.Credentials{APIKey: r.Header.Get(apiKeyHeader)}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		c.BearerToken = strings.TrimSpace(token)
+	}
+	return c
+}
+
+// challenge is the WWW-Authenticate header of RFC 6750: a request that
+// sent no credentials is only told how to authenticate.
+func challenge(err error) string {
+	if errors.Is(err, auth.ErrNoCredentials) {
+		return `Bearer realm="` + authRealm + `"`
+	}
+	return `Bearer realm="` + authRealm + `", error="invalid_token"`
+}
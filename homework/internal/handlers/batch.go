@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homework/internal/domain"
+	"net/http"
+	"strconv"
+)
+
+// batchOperation is one item of the POST /api/v1/devices:batch body. Create
+// and update carry the device; delete names it by serial_num. The device is
+// decoded in a second step, like a single device body, so a bad one can be
+// reported by its index whatever the format of the body.
+type batchOperation struct {
+	Op        domain.Operation `json:"op"`
+	Device    any              `json:"device,omitempty"`
+	SerialNum string           `json:"serial_num,omitempty"`
+	Revision  uint64           `json:"revision,omitempty"`
+}
+
+// batchResult is the outcome of the operation at the same index, with the
+// status the single-device endpoint would have answered.
+type batchResult struct {
+	Status int            `json:"status"`
+	Device *domain.Device `json:"device,omitempty"`
+	Error  *Problem       `json:"error,omitempty"`
+}
+
+// BatchDevices applies an array of create, update and delete operations and
+// answers with a result per operation. Operations are independent unless
+// ?atomic=true, in which case either all of them are applied or none: a
+// failed atomic batch answers with the status of the failed operation, and
+// the others report 424.
+func (h *Handler) BatchDevices(w http.ResponseWriter, r *http.Request) {
+	codec, ok := h.negotiate(w, r, []batchResult(nil))
+	if !ok {
+		return
+	}
+	atomic := false
+	if v := r.URL.Query().Get("atomic"); v != "" {
+		var err error
+		if atomic, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, domain.NewValidationError(domain.FieldError{Field: "atomic", Message: "must be true or false"}))
+			return
+		}
+	}
+
+	var req []batchOperation
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+	ops := make([]domain.BatchOperation, len(req))
+	for i, item := range req {
+		ops[i] = domain.BatchOperation{Op: item.Op, SerialNum: item.SerialNum, Revision: item.Revision}
+		if item.Device == nil {
+			continue
+		}
+		d, err := batchDevice(item.Device)
+		if err != nil {
+			writeError(w, r, domain.NewValidationError(domain.FieldError{
+				Field:   "[" + strconv.Itoa(i) + "].device",
+				Message: "must be a device object",
+			}))
+			return
+		}
+		ops[i].Device = d
+	}
+
+	results, err := h.deviceUC.BatchDevices(r.Context(), ops, atomic)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	out := make([]batchResult, len(results))
+	for i, res := range results {
+		if res.Err != nil {
+			p := problemFromError(r, res.Err)
+			out[i] = batchResult{Status: p.Status, Error: &p}
+			if atomic && !errors.Is(res.Err, domain.ErrAborted) {
+				status = p.Status
+			}
+			continue
+		}
+		out[i] = batchResult{Status: batchStatus(ops[i].Op), Device: res.Device}
+	}
+	respond(w, r, codec, status, out)
+}
+
+// batchDevice decodes the device of a batch item, which the codec of the
+// body left as a generic value.
+func batchDevice(v any) (domain.Device, error) {
+	if _, ok := v.(map[string]any); !ok {
+		return domain.Device{}, fmt.Errorf("got %T, want an object", v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return domain.Device{}, err
+	}
+	return decodeDevice(bytes.NewReader(b))
+}
+
+func batchStatus(op domain.Operation) int {
+	switch op {
+	case domain.OpCreate:
+		return http.StatusCreated
+	case domain.OpDelete:
+		return http.StatusNoContent
+	default:
+		return http.StatusOK
+	}
+}
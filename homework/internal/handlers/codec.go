@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+	"homework/internal/domain"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Codec encodes response bodies in, and decodes request bodies from, one
+// media type. Not every format can represent every value: CanEncode and
+// CanDecode are asked before a codec is chosen, so a request is answered
+// with 406 or 415 before anything is changed.
+type Codec interface {
+	// MediaTypes lists the media types the codec answers to; the first one
+	// is sent as Content-Type.
+	MediaTypes() []string
+	CanEncode(v any) bool
+	CanDecode(v any) bool
+	Encode(w io.Writer, v any) error
+	Decode(r io.Reader, v any) error
+}
+
+// WithCodec registers an additional codec, replacing a built-in one that
+// answers to the same first media type.
+func WithCodec(c Codec) Option {
+	return func(h *Handler) {
+		h.codecs.register(c)
+	}
+}
+
+// defaultCodecs serves handlers that were not built with NewHandler.
+var defaultCodecs = newCodecRegistry()
+
+func (h *Handler) registry() *codecRegistry {
+	if h.codecs == nil {
+		return defaultCodecs
+	}
+	return h.codecs
+}
+
+// codecRegistry holds codecs in order of preference; the first one that can
+// encode a value is used when the client accepts anything.
+type codecRegistry struct {
+	codecs []Codec
+}
+
+func newCodecRegistry() *codecRegistry {
+	c := &codecRegistry{}
+	c.register(jsonCodec{})
+	c.register(yamlCodec{})
+	c.register(msgpackCodec{})
+	c.register(protobufCodec{})
+	c.register(csvCodec{})
+	return c
+}
+
+func (c *codecRegistry) register(codec Codec) {
+	for i, existing := range c.codecs {
+		if existing.MediaTypes()[0] == codec.MediaTypes()[0] {
+			c.codecs[i] = codec
+			return
+		}
+	}
+	c.codecs = append(c.codecs, codec)
+}
+
+// forAccept returns the codec for the most preferred media range of an
+// Accept header that can encode v. The codec answers with the media type
+// the range matched, so text/* is answered as text/yaml rather than
+// application/yaml.
+func (c *codecRegistry) forAccept(accept string, v any) (Codec, bool) {
+	if strings.TrimSpace(accept) == "" {
+		accept = "*/*"
+	}
+	ranges, excluded := parseAccept(accept)
+	for _, rng := range ranges {
+		for _, codec := range c.codecs {
+			if !codec.CanEncode(v) || excluded[codec.MediaTypes()[0]] {
+				continue
+			}
+			if t, ok := matchRange(codec, rng); ok {
+				return namedCodec{Codec: codec, mediaType: t}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// forContentType returns the codec that decodes mediaType into v.
+func (c *codecRegistry) forContentType(mediaType string, v any) (Codec, bool) {
+	for _, codec := range c.codecs {
+		for _, t := range codec.MediaTypes() {
+			if t == mediaType && codec.CanDecode(v) {
+				return codec, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// mediaTypes lists the first media type of every codec that satisfies ok.
+func (c *codecRegistry) mediaTypes(ok func(Codec) bool) string {
+	var types []string
+	for _, codec := range c.codecs {
+		if ok(codec) {
+			types = append(types, codec.MediaTypes()[0])
+		}
+	}
+	return strings.Join(types, ", ")
+}
+
+// parseAccept returns the media ranges of an Accept header, most preferred
+// first, and the media types it refuses with q=0.
+func parseAccept(header string) ([]string, map[string]bool) {
+	type weighted struct {
+		rng string
+		q   float64
+	}
+	var ranges []weighted
+	excluded := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			excluded[mediaType] = true
+			continue
+		}
+		ranges = append(ranges, weighted{rng: mediaType, q: q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	out := make([]string, len(ranges))
+	for i, r := range ranges {
+		out[i] = r.rng
+	}
+	return out, excluded
+}
+
+// matchRange returns the first media type of codec within rng.
+func matchRange(codec Codec, rng string) (string, bool) {
+	for _, t := range codec.MediaTypes() {
+		if rng == "*/*" || t == rng {
+			return t, true
+		}
+		if typ, ok := strings.CutSuffix(rng, "/*"); ok && strings.HasPrefix(t, typ+"/") {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// namedCodec is a codec chosen for one of its media types.
+type namedCodec struct {
+	Codec
+	mediaType string
+}
+
+func (n namedCodec) MediaTypes() []string { return []string{n.mediaType} }
+
+// negotiate picks the codec for a response like v from the Accept header.
+// Without one it answers 406 and returns ok=false, so handlers call it
+// before they change anything.
+func (h *Handler) negotiate(w http.ResponseWriter, r *http.Request, v any) (Codec, bool) {
+	codec, ok := h.registry().forAccept(r.Header.Get("Accept"), v)
+	if !ok {
+		writeProblem(w, newProblem(r, http.StatusNotAcceptable,
+			"this response is available as "+h.registry().mediaTypes(func(c Codec) bool { return c.CanEncode(v) })))
+		return nil, false
+	}
+	return codec, true
+}
+
+// respond writes v with status in the format chosen by negotiate.
+func respond(w http.ResponseWriter, r *http.Request, codec Codec, status int, v any) {
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, v); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", codec.MediaTypes()[0])
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// decodeBody decodes the request body into v with the codec for its
+// Content-Type; a body without one is JSON. It answers 415 or 400 itself
+// and returns ok=false when the request cannot proceed.
+func (h *Handler) decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	mediaType := "application/json"
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			mediaType = ""
+		}
+	}
+	codec, ok := h.registry().forContentType(mediaType, v)
+	if !ok {
+		writeProblem(w, newProblem(r, http.StatusUnsupportedMediaType,
+			"send one of "+h.registry().mediaTypes(func(c Codec) bool { return c.CanDecode(v) })))
+		return false
+	}
+	if err := codec.Decode(r.Body, v); err != nil {
+		if !errors.Is(err, domain.ErrValidation) {
+			err = badRequestBody(err)
+		}
+		writeError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// jsonCodec is the default format. Devices are decoded with decodeDevice,
+// so legacy field names keep working.
+type jsonCodec struct{}
+
+func (jsonCodec) MediaTypes() []string { return []string{"application/json"} }
+func (jsonCodec) CanEncode(any) bool   { return true }
+func (jsonCodec) CanDecode(any) bool   { return true }
+
+func (jsonCodec) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonCodec) Decode(r io.Reader, v any) error {
+	if d, ok := v.(*domain.Device); ok {
+		device, err := decodeDevice(r)
+		if err != nil {
+			return err
+		}
+		*d = device
+		return nil
+	}
+	// Other request bodies are strict, like their schemas.
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// yamlCodec goes through JSON so field names are the same in both formats.
+type yamlCodec struct{}
+
+func (yamlCodec) MediaTypes() []string {
+	return []string{"application/yaml", "application/x-yaml", "text/yaml"}
+}
+func (yamlCodec) CanEncode(any) bool { return true }
+func (yamlCodec) CanDecode(any) bool { return true }
+
+func (yamlCodec) Encode(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// JSON is YAML, so parsing it keeps the field order; only the flow
+	// style and quoting inherited from JSON have to go.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	blockStyle(&doc)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+func (yamlCodec) Decode(r io.Reader, v any) error {
+	// Read first: the decoder flattens read errors into its own, which
+	// would hide a body over the size limit.
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var doc any
+	if err := yaml.NewDecoder(bytes.NewReader(b)).Decode(&doc); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	return jsonCodec{}.Decode(bytes.NewReader(b), v)
+}
+
+// msgpackCodec uses the JSON field names as MessagePack map keys.
+type msgpackCodec struct{}
+
+func (msgpackCodec) MediaTypes() []string {
+	return []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}
+}
+func (msgpackCodec) CanEncode(any) bool { return true }
+func (msgpackCodec) CanDecode(any) bool { return true }
+
+func (msgpackCodec) Encode(w io.Writer, v any) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	return enc.Encode(v)
+}
+
+func (msgpackCodec) Decode(r io.Reader, v any) error {
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	if _, ok := v.(*domain.Device); !ok {
+		dec.DisallowUnknownFields(true)
+	}
+	return dec.Decode(v)
+}
+
+// csvCodec writes devices in the format of ExportDevices. It cannot decode
+// request bodies; use POST /api/v1/devices/import instead.
+type csvCodec struct{}
+
+func (csvCodec) MediaTypes() []string { return []string{csvContentType} }
+
+func (csvCodec) CanEncode(v any) bool {
+	switch v.(type) {
+	case domain.Device, domain.DevicePage:
+		return true
+	}
+	return false
+}
+
+func (csvCodec) CanDecode(any) bool { return false }
+
+func (csvCodec) Encode(w io.Writer, v any) error {
+	var devices []domain.Device
+	switch v := v.(type) {
+	case domain.Device:
+		devices = []domain.Device{v}
+	case domain.DevicePage:
+		devices = v.Devices
+	default:
+		return fmt.Errorf("csv: cannot encode %T", v)
+	}
+	out := newCSVDeviceWriter(w)
+	for _, d := range devices {
+		if err := out.write(d); err != nil {
+			return err
+		}
+	}
+	return out.flush()
+}
+
+func (csvCodec) Decode(io.Reader, any) error {
+	return errors.New("csv: request bodies are not supported")
+}
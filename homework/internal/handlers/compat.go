@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"homework/internal/domain"
+	"io"
+	"strings"
+)
+
+// legacyFields maps the PascalCase keys /api/v1 accepted before the device
+// model got snake_case JSON tags to their current names.
+var legacyFields = map[string]string{
+	"SerialNum": "serial_num",
+	"Model":     "model",
+	"IP":        "ip",
+	"Revision":  "revision",
+}
+
+// decodeDevice reads a device in either the current or the legacy PascalCase
+// format. When both spellings of a field are present the current one wins.
+func decodeDevice(r io.Reader) (domain.Device, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return domain.Device{}, badRequestBody(err)
+	}
+	body, err := json.Marshal(normalizeKeys(raw))
+	if err != nil {
+		return domain.Device{}, badRequestBody(err)
+	}
+	var d domain.Device
+	if err := json.Unmarshal(body, &d); err != nil {
+		return domain.Device{}, badRequestBody(err)
+	}
+	return d, nil
+}
+
+func normalizeKeys(raw map[string]json.RawMessage) map[string]json.RawMessage {
+	for legacy, current := range legacyFields {
+		v, ok := raw[legacy]
+		if !ok {
+			continue
+		}
+		delete(raw, legacy)
+		if _, ok := raw[current]; !ok {
+			raw[current] = v
+		}
+	}
+	return raw
+}
+
+// normalizePatch rewrites legacy field names in a patch document so old
+// clients can keep sending {"Model": ...} or {"path": "/Model"}.
+func normalizePatch(p domain.Patch) (domain.Patch, error) {
+	switch p.Type {
+	case domain.MergePatch:
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(p.Document, &raw); err != nil || raw == nil {
+			// Not an object: leave it to the patch engine to reject.
+			return p, nil
+		}
+		doc, err := json.Marshal(normalizeKeys(raw))
+		if err != nil {
+			return p, badRequestBody(err)
+		}
+		p.Document = doc
+	case domain.JSONPatch:
+		var ops []map[string]any
+		dec := json.NewDecoder(bytes.NewReader(p.Document))
+		dec.UseNumber()
+		if err := dec.Decode(&ops); err != nil {
+			return p, nil
+		}
+		for _, op := range ops {
+			for _, key := range []string{"path", "from"} {
+				if path, ok := op[key].(string); ok {
+					op[key] = normalizePointer(path)
+				}
+			}
+		}
+		doc, err := json.Marshal(ops)
+		if err != nil {
+			return p, fmt.Errorf("encode patch: %w", err)
+		}
+		p.Document = doc
+	}
+	return p, nil
+}
+
+func normalizePointer(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return path
+	}
+	first, rest, nested := strings.Cut(path[1:], "/")
+	if current, ok := legacyFields[first]; ok {
+		first = current
+	}
+	if !nested {
+		return "/" + first
+	}
+	return "/" + first + "/" + rest
+}
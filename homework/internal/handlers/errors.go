@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"homework/internal/domain"
+	"homework/internal/logging"
+	"log/slog"
+	"net/http"
+)
+
+// statusFromError is the single place where domain errors are turned into
+// HTTP status codes. Anything it does not recognise is an internal error.
+func statusFromError(err error) int {
+	switch {
+	case errors.Is(err, domain.ErrValidation):
+		return http.StatusBadRequest
+	case errors.Is(err, domain.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, domain.ErrForbidden), errors.Is(err, domain.ErrQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, domain.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, domain.ErrAlreadyExists), errors.Is(err, domain.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, domain.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, domain.ErrGone):
+		return http.StatusGone
+	case errors.Is(err, domain.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, domain.ErrAborted):
+		return http.StatusFailedDependency
+	case errors.Is(err, domain.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError responds with a problem+json body for err. It is where errors
+// of the use cases reach the client, so it is also where they are logged,
+// with what the client does not get to see.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	p := problemFromError(r, err)
+	level := slog.LevelInfo
+	if p.Status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	logging.LoggerFrom(r.Context()).LogAttrs(r.Context(), level, "request failed",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", p.Status),
+		slog.String("error", err.Error()),
+	)
+	writeProblem(w, p)
+}
+
+// problemFromError describes err as a problem. Server-side failures get a
+// generic detail so internals never reach the client.
+func problemFromError(r *http.Request, err error) Problem {
+	status := statusFromError(err)
+	var detail string
+	if status < http.StatusInternalServerError {
+		detail = err.Error()
+	}
+	p := newProblem(r, status, detail)
+
+	var verr *domain.ValidationError
+	if errors.As(err, &verr) {
+		p.Detail = "request has invalid fields"
+		for _, f := range verr.Fields {
+			p.Errors = append(p.Errors, ProblemField{Field: f.Field, Message: f.Message})
+		}
+	}
+	var perr *domain.PermissionError
+	if errors.As(err, &perr) {
+		p.Permission = perr.Permission
+	}
+	if errors.Is(err, domain.ErrQuotaExceeded) {
+		p.Type = quotaExceededType
+	}
+	return p
+}
+
+// badRequestBody is the error for a body that could not be read or decoded.
+// A body cut off by the size limit, or one the reader found too large, is
+// ErrTooLarge instead.
+func badRequestBody(err error) error {
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return fmt.Errorf("%w: body is larger than %d bytes", domain.ErrTooLarge, maxBytes.Limit)
+	}
+	if errors.Is(err, domain.ErrTooLarge) {
+		return err
+	}
+	return domain.NewValidationError(domain.FieldError{Field: "body", Message: err.Error()})
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"fmt"
+	"homework/internal/domain"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// formatETag tags a device by its revision and creation time. Revisions
+// start over at 1 when a serial number is deleted and created again; the
+// creation time keeps the tags of the two devices apart.
+func formatETag(d domain.Device) string {
+	return `"` + strconv.FormatUint(d.Revision, 10) + "-" +
+		strconv.FormatUint(uint64(d.CreatedAt.UnixMicro()), 36) + `"`
+}
+
+// parseETags splits an If-Match / If-None-Match value into quoted tags. It
+// returns any=true for "*". Weak tags are returned, without W/, only when
+// allowWeak is set, since If-Match uses strong comparison.
+func parseETags(header string, allowWeak bool) (tags []string, any bool) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil, true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !allowWeak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags, false
+}
+
+// ifMatch turns the If-Match header into the revision the use case must
+// check atomically (0 means unconditional). It writes the response and
+// returns ok=false when the request cannot proceed.
+func (h *Handler) ifMatch(w http.ResponseWriter, r *http.Request, serialNum string) (revision uint64, ok bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if h.requireIfMatch {
+			writeProblem(w, newProblem(r, http.StatusPreconditionRequired,
+				"this server requires an If-Match header with the device ETag"))
+			return 0, false
+		}
+		return 0, true
+	}
+
+	tags, any := parseETags(header, false)
+	if any {
+		return 0, true
+	}
+	if len(tags) == 0 {
+		writeError(w, r, fmt.Errorf("%w: no matching ETag", domain.ErrPreconditionFailed))
+		return 0, false
+	}
+
+	// A tag names the device it was read from as well as the revision, so
+	// only the current device can tell whether it matches. The use case
+	// still re-checks the revision under the repository lock.
+	current, err := h.deviceUC.GetDevice(r.Context(), serialNum)
+	if err != nil {
+		writeError(w, r, err)
+		return 0, false
+	}
+	etag := formatETag(current)
+	for _, tag := range tags {
+		if tag == etag {
+			return current.Revision, true
+		}
+	}
+	writeError(w, r, fmt.Errorf("%w: no matching ETag", domain.ErrPreconditionFailed))
+	return 0, false
+}
+
+// notModified reports whether If-None-Match matches the device, in which
+// case a GET should answer 304.
+func notModified(r *http.Request, d domain.Device) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	tags, any := parseETags(header, true)
+	if any {
+		return true
+	}
+	etag := formatETag(d)
+	for _, tag := range tags {
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"homework/internal/domain"
+	"homework/internal/events"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heartbeatInterval keeps idle streams from being cut by proxies.
+const heartbeatInterval = 15 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+// StreamEvents sends device changes as Server-Sent Events, or over a
+// WebSocket when the request asks for an upgrade. Event ids are resource
+// versions. ?model= and ?label=k=v (repeatable) narrow the stream;
+// Last-Event-ID, or ?last_event_id= for WebSocket clients that cannot set
+// headers, resumes after that version.
+func (h *Handler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var from uint64
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("last_event_id")
+	}
+	if last != "" {
+		if from, err = strconv.ParseUint(last, 10, 64); err != nil {
+			writeError(w, r, domain.NewValidationError(domain.FieldError{Field: "Last-Event-ID", Message: "must be an event id"}))
+			return
+		}
+	}
+
+	// Stop watching when the stream ends, not only when the client leaves.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	changes, err := h.deviceUC.WatchDevices(ctx, from)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		streamWebSocket(w, r, changes, filter, h.stopping)
+		return
+	}
+	streamSSE(w, r, changes, filter, h.stopping)
+}
+
+func parseEventFilter(q url.Values) (events.Filter, error) {
+	filter := events.Filter{Model: q.Get("model")}
+	for _, label := range q["label"] {
+		k, v, ok := strings.Cut(label, "=")
+		if !ok || k == "" {
+			return filter, domain.NewValidationError(domain.FieldError{Field: "label", Message: fmt.Sprintf("want key=value, got %q", label)})
+		}
+		if filter.Labels == nil {
+			filter.Labels = make(map[string]string)
+		}
+		filter.Labels[k] = v
+	}
+	return filter, nil
+}
+
+func streamSSE(w http.ResponseWriter, r *http.Request, changes <-chan domain.HistoryEntry, filter events.Filter, stopping <-chan struct{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	// The stream outlives the write timeout of the server, which is meant
+	// for single responses.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stopping:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-changes:
+			if !ok {
+				// Dropped for falling behind; the client reconnects with
+				// Last-Event-ID.
+				return
+			}
+			if !filter.Match(e) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ResourceVersion, e.Op, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func streamWebSocket(w http.ResponseWriter, r *http.Request, changes <-chan domain.HistoryEntry, filter events.Filter, stopping <-chan struct{}) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the request.
+		return
+	}
+	defer conn.Close()
+
+	// The stream is one-way; reading is only needed to process control
+	// frames and notice when the client goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-r.Context().Done():
+			return
+		case <-stopping:
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server is shutting down"),
+				time.Now().Add(time.Second))
+			return
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeatInterval)); err != nil {
+				return
+			}
+		case e, ok := <-changes:
+			if !ok {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber fell behind"),
+					time.Now().Add(time.Second))
+				return
+			}
+			if !filter.Match(e) {
+				continue
+			}
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		}
+	}
+}
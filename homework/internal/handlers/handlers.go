@@ -1,69 +1,138 @@
 package handlers
 
 import (
-	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
+	"homework/internal/auth"
 	"homework/internal/domain"
 	"homework/internal/usecase"
-	"net"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
 // Handler TODO: определить набор полей и методов
 type Handler struct {
-	deviceUC usecase.DeviceUseCase
+	deviceUC       usecase.DeviceUseCase
+	requireIfMatch bool
+	codecs         *codecRegistry
+	// reportDrift receives responses that do not match the OpenAPI
+	// document; nil turns response validation off.
+	reportDrift   func(error)
+	authenticator *auth.Authenticator
+	maxBodySize   int64
+	// stopping is closed when the server shuts down; nil never is.
+	stopping <-chan struct{}
 }
 
-func NewHandler(deviceUC usecase.DeviceUseCase) *Handler {
-	return &Handler{
-		deviceUC: deviceUC,
+// defaultMaxBodySize is large enough for a full batch or import.
+const defaultMaxBodySize = 16 << 20
+
+type Option func(*Handler)
+
+// WithMaxBodySize answers 413 to requests whose body is larger than n bytes.
+func WithMaxBodySize(n int64) Option {
+	return func(h *Handler) {
+		h.maxBodySize = n
+	}
+}
+
+// WithRequireIfMatch makes writes to an existing device answer 428 unless the client sends
+// If-Match.
+func WithRequireIfMatch(required bool) Option {
+	return func(h *Handler) {
+		h.requireIfMatch = required
+	}
+}
+
+// WithShutdown ends event streams once stopping is closed, so a server
+// shutting down does not wait for their clients to leave. Clients resume
+// from the last event id on another instance.
+func WithShutdown(stopping <-chan struct{}) Option {
+	return func(h *Handler) {
+		h.stopping = stopping
+	}
+}
+
+// WithResponseValidation checks every response against the OpenAPI
+// document and passes the ones that do not match to report before sending
+// them unchanged. Tests report to t.Errorf; a staging environment can log.
+func WithResponseValidation(report func(error)) Option {
+	return func(h *Handler) {
+		h.reportDrift = report
 	}
 }
+
+func NewHandler(deviceUC usecase.DeviceUseCase, opts ...Option) *Handler {
+	h := &Handler{
+		deviceUC:    deviceUC,
+		codecs:      newCodecRegistry(),
+		maxBodySize: defaultMaxBodySize,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
 func (h *Handler) CreateDevice(w http.ResponseWriter, r *http.Request) {
-	var device domain.Device
-	err := json.NewDecoder(r.Body).Decode(&device)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	codec, ok := h.negotiate(w, r, domain.Device{})
+	if !ok {
 		return
 	}
-	if net.ParseIP(device.IP).To4() == nil {
-		http.Error(w, "Invalid IP address", http.StatusBadRequest)
+
+	var device domain.Device
+	if !h.decodeBody(w, r, &device) {
 		return
 	}
 
-	err = h.deviceUC.CreateDevice(device)
+	created, err := h.deviceUC.CreateDevice(r.Context(), device)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusConflict)
+		writeError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+
+	w.Header().Set("ETag", formatETag(created))
+	respond(w, r, codec, http.StatusCreated, created)
 }
 
 func (h *Handler) GetDevice(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	serialNum := params["serialNum"]
 
-	device, err := h.deviceUC.GetDevice(serialNum)
-	if err != nil {
-		http.Error(w, "can`t get device", http.StatusNotFound)
+	codec, ok := h.negotiate(w, r, domain.Device{})
+	if !ok {
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(device)
+	device, err := h.deviceUC.GetDevice(r.Context(), serialNum)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+
+	w.Header().Set("ETag", formatETag(device))
+	if notModified(r, device) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	respond(w, r, codec, http.StatusOK, device)
 }
 
 func (h *Handler) DeleteDevice(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	serialNum := params["serialNum"]
 
-	err := h.deviceUC.DeleteDevice(serialNum)
+	revision, ok := h.ifMatch(w, r, serialNum)
+	if !ok {
+		return
+	}
+
+	err := h.deviceUC.DeleteDevice(r.Context(), serialNum, revision)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
@@ -74,27 +143,311 @@ func (h *Handler) UpdateDevice(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	serialNum := params["serialNum"]
 
+	codec, ok := h.negotiate(w, r, domain.Device{})
+	if !ok {
+		return
+	}
+
 	var updatedDevice domain.Device
-	err := json.NewDecoder(r.Body).Decode(&updatedDevice)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !h.decodeBody(w, r, &updatedDevice) {
 		return
 	}
 
 	updatedDevice.SerialNum = serialNum
+	revision, ok := h.ifMatch(w, r, serialNum)
+	if !ok {
+		return
+	}
+	updatedDevice.Revision = revision
 
-	err = h.deviceUC.UpdateDevice(updatedDevice)
+	device, err := h.deviceUC.UpdateDevice(r.Context(), updatedDevice)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("ETag", formatETag(device))
+	respond(w, r, codec, http.StatusOK, device)
+}
+
+func (h *Handler) PatchDevice(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	serialNum := params["serialNum"]
+
+	codec, ok := h.negotiate(w, r, domain.Device{})
+	if !ok {
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	patchType := domain.PatchType(mediaType)
+	if err != nil || (patchType != domain.MergePatch && patchType != domain.JSONPatch) {
+		w.Header().Set("Accept-Patch", string(domain.MergePatch)+", "+string(domain.JSONPatch))
+		writeProblem(w, newProblem(r, http.StatusUnsupportedMediaType,
+			"use "+string(domain.MergePatch)+" or "+string(domain.JSONPatch)))
+		return
+	}
+	document, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, badRequestBody(err))
+		return
+	}
+
+	patch, err := normalizePatch(domain.Patch{Type: patchType, Document: document})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	revision, ok := h.ifMatch(w, r, serialNum)
+	if !ok {
+		return
+	}
+
+	device, err := h.deviceUC.PatchDevice(r.Context(), serialNum, patch, revision)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(device))
+	respond(w, r, codec, http.StatusOK, device)
+}
+
+// transitionRequest is the body of POST /api/v1/devices/{serialNum}/transitions.
+type transitionRequest struct {
+	To     domain.Status `json:"to"`
+	Reason string        `json:"reason"`
+}
+
+func (h *Handler) TransitionDevice(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	serialNum := params["serialNum"]
+
+	codec, ok := h.negotiate(w, r, domain.Device{})
+	if !ok {
+		return
+	}
+
+	var req transitionRequest
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+
+	revision, ok := h.ifMatch(w, r, serialNum)
+	if !ok {
+		return
+	}
+
+	device, err := h.deviceUC.TransitionDevice(r.Context(), serialNum, domain.Transition{
+		To:     req.To,
+		Reason: req.Reason,
+	}, revision)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(device))
+	respond(w, r, codec, http.StatusOK, device)
+}
+
+func (h *Handler) GetDeviceHistory(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	serialNum := params["serialNum"]
+
+	codec, ok := h.negotiate(w, r, []domain.HistoryEntry(nil))
+	if !ok {
+		return
+	}
+
+	entries, err := h.deviceUC.GetDeviceHistory(r.Context(), serialNum)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	respond(w, r, codec, http.StatusOK, entries)
+}
+
+// revertRequest is the body of POST /api/v1/devices/{serialNum}/revert.
+type revertRequest struct {
+	Revision uint64 `json:"revision"`
+}
+
+func (h *Handler) RevertDevice(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	serialNum := params["serialNum"]
+
+	codec, ok := h.negotiate(w, r, domain.Device{})
+	if !ok {
+		return
+	}
+
+	var req revertRequest
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+	if req.Revision == 0 {
+		writeError(w, r, domain.NewValidationError(domain.FieldError{Field: "revision", Message: "must be a positive integer"}))
+		return
+	}
+
+	revision, ok := h.ifMatch(w, r, serialNum)
+	if !ok {
+		return
+	}
+
+	device, err := h.deviceUC.RevertDevice(r.Context(), serialNum, req.Revision, revision)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(device))
+	respond(w, r, codec, http.StatusOK, device)
+}
+
+func (h *Handler) ListTrash(w http.ResponseWriter, r *http.Request) {
+	codec, ok := h.negotiate(w, r, domain.DevicePage{})
+	if !ok {
+		return
+	}
+
+	devices, err := h.deviceUC.ListTrash(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	respond(w, r, codec, http.StatusOK, domain.DevicePage{Devices: devices})
+}
+
+func (h *Handler) RestoreDevice(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	serialNum := params["serialNum"]
+
+	codec, ok := h.negotiate(w, r, domain.Device{})
+	if !ok {
+		return
+	}
+
+	device, err := h.deviceUC.RestoreDevice(r.Context(), serialNum)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(device))
+	respond(w, r, codec, http.StatusOK, device)
+}
+
+func (h *Handler) ListDevices(w http.ResponseWriter, r *http.Request) {
+	codec, ok := h.negotiate(w, r, domain.DevicePage{})
+	if !ok {
+		return
+	}
+
+	filter, err := parseDeviceFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	page, err := h.deviceUC.ListDevices(r.Context(), filter)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	respond(w, r, codec, http.StatusOK, page)
+}
+
+// parseDeviceFilter reads ?model=, ?ip= (address or CIDR), ?sort= (field,
+// "-" prefix for descending), ?limit= and ?cursor= into a domain.DeviceFilter.
+func parseDeviceFilter(q url.Values) (domain.DeviceFilter, error) {
+	filter := domain.DeviceFilter{
+		Model:  q.Get("model"),
+		Cursor: q.Get("cursor"),
+	}
+
+	if ip := q.Get("ip"); ip != "" {
+		prefix, err := domain.ParseNetwork(ip)
+		if err != nil {
+			return filter, domain.NewValidationError(domain.FieldError{Field: "ip", Message: fmt.Sprintf("invalid address or CIDR %q", ip)})
+		}
+		filter.Network = prefix
+	}
+
+	if sortBy := q.Get("sort"); sortBy != "" {
+		if strings.HasPrefix(sortBy, "-") {
+			filter.Desc = true
+			sortBy = sortBy[1:]
+		}
+		filter.SortBy = domain.SortField(sortBy)
+		if !filter.SortBy.Valid() {
+			return filter, domain.NewValidationError(domain.FieldError{Field: "sort", Message: fmt.Sprintf("unknown field %q", sortBy)})
+		}
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return filter, domain.NewValidationError(domain.FieldError{Field: "limit", Message: "must be a positive integer"})
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
+
+// actorHeader names who is making a request. It is used only when the server
+// runs without an authenticator, in which case it is taken at face value for
+// the audit trail; otherwise authenticate replaces it with the principal.
+const actorHeader = "X-Actor"
+
+func withActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if actor := r.Header.Get(actorHeader); actor != "" {
+			r = r.WithContext(domain.WithActor(r.Context(), actor))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody makes reading more than maxBodySize bytes of a body fail, which
+// badRequestBody turns into 413.
+func (h *Handler) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (h *Handler) RegisterHandlers(router *mux.Router) {
-	router.HandleFunc("/api/v1/devices/{serialNum}", h.GetDevice).Methods(http.MethodGet)
-	router.HandleFunc("/api/v1/devices", h.CreateDevice).Methods(http.MethodPost)
-	router.HandleFunc("/api/v1/devices/{serialNum}", h.DeleteDevice).Methods(http.MethodDelete)
-	router.HandleFunc("/api/v1/devices/{serialNum}", h.UpdateDevice).Methods(http.MethodPut)
+	router.Use(h.limitBody, withActor, h.authenticate, h.validateOpenAPI, withTenant)
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	for _, prefix := range []string{"/api/v1", tenantPrefix} {
+		// Registered first so these names are not taken for serial numbers.
+		router.HandleFunc(prefix+"/devices/events", h.StreamEvents).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"/devices/export", h.ExportDevices).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"/devices/import", h.ImportDevices).Methods(http.MethodPost)
+		router.HandleFunc(prefix+"/devices/{serialNum}", h.GetDevice).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"/devices", h.ListDevices).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"/devices", h.CreateDevice).Methods(http.MethodPost)
+		router.HandleFunc(prefix+"/devices:batch", h.BatchDevices).Methods(http.MethodPost)
+		router.HandleFunc(prefix+"/devices/{serialNum}", h.DeleteDevice).Methods(http.MethodDelete)
+		router.HandleFunc(prefix+"/devices/{serialNum}", h.UpdateDevice).Methods(http.MethodPut)
+		router.HandleFunc(prefix+"/devices/{serialNum}", h.PatchDevice).Methods(http.MethodPatch)
+		router.HandleFunc(prefix+"/devices/{serialNum}/transitions", h.TransitionDevice).Methods(http.MethodPost)
+		router.HandleFunc(prefix+"/devices/{serialNum}/history", h.GetDeviceHistory).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"/devices/{serialNum}/revert", h.RevertDevice).Methods(http.MethodPost)
+		router.HandleFunc(prefix+"/devices/{serialNum}/restore", h.RestoreDevice).Methods(http.MethodPost)
+		router.HandleFunc(prefix+"/trash", h.ListTrash).Methods(http.MethodGet)
+	}
+	router.HandleFunc(openAPIPath, h.OpenAPI).Methods(http.MethodGet)
+	router.Handle(strings.TrimSuffix(docsPath, "/"), http.RedirectHandler(docsPath, http.StatusMovedPermanently)).Methods(http.MethodGet)
+	router.PathPrefix(docsPath).Handler(docs()).Methods(http.MethodGet)
 }
@@ -1,20 +1,49 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"homework/internal/auth"
 	"homework/internal/domain"
 	"homework/internal/handlers/mocks"
+	"homework/internal/handlers/pb"
+	"homework/internal/logging"
+	"homework/internal/usecase"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
+// newHandler returns a handler that fails t on every response that does not
+// match the OpenAPI document.
+func newHandler(t *testing.T, uc usecase.DeviceUseCase, opts ...Option) *Handler {
+	t.Helper()
+	validate := WithResponseValidation(func(err error) { t.Errorf("%v", err) })
+	return NewHandler(uc, append([]Option{validate}, opts...)...)
+}
+
+func problemBody(p Problem) string {
+	b, _ := json.Marshal(p)
+	return string(b) + "\n"
+}
+
 func TestHandler_GetDevice(t *testing.T) {
 	mockDeviceUC := new(mocks.DeviceUseCase)
 	handler := &Handler{
@@ -37,9 +66,28 @@ func TestHandler_GetDevice(t *testing.T) {
 				IP:        "0.9.9.0",
 			},
 			mockBehavior: func(r *mocks.DeviceUseCase, expectedDevice domain.Device) {
-				r.On("GetDevice", "1").Return(domain.Device{}, errors.New("can`t get device"))
+				r.On("GetDevice", mock.Anything, "1").Return(domain.Device{}, fmt.Errorf("%w: no device", domain.ErrNotFound))
+			},
+			expectedResponseBody: problemBody(Problem{
+				Type:     "/problems/not-found",
+				Title:    "Not Found",
+				Status:   http.StatusNotFound,
+				Detail:   "not found: no device",
+				Instance: "/devices/1",
+			}),
+		},
+		{
+			SerialNum:      "3",
+			ExpectedStatus: http.StatusInternalServerError,
+			mockBehavior: func(r *mocks.DeviceUseCase, expectedDevice domain.Device) {
+				r.On("GetDevice", mock.Anything, "3").Return(domain.Device{}, errors.New("can`t get device"))
 			},
-			expectedResponseBody: "can`t get device\n",
+			expectedResponseBody: problemBody(Problem{
+				Type:     "/problems/internal-error",
+				Title:    "Internal Server Error",
+				Status:   http.StatusInternalServerError,
+				Instance: "/devices/3",
+			}),
 		},
 		{
 			SerialNum:      "2",
@@ -50,15 +98,15 @@ func TestHandler_GetDevice(t *testing.T) {
 				IP:        "0.9.9.0",
 			},
 			mockBehavior: func(r *mocks.DeviceUseCase, expectedDevice domain.Device) {
-				r.On("GetDevice", "2").Return(expectedDevice, nil)
+				r.On("GetDevice", mock.Anything, "2").Return(expectedDevice, nil)
 			},
-			expectedResponseBody: "{\"SerialNum\":\"2\",\"Model\":\"ppp\",\"IP\":\"0.9.9.0\"}\n",
+			expectedResponseBody: "{\"serial_num\":\"2\",\"model\":\"ppp\",\"ip\":\"0.9.9.0\",\"revision\":0,\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\"}\n",
 		},
 	}
 
 	for _, test := range testTable {
 		test.mockBehavior(mockDeviceUC, test.ExpectedDevice)
-		req := httptest.NewRequest("GET", "/devices/{serialNum}", nil)
+		req := httptest.NewRequest("GET", "/devices/"+test.SerialNum, nil)
 		recorder := httptest.NewRecorder()
 
 		req = mux.SetURLVars(req, map[string]string{
@@ -107,8 +155,8 @@ func TestHandler_GetDeviceWithError(t *testing.T) {
 			},
 		},
 	}
-	mockDeviceUC.On("GetDevice", "1").Return(testTable[0].ExpectedDevice, nil)
-	mockDeviceUC.On("GetDevice", "2").Return(testTable[1].ExpectedDevice, nil)
+	mockDeviceUC.On("GetDevice", mock.Anything, "1").Return(testTable[0].ExpectedDevice, nil)
+	mockDeviceUC.On("GetDevice", mock.Anything, "2").Return(testTable[1].ExpectedDevice, nil)
 
 	for _, test := range testTable {
 		req := httptest.NewRequest("GET", "/devices/{serialNum}", nil)
@@ -164,7 +212,10 @@ func TestHandler_CreateDevice(t *testing.T) {
 	}
 
 	for _, test := range testTable {
-		mockDeviceUC.On("CreateDevice", test.Device).Return(nil)
+		created := test.Device
+		created.Revision = 1
+		created.CreatedAt = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		mockDeviceUC.On("CreateDevice", mock.Anything, test.Device).Return(created, nil)
 
 		deviceJSON, err := json.Marshal(test.Device)
 		if err != nil {
@@ -179,6 +230,10 @@ func TestHandler_CreateDevice(t *testing.T) {
 		if recorder.Code != test.ExpectedStatus {
 			t.Errorf("expected status %d, got %d", test.ExpectedStatus, recorder.Code)
 		}
+		assert.Equal(t, formatETag(created), recorder.Header().Get("ETag"))
+		var got domain.Device
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &got))
+		assert.Equal(t, created, got)
 	}
 }
 
@@ -196,7 +251,7 @@ func TestHandler_CreateDeviceWithUseCaseErr(t *testing.T) {
 	}
 
 	expectedStatus := http.StatusConflict
-	mockDeviceUC.On("CreateDevice", device).Return(errors.New("can`t create device"))
+	mockDeviceUC.On("CreateDevice", mock.Anything, device).Return(domain.Device{}, fmt.Errorf("%w: device is already in repository", domain.ErrAlreadyExists))
 
 	deviceJSON, err := json.Marshal(device)
 	if err != nil {
@@ -234,7 +289,7 @@ func TestHandler_DeleteDevice(t *testing.T) {
 	}
 
 	for _, test := range testTable {
-		mockDeviceUC.On("DeleteDevice", test.SerialNum).Return(nil)
+		mockDeviceUC.On("DeleteDevice", mock.Anything, test.SerialNum, uint64(0)).Return(nil)
 
 		req := httptest.NewRequest("DELETE", "/devices/{serialNum}", nil)
 		recorder := httptest.NewRecorder()
@@ -262,7 +317,7 @@ func TestHandler_DeleteDeviceWithUCError(t *testing.T) {
 	}
 	expectedStatus := http.StatusNotFound
 	expectedError := fmt.Errorf("%w: no device", domain.ErrNotFound)
-	mockDeviceUC.On("DeleteDevice", device.SerialNum).Return(expectedError)
+	mockDeviceUC.On("DeleteDevice", mock.Anything, device.SerialNum, uint64(0)).Return(expectedError)
 
 	req := httptest.NewRequest("DELETE", "/devices/{serialNum}", nil)
 	recorder := httptest.NewRecorder()
@@ -296,9 +351,15 @@ func TestHandler_UpdateDevice(t *testing.T) {
 			},
 			ExpectedStatus: http.StatusNotFound,
 			mockBehavior: func(r *mocks.DeviceUseCase, device domain.Device) {
-				r.On("UpdateDevice", device).Return(errors.New("can`t update device"))
+				r.On("UpdateDevice", mock.Anything, device).Return(domain.Device{}, fmt.Errorf("%w: no device", domain.ErrNotFound))
 			},
-			expectedResponseBody: "can`t update device\n",
+			expectedResponseBody: problemBody(Problem{
+				Type:     "/problems/not-found",
+				Title:    "Not Found",
+				Status:   http.StatusNotFound,
+				Detail:   "not found: no device",
+				Instance: "/devices/1",
+			}),
 		},
 		{
 			Device: domain.Device{
@@ -306,11 +367,14 @@ func TestHandler_UpdateDevice(t *testing.T) {
 				Model:     "ppp",
 				IP:        "0.9.9.0",
 			},
-			ExpectedStatus: http.StatusNoContent,
+			ExpectedStatus: http.StatusOK,
 			mockBehavior: func(r *mocks.DeviceUseCase, device domain.Device) {
-				r.On("UpdateDevice", device).Return(nil)
+				stored := device
+				stored.Revision = 2
+				r.On("UpdateDevice", mock.Anything, device).Return(stored, nil)
 			},
-			expectedResponseBody: "",
+			expectedResponseBody: `{"serial_num":"2","model":"ppp","ip":"0.9.9.0","revision":2,` +
+				`"created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z"}` + "\n",
 		},
 	}
 
@@ -321,7 +385,7 @@ func TestHandler_UpdateDevice(t *testing.T) {
 			t.Errorf("error marshaling device: %s", err.Error())
 		}
 
-		req := httptest.NewRequest("PUT", "/devices/{serialNum}", bytes.NewBuffer(deviceJSON))
+		req := httptest.NewRequest("PUT", "/devices/"+test.Device.SerialNum, bytes.NewBuffer(deviceJSON))
 		recorder := httptest.NewRecorder()
 		req = mux.SetURLVars(req, map[string]string{
 			"serialNum": test.Device.SerialNum,
@@ -333,3 +397,1856 @@ func TestHandler_UpdateDevice(t *testing.T) {
 		assert.Equal(t, recorder.Code, test.ExpectedStatus)
 	}
 }
+
+func TestHandler_ListDevices(t *testing.T) {
+	page := domain.DevicePage{
+		Devices: []domain.Device{
+			{SerialNum: "1", Model: "ppp", IP: "10.0.0.1"},
+		},
+		NextCursor:      "next",
+		ResourceVersion: 7,
+	}
+	testTable := []struct {
+		name                 string
+		query                string
+		mockBehavior         func(r *mocks.DeviceUseCase)
+		expectedStatus       int
+		expectedResponseBody string
+	}{
+		{
+			name:  "filters and sort",
+			query: "?model=ppp&ip=10.0.0.0/8&sort=-ip&limit=1&cursor=abc",
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("ListDevices", mock.Anything, domain.DeviceFilter{
+					Model:   "ppp",
+					Network: netip.MustParsePrefix("10.0.0.0/8"),
+					SortBy:  domain.SortByIP,
+					Desc:    true,
+					Limit:   1,
+					Cursor:  "abc",
+				}).Return(page, nil)
+			},
+			expectedStatus:       http.StatusOK,
+			expectedResponseBody: "{\"devices\":[{\"serial_num\":\"1\",\"model\":\"ppp\",\"ip\":\"10.0.0.1\",\"revision\":0,\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\"}],\"next_cursor\":\"next\",\"resource_version\":7}\n",
+		},
+		{
+			name:  "single ip",
+			query: "?ip=10.0.0.1",
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("ListDevices", mock.Anything, domain.DeviceFilter{Network: netip.MustParsePrefix("10.0.0.1/32")}).
+					Return(domain.DevicePage{Devices: []domain.Device{}}, nil)
+			},
+			expectedStatus:       http.StatusOK,
+			expectedResponseBody: "{\"devices\":[]}\n",
+		},
+		{
+			name:           "bad sort",
+			query:          "?sort=color",
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedResponseBody: problemBody(Problem{
+				Type:     "/problems/validation-error",
+				Title:    "Bad Request",
+				Status:   http.StatusBadRequest,
+				Detail:   "request has invalid fields",
+				Instance: "/devices",
+				Errors:   []ProblemField{{Field: "sort", Message: "unknown field \"color\""}},
+			}),
+		},
+		{
+			name:           "bad ip",
+			query:          "?ip=10.0.0.0/99",
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+			expectedResponseBody: problemBody(Problem{
+				Type:     "/problems/validation-error",
+				Title:    "Bad Request",
+				Status:   http.StatusBadRequest,
+				Detail:   "request has invalid fields",
+				Instance: "/devices",
+				Errors:   []ProblemField{{Field: "ip", Message: "invalid address or CIDR \"10.0.0.0/99\""}},
+			}),
+		},
+		{
+			name:  "bad cursor",
+			query: "?cursor=zzz",
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("ListDevices", mock.Anything, domain.DeviceFilter{Cursor: "zzz"}).
+					Return(domain.DevicePage{}, fmt.Errorf("%w: bad", domain.ErrInvalidCursor))
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedResponseBody: problemBody(Problem{
+				Type:     "/problems/validation-error",
+				Title:    "Bad Request",
+				Status:   http.StatusBadRequest,
+				Detail:   "request has invalid fields",
+				Instance: "/devices",
+				Errors:   []ProblemField{{Field: "cursor", Message: "invalid cursor"}},
+			}),
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			handler := &Handler{
+				deviceUC: mockDeviceUC,
+			}
+			test.mockBehavior(mockDeviceUC)
+
+			req := httptest.NewRequest("GET", "/devices"+test.query, nil)
+			recorder := httptest.NewRecorder()
+			handler.ListDevices(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			assert.Equal(t, test.expectedResponseBody, recorder.Body.String())
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_CreateDeviceInvalidBody(t *testing.T) {
+	mockDeviceUC := new(mocks.DeviceUseCase)
+	handler := &Handler{
+		deviceUC: mockDeviceUC,
+	}
+
+	req := httptest.NewRequest("POST", "/devices", bytes.NewBufferString("{"))
+	recorder := httptest.NewRecorder()
+	handler.CreateDevice(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	mockDeviceUC.AssertNotCalled(t, "CreateDevice", mock.Anything, mock.Anything)
+}
+
+func TestStatusFromError(t *testing.T) {
+	testTable := []struct {
+		err            error
+		expectedStatus int
+	}{
+		{err: domain.NewValidationError(domain.FieldError{Field: "IP", Message: "bad"}), expectedStatus: http.StatusBadRequest},
+		{err: auth.ErrNoCredentials, expectedStatus: http.StatusUnauthorized},
+		{err: fmt.Errorf("%w: no device", domain.ErrNotFound), expectedStatus: http.StatusNotFound},
+		{err: fmt.Errorf("usecase createDevice: %w", fmt.Errorf("%w: device", domain.ErrAlreadyExists)), expectedStatus: http.StatusConflict},
+		{err: domain.ErrConflict, expectedStatus: http.StatusConflict},
+		{err: domain.ErrQuotaExceeded, expectedStatus: http.StatusForbidden},
+		{err: fmt.Errorf("%w: body is larger than 10 bytes", domain.ErrTooLarge), expectedStatus: http.StatusRequestEntityTooLarge},
+		{err: fmt.Errorf("%w: operation 2 failed", domain.ErrAborted), expectedStatus: http.StatusFailedDependency},
+		{err: fmt.Errorf("%w: write wal: %w", domain.ErrUnavailable, errors.New("disk full")), expectedStatus: http.StatusServiceUnavailable},
+		{err: errors.New("boom"), expectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range testTable {
+		assert.Equal(t, test.expectedStatus, statusFromError(test.err), test.err.Error())
+	}
+}
+
+func TestHandler_LogsErrors(t *testing.T) {
+	mockDeviceUC := new(mocks.DeviceUseCase)
+	mockDeviceUC.On("GetDevice", mock.Anything, "1").Return(domain.Device{}, errors.New("disk on fire"))
+	mockDeviceUC.On("GetDevice", mock.Anything, "2").Return(domain.Device{}, fmt.Errorf("%w: no device", domain.ErrNotFound))
+	router := mux.NewRouter()
+	newHandler(t, mockDeviceUC).RegisterHandlers(router)
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	server := logging.Middleware(logger)(router)
+
+	testTable := []struct {
+		serialNum string
+		level     string
+		status    float64
+		error     string
+	}{
+		{serialNum: "1", level: "ERROR", status: http.StatusInternalServerError, error: "disk on fire"},
+		{serialNum: "2", level: "INFO", status: http.StatusNotFound, error: "not found: no device"},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.error, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/devices/"+test.serialNum, nil)
+			req.Header.Set("X-Request-ID", "req-"+test.serialNum)
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, req)
+			assert.Equal(t, int(test.status), recorder.Code)
+			assert.NotContains(t, recorder.Body.String(), "disk on fire")
+
+			// The error is logged once, next to the access log line, both
+			// with the request ID.
+			var lines []map[string]any
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var entry map[string]any
+				require.NoError(t, json.Unmarshal([]byte(line), &entry))
+				assert.Equal(t, "req-"+test.serialNum, entry["request_id"])
+				lines = append(lines, entry)
+			}
+			require.Len(t, lines, 2)
+			assert.Equal(t, "request failed", lines[0]["msg"])
+			assert.Equal(t, test.level, lines[0]["level"])
+			assert.Equal(t, test.status, lines[0]["status"])
+			assert.Equal(t, test.error, lines[0]["error"])
+			assert.Equal(t, "request", lines[1]["msg"])
+			assert.Equal(t, test.status, lines[1]["status"])
+		})
+	}
+}
+
+func TestHandler_ProblemResponses(t *testing.T) {
+	mockDeviceUC := new(mocks.DeviceUseCase)
+	router := mux.NewRouter()
+	newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+	testTable := []struct {
+		name            string
+		method          string
+		target          string
+		body            string
+		mockBehavior    func(r *mocks.DeviceUseCase)
+		expectedProblem Problem
+	}{
+		{
+			name:   "validation errors list fields",
+			method: http.MethodPost,
+			target: "/api/v1/devices",
+			body:   `{"SerialNum":"","IP":"nope"}`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("CreateDevice", mock.Anything, domain.Device{IP: "nope"}).Return(domain.Device{}, domain.NewValidationError(
+					domain.FieldError{Field: "serial_num", Message: "must not be empty"},
+					domain.FieldError{Field: "ip", Message: "must be a valid IPv4 address"},
+				))
+			},
+			expectedProblem: Problem{
+				Type:     "/problems/validation-error",
+				Title:    "Bad Request",
+				Status:   http.StatusBadRequest,
+				Detail:   "request has invalid fields",
+				Instance: "/api/v1/devices",
+				Errors: []ProblemField{
+					{Field: "serial_num", Message: "must not be empty"},
+					{Field: "ip", Message: "must be a valid IPv4 address"},
+				},
+			},
+		},
+		{
+			name:   "conflict",
+			method: http.MethodPost,
+			target: "/api/v1/devices",
+			body:   `{"SerialNum":"1","IP":"1.1.1.1"}`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("CreateDevice", mock.Anything, domain.Device{SerialNum: "1", IP: "1.1.1.1"}).
+					Return(domain.Device{}, fmt.Errorf("%w: device is already in repository", domain.ErrAlreadyExists))
+			},
+			expectedProblem: Problem{
+				Type:     "/problems/conflict",
+				Title:    "Conflict",
+				Status:   http.StatusConflict,
+				Detail:   "already exists: device is already in repository",
+				Instance: "/api/v1/devices",
+			},
+		},
+		{
+			name:   "forbidden names the permission",
+			method: http.MethodDelete,
+			target: "/api/v1/devices/2",
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("DeleteDevice", mock.Anything, "2", uint64(0)).Return(&domain.PermissionError{Permission: "devices.delete"})
+			},
+			expectedProblem: Problem{
+				Type:       "/problems/forbidden",
+				Title:      "Forbidden",
+				Status:     http.StatusForbidden,
+				Detail:     "forbidden: missing permission devices.delete",
+				Instance:   "/api/v1/devices/2",
+				Permission: "devices.delete",
+			},
+		},
+		{
+			name:   "quota exceeded has its own type",
+			method: http.MethodPost,
+			target: "/api/v1/tenants/acme/devices",
+			body:   `{"serial_num":"9","ip":"10.0.0.9"}`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("CreateDevice", mock.Anything, domain.Device{SerialNum: "9", IP: "10.0.0.9"}).
+					Return(domain.Device{}, fmt.Errorf("%w: tenant acme may have at most 1 devices", domain.ErrQuotaExceeded))
+			},
+			expectedProblem: Problem{
+				Type:     "/problems/quota-exceeded",
+				Title:    "Forbidden",
+				Status:   http.StatusForbidden,
+				Detail:   "quota exceeded: tenant acme may have at most 1 devices",
+				Instance: "/api/v1/tenants/acme/devices",
+			},
+		},
+		{
+			name:   "unavailable hides internals",
+			method: http.MethodDelete,
+			target: "/api/v1/devices/1",
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("DeleteDevice", mock.Anything, "1", uint64(0)).Return(fmt.Errorf("%w: sync wal: disk full", domain.ErrUnavailable))
+			},
+			expectedProblem: Problem{
+				Type:     "/problems/unavailable",
+				Title:    "Service Unavailable",
+				Status:   http.StatusServiceUnavailable,
+				Instance: "/api/v1/devices/1",
+			},
+		},
+		{
+			name:         "unknown route",
+			method:       http.MethodGet,
+			target:       "/api/v2/devices",
+			mockBehavior: func(r *mocks.DeviceUseCase) {},
+			expectedProblem: Problem{
+				Type:     "/problems/not-found",
+				Title:    "Not Found",
+				Status:   http.StatusNotFound,
+				Detail:   "no route for /api/v2/devices",
+				Instance: "/api/v2/devices",
+			},
+		},
+		{
+			name:         "method not allowed",
+			method:       http.MethodPatch,
+			target:       "/api/v1/devices",
+			mockBehavior: func(r *mocks.DeviceUseCase) {},
+			expectedProblem: Problem{
+				Type:     "/problems/method-not-allowed",
+				Title:    "Method Not Allowed",
+				Status:   http.StatusMethodNotAllowed,
+				Detail:   "PATCH is not supported for /api/v1/devices",
+				Instance: "/api/v1/devices",
+			},
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			test.mockBehavior(mockDeviceUC)
+			req := httptest.NewRequest(test.method, test.target, bytes.NewBufferString(test.body))
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedProblem.Status, recorder.Code)
+			assert.Equal(t, "application/problem+json", recorder.Header().Get("Content-Type"))
+			var problem Problem
+			assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+			assert.Equal(t, test.expectedProblem, problem)
+		})
+	}
+}
+
+func TestHandler_ConditionalRequests(t *testing.T) {
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	device := domain.Device{SerialNum: "1", Model: "ppp", IP: "0.9.9.0", Revision: 3, CreatedAt: createdAt}
+	etag := `"3-gvrg7162o0"`
+	staleETag := `"2-gvrg7162o0"`
+	// The same revision of a device that was deleted since.
+	earlier := formatETag(domain.Device{Revision: 3, CreatedAt: createdAt.Add(-time.Hour)})
+	stale := fmt.Errorf("%w: device is at revision 4, not 3", domain.ErrPreconditionFailed)
+	updated := device
+	updated.Revision = 4
+
+	testTable := []struct {
+		name           string
+		method         string
+		headers        map[string]string
+		requireIfMatch bool
+		mockBehavior   func(r *mocks.DeviceUseCase)
+		expectedStatus int
+		expectedETag   string
+	}{
+		{
+			name:   "get sets etag",
+			method: http.MethodGet,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedETag:   etag,
+		},
+		{
+			name:    "get not modified",
+			method:  http.MethodGet,
+			headers: map[string]string{"If-None-Match": staleETag + `, W/` + etag},
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+			},
+			expectedStatus: http.StatusNotModified,
+			expectedETag:   etag,
+		},
+		{
+			name:    "get modified",
+			method:  http.MethodGet,
+			headers: map[string]string{"If-None-Match": staleETag},
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedETag:   etag,
+		},
+		{
+			name:    "put with if-match",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": etag},
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+				r.On("UpdateDevice", mock.Anything, domain.Device{SerialNum: "1", Model: "ppp", IP: "0.9.9.0", Revision: 3}).Return(updated, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedETag:   formatETag(updated),
+		},
+		{
+			name:    "put with stale if-match",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": staleETag},
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+			},
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "put with if-match of an earlier device",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": earlier},
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+			},
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "put losing a race",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": etag},
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+				r.On("UpdateDevice", mock.Anything, domain.Device{SerialNum: "1", Model: "ppp", IP: "0.9.9.0", Revision: 3}).Return(domain.Device{}, stale)
+			},
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "put with weak if-match",
+			method:         http.MethodPut,
+			headers:        map[string]string{"If-Match": `W/` + etag},
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "put with several if-match tags",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": `"1-gvrg7162o0", ` + etag},
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+				r.On("UpdateDevice", mock.Anything, domain.Device{SerialNum: "1", Model: "ppp", IP: "0.9.9.0", Revision: 3}).Return(updated, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedETag:   formatETag(updated),
+		},
+		{
+			name:           "put without required if-match",
+			method:         http.MethodPut,
+			requireIfMatch: true,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusPreconditionRequired,
+		},
+		{
+			name:           "delete with any if-match",
+			method:         http.MethodDelete,
+			headers:        map[string]string{"If-Match": "*"},
+			requireIfMatch: true,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("DeleteDevice", mock.Anything, "1", uint64(0)).Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:    "delete with if-match",
+			method:  http.MethodDelete,
+			headers: map[string]string{"If-Match": etag},
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+				r.On("DeleteDevice", mock.Anything, "1", uint64(3)).Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:    "delete with stale if-match",
+			method:  http.MethodDelete,
+			headers: map[string]string{"If-Match": staleETag},
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(device, nil)
+			},
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "delete without required if-match",
+			method:         http.MethodDelete,
+			requireIfMatch: true,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusPreconditionRequired,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			test.mockBehavior(mockDeviceUC)
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC, WithRequireIfMatch(test.requireIfMatch)).RegisterHandlers(router)
+
+			req := httptest.NewRequest(test.method, "/api/v1/devices/1", bytes.NewBufferString(`{"Model":"ppp","IP":"0.9.9.0"}`))
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			assert.Equal(t, test.expectedETag, recorder.Header().Get("ETag"))
+			if test.expectedStatus == http.StatusNotModified {
+				assert.Empty(t, recorder.Body.String())
+			}
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_PatchDevice(t *testing.T) {
+	current := domain.Device{SerialNum: "1", Model: "y", IP: "0.9.9.0", Revision: 3}
+	patched := domain.Device{SerialNum: "1", Model: "x", IP: "0.9.9.0", Revision: 4}
+
+	testTable := []struct {
+		name                 string
+		contentType          string
+		ifMatch              string
+		body                 string
+		mockBehavior         func(r *mocks.DeviceUseCase)
+		expectedStatus       int
+		expectedResponseBody string
+	}{
+		{
+			name:        "merge patch",
+			contentType: "application/merge-patch+json",
+			body:        `{"Model":"x"}`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("PatchDevice", mock.Anything, "1", domain.Patch{Type: domain.MergePatch, Document: []byte(`{"model":"x"}`)}, uint64(0)).
+					Return(patched, nil)
+			},
+			expectedStatus:       http.StatusOK,
+			expectedResponseBody: "{\"serial_num\":\"1\",\"model\":\"x\",\"ip\":\"0.9.9.0\",\"revision\":4,\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\"}\n",
+		},
+		{
+			name:        "json patch with if-match",
+			contentType: "application/json-patch+json; charset=utf-8",
+			ifMatch:     formatETag(current),
+			body:        `[{"op":"replace","path":"/Model","value":"x"}]`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(current, nil)
+				r.On("PatchDevice", mock.Anything, "1", domain.Patch{Type: domain.JSONPatch, Document: []byte(`[{"op":"replace","path":"/model","value":"x"}]`)}, uint64(3)).
+					Return(patched, nil)
+			},
+			expectedStatus:       http.StatusOK,
+			expectedResponseBody: "{\"serial_num\":\"1\",\"model\":\"x\",\"ip\":\"0.9.9.0\",\"revision\":4,\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\"}\n",
+		},
+		{
+			name:           "failed test op",
+			contentType:    "application/json-patch+json",
+			body:           `[{"op":"test","path":"/Model","value":"y"}]`,
+			expectedStatus: http.StatusConflict,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("PatchDevice", mock.Anything, "1", mock.Anything, uint64(0)).
+					Return(domain.Device{}, fmt.Errorf("%w: testing value /Model failed", domain.ErrConflict))
+			},
+		},
+		{
+			name:           "unsupported content type",
+			contentType:    "application/json",
+			body:           `{"Model":"x"}`,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			test.mockBehavior(mockDeviceUC)
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodPatch, "/api/v1/devices/1", bytes.NewBufferString(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			if test.ifMatch != "" {
+				req.Header.Set("If-Match", test.ifMatch)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if test.expectedResponseBody != "" {
+				assert.Equal(t, test.expectedResponseBody, recorder.Body.String())
+				assert.Equal(t, formatETag(patched), recorder.Header().Get("ETag"))
+			}
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_TransitionDevice(t *testing.T) {
+	current := domain.Device{SerialNum: "1", IP: "0.9.9.0", Status: domain.StatusActive, Revision: 3}
+	moved := domain.Device{SerialNum: "1", IP: "0.9.9.0", Status: domain.StatusMaintenance, Revision: 4}
+
+	testTable := []struct {
+		name                 string
+		ifMatch              string
+		body                 string
+		mockBehavior         func(r *mocks.DeviceUseCase)
+		expectedStatus       int
+		expectedResponseBody string
+	}{
+		{
+			name:    "transition",
+			ifMatch: formatETag(current),
+			body:    `{"to":"maintenance","reason":"fan replacement"}`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", mock.Anything, "1").Return(current, nil)
+				r.On("TransitionDevice", mock.Anything, "1", domain.Transition{To: domain.StatusMaintenance, Reason: "fan replacement"}, uint64(3)).
+					Return(moved, nil)
+			},
+			expectedStatus:       http.StatusOK,
+			expectedResponseBody: "{\"serial_num\":\"1\",\"model\":\"\",\"ip\":\"0.9.9.0\",\"status\":\"maintenance\",\"revision\":4,\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\"}\n",
+		},
+		{
+			name: "illegal transition",
+			body: `{"to":"disposed"}`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("TransitionDevice", mock.Anything, "1", domain.Transition{To: domain.StatusDisposed}, uint64(0)).
+					Return(domain.Device{}, &domain.TransitionError{From: domain.StatusActive, To: domain.StatusDisposed})
+			},
+			expectedStatus: http.StatusConflict,
+			expectedResponseBody: problemBody(Problem{
+				Type:     "/problems/conflict",
+				Title:    "Conflict",
+				Status:   http.StatusConflict,
+				Detail:   `cannot move device from "active" to "disposed": active is final`,
+				Instance: "/api/v1/devices/1/transitions",
+			}),
+		},
+		{
+			name:           "unknown field",
+			body:           `{"status":"active"}`,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "actor cannot be chosen",
+			body:           `{"to":"maintenance","actor":"mallory"}`,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			test.mockBehavior(mockDeviceUC)
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/1/transitions", bytes.NewBufferString(test.body))
+			if test.ifMatch != "" {
+				req.Header.Set("If-Match", test.ifMatch)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if test.expectedResponseBody != "" {
+				assert.Equal(t, test.expectedResponseBody, recorder.Body.String())
+			}
+			if test.expectedStatus == http.StatusOK {
+				assert.Equal(t, formatETag(moved), recorder.Header().Get("ETag"))
+			}
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_GetDeviceHistory(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	after := domain.Device{SerialNum: "1", IP: "0.9.9.0", Revision: 1}
+	mockDeviceUC := new(mocks.DeviceUseCase)
+	mockDeviceUC.On("GetDeviceHistory", mock.Anything, "1").
+		Return([]domain.HistoryEntry{{ResourceVersion: 3, SerialNum: "1", Op: domain.OpCreate, Revision: 1, Actor: "alice", At: at, After: &after}}, nil)
+	mockDeviceUC.On("GetDeviceHistory", mock.Anything, "2").
+		Return(nil, fmt.Errorf("%w: no history", domain.ErrNotFound))
+	router := mux.NewRouter()
+	newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/devices/1/history", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `[{"resource_version":3,"serial_num":"1","op":"create","revision":1,"actor":"alice","at":"2024-05-01T12:00:00Z",
+		"after":{"serial_num":"1","model":"","ip":"0.9.9.0","revision":1,"created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z"}}]`,
+		recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/devices/2/history", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestHandler_RevertDevice(t *testing.T) {
+	current := domain.Device{SerialNum: "1", IP: "0.9.9.1", Revision: 4}
+	reverted := domain.Device{SerialNum: "1", IP: "0.9.9.0", Revision: 5}
+	byAlice := mock.MatchedBy(func(ctx context.Context) bool { return domain.ActorFrom(ctx) == "alice" })
+
+	testTable := []struct {
+		name           string
+		ifMatch        string
+		body           string
+		mockBehavior   func(r *mocks.DeviceUseCase)
+		expectedStatus int
+	}{
+		{
+			name:    "revert",
+			ifMatch: formatETag(current),
+			body:    `{"revision":2}`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("GetDevice", byAlice, "1").Return(current, nil)
+				r.On("RevertDevice", byAlice, "1", uint64(2), uint64(4)).Return(reverted, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "unknown revision",
+			body: `{"revision":9}`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("RevertDevice", byAlice, "1", uint64(9), uint64(0)).
+					Return(domain.Device{}, fmt.Errorf("%w: no revision 9 in history", domain.ErrNotFound))
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "missing revision",
+			body:           `{}`,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			test.mockBehavior(mockDeviceUC)
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/1/revert", bytes.NewBufferString(test.body))
+			req.Header.Set("X-Actor", "alice")
+			if test.ifMatch != "" {
+				req.Header.Set("If-Match", test.ifMatch)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if test.expectedStatus == http.StatusOK {
+				assert.Equal(t, formatETag(reverted), recorder.Header().Get("ETag"))
+			}
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_Trash(t *testing.T) {
+	deletedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	trashed := domain.Device{SerialNum: "1", IP: "0.9.9.0", Revision: 2, DeletedAt: &deletedAt}
+	restored := domain.Device{SerialNum: "1", IP: "0.9.9.0", Revision: 3}
+	mockDeviceUC := new(mocks.DeviceUseCase)
+	mockDeviceUC.On("ListTrash", mock.Anything).Return([]domain.Device{trashed}, nil)
+	mockDeviceUC.On("RestoreDevice", mock.Anything, "1").Return(restored, nil)
+	mockDeviceUC.On("RestoreDevice", mock.Anything, "2").
+		Return(domain.Device{}, fmt.Errorf("%w: no device in trash", domain.ErrNotFound))
+	router := mux.NewRouter()
+	newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/trash", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"devices":[{"serial_num":"1","model":"","ip":"0.9.9.0","revision":2,
+		"created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z","deleted_at":"2024-05-01T12:00:00Z"}]}`,
+		recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/devices/1/restore", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, formatETag(restored), recorder.Header().Get("ETag"))
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/devices/2/restore", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestHandler_BatchDevices(t *testing.T) {
+	created := domain.Device{SerialNum: "1", IP: "0.9.9.0", Revision: 1}
+	ops := []domain.BatchOperation{
+		{Op: domain.OpCreate, Device: domain.Device{SerialNum: "1", IP: "0.9.9.0"}},
+		{Op: domain.OpDelete, SerialNum: "2", Revision: 3},
+	}
+	body := `[{"op":"create","device":{"SerialNum":"1","ip":"0.9.9.0"}},{"op":"delete","serial_num":"2","revision":3}]`
+
+	testTable := []struct {
+		name           string
+		query          string
+		body           string
+		mockBehavior   func(r *mocks.DeviceUseCase)
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name: "per item results",
+			body: body,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("BatchDevices", mock.Anything, ops, false).Return([]domain.BatchResult{
+					{Device: &created},
+					{Err: fmt.Errorf("%w: no device", domain.ErrNotFound)},
+				}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody: `[{"status":201,"device":{"serial_num":"1","model":"","ip":"0.9.9.0","revision":1,
+				"created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z"}},
+				{"status":404,"error":{"type":"/problems/not-found","title":"Not Found","status":404,
+				"detail":"not found: no device","instance":"/api/v1/devices:batch"}}]`,
+		},
+		{
+			name:  "atomic failure",
+			body:  body,
+			query: "?atomic=true",
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("BatchDevices", mock.Anything, ops, true).
+					Return(domain.AbortBatch(2, 1, fmt.Errorf("%w: no device", domain.ErrNotFound)), nil)
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedBody: `[{"status":424,"error":{"type":"/problems/aborted","title":"Failed Dependency","status":424,
+				"detail":"aborted: operation 1 failed","instance":"/api/v1/devices:batch"}},
+				{"status":404,"error":{"type":"/problems/not-found","title":"Not Found","status":404,
+				"detail":"not found: no device","instance":"/api/v1/devices:batch"}}]`,
+		},
+		{
+			name:           "bad atomic flag",
+			body:           body,
+			query:          "?atomic=maybe",
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "not an array",
+			body:           `{"op":"create"}`,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "device is not an object",
+			body:           `[{"op":"create","device":[]}]`,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "empty batch",
+			body:           `[]`,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "whole batch rejected",
+			body: `[{"op":"delete","serial_num":"1"}]`,
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("BatchDevices", mock.Anything, []domain.BatchOperation{{Op: domain.OpDelete, SerialNum: "1"}}, false).
+					Return(nil, fmt.Errorf("%w: begin", domain.ErrUnavailable))
+			},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			test.mockBehavior(mockDeviceUC)
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/devices:batch"+test.query, bytes.NewBufferString(test.body))
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if test.expectedBody != "" {
+				assert.JSONEq(t, test.expectedBody, recorder.Body.String())
+			}
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_ExportDevices(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	first := domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1", Labels: map[string]string{"site": "msk", "role": "edge"},
+		Status: domain.StatusActive, Revision: 2, CreatedAt: at, UpdatedAt: at}
+	second := domain.Device{SerialNum: "2", Model: "a,b", IP: "10.0.0.2", Hostname: "=cmd()", Location: "'quoted",
+		Revision: 1, CreatedAt: at, UpdatedAt: at}
+	newRouter := func(t *testing.T) (*mux.Router, *mocks.DeviceUseCase) {
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("ListDevices", mock.Anything, domain.DeviceFilter{Model: "a", Limit: exportPageSize}).
+			Return(domain.DevicePage{Devices: []domain.Device{first}, NextCursor: "c1"}, nil)
+		mockDeviceUC.On("ListDevices", mock.Anything, domain.DeviceFilter{Model: "a", Limit: exportPageSize, Cursor: "c1"}).
+			Return(domain.DevicePage{Devices: []domain.Device{second}}, nil)
+		router := mux.NewRouter()
+		newHandler(t, mockDeviceUC).RegisterHandlers(router)
+		return router, mockDeviceUC
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		router, mockDeviceUC := newRouter(t)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/devices/export?model=a&cursor=ignored", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+		assert.Equal(t, `serial_num,model,ip,firmware_version,mac,hostname,site,location,labels,status,revision,created_at,updated_at
+1,a,10.0.0.1,,,,,,role=edge;site=msk,active,2,2024-05-01T12:00:00Z,2024-05-01T12:00:00Z
+2,"a,b",10.0.0.2,,,'=cmd(),,''quoted,,,1,2024-05-01T12:00:00Z,2024-05-01T12:00:00Z
+`, recorder.Body.String())
+		mockDeviceUC.AssertExpectations(t)
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		router, _ := newRouter(t)
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/devices/export?model=a", nil)
+		req.Header.Set("Accept", "application/x-ndjson")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "application/x-ndjson", recorder.Header().Get("Content-Type"))
+		lines := strings.Split(strings.TrimSuffix(recorder.Body.String(), "\n"), "\n")
+		if assert.Len(t, lines, 2) {
+			var d domain.Device
+			assert.NoError(t, json.Unmarshal([]byte(lines[1]), &d))
+			assert.Equal(t, second, d)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		router, _ := newRouter(t)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/devices/export?format=xlsx", nil))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+}
+
+func TestHandler_ImportDevices(t *testing.T) {
+	testTable := []struct {
+		name           string
+		query          string
+		contentType    string
+		body           string
+		mockBehavior   func(r *mocks.DeviceUseCase)
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:        "csv",
+			query:       "?on_conflict=skip&dry_run=true",
+			contentType: "text/csv; charset=utf-8",
+			body:        "ip,serial_num,labels\n10.0.0.1,1,site=msk\n10.0.0.2\n10.0.0.3,3,site\n",
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("ImportDevices", mock.Anything, mock.MatchedBy(func(rows []domain.ImportRow) bool {
+					return len(rows) == 3 &&
+						rows[0].Row == 2 && reflect.DeepEqual(rows[0].Device, domain.Device{SerialNum: "1", IP: "10.0.0.1", Labels: map[string]string{"site": "msk"}}) &&
+						rows[1].Row == 3 && errors.Is(rows[1].Err, domain.ErrValidation) &&
+						rows[2].Row == 4 && errors.Is(rows[2].Err, domain.ErrValidation)
+				}), domain.ImportOptions{OnConflict: domain.ConflictSkip, DryRun: true}).
+					Return(domain.ImportReport{DryRun: true, Created: 1, Errors: []domain.ImportError{
+						{Row: 3, Err: domain.NewValidationError(domain.FieldError{Field: "row", Message: "has 1 fields, want 3"})},
+					}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody: `{"dry_run":true,"created":1,"updated":0,"skipped":0,"errors":[{"row":3,"error":{
+				"type":"/problems/validation-error","title":"Bad Request","status":400,"detail":"request has invalid fields",
+				"instance":"/api/v1/devices/import","errors":[{"field":"row","message":"has 1 fields, want 3"}]}}]}`,
+		},
+		{
+			name:        "csv multi-line field",
+			contentType: "text/csv",
+			body:        "serial_num,location,hostname\n1,\"rack 1\nshelf 2\",'=cmd()\n2,''quoted,'x\n",
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("ImportDevices", mock.Anything, []domain.ImportRow{
+					{Row: 2, Device: domain.Device{SerialNum: "1", Location: "rack 1\nshelf 2", Hostname: "=cmd()"}},
+					{Row: 4, Device: domain.Device{SerialNum: "2", Location: "'quoted", Hostname: "'x"}},
+				}, domain.ImportOptions{OnConflict: domain.ConflictFail}).
+					Return(domain.ImportReport{Created: 2}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"dry_run":false,"created":2,"updated":0,"skipped":0}`,
+		},
+		{
+			name:        "ndjson failure writes nothing",
+			contentType: "application/x-ndjson",
+			body:        "{\"SerialNum\":\"1\",\"ip\":\"10.0.0.1\"}\n\n{\"serial_num\":\"2\",\"ip\":\"10.0.0.2\"}\n",
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("ImportDevices", mock.Anything, []domain.ImportRow{
+					{Row: 1, Device: domain.Device{SerialNum: "1", IP: "10.0.0.1"}},
+					{Row: 3, Device: domain.Device{SerialNum: "2", IP: "10.0.0.2"}},
+				}, domain.ImportOptions{OnConflict: domain.ConflictFail}).
+					Return(domain.ImportReport{Errors: []domain.ImportError{
+						{Row: 1, SerialNum: "1", Err: fmt.Errorf("%w: device is already in repository", domain.ErrAlreadyExists)},
+					}}, nil)
+			},
+			expectedStatus: http.StatusConflict,
+			expectedBody: `{"dry_run":false,"created":0,"updated":0,"skipped":0,"errors":[{"row":1,"serial_num":"1","error":{
+				"type":"/problems/conflict","title":"Conflict","status":409,
+				"detail":"already exists: device is already in repository","instance":"/api/v1/devices/import"}}]}`,
+		},
+		{
+			name:           "unknown column",
+			query:          "?format=csv",
+			body:           "serial_num,colour\n1,red\n",
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unsupported media type",
+			contentType:    "application/json",
+			body:           `[]`,
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:           "bad dry run flag",
+			query:          "?dry_run=maybe",
+			contentType:    "text/csv",
+			body:           "serial_num\n1\n",
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "too many rows",
+			contentType:    "text/csv",
+			body:           "serial_num\n" + strings.Repeat("1\n", maxImportRows+1),
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			test.mockBehavior(mockDeviceUC)
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/import"+test.query, bytes.NewBufferString(test.body))
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if test.expectedBody != "" {
+				assert.JSONEq(t, test.expectedBody, recorder.Body.String())
+			}
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_BodySizeLimit(t *testing.T) {
+	testTable := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+	}{
+		{name: "create", path: "/api/v1/devices", body: `{"serial_num":"1","ip":"10.0.0.1"}`},
+		{name: "create as yaml", path: "/api/v1/devices", contentType: "application/yaml", body: "serial_num: \"1\"\nip: 10.0.0.1\n"},
+		{name: "create as msgpack", path: "/api/v1/devices", contentType: "application/msgpack", body: "\x82\xaaserial_num\xa11\xa2ip\xa810.0.0.1"},
+		{name: "batch", path: "/api/v1/devices:batch", body: `[{"op":"delete","serial_num":"1"}]`},
+		{name: "import", path: "/api/v1/devices/import", contentType: "application/x-ndjson", body: `{"serial_num":"1","ip":"10.0.0.1"}`},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC, WithMaxBodySize(16)).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code, recorder.Body.String())
+			assert.Contains(t, recorder.Body.String(), "body is larger than 16 bytes")
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_ContentNegotiation(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	device := domain.Device{SerialNum: "1", Model: "a", IP: "0.9.9.0", Labels: map[string]string{"role": "edge"},
+		Status: domain.StatusActive, Revision: 2, CreatedAt: at, UpdatedAt: at}
+	mockDeviceUC := new(mocks.DeviceUseCase)
+	mockDeviceUC.On("GetDevice", mock.Anything, "1").Return(device, nil)
+	mockDeviceUC.On("GetDeviceHistory", mock.Anything, "1").
+		Return([]domain.HistoryEntry{{ResourceVersion: 7, SerialNum: "1", Op: domain.OpCreate, Revision: 1, At: at, After: &device}}, nil)
+	router := mux.NewRouter()
+	newHandler(t, mockDeviceUC).RegisterHandlers(router)
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	testTable := []struct {
+		name        string
+		accept      string
+		contentType string
+	}{
+		{name: "no accept", contentType: "application/json"},
+		{name: "anything", accept: "*/*", contentType: "application/json"},
+		{name: "alias", accept: "application/x-yaml", contentType: "application/x-yaml"},
+		{name: "by preference", accept: "application/json;q=0.5, application/msgpack", contentType: "application/msgpack"},
+		{name: "type wildcard", accept: "text/*", contentType: "text/yaml"},
+		{name: "excluded", accept: "application/json;q=0, */*", contentType: "application/yaml"},
+	}
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := get("/api/v1/devices/1", test.accept)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, test.contentType, recorder.Header().Get("Content-Type"))
+			assert.Equal(t, "Accept", recorder.Header().Get("Vary"))
+		})
+	}
+
+	t.Run("yaml", func(t *testing.T) {
+		recorder := get("/api/v1/devices/1", "application/yaml")
+		assert.Equal(t, `serial_num: "1"
+model: a
+ip: 0.9.9.0
+labels:
+  role: edge
+status: active
+revision: 2
+created_at: "2024-05-01T12:00:00Z"
+updated_at: "2024-05-01T12:00:00Z"
+`, recorder.Body.String())
+	})
+
+	t.Run("msgpack", func(t *testing.T) {
+		recorder := get("/api/v1/devices/1", "application/msgpack")
+		dec := msgpack.NewDecoder(recorder.Body)
+		dec.SetCustomStructTag("json")
+		var got domain.Device
+		require.NoError(t, dec.Decode(&got))
+		got.CreatedAt, got.UpdatedAt = got.CreatedAt.UTC(), got.UpdatedAt.UTC()
+		assert.Equal(t, device, got)
+	})
+
+	t.Run("protobuf", func(t *testing.T) {
+		recorder := get("/api/v1/devices/1/history", "application/x-protobuf")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var history pb.History
+		require.NoError(t, proto.Unmarshal(recorder.Body.Bytes(), &history))
+		require.Len(t, history.Entries, 1)
+		assert.Equal(t, uint64(7), history.Entries[0].ResourceVersion)
+		assert.Equal(t, "0.9.9.0", history.Entries[0].After.Ip)
+		assert.Equal(t, at, history.Entries[0].After.CreatedAt.AsTime())
+		assert.Nil(t, history.Entries[0].Before)
+	})
+
+	t.Run("not acceptable", func(t *testing.T) {
+		recorder := get("/api/v1/devices/1", "text/html")
+		assert.Equal(t, http.StatusNotAcceptable, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "application/json, application/yaml, application/msgpack, application/x-protobuf, text/csv")
+
+		// CSV cannot represent history, and nothing is called before 406.
+		recorder = get("/api/v1/devices/2/history", "text/csv")
+		assert.Equal(t, http.StatusNotAcceptable, recorder.Code)
+	})
+}
+
+func TestHandler_DecodeByContentType(t *testing.T) {
+	want := domain.Device{SerialNum: "1", Model: "a", IP: "0.9.9.0", Labels: map[string]string{"role": "edge"}}
+	protoBody, err := proto.Marshal(&pb.Device{SerialNum: "1", Model: "a", Ip: "0.9.9.0", Labels: map[string]string{"role": "edge"}})
+	require.NoError(t, err)
+	var msgpackBody bytes.Buffer
+	enc := msgpack.NewEncoder(&msgpackBody)
+	enc.SetCustomStructTag("json")
+	require.NoError(t, enc.Encode(want))
+
+	testTable := []struct {
+		name           string
+		contentType    string
+		body           []byte
+		expectedStatus int
+	}{
+		{name: "json", contentType: "application/json; charset=utf-8", body: []byte(`{"serial_num":"1","model":"a","ip":"0.9.9.0","labels":{"role":"edge"}}`), expectedStatus: http.StatusCreated},
+		{name: "yaml", contentType: "application/yaml", body: []byte("serial_num: \"1\"\nmodel: a\nip: 0.9.9.0\nlabels:\n  role: edge\n"), expectedStatus: http.StatusCreated},
+		{name: "legacy yaml", contentType: "text/yaml", body: []byte("SerialNum: \"1\"\nModel: a\nIP: 0.9.9.0\nlabels: {role: edge}\n"), expectedStatus: http.StatusCreated},
+		{name: "msgpack", contentType: "application/msgpack", body: msgpackBody.Bytes(), expectedStatus: http.StatusCreated},
+		{name: "protobuf", contentType: "application/x-protobuf", body: protoBody, expectedStatus: http.StatusCreated},
+		{name: "bad protobuf", contentType: "application/x-protobuf", body: []byte{0xff}, expectedStatus: http.StatusBadRequest},
+		{name: "csv", contentType: "text/csv", body: []byte("serial_num\n1\n"), expectedStatus: http.StatusUnsupportedMediaType},
+		{name: "unknown", contentType: "application/xml", body: []byte("<device/>"), expectedStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			if test.expectedStatus == http.StatusCreated {
+				mockDeviceUC.On("CreateDevice", mock.Anything, want).Return(domain.Device{}, nil)
+			}
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/devices", bytes.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code, recorder.Body.String())
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_DecodeRequestsByContentType(t *testing.T) {
+	msgpackOf := func(v any) []byte {
+		b, err := msgpack.Marshal(v)
+		require.NoError(t, err)
+		return b
+	}
+	device := domain.Device{SerialNum: "1", IP: "0.9.9.0", Revision: 2}
+	created := []domain.BatchOperation{{Op: domain.OpCreate, Device: domain.Device{SerialNum: "1", IP: "0.9.9.0"}}}
+
+	testTable := []struct {
+		name           string
+		path           string
+		contentType    string
+		body           []byte
+		mockBehavior   func(r *mocks.DeviceUseCase)
+		expectedStatus int
+	}{
+		{
+			name:        "transition as yaml",
+			path:        "/api/v1/devices/1/transitions",
+			contentType: "application/yaml",
+			body:        []byte("to: maintenance\nreason: fan replacement\n"),
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("TransitionDevice", mock.Anything, "1", domain.Transition{To: domain.StatusMaintenance, Reason: "fan replacement"}, uint64(0)).
+					Return(device, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:        "transition as msgpack",
+			path:        "/api/v1/devices/1/transitions",
+			contentType: "application/msgpack",
+			body:        msgpackOf(map[string]any{"to": "maintenance"}),
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("TransitionDevice", mock.Anything, "1", domain.Transition{To: domain.StatusMaintenance}, uint64(0)).
+					Return(device, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "transition with unknown field as yaml",
+			path:           "/api/v1/devices/1/transitions",
+			contentType:    "application/yaml",
+			body:           []byte("to: maintenance\nactor: mallory\n"),
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "transition as protobuf",
+			path:           "/api/v1/devices/1/transitions",
+			contentType:    "application/x-protobuf",
+			body:           []byte{0x0a, 0x01, 0x31},
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "revert as msgpack",
+			path:        "/api/v1/devices/1/revert",
+			contentType: "application/msgpack",
+			body:        msgpackOf(map[string]any{"revision": 1}),
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("RevertDevice", mock.Anything, "1", uint64(1), uint64(0)).Return(device, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:        "batch as yaml",
+			path:        "/api/v1/devices:batch",
+			contentType: "application/yaml",
+			body:        []byte("- op: create\n  device:\n    SerialNum: \"1\"\n    ip: 0.9.9.0\n"),
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("BatchDevices", mock.Anything, created, false).Return([]domain.BatchResult{{Device: &device}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:        "batch as msgpack",
+			path:        "/api/v1/devices:batch",
+			contentType: "application/msgpack",
+			body:        msgpackOf([]any{map[string]any{"op": "create", "device": map[string]any{"serial_num": "1", "ip": "0.9.9.0"}}}),
+			mockBehavior: func(r *mocks.DeviceUseCase) {
+				r.On("BatchDevices", mock.Anything, created, false).Return([]domain.BatchResult{{Device: &device}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "batch device is not an object as msgpack",
+			path:           "/api/v1/devices:batch",
+			contentType:    "application/msgpack",
+			body:           msgpackOf([]any{map[string]any{"op": "create", "device": "1"}}),
+			mockBehavior:   func(r *mocks.DeviceUseCase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			test.mockBehavior(mockDeviceUC)
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodPost, test.path, bytes.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code, recorder.Body.String())
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	router := mux.NewRouter()
+	newHandler(t, new(mocks.DeviceUseCase)).RegisterHandlers(router)
+
+	routed := make(map[string]bool)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || strings.HasPrefix(path, strings.TrimSuffix(docsPath, "/")) {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			key := operationKey(method, path)
+			routed[key] = true
+			assert.NotNil(t, apiSpec.operation(method, path), "%s is not documented", key)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	for key := range apiSpec.operations {
+		assert.True(t, routed[key], "%s is documented but not routed", key)
+	}
+}
+
+func TestHandler_OpenAPIDocument(t *testing.T) {
+	router := mux.NewRouter()
+	newHandler(t, new(mocks.DeviceUseCase)).RegisterHandlers(router)
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	recorder := get("/api/v1/openapi.json")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var doc struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &doc))
+	assert.Equal(t, "3.1.0", doc.OpenAPI)
+	assert.Contains(t, doc.Paths["/api/v1/devices/{serialNum}"], "patch")
+
+	recorder = get("/api/v1/docs")
+	assert.Equal(t, http.StatusMovedPermanently, recorder.Code)
+	assert.Equal(t, docsPath, recorder.Header().Get("Location"))
+
+	recorder = get("/api/v1/docs/")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "swagger-ui")
+
+	recorder = get("/api/v1/docs/swagger-initializer.js")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `url: "/api/v1/openapi.json"`)
+
+	recorder = get("/api/v1/docs/swagger-ui-bundle.js")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestHandler_RequestValidation(t *testing.T) {
+	testTable := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedFields []ProblemField
+	}{
+		{
+			name:           "query type",
+			method:         http.MethodGet,
+			path:           "/api/v1/devices?limit=ten",
+			expectedFields: []ProblemField{{Field: "limit"}},
+		},
+		{
+			name:           "query enum",
+			method:         http.MethodPost,
+			path:           "/api/v1/devices/import?on_conflict=replace",
+			body:           "serial_num\n1\n",
+			expectedFields: []ProblemField{{Field: "on_conflict"}},
+		},
+		{
+			name:           "body enum",
+			method:         http.MethodPost,
+			path:           "/api/v1/devices",
+			body:           `{"serial_num":"1","ip":"10.0.0.1","status":"lost"}`,
+			expectedFields: []ProblemField{{Field: "status"}},
+		},
+		{
+			name:   "missing and unknown properties",
+			method: http.MethodPost,
+			path:   "/api/v1/devices/1/transitions",
+			body:   `{"status":"active"}`,
+			expectedFields: []ProblemField{
+				{Field: "to", Message: "is required"},
+				{Field: "status", Message: "is not allowed"},
+			},
+		},
+		{
+			name:           "nested",
+			method:         http.MethodPost,
+			path:           "/api/v1/devices:batch",
+			body:           `[{"op":"delete","serial_num":"1"},{"op":"create","device":{"labels":{"role":1}}}]`,
+			expectedFields: []ProblemField{{Field: "[1].device.labels.role"}},
+		},
+	}
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC).RegisterHandlers(router)
+
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if strings.Contains(test.path, "import") {
+				req.Header.Set("Content-Type", "text/csv")
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			var p Problem
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p))
+			require.Len(t, p.Errors, len(test.expectedFields), p.Errors)
+			for i, f := range test.expectedFields {
+				assert.Equal(t, f.Field, p.Errors[i].Field)
+				assert.NotEmpty(t, p.Errors[i].Message)
+				if f.Message != "" {
+					assert.Equal(t, f.Message, p.Errors[i].Message)
+				}
+			}
+			// Nothing reaches the use case.
+			mockDeviceUC.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_ResponseValidation(t *testing.T) {
+	serve := func(h *Handler, path string) *httptest.ResponseRecorder {
+		router := mux.NewRouter()
+		h.RegisterHandlers(router)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+	var drift []error
+	report := WithResponseValidation(func(err error) { drift = append(drift, err) })
+
+	t.Run("body drifted", func(t *testing.T) {
+		drift = nil
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("GetDevice", mock.Anything, "1").Return(domain.Device{SerialNum: "1", Status: "lost"}, nil)
+		recorder := serve(NewHandler(mockDeviceUC, report), "/api/v1/devices/1")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		if assert.Len(t, drift, 1) {
+			assert.Contains(t, drift[0].Error(), "openapi: GET /api/v1/devices/{serialNum}: response does not match the document: status 200")
+			assert.Contains(t, drift[0].Error(), "at '/status': value must be one of")
+		}
+	})
+
+	t.Run("status not documented", func(t *testing.T) {
+		drift = nil
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("GetDevice", mock.Anything, "1").Return(domain.Device{}, domain.ErrGone)
+		recorder := serve(NewHandler(mockDeviceUC, report), "/api/v1/devices/1")
+		assert.Equal(t, http.StatusGone, recorder.Code)
+		assert.Len(t, drift, 1)
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		drift = nil
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("GetDevice", mock.Anything, "1").Return(domain.Device{}, domain.ErrGone)
+		recorder := serve(NewHandler(mockDeviceUC), "/api/v1/devices/1")
+		assert.Equal(t, http.StatusGone, recorder.Code)
+		assert.Empty(t, drift)
+	})
+
+	t.Run("media type alias", func(t *testing.T) {
+		mockDeviceUC := new(mocks.DeviceUseCase)
+		mockDeviceUC.On("GetDevice", mock.Anything, "1").Return(domain.Device{SerialNum: "1"}, nil)
+		router := mux.NewRouter()
+		newHandler(t, mockDeviceUC).RegisterHandlers(router)
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/devices/1", nil)
+		req.Header.Set("Accept", "application/vnd.msgpack")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+}
+
+func TestHandler_Authentication(t *testing.T) {
+	authenticator, err := auth.New(auth.WithAPIKeys(map[string]string{"ci": auth.HashAPIKey("secret")}))
+	require.NoError(t, err)
+
+	testTable := []struct {
+		name      string
+		path      string
+		header    http.Header
+		code      int
+		challenge string
+	}{
+		{
+			name:      "no credentials",
+			path:      "/api/v1/devices/1",
+			code:      http.StatusUnauthorized,
+			challenge: `Bearer realm="homework"`,
+		},
+		{
+			name:      "unknown api key",
+			path:      "/api/v1/devices/1",
+			header:    http.Header{"X-Api-Key": {"guess"}},
+			code:      http.StatusUnauthorized,
+			challenge: `Bearer realm="homework", error="invalid_token"`,
+		},
+		{
+			name:      "bearer tokens not configured",
+			path:      "/api/v1/devices/1",
+			header:    http.Header{"Authorization": {"Bearer abc.def.ghi"}},
+			code:      http.StatusUnauthorized,
+			challenge: `Bearer realm="homework", error="invalid_token"`,
+		},
+		{
+			name:   "api key",
+			path:   "/api/v1/devices/1",
+			header: http.Header{"X-Api-Key": {"secret"}, "X-Actor": {"mallory"}},
+			code:   http.StatusOK,
+		},
+		{
+			name: "openapi document is public",
+			path: openAPIPath,
+			code: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			mockDeviceUC.On("GetDevice", mock.MatchedBy(func(ctx context.Context) bool {
+				p, ok := auth.PrincipalFrom(ctx)
+				return ok && p.Subject == "ci" && p.Method == auth.MethodAPIKey && domain.ActorFrom(ctx) == "ci"
+			}), "1").Return(domain.Device{SerialNum: "1"}, nil).Maybe()
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC, WithAuthenticator(authenticator)).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, tc.code, recorder.Code)
+			assert.Equal(t, tc.challenge, recorder.Header().Get("WWW-Authenticate"))
+			if tc.code == http.StatusUnauthorized {
+				assert.Equal(t, problemContentType, recorder.Header().Get("Content-Type"))
+				mockDeviceUC.AssertNotCalled(t, "GetDevice", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestHandler_Tenants(t *testing.T) {
+	authenticator, err := auth.New(
+		auth.WithAPIKeys(map[string]string{"acme-ci": auth.HashAPIKey("acme-key")}),
+		auth.WithAPIKeyTenants(map[string]string{"acme-ci": "acme"}),
+	)
+	require.NoError(t, err)
+
+	testTable := []struct {
+		name   string
+		opts   []Option
+		path   string
+		header http.Header
+		code   int
+		tenant string
+	}{
+		{
+			name:   "default tenant",
+			path:   "/api/v1/devices/1",
+			code:   http.StatusOK,
+			tenant: domain.DefaultTenant,
+		},
+		{
+			name:   "tenant in path",
+			path:   "/api/v1/tenants/acme/devices/1",
+			code:   http.StatusOK,
+			tenant: "acme",
+		},
+		{
+			name: "invalid tenant",
+			path: "/api/v1/tenants/Acme/devices/1",
+			code: http.StatusBadRequest,
+		},
+		{
+			name:   "tenant of the principal",
+			opts:   []Option{WithAuthenticator(authenticator)},
+			path:   "/api/v1/devices/1",
+			header: http.Header{"X-Api-Key": {"acme-key"}},
+			code:   http.StatusOK,
+			tenant: "acme",
+		},
+		{
+			name:   "own tenant in path",
+			opts:   []Option{WithAuthenticator(authenticator)},
+			path:   "/api/v1/tenants/acme/devices/1",
+			header: http.Header{"X-Api-Key": {"acme-key"}},
+			code:   http.StatusOK,
+			tenant: "acme",
+		},
+		{
+			name:   "other tenant in path",
+			opts:   []Option{WithAuthenticator(authenticator)},
+			path:   "/api/v1/tenants/globex/devices/1",
+			header: http.Header{"X-Api-Key": {"acme-key"}},
+			code:   http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDeviceUC := new(mocks.DeviceUseCase)
+			mockDeviceUC.On("GetDevice", mock.MatchedBy(func(ctx context.Context) bool {
+				return domain.TenantFrom(ctx) == tc.tenant
+			}), "1").Return(domain.Device{SerialNum: "1"}, nil).Maybe()
+			router := mux.NewRouter()
+			newHandler(t, mockDeviceUC, tc.opts...).RegisterHandlers(router)
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, tc.code, recorder.Code)
+			if tc.code != http.StatusOK {
+				assert.Equal(t, problemContentType, recorder.Header().Get("Content-Type"))
+				mockDeviceUC.AssertNotCalled(t, "GetDevice", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestHandler_StreamEvents(t *testing.T) {
+	uc := new(mocks.DeviceUseCase)
+	router := mux.NewRouter()
+	newHandler(t, uc).RegisterHandlers(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	change := func(version uint64, model string) domain.HistoryEntry {
+		d := domain.Device{SerialNum: "1", Model: model, IP: "0.9.9.0", Revision: 1}
+		return domain.HistoryEntry{ResourceVersion: version, SerialNum: d.SerialNum, Op: domain.OpCreate, Revision: 1, After: &d}
+	}
+
+	t.Run("sse", func(t *testing.T) {
+		changes := make(chan domain.HistoryEntry, 2)
+		uc.On("WatchDevices", mock.Anything, uint64(0)).Return((<-chan domain.HistoryEntry)(changes), nil).Once()
+
+		resp, err := http.Get(server.URL + "/api/v1/devices/events?model=a")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		changes <- change(1, "b")
+		changes <- change(2, "a")
+		reader := bufio.NewReader(resp.Body)
+		var lines []string
+		for len(lines) < 3 {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+		assert.Equal(t, "id: 2", lines[0])
+		assert.Equal(t, "event: create", lines[1])
+		assert.True(t, strings.HasPrefix(lines[2], `data: {"resource_version":2,"serial_num":"1","op":"create"`), lines[2])
+	})
+
+	t.Run("websocket resumes after last_event_id", func(t *testing.T) {
+		changes := make(chan domain.HistoryEntry, 1)
+		changes <- change(2, "a")
+		uc.On("WatchDevices", mock.Anything, uint64(1)).Return((<-chan domain.HistoryEntry)(changes), nil).Once()
+
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/devices/events?last_event_id=1"
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		var e domain.HistoryEntry
+		require.NoError(t, conn.ReadJSON(&e))
+		assert.Equal(t, uint64(2), e.ResourceVersion)
+		assert.Equal(t, "a", e.After.Model)
+
+		// A closed watch tells the client to come back later.
+		close(changes)
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater), err)
+	})
+
+	t.Run("resume point no longer retained", func(t *testing.T) {
+		uc.On("WatchDevices", mock.Anything, uint64(7)).Return(nil, fmt.Errorf("%w: compacted", domain.ErrGone)).Once()
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/devices/events", nil)
+		req.Header.Set("Last-Event-ID", "7")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusGone, resp.StatusCode)
+	})
+
+	t.Run("bad label filter", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/v1/devices/events?label=site")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("bad last event id", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/v1/devices/events?last_event_id=x")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("server shuts down", func(t *testing.T) {
+		uc := new(mocks.DeviceUseCase)
+		uc.On("WatchDevices", mock.Anything, uint64(0)).Return((<-chan domain.HistoryEntry)(make(chan domain.HistoryEntry)), nil)
+		stopping := make(chan struct{})
+		router := mux.NewRouter()
+		newHandler(t, uc, WithShutdown(stopping)).RegisterHandlers(router)
+		server := httptest.NewServer(router)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/api/v1/devices/events")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/devices/events", nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		close(stopping)
+		_, err = io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseServiceRestart), err)
+	})
+}
+
+func TestDecodeDevice(t *testing.T) {
+	testTable := []struct {
+		name     string
+		body     string
+		expected domain.Device
+	}{
+		{
+			name:     "legacy pascal case",
+			body:     `{"SerialNum":"1","Model":"ppp","IP":"0.9.9.0"}`,
+			expected: domain.Device{SerialNum: "1", Model: "ppp", IP: "0.9.9.0"},
+		},
+		{
+			name: "snake case with new fields",
+			body: `{"serial_num":"1","model":"ppp","ip":"0.9.9.0","firmware_version":"1.2.3","mac":"00:1a:2b:3c:4d:5e",
+				"hostname":"sw-1","site":"msk","location":"rack 4","labels":{"role":"edge"},"status":"active"}`,
+			expected: domain.Device{
+				SerialNum:       "1",
+				Model:           "ppp",
+				IP:              "0.9.9.0",
+				FirmwareVersion: "1.2.3",
+				MAC:             "00:1a:2b:3c:4d:5e",
+				Hostname:        "sw-1",
+				Site:            "msk",
+				Location:        "rack 4",
+				Labels:          map[string]string{"role": "edge"},
+				Status:          domain.StatusActive,
+			},
+		},
+		{
+			name:     "current spelling wins",
+			body:     `{"SerialNum":"old","serial_num":"new","ip":"0.9.9.0"}`,
+			expected: domain.Device{SerialNum: "new", IP: "0.9.9.0"},
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := decodeDevice(bytes.NewBufferString(test.body))
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, d)
+		})
+	}
+
+	_, err := decodeDevice(bytes.NewBufferString(`[]`))
+	assert.ErrorIs(t, err, domain.ErrValidation)
+}
+
+func TestNormalizePatch(t *testing.T) {
+	merge, err := normalizePatch(domain.Patch{Type: domain.MergePatch, Document: []byte(`{"Model":"x","labels":{"Model":"y"}}`)})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"model":"x","labels":{"Model":"y"}}`, string(merge.Document))
+
+	ops, err := normalizePatch(domain.Patch{Type: domain.JSONPatch, Document: []byte(`[
+		{"op":"test","path":"/IP","value":"1.1.1.1"},
+		{"op":"copy","from":"/Model","path":"/labels/Model"}
+	]`)})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"op":"test","path":"/ip","value":"1.1.1.1"},
+		{"op":"copy","from":"/model","path":"/labels/Model"}
+	]`, string(ops.Document))
+}
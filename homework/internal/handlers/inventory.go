@@ -0,0 +1,407 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homework/internal/domain"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	csvContentType    = "text/csv"
+	ndjsonContentType = "application/x-ndjson"
+
+	// exportPageSize is how many devices an export reads per ListDevices
+	// call.
+	exportPageSize = 1000
+	// maxNDJSONLine bounds a single device of an NDJSON import.
+	maxNDJSONLine = 1 << 20
+	// maxImportRows bounds the devices of an import, which are written as
+	// a single batch.
+	maxImportRows = 10000
+)
+
+var errTooManyRows = fmt.Errorf("%w: at most %d devices per import", domain.ErrTooLarge, maxImportRows)
+
+// csvColumns is the header of a CSV export. An import accepts any subset in
+// any order as long as serial_num is present; revision and the timestamps
+// are ignored so an export can be imported again as is.
+var csvColumns = []string{
+	"serial_num", "model", "ip", "firmware_version", "mac", "hostname", "site", "location",
+	"labels", "status", "revision", "created_at", "updated_at",
+}
+
+// ExportDevices streams every device matching ?model=, ?ip= and ?sort= as
+// CSV or NDJSON, chosen by ?format= or the Accept header; CSV is the
+// default. Devices are written page by page, so an export of the whole
+// inventory is never held in memory.
+func (h *Handler) ExportDevices(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+		if strings.Contains(r.Header.Get("Accept"), ndjsonContentType) {
+			format = "ndjson"
+		}
+	}
+	if format != "csv" && format != "ndjson" {
+		writeError(w, r, domain.NewValidationError(domain.FieldError{Field: "format", Message: "must be csv or ndjson"}))
+		return
+	}
+	filter, err := parseDeviceFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	filter.Limit = exportPageSize
+	filter.Cursor = ""
+
+	page, err := h.deviceUC.ListDevices(r.Context(), filter)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var out deviceWriter
+	if format == "csv" {
+		w.Header().Set("Content-Type", csvContentType)
+		out = newCSVDeviceWriter(w)
+	} else {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		out = &ndjsonDeviceWriter{enc: json.NewEncoder(w)}
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="devices.`+format+`"`)
+	flusher, _ := w.(http.Flusher)
+	for {
+		for _, d := range page.Devices {
+			if err := out.write(d); err != nil {
+				return
+			}
+		}
+		if err := out.flush(); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if page.NextCursor == "" {
+			return
+		}
+		filter.Cursor = page.NextCursor
+		if page, err = h.deviceUC.ListDevices(r.Context(), filter); err != nil {
+			// The status is already sent; a truncated body is all we can do.
+			return
+		}
+	}
+}
+
+// importReport is the response of POST /api/v1/devices/import.
+type importReport struct {
+	DryRun  bool          `json:"dry_run"`
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Skipped int           `json:"skipped"`
+	Errors  []importError `json:"errors,omitempty"`
+}
+
+type importError struct {
+	Row       int     `json:"row"`
+	SerialNum string  `json:"serial_num,omitempty"`
+	Error     Problem `json:"error"`
+}
+
+// ImportDevices reads devices from a CSV or NDJSON body, chosen by ?format=
+// or Content-Type. ?on_conflict= is fail (the default), skip or overwrite;
+// ?dry_run=true only reports what would happen. Rows are numbered from 1,
+// the CSV header being row 1. A failed on_conflict=fail import writes
+// nothing and answers with the status of its first rejected row. More than
+// maxImportRows devices are refused with 413.
+func (h *Handler) ImportDevices(w http.ResponseWriter, r *http.Request) {
+	codec, ok := h.negotiate(w, r, importReport{})
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case csvContentType:
+			format = "csv"
+		case ndjsonContentType:
+			format = "ndjson"
+		}
+	}
+	var read func(io.Reader) ([]domain.ImportRow, error)
+	switch format {
+	case "csv":
+		read = readCSVDevices
+	case "ndjson":
+		read = readNDJSONDevices
+	default:
+		writeProblem(w, newProblem(r, http.StatusUnsupportedMediaType,
+			"send "+csvContentType+" or "+ndjsonContentType))
+		return
+	}
+
+	opts := domain.ImportOptions{OnConflict: domain.OnConflict(q.Get("on_conflict"))}
+	if opts.OnConflict == "" {
+		opts.OnConflict = domain.ConflictFail
+	}
+	if v := q.Get("dry_run"); v != "" {
+		var err error
+		if opts.DryRun, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, domain.NewValidationError(domain.FieldError{Field: "dry_run", Message: "must be true or false"}))
+			return
+		}
+	}
+
+	rows, err := read(r.Body)
+	if err != nil {
+		writeError(w, r, badRequestBody(err))
+		return
+	}
+	report, err := h.deviceUC.ImportDevices(r.Context(), rows, opts)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	out := importReport{
+		DryRun:  report.DryRun,
+		Created: report.Created,
+		Updated: report.Updated,
+		Skipped: report.Skipped,
+	}
+	for _, e := range report.Errors {
+		p := problemFromError(r, e.Err)
+		out.Errors = append(out.Errors, importError{Row: e.Row, SerialNum: e.SerialNum, Error: p})
+		if status == http.StatusOK && !opts.DryRun && opts.OnConflict == domain.ConflictFail {
+			status = p.Status
+		}
+	}
+	respond(w, r, codec, status, out)
+}
+
+type deviceWriter interface {
+	write(d domain.Device) error
+	flush() error
+}
+
+type csvDeviceWriter struct {
+	w *csv.Writer
+	// err is the error of writing the header.
+	err error
+}
+
+func newCSVDeviceWriter(w io.Writer) *csvDeviceWriter {
+	out := &csvDeviceWriter{w: csv.NewWriter(w)}
+	out.err = out.w.Write(csvColumns)
+	return out
+}
+
+func (c *csvDeviceWriter) write(d domain.Device) error {
+	if c.err != nil {
+		return c.err
+	}
+	record := []string{
+		d.SerialNum, d.Model, d.IP, d.FirmwareVersion, d.MAC, d.Hostname, d.Site, d.Location,
+		formatLabels(d.Labels), string(d.Status), strconv.FormatUint(d.Revision, 10),
+		d.CreatedAt.Format(time.RFC3339Nano), d.UpdatedAt.Format(time.RFC3339Nano),
+	}
+	for i, v := range record {
+		record[i] = escapeFormula(v)
+	}
+	return c.w.Write(record)
+}
+
+// escapeFormula keeps a spreadsheet from running a cell as a formula by
+// prefixing cells that would start one with a quote, which spreadsheets do
+// not show. Cells that start with a quote get another one, so that
+// unescapeFormula can undo it on import and an export imports unchanged.
+func escapeFormula(v string) string {
+	if v != "" && strings.ContainsRune(formulaPrefixes+"'", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+func unescapeFormula(v string) string {
+	if len(v) > 1 && v[0] == '\'' && strings.ContainsRune(formulaPrefixes+"'", rune(v[1])) {
+		return v[1:]
+	}
+	return v
+}
+
+// formulaPrefixes are the characters spreadsheets start a formula with.
+const formulaPrefixes = "=+-@\t\r"
+
+func (c *csvDeviceWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonDeviceWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonDeviceWriter) write(d domain.Device) error {
+	return n.enc.Encode(d)
+}
+
+func (n *ndjsonDeviceWriter) flush() error {
+	return nil
+}
+
+// readCSVDevices reads a CSV import. A row with the wrong number of fields
+// or bad labels is reported on its own; a file that is not CSV at all, or
+// whose header names unknown columns, is rejected as a whole.
+func readCSVDevices(r io.Reader) ([]domain.ImportRow, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty CSV")
+	}
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(csvColumns))
+	for _, c := range csvColumns {
+		known[c] = true
+	}
+	hasSerialNum := false
+	for i, c := range header {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if !known[c] {
+			return nil, fmt.Errorf("unknown CSV column %q", c)
+		}
+		hasSerialNum = hasSerialNum || c == "serial_num"
+		header[i] = c
+	}
+	if !hasSerialNum {
+		return nil, errors.New("CSV header has no serial_num column")
+	}
+
+	var rows []domain.ImportRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if len(rows) == maxImportRows {
+			return nil, errTooManyRows
+		}
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, err
+		}
+		// Quoted fields can span lines, so the row is numbered by the line
+		// it starts on rather than counted.
+		line, _ := cr.FieldPos(0)
+		row := domain.ImportRow{Row: line}
+		if err != nil {
+			row.Err = domain.NewValidationError(domain.FieldError{
+				Field:   "row",
+				Message: fmt.Sprintf("has %d fields, want %d", len(record), len(header)),
+			})
+			rows = append(rows, row)
+			continue
+		}
+		row.Device, row.Err = deviceFromCSV(header, record)
+		rows = append(rows, row)
+	}
+}
+
+func deviceFromCSV(header, record []string) (domain.Device, error) {
+	var d domain.Device
+	for i, c := range header {
+		v := unescapeFormula(strings.TrimSpace(record[i]))
+		switch c {
+		case "serial_num":
+			d.SerialNum = v
+		case "model":
+			d.Model = v
+		case "ip":
+			d.IP = v
+		case "firmware_version":
+			d.FirmwareVersion = v
+		case "mac":
+			d.MAC = v
+		case "hostname":
+			d.Hostname = v
+		case "site":
+			d.Site = v
+		case "location":
+			d.Location = v
+		case "status":
+			d.Status = domain.Status(v)
+		case "labels":
+			labels, err := parseLabels(v)
+			if err != nil {
+				return d, err
+			}
+			d.Labels = labels
+		}
+	}
+	return d, nil
+}
+
+// formatLabels writes labels as key=value pairs separated by ";", sorted by
+// key.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+func parseLabels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, domain.NewValidationError(domain.FieldError{
+				Field:   "labels",
+				Message: fmt.Sprintf("want key=value pairs separated by ';', got %q", pair),
+			})
+		}
+		labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
+
+// readNDJSONDevices reads one device per line, in the same format as
+// CreateDevice accepts. Blank lines are skipped but still counted.
+func readNDJSONDevices(r io.Reader) ([]domain.ImportRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLine)
+	var rows []domain.ImportRow
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if len(rows) == maxImportRows {
+			return nil, errTooManyRows
+		}
+		d, err := decodeDevice(strings.NewReader(line))
+		rows = append(rows, domain.ImportRow{Row: n, Device: d, Err: err})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
@@ -3,9 +3,12 @@
 package mocks
 
 import (
+	context "context"
 	domain "homework/internal/domain"
 
 	mock "github.com/stretchr/testify/mock"
+
+	time "time"
 )
 
 // DeviceUseCase is an autogenerated mock type for the DeviceUseCase type
@@ -13,27 +16,63 @@ type DeviceUseCase struct {
 	mock.Mock
 }
 
-// CreateDevice provides a mock function with given fields: d
-func (_m *DeviceUseCase) CreateDevice(d domain.Device) error {
-	ret := _m.Called(d)
+// BatchDevices provides a mock function with given fields: ctx, ops, atomic
+func (_m *DeviceUseCase) BatchDevices(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	ret := _m.Called(ctx, ops, atomic)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(domain.Device) error); ok {
-		r0 = rf(d)
+	var r0 []domain.BatchResult
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, []domain.BatchOperation, bool) ([]domain.BatchResult, error)); ok {
+		return rf(ctx, ops, atomic)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, []domain.BatchOperation, bool) []domain.BatchResult); ok {
+		r0 = rf(ctx, ops, atomic)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.BatchResult)
+		}
 	}
 
-	return r0
+	if rf, ok := ret.Get(1).(func(context.Context, []domain.BatchOperation, bool) error); ok {
+		r1 = rf(ctx, ops, atomic)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CreateDevice provides a mock function with given fields: ctx, d
+func (_m *DeviceUseCase) CreateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	ret := _m.Called(ctx, d)
+
+	var r0 domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, domain.Device) (domain.Device, error)); ok {
+		return rf(ctx, d)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, domain.Device) domain.Device); ok {
+		r0 = rf(ctx, d)
+	} else {
+		r0 = ret.Get(0).(domain.Device)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, domain.Device) error); ok {
+		r1 = rf(ctx, d)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
-// DeleteDevice provides a mock function with given fields: _a0
-func (_m *DeviceUseCase) DeleteDevice(_a0 string) error {
-	ret := _m.Called(_a0)
+// DeleteDevice provides a mock function with given fields: ctx, serialNum, revision
+func (_m *DeviceUseCase) DeleteDevice(ctx context.Context, serialNum string, revision uint64) error {
+	ret := _m.Called(ctx, serialNum, revision)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint64) error); ok {
+		r0 = rf(ctx, serialNum, revision)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -41,23 +80,23 @@ func (_m *DeviceUseCase) DeleteDevice(_a0 string) error {
 	return r0
 }
 
-// GetDevice provides a mock function with given fields: _a0
-func (_m *DeviceUseCase) GetDevice(_a0 string) (domain.Device, error) {
-	ret := _m.Called(_a0)
+// GetDevice provides a mock function with given fields: ctx, serialNum
+func (_m *DeviceUseCase) GetDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	ret := _m.Called(ctx, serialNum)
 
 	var r0 domain.Device
 	var r1 error
-	if rf, ok := ret.Get(0).(func(string) (domain.Device, error)); ok {
-		return rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string) (domain.Device, error)); ok {
+		return rf(ctx, serialNum)
 	}
-	if rf, ok := ret.Get(0).(func(string) domain.Device); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string) domain.Device); ok {
+		r0 = rf(ctx, serialNum)
 	} else {
 		r0 = ret.Get(0).(domain.Device)
 	}
 
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(_a0)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, serialNum)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -65,18 +104,274 @@ func (_m *DeviceUseCase) GetDevice(_a0 string) (domain.Device, error) {
 	return r0, r1
 }
 
-// UpdateDevice provides a mock function with given fields: _a0
-func (_m *DeviceUseCase) UpdateDevice(_a0 domain.Device) error {
-	ret := _m.Called(_a0)
+// GetDeviceHistory provides a mock function with given fields: ctx, serialNum
+func (_m *DeviceUseCase) GetDeviceHistory(ctx context.Context, serialNum string) ([]domain.HistoryEntry, error) {
+	ret := _m.Called(ctx, serialNum)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(domain.Device) error); ok {
-		r0 = rf(_a0)
+	var r0 []domain.HistoryEntry
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) ([]domain.HistoryEntry, error)); ok {
+		return rf(ctx, serialNum)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string) []domain.HistoryEntry); ok {
+		r0 = rf(ctx, serialNum)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.HistoryEntry)
+		}
 	}
 
-	return r0
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, serialNum)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ImportDevices provides a mock function with given fields: ctx, rows, opts
+func (_m *DeviceUseCase) ImportDevices(ctx context.Context, rows []domain.ImportRow, opts domain.ImportOptions) (domain.ImportReport, error) {
+	ret := _m.Called(ctx, rows, opts)
+
+	var r0 domain.ImportReport
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, []domain.ImportRow, domain.ImportOptions) (domain.ImportReport, error)); ok {
+		return rf(ctx, rows, opts)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, []domain.ImportRow, domain.ImportOptions) domain.ImportReport); ok {
+		r0 = rf(ctx, rows, opts)
+	} else {
+		r0 = ret.Get(0).(domain.ImportReport)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, []domain.ImportRow, domain.ImportOptions) error); ok {
+		r1 = rf(ctx, rows, opts)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListDevices provides a mock function with given fields: ctx, f
+func (_m *DeviceUseCase) ListDevices(ctx context.Context, f domain.DeviceFilter) (domain.DevicePage, error) {
+	ret := _m.Called(ctx, f)
+
+	var r0 domain.DevicePage
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, domain.DeviceFilter) (domain.DevicePage, error)); ok {
+		return rf(ctx, f)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, domain.DeviceFilter) domain.DevicePage); ok {
+		r0 = rf(ctx, f)
+	} else {
+		r0 = ret.Get(0).(domain.DevicePage)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, domain.DeviceFilter) error); ok {
+		r1 = rf(ctx, f)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListTrash provides a mock function with given fields: ctx
+func (_m *DeviceUseCase) ListTrash(ctx context.Context) ([]domain.Device, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context) ([]domain.Device, error)); ok {
+		return rf(ctx)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context) []domain.Device); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.Device)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// PatchDevice provides a mock function with given fields: ctx, serialNum, p, revision
+func (_m *DeviceUseCase) PatchDevice(ctx context.Context, serialNum string, p domain.Patch, revision uint64) (domain.Device, error) {
+	ret := _m.Called(ctx, serialNum, p, revision)
+
+	var r0 domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, domain.Patch, uint64) (domain.Device, error)); ok {
+		return rf(ctx, serialNum, p, revision)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, domain.Patch, uint64) domain.Device); ok {
+		r0 = rf(ctx, serialNum, p, revision)
+	} else {
+		r0 = ret.Get(0).(domain.Device)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, domain.Patch, uint64) error); ok {
+		r1 = rf(ctx, serialNum, p, revision)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// PurgeTrash provides a mock function with given fields: ctx, retention
+func (_m *DeviceUseCase) PurgeTrash(ctx context.Context, retention time.Duration) (int, error) {
+	ret := _m.Called(ctx, retention)
+
+	var r0 int
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration) (int, error)); ok {
+		return rf(ctx, retention)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration) int); ok {
+		r0 = rf(ctx, retention)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, time.Duration) error); ok {
+		r1 = rf(ctx, retention)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RestoreDevice provides a mock function with given fields: ctx, serialNum
+func (_m *DeviceUseCase) RestoreDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	ret := _m.Called(ctx, serialNum)
+
+	var r0 domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) (domain.Device, error)); ok {
+		return rf(ctx, serialNum)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string) domain.Device); ok {
+		r0 = rf(ctx, serialNum)
+	} else {
+		r0 = ret.Get(0).(domain.Device)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, serialNum)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RevertDevice provides a mock function with given fields: ctx, serialNum, toRevision, revision
+func (_m *DeviceUseCase) RevertDevice(ctx context.Context, serialNum string, toRevision uint64, revision uint64) (domain.Device, error) {
+	ret := _m.Called(ctx, serialNum, toRevision, revision)
+
+	var r0 domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint64, uint64) (domain.Device, error)); ok {
+		return rf(ctx, serialNum, toRevision, revision)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint64, uint64) domain.Device); ok {
+		r0 = rf(ctx, serialNum, toRevision, revision)
+	} else {
+		r0 = ret.Get(0).(domain.Device)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint64, uint64) error); ok {
+		r1 = rf(ctx, serialNum, toRevision, revision)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TransitionDevice provides a mock function with given fields: ctx, serialNum, t, revision
+func (_m *DeviceUseCase) TransitionDevice(ctx context.Context, serialNum string, t domain.Transition, revision uint64) (domain.Device, error) {
+	ret := _m.Called(ctx, serialNum, t, revision)
+
+	var r0 domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, domain.Transition, uint64) (domain.Device, error)); ok {
+		return rf(ctx, serialNum, t, revision)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, domain.Transition, uint64) domain.Device); ok {
+		r0 = rf(ctx, serialNum, t, revision)
+	} else {
+		r0 = ret.Get(0).(domain.Device)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, domain.Transition, uint64) error); ok {
+		r1 = rf(ctx, serialNum, t, revision)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateDevice provides a mock function with given fields: ctx, d
+func (_m *DeviceUseCase) UpdateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	ret := _m.Called(ctx, d)
+
+	var r0 domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, domain.Device) (domain.Device, error)); ok {
+		return rf(ctx, d)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, domain.Device) domain.Device); ok {
+		r0 = rf(ctx, d)
+	} else {
+		r0 = ret.Get(0).(domain.Device)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, domain.Device) error); ok {
+		r1 = rf(ctx, d)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// WatchDevices provides a mock function with given fields: ctx, fromVersion
+func (_m *DeviceUseCase) WatchDevices(ctx context.Context, fromVersion uint64) (<-chan domain.HistoryEntry, error) {
+	ret := _m.Called(ctx, fromVersion)
+
+	var r0 <-chan domain.HistoryEntry
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, uint64) (<-chan domain.HistoryEntry, error)); ok {
+		return rf(ctx, fromVersion)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, uint64) <-chan domain.HistoryEntry); ok {
+		r0 = rf(ctx, fromVersion)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(<-chan domain.HistoryEntry)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, uint64) error); ok {
+		r1 = rf(ctx, fromVersion)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
 // NewDeviceUseCase creates a new instance of DeviceUseCase. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
@@ -0,0 +1,607 @@
+package handlers
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	swaggerFiles "github.com/swaggo/files/v2"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"gopkg.in/yaml.v3"
+	"homework/internal/domain"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// openAPIYAML is the contract of /api/v1. It is written in YAML and served
+// as JSON.
+//
+//go:embed openapi.yaml
+var openAPIYAML []byte
+
+const (
+	openAPIPath = "/api/v1/openapi.json"
+	docsPath    = "/api/v1/docs/"
+)
+
+// apiSpec is loaded once; a document that does not load is a programming
+// error caught by any test of this package.
+var apiSpec = mustLoadSpec(openAPIYAML)
+
+// spec is the OpenAPI document compiled for validation. Operations are
+// keyed by method and mux path template, which are spelled the same as the
+// document's paths.
+type spec struct {
+	json       []byte
+	operations map[string]*operation
+}
+
+type operation struct {
+	// streaming operations answer with SSE or a WebSocket; their responses
+	// are not checked.
+	streaming bool
+	params    []parameter
+	// body maps the media types of the request body to their schemas; nil
+	// for media types that are not JSON.
+	body      map[string]*jsonschema.Schema
+	responses map[string]*response
+}
+
+type parameter struct {
+	name     string
+	in       string
+	required bool
+	// typ is the schema type, used to read the string value of the
+	// parameter before it is validated.
+	typ    string
+	schema *jsonschema.Schema
+}
+
+type response struct {
+	content map[string]*jsonschema.Schema
+}
+
+func operationKey(method, path string) string {
+	return method + " " + path
+}
+
+func (s *spec) operation(method, path string) *operation {
+	return s.operations[operationKey(method, path)]
+}
+
+func mustLoadSpec(src []byte) *spec {
+	s, err := loadSpec(src)
+	if err != nil {
+		panic(fmt.Sprintf("openapi: %v", err))
+	}
+	return s
+}
+
+func loadSpec(src []byte) (*spec, error) {
+	var raw map[string]any
+	if err := yaml.Unmarshal(src, &raw); err != nil {
+		return nil, err
+	}
+	addTenantPaths(raw)
+	b, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// jsonschema wants its own number representation.
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	l := &specLoader{doc: doc, compiler: jsonschema.NewCompiler()}
+	l.compiler.DefaultDraft(jsonschema.Draft2020)
+	if err := l.compiler.AddResource(specURL, doc); err != nil {
+		return nil, err
+	}
+
+	s := &spec{json: b, operations: make(map[string]*operation)}
+	paths, _ := l.object("#/paths")
+	for path := range paths {
+		item, _ := l.object(pointer("#/paths", path))
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+			op, err := l.operation(pointer("#/paths", path), method)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(method), path, err)
+			}
+			s.operations[operationKey(strings.ToUpper(method), path)] = op
+		}
+	}
+	return s, nil
+}
+
+// addTenantPaths documents every device and trash path of doc a second time
+// under tenantPrefix. The copies only add the tenant parameter and suffix
+// their operation ids, so the document keeps a single source for both.
+func addTenantPaths(doc map[string]any) {
+	paths, _ := doc["paths"].(map[string]any)
+	var tenantPaths []string
+	for path := range paths {
+		if rest, ok := strings.CutPrefix(path, "/api/v1"); ok && (strings.HasPrefix(rest, "/devices") || rest == "/trash") {
+			tenantPaths = append(tenantPaths, rest)
+		}
+	}
+	for _, rest := range tenantPaths {
+		item := cloneYAML(paths["/api/v1"+rest]).(map[string]any)
+		params, _ := item["parameters"].([]any)
+		item["parameters"] = append([]any{map[string]any{"$ref": "#/components/parameters/Tenant"}}, params...)
+		for method, op := range item {
+			if op, ok := op.(map[string]any); ok && method != "parameters" {
+				op["operationId"] = fmt.Sprint(op["operationId"], "InTenant")
+			}
+		}
+		paths[tenantPrefix+rest] = item
+	}
+}
+
+// cloneYAML deep-copies a decoded YAML value.
+func cloneYAML(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = cloneYAML(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = cloneYAML(e)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// specURL names the document in schema error messages.
+const specURL = "urn:homework:openapi"
+
+// specLoader reads the parsed document by JSON pointer, following local
+// $refs.
+type specLoader struct {
+	doc      any
+	compiler *jsonschema.Compiler
+}
+
+// pointer appends escaped tokens to a JSON pointer fragment.
+func pointer(base string, tokens ...string) string {
+	for _, t := range tokens {
+		t = strings.ReplaceAll(t, "~", "~0")
+		t = strings.ReplaceAll(t, "/", "~1")
+		base += "/" + url.PathEscape(t)
+	}
+	return base
+}
+
+// object returns the object at ptr, after following a $ref it consists of,
+// along with the pointer it was found at.
+func (l *specLoader) object(ptr string) (map[string]any, string) {
+	v := l.doc
+	for _, t := range strings.Split(strings.TrimPrefix(ptr, "#/"), "/") {
+		t, _ = url.PathUnescape(t)
+		t = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+		switch parent := v.(type) {
+		case map[string]any:
+			v = parent[t]
+		case []any:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(parent) {
+				return nil, ptr
+			}
+			v = parent[i]
+		default:
+			return nil, ptr
+		}
+	}
+	obj, _ := v.(map[string]any)
+	if ref, ok := obj["$ref"].(string); ok {
+		return l.object(ref)
+	}
+	return obj, ptr
+}
+
+func (l *specLoader) schema(ptr string) (*jsonschema.Schema, error) {
+	return l.compiler.Compile(specURL + ptr)
+}
+
+func (l *specLoader) operation(pathPtr, method string) (*operation, error) {
+	opPtr := pointer(pathPtr, method)
+	raw, _ := l.object(opPtr)
+	op := &operation{responses: make(map[string]*response)}
+	op.streaming, _ = raw["x-streaming"].(bool)
+
+	// Path-level parameters first; the operation's override them by name
+	// and location.
+	var refs []string
+	for _, base := range []string{pathPtr, opPtr} {
+		list, _ := l.array(pointer(base, "parameters"))
+		for i := range list {
+			refs = append(refs, pointer(base, "parameters", strconv.Itoa(i)))
+		}
+	}
+	seen := make(map[string]int)
+	for _, ref := range refs {
+		p, err := l.parameter(ref)
+		if err != nil {
+			return nil, err
+		}
+		key := p.in + " " + strings.ToLower(p.name)
+		if i, ok := seen[key]; ok {
+			op.params[i] = p
+			continue
+		}
+		seen[key] = len(op.params)
+		op.params = append(op.params, p)
+	}
+
+	if body, ptr := l.object(pointer(opPtr, "requestBody")); body != nil {
+		content, err := l.content(pointer(ptr, "content"))
+		if err != nil {
+			return nil, err
+		}
+		op.body = content
+	}
+
+	responses, _ := l.object(pointer(opPtr, "responses"))
+	for status := range responses {
+		_, ptr := l.object(pointer(opPtr, "responses", status))
+		content, err := l.content(pointer(ptr, "content"))
+		if err != nil {
+			return nil, err
+		}
+		op.responses[status] = &response{content: content}
+	}
+	return op, nil
+}
+
+func (l *specLoader) array(ptr string) ([]any, string) {
+	parent, _ := l.object(ptr[:strings.LastIndex(ptr, "/")])
+	list, _ := parent[ptr[strings.LastIndex(ptr, "/")+1:]].([]any)
+	return list, ptr
+}
+
+func (l *specLoader) parameter(ptr string) (parameter, error) {
+	raw, ptr := l.object(ptr)
+	p := parameter{}
+	p.name, _ = raw["name"].(string)
+	p.in, _ = raw["in"].(string)
+	p.required, _ = raw["required"].(bool)
+	if schema, _ := raw["schema"].(map[string]any); schema != nil {
+		p.typ, _ = schema["type"].(string)
+		var err error
+		if p.schema, err = l.schema(pointer(ptr, "schema")); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// content compiles the schemas of JSON media types.
+func (l *specLoader) content(ptr string) (map[string]*jsonschema.Schema, error) {
+	raw, _ := l.object(ptr)
+	if raw == nil {
+		return nil, nil
+	}
+	content := make(map[string]*jsonschema.Schema, len(raw))
+	for mediaType := range raw {
+		content[mediaType] = nil
+		media, _ := l.object(pointer(ptr, mediaType))
+		if _, ok := media["schema"]; !ok || !isJSON(mediaType) {
+			continue
+		}
+		schema, err := l.schema(pointer(ptr, mediaType, "schema"))
+		if err != nil {
+			return nil, err
+		}
+		content[mediaType] = schema
+	}
+	return content, nil
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// validateRequest checks the parameters and a JSON body against the
+// operation. Bodies that are not JSON at all are left to the handler, which
+// reports them in its own words.
+func (op *operation) validateRequest(r *http.Request) error {
+	var fields []domain.FieldError
+	for _, p := range op.params {
+		var values []string
+		switch p.in {
+		case "query":
+			values = r.URL.Query()[p.name]
+		case "header":
+			values = r.Header.Values(p.name)
+		case "path":
+			if v, ok := mux.Vars(r)[p.name]; ok {
+				values = []string{v}
+			}
+		}
+		if len(values) == 0 {
+			if p.required {
+				fields = append(fields, domain.FieldError{Field: p.name, Message: "is required"})
+			}
+			continue
+		}
+		if p.schema == nil {
+			continue
+		}
+		if err := p.schema.Validate(p.value(values)); err != nil {
+			fields = append(fields, schemaFieldErrors(p.name, err)...)
+		}
+	}
+
+	if len(op.body) > 0 && r.Body != nil {
+		mediaType := "application/json"
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			mediaType, _, _ = mime.ParseMediaType(ct)
+		}
+		if schema := op.body[mediaType]; schema != nil {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				return badRequestBody(err)
+			}
+			r.Body = io.NopCloser(bytes.NewReader(b))
+			if v, err := jsonschema.UnmarshalJSON(bytes.NewReader(b)); err == nil {
+				if err := schema.Validate(v); err != nil {
+					fields = append(fields, schemaFieldErrors("", err)...)
+				}
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		return domain.NewValidationError(fields...)
+	}
+	return nil
+}
+
+// value reads the string values of a parameter as the type of its schema.
+// Values that do not parse are passed on as strings for the schema to
+// reject.
+func (p parameter) value(values []string) any {
+	scalar := func(s string) any {
+		switch p.typ {
+		case "integer":
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return json.Number(strconv.FormatInt(n, 10))
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(s); err == nil {
+				return b
+			}
+		}
+		return s
+	}
+	if p.typ == "array" {
+		items := make([]any, len(values))
+		for i, v := range values {
+			items[i] = v
+		}
+		return items
+	}
+	return scalar(values[0])
+}
+
+var schemaPrinter = message.NewPrinter(language.English)
+
+// schemaFieldErrors flattens a schema validation error into field errors
+// named like the rest of the API: "device.labels", "[2].op".
+func schemaFieldErrors(prefix string, err error) []domain.FieldError {
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return []domain.FieldError{{Field: prefix, Message: err.Error()}}
+	}
+	var fields []domain.FieldError
+	var walk func(e *jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) > 0 {
+			for _, c := range e.Causes {
+				walk(c)
+			}
+			return
+		}
+		at := fieldName(prefix, e.InstanceLocation)
+		switch k := e.ErrorKind.(type) {
+		case *kind.Required:
+			for _, name := range k.Missing {
+				fields = append(fields, domain.FieldError{Field: fieldName(at, []string{name}), Message: "is required"})
+			}
+		case *kind.AdditionalProperties:
+			for _, name := range k.Properties {
+				fields = append(fields, domain.FieldError{Field: fieldName(at, []string{name}), Message: "is not allowed"})
+			}
+		default:
+			if at == "" {
+				at = "body"
+			}
+			fields = append(fields, domain.FieldError{Field: at, Message: e.ErrorKind.LocalizedString(schemaPrinter)})
+		}
+	}
+	walk(verr)
+	return fields
+}
+
+func fieldName(prefix string, location []string) string {
+	name := prefix
+	for _, t := range location {
+		if _, err := strconv.Atoi(t); err == nil {
+			name += "[" + t + "]"
+			continue
+		}
+		if name != "" {
+			name += "."
+		}
+		name += t
+	}
+	return name
+}
+
+// validateResponse checks that the status is documented for the
+// operation, that the body is in one of its media types, and that a JSON
+// body matches the schema. aliases gives the other names of a media type.
+func (op *operation) validateResponse(status int, header http.Header, body []byte, aliases func(string) []string) error {
+	resp, ok := op.responses[strconv.Itoa(status)]
+	if !ok {
+		resp, ok = op.responses[strconv.Itoa(status/100)+"XX"]
+	}
+	if !ok {
+		resp, ok = op.responses["default"]
+	}
+	if !ok {
+		return fmt.Errorf("status %d is not documented", status)
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("status %d: bad Content-Type: %w", status, err)
+	}
+	schema, ok := resp.content[mediaType]
+	for _, alias := range aliases(mediaType) {
+		if ok {
+			break
+		}
+		schema, ok = resp.content[alias]
+	}
+	if !ok {
+		documented := make([]string, 0, len(resp.content))
+		for t := range resp.content {
+			documented = append(documented, t)
+		}
+		sort.Strings(documented)
+		return fmt.Errorf("status %d: Content-Type %s is not documented, want one of %v", status, mediaType, documented)
+	}
+	if schema == nil {
+		return nil
+	}
+	v, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("status %d: body is not JSON: %w", status, err)
+	}
+	if err := schema.Validate(v); err != nil {
+		return fmt.Errorf("status %d: %w", status, err)
+	}
+	return nil
+}
+
+// validateOpenAPI rejects requests that do not match the document with a
+// 400 problem. When response validation is on, responses are buffered and
+// one that drifted from the document is reported before it is sent. Routes
+// the document does not describe pass through; TestOpenAPICoversRoutes keeps
+// them in sync.
+func (h *Handler) validateOpenAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, _ := mux.CurrentRoute(r).GetPathTemplate()
+		op := apiSpec.operation(r.Method, path)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := op.validateRequest(r); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if h.reportDrift == nil || op.streaming {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buf := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+		next.ServeHTTP(buf, r)
+		if err := op.validateResponse(buf.status, buf.header, buf.body.Bytes(), h.mediaTypeAliases); err != nil {
+			h.reportDrift(fmt.Errorf("openapi: %s %s: response does not match the document: %w", r.Method, path, err))
+		}
+		w.WriteHeader(buf.status)
+		_, _ = w.Write(buf.body.Bytes())
+	})
+}
+
+// mediaTypeAliases returns the other media types of the codec answering to
+// mediaType.
+func (h *Handler) mediaTypeAliases(mediaType string) []string {
+	for _, c := range h.registry().codecs {
+		for _, t := range c.MediaTypes() {
+			if t == mediaType {
+				return c.MediaTypes()
+			}
+		}
+	}
+	return nil
+}
+
+// bufferedResponse holds a response until it has been validated. Headers go
+// straight to the real writer since nothing is sent before the body.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wroteHeader {
+		b.status = status
+		b.wroteHeader = true
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
+
+// OpenAPI serves the document the API is validated against.
+func (h *Handler) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(apiSpec.json)
+}
+
+// swaggerInitializer replaces the one of swagger-ui-dist, which points at
+// the petstore example.
+const swaggerInitializer = `window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: "` + openAPIPath + `",
+    dom_id: "#swagger-ui",
+    deepLinking: true,
+    presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+    layout: "StandaloneLayout"
+  });
+};
+`
+
+// docs serves Swagger UI for the document from files embedded in the
+// binary.
+func docs() http.Handler {
+	files := http.StripPrefix(docsPath, http.FileServer(http.FS(swaggerFiles.FS)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == docsPath+"swagger-initializer.js" {
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			_, _ = io.WriteString(w, swaggerInitializer)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,96 @@
+package pb
+
+import (
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"homework/internal/domain"
+	"time"
+)
+
+// FromDevice converts a device to its message; nil stays nil.
+func FromDevice(d *domain.Device) *Device {
+	if d == nil {
+		return nil
+	}
+	m := &Device{
+		SerialNum:       d.SerialNum,
+		Model:           d.Model,
+		Ip:              d.IP,
+		FirmwareVersion: d.FirmwareVersion,
+		Mac:             d.MAC,
+		Hostname:        d.Hostname,
+		Site:            d.Site,
+		Location:        d.Location,
+		Labels:          d.Labels,
+		Status:          string(d.Status),
+		Revision:        d.Revision,
+		CreatedAt:       fromTime(d.CreatedAt),
+		UpdatedAt:       fromTime(d.UpdatedAt),
+	}
+	if d.DeletedAt != nil {
+		m.DeletedAt = timestamppb.New(*d.DeletedAt)
+	}
+	for _, t := range d.Transitions {
+		m.Transitions = append(m.Transitions, &Transition{
+			From:   string(t.From),
+			To:     string(t.To),
+			Actor:  t.Actor,
+			Reason: t.Reason,
+			At:     fromTime(t.At),
+		})
+	}
+	return m
+}
+
+// ToDevice reads a device sent by a client. Of the server-managed fields
+// only the revision is kept; the repository sets the others.
+func ToDevice(m *Device) domain.Device {
+	d := domain.Device{
+		SerialNum:       m.GetSerialNum(),
+		Model:           m.GetModel(),
+		IP:              m.GetIp(),
+		FirmwareVersion: m.GetFirmwareVersion(),
+		MAC:             m.GetMac(),
+		Hostname:        m.GetHostname(),
+		Site:            m.GetSite(),
+		Location:        m.GetLocation(),
+		Labels:          m.GetLabels(),
+		Status:          domain.Status(m.GetStatus()),
+		Revision:        m.GetRevision(),
+	}
+	if len(d.Labels) == 0 {
+		d.Labels = nil
+	}
+	return d
+}
+
+// FromDevicePage converts a page of ListDevices.
+func FromDevicePage(p domain.DevicePage) *DevicePage {
+	m := &DevicePage{NextCursor: p.NextCursor, ResourceVersion: p.ResourceVersion}
+	for i := range p.Devices {
+		m.Devices = append(m.Devices, FromDevice(&p.Devices[i]))
+	}
+	return m
+}
+
+// FromHistoryEntry converts a change, as returned by GetDeviceHistory and
+// WatchDevices.
+func FromHistoryEntry(e domain.HistoryEntry) *HistoryEntry {
+	return &HistoryEntry{
+		ResourceVersion: e.ResourceVersion,
+		SerialNum:       e.SerialNum,
+		Op:              string(e.Op),
+		Revision:        e.Revision,
+		Actor:           e.Actor,
+		At:              fromTime(e.At),
+		Before:          FromDevice(e.Before),
+		After:           FromDevice(e.After),
+	}
+}
+
+// fromTime leaves zero times unset rather than encoding year 1.
+func fromTime(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
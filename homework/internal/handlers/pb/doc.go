@@ -0,0 +1,7 @@
+// Package pb holds the Protobuf messages and the gRPC service of the device
+// API, generated from device.proto and device_service.proto, and their
+// conversions from and to the domain types.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative device.proto
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative device_service.proto
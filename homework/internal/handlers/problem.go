@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type     string         `json:"type"`
+	Title    string         `json:"title"`
+	Status   int            `json:"status"`
+	Detail   string         `json:"detail,omitempty"`
+	Instance string         `json:"instance,omitempty"`
+	Errors   []ProblemField `json:"errors,omitempty"`
+	// Permission is the permission a 403 was answered for.
+	Permission string `json:"permission,omitempty"`
+}
+
+// ProblemField explains why a single request field was rejected.
+type ProblemField struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// problemTypes gives every status we emit a stable type URI that clients
+// can switch on instead of parsing titles or details.
+var problemTypes = map[int]string{
+	http.StatusBadRequest:            "/problems/validation-error",
+	http.StatusUnauthorized:          "/problems/unauthenticated",
+	http.StatusForbidden:             "/problems/forbidden",
+	http.StatusNotFound:              "/problems/not-found",
+	http.StatusMethodNotAllowed:      "/problems/method-not-allowed",
+	http.StatusNotAcceptable:         "/problems/not-acceptable",
+	http.StatusConflict:              "/problems/conflict",
+	http.StatusGone:                  "/problems/gone",
+	http.StatusPreconditionFailed:    "/problems/precondition-failed",
+	http.StatusPreconditionRequired:  "/problems/precondition-required",
+	http.StatusFailedDependency:      "/problems/aborted",
+	http.StatusRequestEntityTooLarge: "/problems/too-large",
+	http.StatusUnsupportedMediaType:  "/problems/unsupported-media-type",
+	http.StatusServiceUnavailable:    "/problems/unavailable",
+	http.StatusInternalServerError:   "/problems/internal-error",
+}
+
+// quotaExceededType tells a 403 for a tenant out of devices from one for a
+// missing permission.
+const quotaExceededType = "/problems/quota-exceeded"
+
+func newProblem(r *http.Request, status int, detail string) Problem {
+	typ, ok := problemTypes[status]
+	if !ok {
+		typ = "about:blank"
+	}
+	return Problem{
+		Type:     typ,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+}
+
+func writeProblem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, newProblem(r, http.StatusNotFound, "no route for "+r.URL.Path))
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, newProblem(r, http.StatusMethodNotAllowed, r.Method+" is not supported for "+r.URL.Path))
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"homework/internal/domain"
+	"homework/internal/handlers/pb"
+	"io"
+)
+
+// protobufCodec speaks the messages of pb/device.proto, which cover devices,
+// device pages and history.
+type protobufCodec struct{}
+
+func (protobufCodec) MediaTypes() []string {
+	return []string{"application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf"}
+}
+
+func (protobufCodec) CanEncode(v any) bool {
+	switch v.(type) {
+	case domain.Device, domain.DevicePage, []domain.HistoryEntry:
+		return true
+	}
+	return false
+}
+
+func (protobufCodec) CanDecode(v any) bool {
+	_, ok := v.(*domain.Device)
+	return ok
+}
+
+func (protobufCodec) Encode(w io.Writer, v any) error {
+	var m proto.Message
+	switch v := v.(type) {
+	case domain.Device:
+		m = pb.FromDevice(&v)
+	case domain.DevicePage:
+		m = pb.FromDevicePage(v)
+	case []domain.HistoryEntry:
+		history := &pb.History{}
+		for _, e := range v {
+			history.Entries = append(history.Entries, pb.FromHistoryEntry(e))
+		}
+		m = history
+	default:
+		return fmt.Errorf("protobuf: cannot encode %T", v)
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (protobufCodec) Decode(r io.Reader, v any) error {
+	d, ok := v.(*domain.Device)
+	if !ok {
+		return fmt.Errorf("protobuf: cannot decode %T", v)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var m pb.Device
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*d = pb.ToDevice(&m)
+	return nil
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"homework/internal/auth"
+	"homework/internal/domain"
+	"net/http"
+)
+
+// tenantPrefix is where the device routes of a named tenant live; the same
+// routes under /api/v1 use the tenant of the principal.
+const tenantPrefix = "/api/v1/tenants/{tenant}"
+
+// withTenant sets the tenant the request works on: the one in the path, or
+// else the tenant of the principal. An authenticated principal may only
+// name its own tenant; without authentication any tenant can be named and
+// requests that name none use domain.DefaultTenant.
+func withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, named := mux.Vars(r)["tenant"]
+		if named && !domain.ValidTenant(tenant) {
+			writeError(w, r, domain.NewValidationError(domain.FieldError{Field: "tenant", Message: fmt.Sprintf("invalid tenant %q", tenant)}))
+			return
+		}
+		if p, ok := auth.PrincipalFrom(r.Context()); ok {
+			if named && tenant != p.Tenant {
+				writeError(w, r, fmt.Errorf("%w: %s may not access tenant %s", domain.ErrForbidden, p.Subject, tenant))
+				return
+			}
+			tenant = p.Tenant
+		}
+		if tenant != "" {
+			r = r.WithContext(domain.WithTenant(r.Context(), tenant))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,168 @@
+// Package health answers the liveness and readiness probes of the service
+// from checks that its dependencies register.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds a check registered without a timeout of its own.
+const DefaultTimeout = 2 * time.Second
+
+const (
+	StatusPass = "pass"
+	StatusFail = "fail"
+)
+
+// Func reports whether a dependency works; nil means it does. It should
+// give up when ctx is done.
+type Func func(ctx context.Context) error
+
+type check struct {
+	name    string
+	timeout time.Duration
+	fn      Func
+}
+
+// Registry holds the checks behind the probes. Liveness and readiness
+// checks are separate, so an instance can stop taking traffic without
+// being restarted.
+type Registry struct {
+	mu        sync.RWMutex
+	liveness  []check
+	readiness []check
+}
+
+func New() *Registry {
+	return &Registry{}
+}
+
+// Live registers a liveness check. Failing it gets the process restarted,
+// so only check what a restart fixes.
+func (r *Registry) Live(name string, timeout time.Duration, fn Func) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.liveness = append(r.liveness, newCheck(name, timeout, fn))
+}
+
+// Ready registers a readiness check. Failing it takes the instance out of
+// load balancing until it passes again.
+func (r *Registry) Ready(name string, timeout time.Duration, fn Func) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readiness = append(r.readiness, newCheck(name, timeout, fn))
+}
+
+func newCheck(name string, timeout time.Duration, fn Func) check {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return check{name: name, timeout: timeout, fn: fn}
+}
+
+// Report is the outcome of a probe: it passes when every check does.
+type Report struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// CheckResult is the outcome of a single check, in registration order.
+type CheckResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Liveness runs the liveness checks.
+func (r *Registry) Liveness(ctx context.Context) Report {
+	r.mu.RLock()
+	checks := r.liveness
+	r.mu.RUnlock()
+	return run(ctx, checks)
+}
+
+// Readiness runs the readiness checks.
+func (r *Registry) Readiness(ctx context.Context) Report {
+	r.mu.RLock()
+	checks := r.readiness
+	r.mu.RUnlock()
+	return run(ctx, checks)
+}
+
+// LivenessHandler answers liveness probes: 200 when Liveness passes, 503
+// otherwise, with the Report as the body.
+func (r *Registry) LivenessHandler() http.Handler {
+	return reportHandler(r.Liveness)
+}
+
+// ReadinessHandler answers readiness probes like LivenessHandler.
+func (r *Registry) ReadinessHandler() http.Handler {
+	return reportHandler(r.Readiness)
+}
+
+func reportHandler(probe func(context.Context) Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := probe(r.Context())
+		code := http.StatusOK
+		if report.Status != StatusPass {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
+
+// run runs checks at once, each under its own timeout.
+func run(ctx context.Context, checks []check) Report {
+	report := Report{Status: StatusPass, Checks: make([]CheckResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			report.Checks[i] = c.run(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, res := range report.Checks {
+		if res.Status != StatusPass {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func (c check) run(ctx context.Context) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	// A check that ignores ctx is left behind rather than waited for.
+	done := make(chan error, 1)
+	go func() { done <- c.fn(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", c.timeout)
+	}
+	res := CheckResult{
+		Name:      c.name,
+		Status:    StatusPass,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status, res.Error = StatusFail, err.Error()
+	}
+	return res
+}
@@ -0,0 +1,115 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"homework/internal/health"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func pass(context.Context) error { return nil }
+
+func TestRegistry_Readiness(t *testing.T) {
+	testTable := []struct {
+		name       string
+		register   func(r *health.Registry)
+		wantStatus string
+		wantChecks []health.CheckResult
+	}{
+		{
+			name:       "no checks",
+			register:   func(*health.Registry) {},
+			wantStatus: health.StatusPass,
+			wantChecks: []health.CheckResult{},
+		},
+		{
+			name: "all pass",
+			register: func(r *health.Registry) {
+				r.Ready("repository", 0, pass)
+				r.Ready("broker", time.Second, pass)
+			},
+			wantStatus: health.StatusPass,
+			wantChecks: []health.CheckResult{
+				{Name: "repository", Status: health.StatusPass},
+				{Name: "broker", Status: health.StatusPass},
+			},
+		},
+		{
+			name: "one fails",
+			register: func(r *health.Registry) {
+				r.Ready("repository", 0, func(context.Context) error { return errors.New("repository is closed") })
+				r.Ready("broker", 0, pass)
+			},
+			wantStatus: health.StatusFail,
+			wantChecks: []health.CheckResult{
+				{Name: "repository", Status: health.StatusFail, Error: "repository is closed"},
+				{Name: "broker", Status: health.StatusPass},
+			},
+		},
+		{
+			name: "times out",
+			register: func(r *health.Registry) {
+				r.Ready("hung", 10*time.Millisecond, func(context.Context) error { select {} })
+				r.Ready("slow", 10*time.Millisecond, func(ctx context.Context) error {
+					<-ctx.Done()
+					return ctx.Err()
+				})
+			},
+			wantStatus: health.StatusFail,
+			wantChecks: []health.CheckResult{
+				{Name: "hung", Status: health.StatusFail, Error: "timed out after 10ms"},
+				{Name: "slow", Status: health.StatusFail, Error: "timed out after 10ms"},
+			},
+		},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			r := health.New()
+			tc.register(r)
+			report := r.Readiness(context.Background())
+			assert.Equal(t, tc.wantStatus, report.Status)
+			for i := range report.Checks {
+				assert.GreaterOrEqual(t, report.Checks[i].LatencyMS, 0.0)
+				report.Checks[i].LatencyMS = 0
+			}
+			assert.Equal(t, tc.wantChecks, report.Checks)
+		})
+	}
+}
+
+func TestRegistry_Handlers(t *testing.T) {
+	r := health.New()
+	r.Live("goroutines", 0, pass)
+	ready := errors.New("shutting down")
+	r.Ready("lifecycle", 0, func(context.Context) error { return ready })
+
+	probe := func(h http.Handler) (int, health.Report) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var report health.Report
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+		return rec.Code, report
+	}
+
+	// Readiness fails on its own; liveness stays healthy.
+	code, report := probe(r.ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, health.StatusFail, report.Status)
+	assert.Equal(t, "shutting down", report.Checks[0].Error)
+	code, report = probe(r.LivenessHandler())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusPass, report.Status)
+	assert.Equal(t, "goroutines", report.Checks[0].Name)
+
+	ready = nil
+	code, _ = probe(r.ReadinessHandler())
+	assert.Equal(t, http.StatusOK, code)
+}
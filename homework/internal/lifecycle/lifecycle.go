@@ -0,0 +1,183 @@
+// Package lifecycle runs the servers and background workers of the service
+// and shuts them down in order when it is told to stop, typically by
+// SIGTERM during a rolling deploy.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lifecycle stops what it runs in this order:
+//
+//  1. readiness fails, so load balancers stop sending new requests;
+//  2. after the drain delay, servers stop accepting connections and finish
+//     the requests in flight, and Stopping is closed to end streams;
+//  3. background workers are cancelled and waited for;
+//  4. shutdown hooks run, the last registered first, so the repository
+//     registered before everything that uses it is flushed last.
+//
+// Steps 2 to 4 share the shutdown timeout.
+type Lifecycle struct {
+	drainDelay time.Duration
+	timeout    time.Duration
+
+	servers []server
+	workers []worker
+	hooks   []hook
+
+	ready    atomic.Bool
+	stopping chan struct{}
+}
+
+type server struct {
+	name     string
+	serve    func() error
+	shutdown func(context.Context) error
+}
+
+type worker struct {
+	name string
+	run  func(context.Context)
+}
+
+type hook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// New returns a Lifecycle that fails readiness for drainDelay before it
+// stops anything and gives up on a clean shutdown after timeout.
+func New(drainDelay, timeout time.Duration) *Lifecycle {
+	return &Lifecycle{
+		drainDelay: drainDelay,
+		timeout:    timeout,
+		stopping:   make(chan struct{}),
+	}
+}
+
+// Serve runs serve until shutdown is called to stop it. serve returning
+// http.ErrServerClosed counts as a clean stop; returning anything else
+// shuts everything down.
+func (l *Lifecycle) Serve(name string, serve func() error, shutdown func(context.Context) error) {
+	l.servers = append(l.servers, server{name: name, serve: serve, shutdown: shutdown})
+}
+
+// Go runs a background worker until its context is cancelled, after the
+// servers have stopped.
+func (l *Lifecycle) Go(name string, run func(ctx context.Context)) {
+	l.workers = append(l.workers, worker{name: name, run: run})
+}
+
+// OnShutdown registers fn to run once servers and workers have stopped,
+// to flush and release what they used.
+func (l *Lifecycle) OnShutdown(name string, fn func(ctx context.Context) error) {
+	l.hooks = append(l.hooks, hook{name: name, fn: fn})
+}
+
+// Stopping is closed when the servers start shutting down.
+func (l *Lifecycle) Stopping() <-chan struct{} {
+	return l.stopping
+}
+
+// Ready reports whether Run is serving and not shutting down.
+func (l *Lifecycle) Ready() bool {
+	return l.ready.Load()
+}
+
+// CheckReady is a readiness check that fails once shutdown begins.
+func (l *Lifecycle) CheckReady(context.Context) error {
+	if !l.Ready() {
+		return errors.New("not serving")
+	}
+	return nil
+}
+
+// Run starts everything registered and blocks until ctx is done or a
+// server fails, then shuts down. It returns the failure, if any, joined
+// with whatever went wrong while shutting down.
+func (l *Lifecycle) Run(ctx context.Context) error {
+	failed := make(chan error, len(l.servers))
+	for _, s := range l.servers {
+		go func(s server) {
+			if err := s.serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("%s: %w", s.name, err)
+			}
+		}(s)
+	}
+	workerCtx, cancelWorkers := context.WithCancel(context.Background())
+	defer cancelWorkers()
+	var workers sync.WaitGroup
+	for _, w := range l.workers {
+		workers.Add(1)
+		go func(w worker) {
+			defer workers.Done()
+			w.run(workerCtx)
+		}(w)
+	}
+	l.ready.Store(true)
+
+	var cause error
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down", "cause", context.Cause(ctx))
+		l.ready.Store(false)
+		time.Sleep(l.drainDelay)
+	case cause = <-failed:
+		slog.Error("shutting down", "cause", cause)
+		l.ready.Store(false)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	errs := []error{cause}
+	errs = append(errs, l.stopServers(shutdownCtx)...)
+	cancelWorkers()
+	if err := wait(shutdownCtx, &workers); err != nil {
+		errs = append(errs, fmt.Errorf("workers: %w", err))
+	}
+	for i := len(l.hooks) - 1; i >= 0; i-- {
+		if err := l.hooks[i].fn(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.hooks[i].name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stopServers shuts every server down at once and waits for all of them.
+func (l *Lifecycle) stopServers(ctx context.Context) []error {
+	close(l.stopping)
+	errs := make([]error, len(l.servers))
+	var wg sync.WaitGroup
+	for i, s := range l.servers {
+		wg.Add(1)
+		go func(i int, s server) {
+			defer wg.Done()
+			if err := s.shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", s.name, err)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	return errs
+}
+
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,125 @@
+package lifecycle_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"homework/internal/lifecycle"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects the steps of a shutdown in the order they happen.
+type recorder struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (r *recorder) add(step string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, step)
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.steps...)
+}
+
+func TestLifecycle_Run(t *testing.T) {
+	rec := &recorder{}
+	life := lifecycle.New(10*time.Millisecond, time.Second)
+	stopped := make(chan struct{})
+	life.Serve("http", func() error {
+		<-stopped
+		return http.ErrServerClosed
+	}, func(context.Context) error {
+		if life.Ready() {
+			rec.add("still ready")
+		}
+		select {
+		case <-life.Stopping():
+		default:
+			rec.add("not stopping")
+		}
+		rec.add("http")
+		close(stopped)
+		return nil
+	})
+	life.Go("purge", func(ctx context.Context) {
+		<-ctx.Done()
+		rec.add("purge")
+	})
+	life.OnShutdown("repository", func(context.Context) error {
+		rec.add("repository")
+		return nil
+	})
+	life.OnShutdown("cache", func(context.Context) error {
+		rec.add("cache")
+		return errors.New("disk full")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- life.Run(ctx) }()
+	require.Eventually(t, life.Ready, time.Second, time.Millisecond)
+	cancel()
+
+	err := <-done
+	assert.EqualError(t, err, "cache: disk full")
+	assert.Equal(t, []string{"http", "purge", "cache", "repository"}, rec.get())
+	assert.False(t, life.Ready())
+}
+
+func TestLifecycle_ServerFails(t *testing.T) {
+	life := lifecycle.New(time.Hour, time.Second)
+	life.Serve("grpc", func() error {
+		return errors.New("address already in use")
+	}, func(context.Context) error { return nil })
+	flushed := false
+	life.OnShutdown("repository", func(context.Context) error {
+		flushed = true
+		return nil
+	})
+
+	// A failed server does not wait out the drain delay.
+	err := life.Run(context.Background())
+	assert.EqualError(t, err, "grpc: address already in use")
+	assert.True(t, flushed)
+}
+
+func TestLifecycle_ShutdownTimeout(t *testing.T) {
+	life := lifecycle.New(0, 10*time.Millisecond)
+	life.Go("stuck", func(context.Context) { select {} })
+	var deadline bool
+	life.OnShutdown("repository", func(ctx context.Context) error {
+		_, deadline = ctx.Deadline()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := life.Run(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.EqualError(t, err, "workers: context deadline exceeded\nrepository: context deadline exceeded")
+	assert.True(t, deadline)
+}
+
+func TestLifecycle_CheckReady(t *testing.T) {
+	life := lifecycle.New(0, time.Second)
+	ctx := context.Background()
+	assert.EqualError(t, life.CheckReady(ctx), "not serving")
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- life.Run(runCtx) }()
+	require.Eventually(t, life.Ready, time.Second, time.Millisecond)
+	assert.NoError(t, life.CheckReady(ctx))
+	cancel()
+	assert.NoError(t, <-done)
+	assert.EqualError(t, life.CheckReady(ctx), "not serving")
+}
@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"homework/internal/statuswriter"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader correlates a request with the log lines it caused. A
+// valid one sent by the client is kept; it is always echoed back.
+const RequestIDHeader = "X-Request-ID"
+
+// Middleware gives every request an ID and a logger tagged with it, and
+// writes an access log line once the response is done.
+func Middleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := RequestID(r.Header.Get(RequestIDHeader))
+			w.Header().Set(RequestIDHeader, id)
+			l := logger.With(RequestIDKey, id)
+			rec := statuswriter.Wrap(w)
+			start := time.Now()
+			next.ServeHTTP(rec, r.WithContext(WithLogger(r.Context(), l)))
+			l.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.Status()),
+				slog.Int64("bytes", rec.Bytes()),
+				slog.Duration("duration", time.Since(start)),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("user_agent", r.UserAgent()),
+			)
+		})
+	}
+}
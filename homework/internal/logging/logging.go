@@ -0,0 +1,66 @@
+// Package logging sets up the structured logger of the service and carries
+// a request-scoped logger, tagged with the request ID, in the context.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// RequestIDKey is the attribute every request-scoped log line carries.
+const RequestIDKey = "request_id"
+
+// New returns a logger writing to w in format, dropping records below
+// level.
+func New(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx that carries l.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the logger of ctx, or the default one outside a
+// request.
+func LoggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// requestIDPattern keeps IDs chosen by clients short and free of anything
+// that could garble a log line.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID returns id when a client may pick it, or else a new random
+// one.
+func RequestID(id string) string {
+	if requestIDPattern.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
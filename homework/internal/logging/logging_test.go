@@ -0,0 +1,120 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"homework/internal/logging"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	testTable := []struct {
+		format  string
+		want    string
+		wantErr string
+	}{
+		{format: logging.FormatJSON, want: `{"level":"WARN","msg":"disk almost full","free":3}`},
+		{format: logging.FormatText, want: `level=WARN msg="disk almost full" free=3`},
+		{format: "xml", wantErr: `unknown log format "xml"`},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := logging.New(&buf, tc.format, slog.LevelWarn)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			logger = slog.New(withoutTime{logger.Handler()})
+			logger.Info("purged trash", "devices", 2)
+			logger.Warn("disk almost full", "free", 3)
+			assert.Equal(t, tc.want+"\n", buf.String())
+		})
+	}
+}
+
+// withoutTime drops the time of records so the output can be compared.
+type withoutTime struct{ slog.Handler }
+
+func (h withoutTime) Handle(ctx context.Context, r slog.Record) error {
+	r.Time = time.Time{}
+	return h.Handler.Handle(ctx, r)
+}
+
+func TestRequestID(t *testing.T) {
+	assert.Equal(t, "3f2a-b7.c:1_x", logging.RequestID("3f2a-b7.c:1_x"))
+	for _, id := range []string{"", "has space", "line\nbreak", strings.Repeat("a", 129)} {
+		generated := logging.RequestID(id)
+		assert.Regexp(t, "^[0-9a-f]{32}$", generated, id)
+	}
+	assert.NotEqual(t, logging.RequestID(""), logging.RequestID(""))
+}
+
+func TestMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	handler := logging.Middleware(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.LoggerFrom(r.Context()).Info("handling")
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("short and stout"))
+	}))
+	entries := func() []map[string]any {
+		var out []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var entry map[string]any
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			out = append(out, entry)
+		}
+		logs.Reset()
+		return out
+	}
+
+	t.Run("propagates", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/devices/1", nil)
+		req.Header.Set("X-Request-ID", "req-1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, "req-1", rec.Header().Get("X-Request-ID"))
+
+		logged := entries()
+		require.Len(t, logged, 2)
+		assert.Equal(t, "handling", logged[0]["msg"])
+		assert.Equal(t, "req-1", logged[0]["request_id"])
+		access := logged[1]
+		assert.Equal(t, "request", access["msg"])
+		assert.Equal(t, "req-1", access["request_id"])
+		assert.Equal(t, http.MethodPut, access["method"])
+		assert.Equal(t, "/api/v1/devices/1", access["path"])
+		assert.Equal(t, float64(http.StatusTeapot), access["status"])
+		assert.Equal(t, float64(len("short and stout")), access["bytes"])
+		assert.Contains(t, access, "duration")
+	})
+
+	t.Run("generates", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Request-ID", "not a valid id")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		id := rec.Header().Get("X-Request-ID")
+		assert.Len(t, id, 32)
+		for _, entry := range entries() {
+			assert.Equal(t, id, entry["request_id"])
+		}
+	})
+}
+
+func TestLoggerFrom(t *testing.T) {
+	assert.Same(t, slog.Default(), logging.LoggerFrom(context.Background()))
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	assert.Same(t, logger, logging.LoggerFrom(logging.WithLogger(context.Background(), logger)))
+}
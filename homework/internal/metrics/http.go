@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"homework/internal/statuswriter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// unmatchedRoute labels requests no route answers, so that scans of random
+// paths do not add series.
+const unmatchedRoute = "unmatched"
+
+// methods are the request methods kept as labels; any other is "other".
+var methods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// HTTP records the requests of a router by route template, method and
+// status.
+type HTTP struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+}
+
+func NewHTTP(reg prometheus.Registerer) *HTTP {
+	labels := []string{"route", "method", "status"}
+	m := &HTTP{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests answered.",
+		}, labels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time to answer HTTP requests; event streams count until they end.",
+			Buckets: prometheus.DefBuckets,
+		}, labels),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests being answered, event streams included.",
+		}),
+	}
+	reg.MustRegister(m.requests, m.duration, m.inFlight)
+	return m
+}
+
+// Instrument wraps router. It sits outside the router rather than in its
+// middleware so that requests no route matches are counted too.
+func (m *HTTP) Instrument(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := unmatchedRoute
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.MatchErr == nil && match.Route != nil {
+			if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		method := r.Method
+		if !methods[method] {
+			method = "other"
+		}
+
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+		rec := statuswriter.Wrap(w)
+		start := time.Now()
+		defer func() {
+			status := strconv.Itoa(rec.Status())
+			m.requests.WithLabelValues(route, method, status).Inc()
+			m.duration.WithLabelValues(route, method, status).Observe(time.Since(start).Seconds())
+		}()
+		router.ServeHTTP(rec, r)
+	})
+}
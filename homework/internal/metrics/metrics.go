@@ -0,0 +1,82 @@
+// Package metrics exports Prometheus metrics of the HTTP API, the device use
+// cases and the repository. Labels only ever hold route templates, methods,
+// statuses, operation names, error kinds and models, never serial numbers
+// or other per-device values.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"homework/internal/domain"
+	"time"
+)
+
+// operations records the calls of one layer: how many there were and how
+// long they took in the histogram, how many failed by kind in the counter.
+type operations struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+func newOperations(reg prometheus.Registerer, subsystem string) *operations {
+	o := &operations{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Subsystem: subsystem,
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of " + subsystem + " operations; its count is the number of calls.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      "operation_errors_total",
+			Help:      "Failed " + subsystem + " operations by kind of error.",
+		}, []string{"operation", "kind"}),
+	}
+	reg.MustRegister(o.duration, o.errors)
+	return o
+}
+
+// start times a call of op. The returned func records its outcome and
+// passes err through.
+func (o *operations) start(op string) func(err error) error {
+	begin := time.Now()
+	return func(err error) error {
+		o.duration.WithLabelValues(op).Observe(time.Since(begin).Seconds())
+		if err != nil {
+			o.errors.WithLabelValues(op, errorKind(err)).Inc()
+		}
+		return err
+	}
+}
+
+// errorKinds are checked in order; the first match names the kind.
+var errorKinds = []struct {
+	err  error
+	kind string
+}{
+	{domain.ErrValidation, "validation"},
+	{domain.ErrNotFound, "not_found"},
+	{domain.ErrAlreadyExists, "already_exists"},
+	{domain.ErrConflict, "conflict"},
+	{domain.ErrPreconditionFailed, "precondition_failed"},
+	{domain.ErrAborted, "aborted"},
+	{domain.ErrGone, "gone"},
+	{domain.ErrUnauthenticated, "unauthenticated"},
+	{domain.ErrForbidden, "forbidden"},
+	{domain.ErrQuotaExceeded, "quota_exceeded"},
+	{domain.ErrTooLarge, "too_large"},
+	{domain.ErrUnavailable, "unavailable"},
+	{context.Canceled, "canceled"},
+	{context.DeadlineExceeded, "deadline_exceeded"},
+}
+
+// errorKind names the domain error err wraps, or "internal".
+func errorKind(err error) string {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k.kind
+		}
+	}
+	return "internal"
+}
@@ -0,0 +1,177 @@
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"homework/internal/domain"
+	"homework/internal/handlers/mocks"
+	"homework/internal/metrics"
+	"homework/internal/repository"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sampleCount returns how many observations the histogram name has with
+// the given label values.
+func sampleCount(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) uint64 {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	next:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue next
+				}
+			}
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+// errOf drops the device a write returns, so that its error can be checked
+// in place.
+func errOf(_ domain.Device, err error) error {
+	return err
+}
+
+func TestHTTP_Instrument(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/devices/events", func(w http.ResponseWriter, r *http.Request) {
+		_, ok := w.(http.Flusher)
+		assert.True(t, ok, "event streams need to flush")
+	})
+	router.HandleFunc("/api/v1/devices/{serial}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}).Methods(http.MethodGet, "BREW")
+	handler := metrics.NewHTTP(reg).Instrument(router)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/v1/devices/1", nil),
+		httptest.NewRequest(http.MethodGet, "/api/v1/devices/2", nil),
+		httptest.NewRequest("BREW", "/api/v1/devices/3", nil),
+		httptest.NewRequest(http.MethodGet, "/api/v1/devices/events", nil),
+		httptest.NewRequest(http.MethodGet, "/wp-admin/1", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	expected := `
+# HELP http_requests_total HTTP requests answered.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",route="/api/v1/devices/events",status="200"} 1
+http_requests_total{method="GET",route="/api/v1/devices/{serial}",status="404"} 2
+http_requests_total{method="GET",route="unmatched",status="404"} 1
+http_requests_total{method="other",route="/api/v1/devices/{serial}",status="404"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "http_requests_total"))
+	assert.Equal(t, uint64(2), sampleCount(t, reg, "http_request_duration_seconds",
+		map[string]string{"route": "/api/v1/devices/{serial}", "method": "GET", "status": "404"}))
+}
+
+func TestNewDeviceUseCase(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	next := new(mocks.DeviceUseCase)
+	next.On("GetDevice", mock.Anything, "1").Return(domain.Device{SerialNum: "1"}, nil)
+	next.On("GetDevice", mock.Anything, "2").Return(domain.Device{}, fmt.Errorf("%w: device 2", domain.ErrNotFound))
+	next.On("CreateDevice", mock.Anything, mock.Anything).Return(domain.Device{}, fmt.Errorf("disk on fire"))
+	next.On("BatchDevices", mock.Anything, mock.Anything, true).Return(nil, fmt.Errorf("%w: operation 0 failed", domain.ErrAborted))
+	uc := metrics.NewDeviceUseCase(next, reg)
+
+	d, err := uc.GetDevice(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", d.SerialNum)
+	_, err = uc.GetDevice(context.Background(), "2")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+	_, err = uc.CreateDevice(context.Background(), domain.Device{SerialNum: "3"})
+	assert.EqualError(t, err, "disk on fire")
+	_, err = uc.BatchDevices(context.Background(), []domain.BatchOperation{{Op: domain.OpDelete, SerialNum: "1"}}, true)
+	assert.ErrorIs(t, err, domain.ErrAborted)
+
+	expected := `
+# HELP device_usecase_operation_errors_total Failed device_usecase operations by kind of error.
+# TYPE device_usecase_operation_errors_total counter
+device_usecase_operation_errors_total{kind="aborted",operation="batch_devices"} 1
+device_usecase_operation_errors_total{kind="internal",operation="create_device"} 1
+device_usecase_operation_errors_total{kind="not_found",operation="get_device"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "device_usecase_operation_errors_total"))
+	assert.Equal(t, uint64(2), sampleCount(t, reg, "device_usecase_operation_duration_seconds", map[string]string{"operation": "get_device"}))
+	assert.Equal(t, uint64(1), sampleCount(t, reg, "device_usecase_operation_duration_seconds", map[string]string{"operation": "create_device"}))
+}
+
+func TestNewDeviceRepository(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	repo := metrics.NewDeviceRepository(repository.New(), reg)
+	ctx := context.Background()
+
+	require.NoError(t, errOf(repo.CreateDevice(ctx, domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})))
+	assert.ErrorIs(t, errOf(repo.CreateDevice(ctx, domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})), domain.ErrAlreadyExists)
+	_, err := repo.GetDevice(ctx, "2")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+
+	expected := `
+# HELP device_repository_operation_errors_total Failed device_repository operations by kind of error.
+# TYPE device_repository_operation_errors_total counter
+device_repository_operation_errors_total{kind="already_exists",operation="create_device"} 1
+device_repository_operation_errors_total{kind="not_found",operation="get_device"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "device_repository_operation_errors_total"))
+	assert.Equal(t, uint64(2), sampleCount(t, reg, "device_repository_operation_duration_seconds", map[string]string{"operation": "create_device"}))
+}
+
+func TestNewModelCollector(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("by model", func(t *testing.T) {
+		repo := repository.New()
+		require.NoError(t, errOf(repo.CreateDevice(ctx, domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})))
+		require.NoError(t, errOf(repo.CreateDevice(ctx, domain.Device{SerialNum: "2", Model: "a", IP: "10.0.0.2"})))
+		require.NoError(t, errOf(repo.CreateDevice(domain.WithTenant(ctx, "acme"), domain.Device{SerialNum: "1", Model: "b", IP: "10.0.0.1"})))
+
+		expected := `
+# HELP devices Devices by model, across tenants; deleted ones do not count.
+# TYPE devices gauge
+devices{model="a"} 2
+devices{model="b"} 1
+`
+		assert.NoError(t, testutil.CollectAndCompare(metrics.NewModelCollector(repo), strings.NewReader(expected)))
+	})
+
+	t.Run("capped", func(t *testing.T) {
+		repo := repository.New()
+		for i := 0; i < 105; i++ {
+			serial := strconv.Itoa(i)
+			require.NoError(t, errOf(repo.CreateDevice(ctx, domain.Device{SerialNum: serial, Model: "m" + serial, IP: "10.0.0.1"})))
+		}
+		require.NoError(t, errOf(repo.CreateDevice(ctx, domain.Device{SerialNum: "x", Model: "m104", IP: "10.0.0.1"})))
+
+		collector := metrics.NewModelCollector(repo)
+		assert.Equal(t, 101, testutil.CollectAndCount(collector))
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(collector)
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		byModel := map[string]float64{}
+		for _, m := range families[0].GetMetric() {
+			byModel[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+		// The most common model is kept; of the rest, the last in order go.
+		assert.Equal(t, 2.0, byModel["m104"])
+		assert.Equal(t, 5.0, byModel["_other"])
+	})
+}
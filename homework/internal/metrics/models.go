@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"time"
+)
+
+const (
+	// maxModels caps the series of the devices gauge; the least common
+	// models beyond it are summed up under otherModel.
+	maxModels  = 100
+	otherModel = "_other"
+
+	countTimeout = 5 * time.Second
+)
+
+// ModelCounter counts the devices of every model, across tenants.
+type ModelCounter interface {
+	CountByModel(ctx context.Context) (map[string]int, error)
+}
+
+// modelCollector asks for the counts on every scrape, so the gauge never
+// drifts from the repository.
+type modelCollector struct {
+	counter ModelCounter
+	desc    *prometheus.Desc
+}
+
+// NewModelCollector returns a collector of the devices gauge, by model.
+func NewModelCollector(counter ModelCounter) prometheus.Collector {
+	return &modelCollector{
+		counter: counter,
+		desc:    prometheus.NewDesc("devices", "Devices by model, across tenants; deleted ones do not count.", []string{"model"}, nil),
+	}
+}
+
+func (c *modelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *modelCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), countTimeout)
+	defer cancel()
+	counts, err := c.counter.CountByModel(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for model, n := range capModels(counts) {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), model)
+	}
+}
+
+// capModels keeps the maxModels most common models and sums up the rest.
+func capModels(counts map[string]int) map[string]int {
+	if len(counts) <= maxModels {
+		return counts
+	}
+	models := make([]string, 0, len(counts))
+	for model := range counts {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		if counts[models[i]] != counts[models[j]] {
+			return counts[models[i]] > counts[models[j]]
+		}
+		return models[i] < models[j]
+	})
+	capped := make(map[string]int, maxModels+1)
+	for i, model := range models {
+		if i < maxModels {
+			capped[model] = counts[model]
+		} else {
+			capped[otherModel] += counts[model]
+		}
+	}
+	return capped
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"homework/internal/domain"
+	"homework/internal/repository"
+	"time"
+)
+
+type deviceRepository struct {
+	next repository.Device
+	ops  *operations
+}
+
+// NewDeviceRepository wraps repo to record every call in the
+// device_repository metrics. Time spent waiting for locks or the database
+// counts, which is what shows contention.
+func NewDeviceRepository(repo repository.Device, reg prometheus.Registerer) repository.Device {
+	return &deviceRepository{next: repo, ops: newOperations(reg, "device_repository")}
+}
+
+func (r *deviceRepository) GetDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	done := r.ops.start("get_device")
+	d, err := r.next.GetDevice(ctx, serialNum)
+	return d, done(err)
+}
+
+func (r *deviceRepository) CreateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	done := r.ops.start("create_device")
+	created, err := r.next.CreateDevice(ctx, d)
+	return created, done(err)
+}
+
+func (r *deviceRepository) DeleteDevice(ctx context.Context, serialNum string, revision uint64) error {
+	done := r.ops.start("delete_device")
+	return done(r.next.DeleteDevice(ctx, serialNum, revision))
+}
+
+func (r *deviceRepository) UpdateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	done := r.ops.start("update_device")
+	updated, err := r.next.UpdateDevice(ctx, d)
+	return updated, done(err)
+}
+
+func (r *deviceRepository) ListDevices(ctx context.Context, f domain.DeviceFilter) (domain.DevicePage, error) {
+	done := r.ops.start("list_devices")
+	page, err := r.next.ListDevices(ctx, f)
+	return page, done(err)
+}
+
+func (r *deviceRepository) GetDeviceHistory(ctx context.Context, serialNum string) ([]domain.HistoryEntry, error) {
+	done := r.ops.start("get_device_history")
+	history, err := r.next.GetDeviceHistory(ctx, serialNum)
+	return history, done(err)
+}
+
+func (r *deviceRepository) ListTrash(ctx context.Context) ([]domain.Device, error) {
+	done := r.ops.start("list_trash")
+	devices, err := r.next.ListTrash(ctx)
+	return devices, done(err)
+}
+
+func (r *deviceRepository) RestoreDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	done := r.ops.start("restore_device")
+	restored, err := r.next.RestoreDevice(ctx, serialNum)
+	return restored, done(err)
+}
+
+func (r *deviceRepository) PurgeTrash(ctx context.Context, deletedBefore time.Time) (int, error) {
+	done := r.ops.start("purge_trash")
+	n, err := r.next.PurgeTrash(ctx, deletedBefore)
+	return n, done(err)
+}
+
+func (r *deviceRepository) Watch(ctx context.Context, fromVersion uint64) (<-chan domain.HistoryEntry, error) {
+	done := r.ops.start("watch")
+	changes, err := r.next.Watch(ctx, fromVersion)
+	return changes, done(err)
+}
+
+func (r *deviceRepository) BatchDevices(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	done := r.ops.start("batch_devices")
+	results, err := r.next.BatchDevices(ctx, ops, atomic)
+	return results, done(err)
+}
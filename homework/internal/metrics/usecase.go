@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"homework/internal/domain"
+	"homework/internal/usecase"
+	"time"
+)
+
+type deviceUseCase struct {
+	next usecase.DeviceUseCase
+	ops  *operations
+}
+
+// NewDeviceUseCase wraps uc to record every call in the device_usecase
+// metrics. WatchDevices counts until the subscription is set up, not for as
+// long as it lasts.
+func NewDeviceUseCase(uc usecase.DeviceUseCase, reg prometheus.Registerer) usecase.DeviceUseCase {
+	return &deviceUseCase{next: uc, ops: newOperations(reg, "device_usecase")}
+}
+
+func (u *deviceUseCase) GetDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	done := u.ops.start("get_device")
+	d, err := u.next.GetDevice(ctx, serialNum)
+	return d, done(err)
+}
+
+func (u *deviceUseCase) CreateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	done := u.ops.start("create_device")
+	created, err := u.next.CreateDevice(ctx, d)
+	return created, done(err)
+}
+
+func (u *deviceUseCase) DeleteDevice(ctx context.Context, serialNum string, revision uint64) error {
+	done := u.ops.start("delete_device")
+	return done(u.next.DeleteDevice(ctx, serialNum, revision))
+}
+
+func (u *deviceUseCase) UpdateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	done := u.ops.start("update_device")
+	updated, err := u.next.UpdateDevice(ctx, d)
+	return updated, done(err)
+}
+
+func (u *deviceUseCase) ListDevices(ctx context.Context, f domain.DeviceFilter) (domain.DevicePage, error) {
+	done := u.ops.start("list_devices")
+	page, err := u.next.ListDevices(ctx, f)
+	return page, done(err)
+}
+
+func (u *deviceUseCase) PatchDevice(ctx context.Context, serialNum string, p domain.Patch, revision uint64) (domain.Device, error) {
+	done := u.ops.start("patch_device")
+	d, err := u.next.PatchDevice(ctx, serialNum, p, revision)
+	return d, done(err)
+}
+
+func (u *deviceUseCase) TransitionDevice(ctx context.Context, serialNum string, t domain.Transition, revision uint64) (domain.Device, error) {
+	done := u.ops.start("transition_device")
+	d, err := u.next.TransitionDevice(ctx, serialNum, t, revision)
+	return d, done(err)
+}
+
+func (u *deviceUseCase) GetDeviceHistory(ctx context.Context, serialNum string) ([]domain.HistoryEntry, error) {
+	done := u.ops.start("get_device_history")
+	history, err := u.next.GetDeviceHistory(ctx, serialNum)
+	return history, done(err)
+}
+
+func (u *deviceUseCase) RevertDevice(ctx context.Context, serialNum string, toRevision, revision uint64) (domain.Device, error) {
+	done := u.ops.start("revert_device")
+	d, err := u.next.RevertDevice(ctx, serialNum, toRevision, revision)
+	return d, done(err)
+}
+
+func (u *deviceUseCase) ListTrash(ctx context.Context) ([]domain.Device, error) {
+	done := u.ops.start("list_trash")
+	devices, err := u.next.ListTrash(ctx)
+	return devices, done(err)
+}
+
+func (u *deviceUseCase) RestoreDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	done := u.ops.start("restore_device")
+	d, err := u.next.RestoreDevice(ctx, serialNum)
+	return d, done(err)
+}
+
+func (u *deviceUseCase) PurgeTrash(ctx context.Context, retention time.Duration) (int, error) {
+	done := u.ops.start("purge_trash")
+	n, err := u.next.PurgeTrash(ctx, retention)
+	return n, done(err)
+}
+
+func (u *deviceUseCase) WatchDevices(ctx context.Context, fromVersion uint64) (<-chan domain.HistoryEntry, error) {
+	done := u.ops.start("watch_devices")
+	changes, err := u.next.WatchDevices(ctx, fromVersion)
+	return changes, done(err)
+}
+
+func (u *deviceUseCase) BatchDevices(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	done := u.ops.start("batch_devices")
+	results, err := u.next.BatchDevices(ctx, ops, atomic)
+	return results, done(err)
+}
+
+func (u *deviceUseCase) ImportDevices(ctx context.Context, rows []domain.ImportRow, opts domain.ImportOptions) (domain.ImportReport, error) {
+	done := u.ops.start("import_devices")
+	report, err := u.next.ImportDevices(ctx, rows, opts)
+	return report, done(err)
+}
@@ -0,0 +1,184 @@
+// Package rbac decides what an authenticated principal may do with devices.
+// Roles bundle permissions, each optionally limited to devices of some
+// models or with some labels, and are given to principals by the roles
+// claim of their token or by the subjects section of the policy file.
+package rbac
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"homework/internal/auth"
+	"homework/internal/domain"
+	"os"
+	"slices"
+	"sort"
+)
+
+type Permission string
+
+const (
+	DevicesRead    Permission = "devices.read"
+	DevicesCreate  Permission = "devices.create"
+	DevicesUpdate  Permission = "devices.update"
+	DevicesDelete  Permission = "devices.delete"
+	DevicesRestore Permission = "devices.restore"
+	DevicesPurge   Permission = "devices.purge"
+	// All grants every permission.
+	All Permission = "*"
+)
+
+var permissions = []Permission{DevicesRead, DevicesCreate, DevicesUpdate, DevicesDelete, DevicesRestore, DevicesPurge, All}
+
+// Grant gives a permission on the devices it covers: with models, only
+// devices of one of them; with labels, only devices that carry all of them.
+type Grant struct {
+	Permission Permission        `yaml:"permission"`
+	Models     []string          `yaml:"models"`
+	Labels     map[string]string `yaml:"labels"`
+}
+
+func (g Grant) scoped() bool {
+	return len(g.Models) > 0 || len(g.Labels) > 0
+}
+
+func (g Grant) covers(d domain.Device) bool {
+	if len(g.Models) > 0 && !slices.Contains(g.Models, d.Model) {
+		return false
+	}
+	for k, v := range g.Labels {
+		if d.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy is a set of roles and the roles given to subjects. A nil Policy
+// allows everything, for a service that runs without authentication.
+type Policy struct {
+	Roles map[string][]Grant `yaml:"roles"`
+	// Subjects gives roles to principals by subject, which is how API keys,
+	// whose principals have no roles of their own, get any.
+	Subjects map[string][]string `yaml:"subjects"`
+}
+
+// Load reads a policy from a YAML file:
+//
+//	roles:
+//	  admin:
+//	    - permission: "*"
+//	  technician:
+//	    - permission: devices.read
+//	    - permission: devices.update
+//	      models: [X100]
+//	      labels: {site: ams}
+//	subjects:
+//	  ci: [admin]
+func Load(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy: %w", err)
+	}
+	p, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Parse parses and checks a policy; see Load for the format.
+func Parse(b []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parse policy: %w", err)
+	}
+	for role, grants := range p.Roles {
+		for i, g := range grants {
+			if !slices.Contains(permissions, g.Permission) {
+				return nil, fmt.Errorf("parse policy: role %s, grant %d: unknown permission %q", role, i, g.Permission)
+			}
+		}
+	}
+	for subject, roles := range p.Subjects {
+		for _, role := range roles {
+			if _, ok := p.Roles[role]; !ok {
+				return nil, fmt.Errorf("parse policy: subject %s: unknown role %q", subject, role)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Scope returns the devices the principal of ctx may perm. Without a
+// single grant of perm it returns a *domain.PermissionError instead. Roles
+// the policy does not define are ignored, so a token may carry roles meant
+// for other services.
+func (p *Policy) Scope(ctx context.Context, perm Permission) (Scope, error) {
+	if p == nil {
+		return Scope{perm: perm, all: true}, nil
+	}
+	principal, ok := auth.PrincipalFrom(ctx)
+	if !ok {
+		return Scope{}, &domain.PermissionError{Permission: string(perm)}
+	}
+	if principal.Method == auth.MethodInternal {
+		return Scope{perm: perm, all: true}, nil
+	}
+
+	s := Scope{perm: perm}
+	for _, role := range p.roles(principal) {
+		for _, g := range p.Roles[role] {
+			if g.Permission != perm && g.Permission != All {
+				continue
+			}
+			if !g.scoped() {
+				return Scope{perm: perm, all: true}, nil
+			}
+			s.grants = append(s.grants, g)
+		}
+	}
+	if len(s.grants) == 0 {
+		return Scope{}, &domain.PermissionError{Permission: string(perm)}
+	}
+	return s, nil
+}
+
+func (p *Policy) roles(principal auth.Principal) []string {
+	roles := append(slices.Clone(principal.Roles), p.Subjects[principal.Subject]...)
+	sort.Strings(roles)
+	return slices.Compact(roles)
+}
+
+// Scope is the part of the inventory a permission was granted on.
+type Scope struct {
+	perm   Permission
+	all    bool
+	grants []Grant
+}
+
+// All reports whether the permission covers every device, so the caller
+// need not look at them.
+func (s Scope) All() bool {
+	return s.all
+}
+
+func (s Scope) Covers(d domain.Device) bool {
+	if s.all {
+		return true
+	}
+	for _, g := range s.grants {
+		if g.covers(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns a *domain.PermissionError naming d unless s covers it.
+func (s Scope) Check(d domain.Device) error {
+	if s.Covers(d) {
+		return nil
+	}
+	return &domain.PermissionError{Permission: string(s.perm), SerialNum: d.SerialNum}
+}
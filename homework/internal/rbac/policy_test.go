@@ -0,0 +1,151 @@
+package rbac_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"homework/internal/auth"
+	"homework/internal/domain"
+	"homework/internal/rbac"
+	"testing"
+)
+
+const policyYAML = `
+roles:
+  admin:
+    - permission: "*"
+  technician:
+    - permission: devices.read
+    - permission: devices.update
+      models: [X100, X200]
+    - permission: devices.update
+      labels: {site: ams, rack: "7"}
+subjects:
+  ci: [admin]
+  field-tablet: [technician]
+`
+
+func TestParse(t *testing.T) {
+	testTable := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{name: "valid", doc: policyYAML},
+		{name: "not yaml", doc: "roles: [", wantErr: "parse policy: yaml: line 1: did not find expected node content"},
+		{
+			name:    "unknown permission",
+			doc:     "roles:\n  ops:\n    - permission: devices.reboot\n",
+			wantErr: `parse policy: role ops, grant 0: unknown permission "devices.reboot"`,
+		},
+		{
+			name:    "unknown role",
+			doc:     "roles:\n  ops: []\nsubjects:\n  ci: [admin]\n",
+			wantErr: `parse policy: subject ci: unknown role "admin"`,
+		},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := rbac.Parse([]byte(tc.doc))
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestPolicy_Scope(t *testing.T) {
+	policy, err := rbac.Parse([]byte(policyYAML))
+	require.NoError(t, err)
+	as := func(p auth.Principal) context.Context {
+		return auth.WithPrincipal(context.Background(), p)
+	}
+	x100 := domain.Device{SerialNum: "1", Model: "X100"}
+	x300 := domain.Device{SerialNum: "2", Model: "X300"}
+	rack7 := domain.Device{SerialNum: "3", Model: "X300", Labels: map[string]string{"site": "ams", "rack": "7", "row": "b"}}
+	rack8 := domain.Device{SerialNum: "4", Model: "X300", Labels: map[string]string{"site": "ams", "rack": "8"}}
+
+	testTable := []struct {
+		name    string
+		policy  *rbac.Policy
+		ctx     context.Context
+		perm    rbac.Permission
+		all     bool
+		covers  []domain.Device
+		denies  []domain.Device
+		wantErr string
+	}{
+		{
+			name:   "no policy",
+			ctx:    context.Background(),
+			perm:   rbac.DevicesDelete,
+			all:    true,
+			covers: []domain.Device{x100, x300},
+		},
+		{
+			name:    "no principal",
+			policy:  policy,
+			ctx:     context.Background(),
+			perm:    rbac.DevicesRead,
+			wantErr: "forbidden: missing permission devices.read",
+		},
+		{
+			name:   "internal",
+			policy: policy,
+			ctx:    as(auth.Principal{Subject: "purge", Method: auth.MethodInternal}),
+			perm:   rbac.DevicesPurge,
+			all:    true,
+		},
+		{
+			name:   "wildcard by subject",
+			policy: policy,
+			ctx:    as(auth.Principal{Subject: "ci", Method: auth.MethodAPIKey}),
+			perm:   rbac.DevicesDelete,
+			all:    true,
+		},
+		{
+			name:   "unscoped role from token",
+			policy: policy,
+			ctx:    as(auth.Principal{Subject: "bob", Method: auth.MethodJWT, Roles: []string{"technician"}}),
+			perm:   rbac.DevicesRead,
+			all:    true,
+		},
+		{
+			name:   "grants add up",
+			policy: policy,
+			ctx:    as(auth.Principal{Subject: "field-tablet", Method: auth.MethodAPIKey}),
+			perm:   rbac.DevicesUpdate,
+			covers: []domain.Device{x100, rack7},
+			denies: []domain.Device{x300, rack8},
+		},
+		{
+			name:    "missing permission",
+			policy:  policy,
+			ctx:     as(auth.Principal{Subject: "bob", Method: auth.MethodJWT, Roles: []string{"technician", "unknown"}}),
+			perm:    rbac.DevicesCreate,
+			wantErr: "forbidden: missing permission devices.create",
+		},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.name, func(t *testing.T) {
+			scope, err := tc.policy.Scope(tc.ctx, tc.perm)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				assert.ErrorIs(t, err, domain.ErrForbidden)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.all, scope.All())
+			for _, d := range tc.covers {
+				assert.NoError(t, scope.Check(d), d.SerialNum)
+			}
+			for _, d := range tc.denies {
+				assert.EqualError(t, scope.Check(d), "forbidden: missing permission "+string(tc.perm)+" on device "+d.SerialNum)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"homework/internal/domain"
+)
+
+// BatchDevices applies ops in order under a single lock. Each operation sees
+// the effect of the ones before it. Without atomic every operation succeeds
+// or fails on its own; with atomic the first failure leaves the repository
+// untouched and every other operation is reported as domain.ErrAborted. The
+// error is only set when the batch could not be attempted at all.
+func (r *Repo) BatchDevices(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := make([]domain.BatchResult, len(ops))
+	if !atomic {
+		for i, op := range ops {
+			c, err := batchChange(ctx, r, op)
+			if err == nil {
+				err = r.apply(c)
+			}
+			results[i] = batchResult(c, err)
+		}
+		return results, nil
+	}
+
+	s := &staged{state: r, devices: make(map[Key]*domain.Device), trash: make(map[Key]bool), live: make(map[string]int)}
+	changes := make([]change, 0, len(ops))
+	for i, op := range ops {
+		c, err := batchChange(ctx, s, op)
+		if err != nil {
+			return domain.AbortBatch(len(ops), i, err), nil
+		}
+		s.stage(c)
+		changes = append(changes, c)
+	}
+	if err := r.apply(changes...); err != nil {
+		return nil, err
+	}
+	for i, c := range changes {
+		results[i] = batchResult(c, nil)
+	}
+	return results, nil
+}
+
+func batchChange(ctx context.Context, s state, op domain.BatchOperation) (change, error) {
+	switch op.Op {
+	case domain.OpCreate:
+		return createChange(ctx, s, op.Device)
+	case domain.OpUpdate:
+		d := op.Device
+		d.Revision = op.Revision
+		return updateChange(ctx, s, d)
+	case domain.OpDelete:
+		return deleteChange(ctx, s, op.SerialNum, op.Revision)
+	default:
+		return change{}, errBatchOp(op.Op)
+	}
+}
+
+func errBatchOp(op domain.Operation) error {
+	return domain.NewValidationError(domain.FieldError{Field: "op", Message: fmt.Sprintf("unsupported operation %q", op)})
+}
+
+func batchResult(c change, err error) domain.BatchResult {
+	if err != nil {
+		return domain.BatchResult{Err: err}
+	}
+	if c.Device == nil {
+		return domain.BatchResult{}
+	}
+	d := c.Device.Clone()
+	return domain.BatchResult{Device: &d}
+}
+
+// staged is the state seen by an atomic batch: its own changes so far on
+// top of the stored devices.
+type staged struct {
+	state
+	// devices holds staged devices; nil means no longer live.
+	devices map[Key]*domain.Device
+	trash   map[Key]bool
+	// live is how many live devices the batch added to each tenant, or
+	// removed if negative.
+	live map[string]int
+}
+
+func (s *staged) device(k Key) (domain.Device, bool) {
+	if d, ok := s.devices[k]; ok {
+		if d == nil {
+			return domain.Device{}, false
+		}
+		return *d, true
+	}
+	return s.state.device(k)
+}
+
+func (s *staged) inTrash(k Key) bool {
+	if trashed, ok := s.trash[k]; ok {
+		return trashed
+	}
+	return s.state.inTrash(k)
+}
+
+func (s *staged) quota(tenant string, added int) error {
+	return s.state.quota(tenant, added+s.live[tenant])
+}
+
+func (s *staged) stage(c change) {
+	k := c.key()
+	_, wasLive := s.device(k)
+	switch {
+	case c.Device != nil:
+		s.devices[k] = c.Device
+		s.trash[k] = false
+		if !wasLive {
+			s.live[k.Tenant]++
+		}
+		return
+	case c.Trashed != nil:
+		s.devices[k] = nil
+		s.trash[k] = true
+	default:
+		s.devices[k] = nil
+		s.trash[k] = false
+	}
+	if wasLive {
+		s.live[k.Tenant]--
+	}
+}
@@ -1,48 +1,167 @@
 package repository
 
 import (
+	"context"
 	"fmt"
 	"homework/internal/domain"
+	"time"
 )
 
-func (r *Repo) GetDevice(serialNum string) (d domain.Device, err error) {
+// now is the clock for CreatedAt/UpdatedAt. UTC drops the monotonic reading
+// so stored values compare equal after a round trip through disk.
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+func (r *Repo) GetDevice(ctx context.Context, serialNum string) (d domain.Device, err error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	d, ok := r.Devices[serialNum]
+	d, ok := r.Devices[keyOf(ctx, serialNum)]
 	if !ok {
 		return domain.Device{}, fmt.Errorf("%w: no device", domain.ErrNotFound)
 	}
-	return d, nil
+	return d.Clone(), nil
 }
 
-func (r *Repo) CreateDevice(d domain.Device) error {
+func (r *Repo) CreateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	_, e := r.Devices[d.SerialNum]
-	if e {
-		return fmt.Errorf("device is already in repository")
+	c, err := createChange(ctx, r, d)
+	if err != nil {
+		return domain.Device{}, err
 	}
-	r.Devices[d.SerialNum] = d
-	return nil
+	return r.applyDevice(c)
 }
-func (r *Repo) DeleteDevice(serialNum string) error {
+
+// DeleteDevice moves the device to the trash, where it is hidden from Get
+// and List until it is restored or purged. A non-zero revision must match
+// the stored one.
+func (r *Repo) DeleteDevice(ctx context.Context, serialNum string, revision uint64) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	_, ok := r.Devices[serialNum]
-	if !ok {
-		return fmt.Errorf("%w: no device", domain.ErrNotFound)
+	c, err := deleteChange(ctx, r, serialNum, revision)
+	if err != nil {
+		return err
 	}
-	delete(r.Devices, serialNum)
-	return nil
+	return r.apply(c)
 }
-func (r *Repo) UpdateDevice(d domain.Device) error {
+
+// UpdateDevice replaces the device if d.Revision is 0 or equals the stored
+// revision, and bumps the revision. An empty Status and nil Transitions keep
+// the stored ones.
+func (r *Repo) UpdateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	_, e := r.Devices[d.SerialNum]
-	if e {
-		r.Devices[d.SerialNum] = d
-		return nil
+	c, err := updateChange(ctx, r, d)
+	if err != nil {
+		return domain.Device{}, err
 	}
+	return r.applyDevice(c)
+}
+
+// applyDevice applies a change that stores a device and returns the device.
+// Callers must hold r.mu for writing.
+func (r *Repo) applyDevice(c change) (domain.Device, error) {
+	if err := r.apply(c); err != nil {
+		return domain.Device{}, err
+	}
+	return c.Device.Clone(), nil
+}
 
-	return fmt.Errorf("%w: no device", domain.ErrNotFound)
+// state is what a change is checked against: the stored devices, or a batch
+// staged on top of them.
+type state interface {
+	device(k Key) (domain.Device, bool)
+	inTrash(k Key) bool
+	// quota checks that tenant may have another live device on top of
+	// added ones not stored yet.
+	quota(tenant string, added int) error
+}
+
+func (r *Repo) device(k Key) (domain.Device, bool) {
+	d, ok := r.Devices[k]
+	return d, ok
+}
+
+func (r *Repo) inTrash(k Key) bool {
+	_, ok := r.trash[k]
+	return ok
+}
+
+func (r *Repo) quota(tenant string, added int) error {
+	return checkQuota(r.quotas, tenant, r.live[tenant]+added)
+}
+
+func createChange(ctx context.Context, s state, d domain.Device) (change, error) {
+	k := keyOf(ctx, d.SerialNum)
+	if _, e := s.device(k); e {
+		return change{}, fmt.Errorf("%w: device is already in repository", domain.ErrAlreadyExists)
+	}
+	if s.inTrash(k) {
+		return change{}, errInTrash
+	}
+	if err := s.quota(k.Tenant, 0); err != nil {
+		return change{}, err
+	}
+	d.Revision = 1
+	d.DeletedAt = nil
+	d.CreatedAt = now()
+	d.UpdatedAt = d.CreatedAt
+	return change{Tenant: k.Tenant, Device: &d, Entry: newEntry(ctx, domain.OpCreate, nil, &d)}, nil
+}
+
+func deleteChange(ctx context.Context, s state, serialNum string, revision uint64) (change, error) {
+	k := keyOf(ctx, serialNum)
+	current, ok := s.device(k)
+	if !ok {
+		return change{}, fmt.Errorf("%w: no device", domain.ErrNotFound)
+	}
+	if err := checkRevision(current, revision); err != nil {
+		return change{}, err
+	}
+	return change{Tenant: k.Tenant, Trashed: tombstone(current), Entry: newEntry(ctx, domain.OpDelete, &current, nil)}, nil
+}
+
+func updateChange(ctx context.Context, s state, d domain.Device) (change, error) {
+	k := keyOf(ctx, d.SerialNum)
+	current, ok := s.device(k)
+	if !ok {
+		return change{}, fmt.Errorf("%w: no device", domain.ErrNotFound)
+	}
+	if err := checkRevision(current, d.Revision); err != nil {
+		return change{}, err
+	}
+	stampUpdate(&d, current)
+	return change{Tenant: k.Tenant, Device: &d, Entry: newEntry(ctx, domain.OpUpdate, &current, &d)}, nil
+}
+
+// stampUpdate sets the server-managed fields of d, which replaces current.
+func stampUpdate(d *domain.Device, current domain.Device) {
+	d.Revision = current.Revision + 1
+	d.CreatedAt = current.CreatedAt
+	d.UpdatedAt = now()
+	d.DeletedAt = nil
+	if d.Status == "" {
+		d.Status = current.Status
+	}
+	if d.Transitions == nil {
+		d.Transitions = current.Transitions
+	}
+}
+
+// errInTrash keeps a serial number from being reused while its old device
+// can still be restored.
+var errInTrash = fmt.Errorf("%w: device is in the trash; restore it or wait for it to be purged", domain.ErrAlreadyExists)
+
+func tombstone(d domain.Device) *domain.Device {
+	deletedAt := now()
+	d.DeletedAt = &deletedAt
+	return &d
+}
+
+func checkRevision(current domain.Device, expected uint64) error {
+	if expected != 0 && expected != current.Revision {
+		return fmt.Errorf("%w: device is at revision %d, not %d", domain.ErrPreconditionFailed, current.Revision, expected)
+	}
+	return nil
 }
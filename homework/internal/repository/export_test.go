@@ -0,0 +1,33 @@
+package repository
+
+import "errors"
+
+// FailNextWALWrite makes the next append to the WAL of f write only n
+// bytes and fail. When truncErr is set, undoing the partial write fails
+// with it as well.
+func FailNextWALWrite(f *FileRepo, n int, truncErr error) {
+	f.wal = &faultyWAL{walFile: f.wal, n: n, truncErr: truncErr}
+}
+
+type faultyWAL struct {
+	walFile
+	n        int
+	truncErr error
+	failed   bool
+}
+
+func (w *faultyWAL) Write(p []byte) (int, error) {
+	if w.failed {
+		return w.walFile.Write(p)
+	}
+	w.failed = true
+	n, _ := w.walFile.Write(p[:w.n])
+	return n, errors.New("no space left on device")
+}
+
+func (w *faultyWAL) Truncate(size int64) error {
+	if w.truncErr != nil {
+		return w.truncErr
+	}
+	return w.walFile.Truncate(size)
+}
@@ -0,0 +1,448 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"homework/internal/domain"
+	"homework/internal/events"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	walFileName      = "devices.wal"
+	snapshotFileName = "devices.snapshot"
+
+	// DefaultSnapshotEvery is the number of WAL records after which the
+	// log is compacted into a fresh snapshot.
+	DefaultSnapshotEvery = 1000
+
+	walHeaderSize = 8
+	maxRecordSize = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walRecord is one append to the write-ahead log. All changes of a record
+// are applied together on replay.
+type walRecord struct {
+	Seq     uint64   `json:"seq"`
+	Changes []change `json:"changes"`
+}
+
+type snapshot struct {
+	Seq     uint64                     `json:"seq"`
+	Version uint64                     `json:"version"`
+	Tenants map[string]*tenantSnapshot `json:"tenants,omitempty"`
+	// Snapshots written before tenants existed hold the devices of
+	// domain.DefaultTenant here instead of in Tenants.
+	tenantSnapshot
+}
+
+// tenantSnapshot is the state of one tenant, with history by serial number.
+type tenantSnapshot struct {
+	Trash   []domain.Device                  `json:"trash,omitempty"`
+	Devices []domain.Device                  `json:"devices,omitempty"`
+	History map[string][]domain.HistoryEntry `json:"history,omitempty"`
+}
+
+// FileRepo is a Repo that survives restarts. Every change is appended to a
+// write-ahead log and fsynced before it becomes visible; the log is
+// periodically compacted into a snapshot. On open the snapshot is loaded and
+// the log is replayed on top of it.
+//
+// WAL records are framed as [length uint32][crc32c uint32][json payload].
+// A record that is short or fails its checksum at the end of the log marks a
+// torn write from a crash: it is truncated away. When a whole record follows
+// a bad one the log is corrupt instead, and opening it fails.
+type FileRepo struct {
+	*Repo
+	dir string
+	wal walFile
+	// failed is set when a failed append could not be undone; the WAL may
+	// end in a partial record, so no more records are written after it.
+	failed        error
+	seq           uint64
+	walRecords    int
+	snapshotEvery int
+	truncated     int64
+}
+
+// walFile is the part of *os.File the WAL is written through.
+type walFile interface {
+	io.WriteSeeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+func NewFile(dir string, snapshotEvery int, opts ...Option) (*FileRepo, error) {
+	if snapshotEvery <= 0 {
+		snapshotEvery = DefaultSnapshotEvery
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	f := &FileRepo{
+		Repo:          New(opts...),
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+	}
+	if err := f.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := f.replay(); err != nil {
+		return nil, err
+	}
+	// Watchers can only resume from changes made after the restart.
+	f.feed = events.NewBroadcaster(events.DefaultReplay, f.version)
+	f.Repo.journal = f
+	return f, nil
+}
+
+// Truncated reports how many bytes of a torn WAL tail were discarded on open.
+func (f *FileRepo) Truncated() int64 {
+	return f.truncated
+}
+
+func (f *FileRepo) loadSnapshot() error {
+	b, err := os.ReadFile(filepath.Join(f.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	f.loadTenant(domain.DefaultTenant, &s.tenantSnapshot)
+	for tenant, ts := range s.Tenants {
+		f.loadTenant(tenant, ts)
+	}
+	f.seq = s.Seq
+	f.version = s.Version
+	return nil
+}
+
+func (f *FileRepo) loadTenant(tenant string, s *tenantSnapshot) {
+	for _, d := range s.Devices {
+		f.Devices[Key{Tenant: tenant, SerialNum: d.SerialNum}] = d
+		f.live[tenant]++
+	}
+	for _, d := range s.Trash {
+		f.trash[Key{Tenant: tenant, SerialNum: d.SerialNum}] = d
+	}
+	for serialNum, entries := range s.History {
+		for i := range entries {
+			entries[i].Tenant = tenant
+		}
+		f.history[Key{Tenant: tenant, SerialNum: serialNum}] = entries
+	}
+}
+
+func (f *FileRepo) replay() error {
+	wal, err := os.OpenFile(filepath.Join(f.dir, walFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	var good int64
+	r := bufio.NewReader(wal)
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF || errors.Is(err, errTornRecord) {
+			// A torn tail is what a crash mid-append leaves: keep everything
+			// before it, once checkTornTail has made sure it is the tail.
+			break
+		}
+		if err != nil {
+			_ = wal.Close()
+			return fmt.Errorf("replay wal at offset %d: %w", good, err)
+		}
+		good += n
+		if rec.Seq <= f.seq {
+			// Already contained in the snapshot.
+			continue
+		}
+		for _, c := range rec.Changes {
+			f.applyLocked(c)
+		}
+		f.seq = rec.Seq
+		f.walRecords++
+	}
+
+	size, err := wal.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = wal.Close()
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	if size > good {
+		if err := checkTornTail(wal, good, size); err != nil {
+			_ = wal.Close()
+			return err
+		}
+		f.truncated = size - good
+		if err := wal.Truncate(good); err != nil {
+			_ = wal.Close()
+			return fmt.Errorf("truncate torn wal tail: %w", err)
+		}
+		if _, err := wal.Seek(good, io.SeekStart); err != nil {
+			_ = wal.Close()
+			return fmt.Errorf("seek wal: %w", err)
+		}
+	}
+	f.wal = wal
+	return nil
+}
+
+// checkTornTail makes sure that the bad record at off is the last one in the
+// WAL. Appends are serial, so only the last one can be torn by a crash; a
+// whole record after a bad one means the bad one is corruption, and
+// truncating there would drop the records after it.
+func checkTornTail(wal io.ReaderAt, off, size int64) error {
+	tail := make([]byte, size-off)
+	if _, err := wal.ReadAt(tail, off); err != nil {
+		return fmt.Errorf("read wal tail: %w", err)
+	}
+	for i := 1; i+walHeaderSize <= len(tail); i++ {
+		if binary.BigEndian.Uint32(tail[i:]) > uint32(len(tail)-i-walHeaderSize) {
+			continue
+		}
+		if _, _, err := readRecord(bytes.NewReader(tail[i:])); !errors.Is(err, errTornRecord) {
+			return fmt.Errorf("replay wal at offset %d: bad record followed by a whole one at offset %d", off, off+int64(i))
+		}
+	}
+	return nil
+}
+
+// errTornRecord marks a record that was not completely written. Anything
+// else readRecord fails with means the log is corrupt.
+var errTornRecord = errors.New("torn wal record")
+
+func readRecord(r io.Reader) (walRecord, int64, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return walRecord{}, 0, io.EOF
+		}
+		return walRecord{}, 0, fmt.Errorf("%w: short header", errTornRecord)
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	sum := binary.BigEndian.Uint32(header[4:])
+	if size > maxRecordSize {
+		return walRecord{}, 0, fmt.Errorf("%w: record too large", errTornRecord)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return walRecord{}, 0, fmt.Errorf("%w: short payload", errTornRecord)
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return walRecord{}, 0, fmt.Errorf("%w: checksum mismatch", errTornRecord)
+	}
+	// The checksum matches, so the record was written whole: a payload
+	// that does not decode is corruption, not a crash.
+	var rec walRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return walRecord{}, 0, fmt.Errorf("decode wal record: %w", err)
+	}
+	return rec, int64(walHeaderSize + size), nil
+}
+
+// append implements journal. It is called with f.mu held for writing.
+func (f *FileRepo) append(changes []change) error {
+	if f.wal == nil {
+		return fmt.Errorf("%w: repository is closed", domain.ErrUnavailable)
+	}
+	if f.failed != nil {
+		return fmt.Errorf("%w: %w", domain.ErrUnavailable, f.failed)
+	}
+	payload, err := json.Marshal(walRecord{Seq: f.seq + 1, Changes: changes})
+	if err != nil {
+		return fmt.Errorf("%w: encode wal record: %w", domain.ErrUnavailable, err)
+	}
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:walHeaderSize], crc32.Checksum(payload, crcTable))
+	copy(buf[walHeaderSize:], payload)
+
+	offset, err := f.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("%w: seek wal: %w", domain.ErrUnavailable, err)
+	}
+	if _, err := f.wal.Write(buf); err != nil {
+		return f.rollback(offset, fmt.Errorf("%w: write wal: %w", domain.ErrUnavailable, err))
+	}
+	if err := f.wal.Sync(); err != nil {
+		return f.rollback(offset, fmt.Errorf("%w: sync wal: %w", domain.ErrUnavailable, err))
+	}
+	f.seq++
+	f.walRecords++
+
+	if f.walRecords >= f.snapshotEvery {
+		// The change itself is already durable; a failed compaction is
+		// retried on the next append.
+		_ = f.snapshotLocked(changes)
+	}
+	return nil
+}
+
+// rollback cuts what a failed append may have left of its record off the
+// WAL, so that the next record follows the last acknowledged one. When
+// that fails too, the repository refuses further writes.
+func (f *FileRepo) rollback(offset int64, cause error) error {
+	if err := f.wal.Truncate(offset); err != nil {
+		f.failed = fmt.Errorf("wal ends in a partial record: truncate: %w", err)
+		return cause
+	}
+	if _, err := f.wal.Seek(offset, io.SeekStart); err != nil {
+		f.failed = fmt.Errorf("wal ends in a partial record: seek: %w", err)
+	}
+	return cause
+}
+
+// Snapshot writes the current state to disk and truncates the WAL.
+func (f *FileRepo) Snapshot() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.snapshotLocked(nil)
+}
+
+// snapshotLocked persists the current state plus pending, which are the
+// changes of the record being appended and not yet applied to Devices.
+func (f *FileRepo) snapshotLocked(pending []change) error {
+	state := newState()
+	state.version = f.version
+	for k, d := range f.Devices {
+		state.Devices[k] = d
+	}
+	for k, d := range f.trash {
+		state.trash[k] = d
+	}
+	for k, entries := range f.history {
+		// Cap the slices so appending pending entries never writes into
+		// the live history.
+		state.history[k] = entries[:len(entries):len(entries)]
+	}
+	for _, c := range pending {
+		state.applyLocked(c)
+	}
+
+	s := snapshot{
+		Seq:     f.seq,
+		Version: state.version,
+		Tenants: make(map[string]*tenantSnapshot),
+	}
+	tenant := func(name string) *tenantSnapshot {
+		ts, ok := s.Tenants[name]
+		if !ok {
+			ts = &tenantSnapshot{History: make(map[string][]domain.HistoryEntry)}
+			s.Tenants[name] = ts
+		}
+		return ts
+	}
+	for k, d := range state.Devices {
+		ts := tenant(k.Tenant)
+		ts.Devices = append(ts.Devices, d)
+	}
+	for k, d := range state.trash {
+		ts := tenant(k.Tenant)
+		ts.Trash = append(ts.Trash, d)
+	}
+	for k, entries := range state.history {
+		tenant(k.Tenant).History[k.SerialNum] = entries
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+
+	tmp := filepath.Join(f.dir, snapshotFileName+".tmp")
+	if err := writeFileSync(tmp, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(f.dir, snapshotFileName)); err != nil {
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+	if err := syncDir(f.dir); err != nil {
+		return err
+	}
+
+	// Records up to f.seq are in the snapshot now; if we crash before the
+	// truncate below, replay skips them by sequence number.
+	if err := f.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if _, err := f.wal.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	f.walRecords = 0
+	return nil
+}
+
+// Ping checks that the repository is open and its WAL is still on disk.
+func (f *FileRepo) Ping(context.Context) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.wal == nil {
+		return fmt.Errorf("%w: repository is closed", domain.ErrUnavailable)
+	}
+	if f.failed != nil {
+		return fmt.Errorf("%w: %w", domain.ErrUnavailable, f.failed)
+	}
+	if _, err := os.Stat(filepath.Join(f.dir, walFileName)); err != nil {
+		return fmt.Errorf("%w: stat wal: %w", domain.ErrUnavailable, err)
+	}
+	return nil
+}
+
+// Close compacts the log and releases the WAL file.
+func (f *FileRepo) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.wal == nil {
+		return nil
+	}
+	snapErr := f.snapshotLocked(nil)
+	err := f.wal.Close()
+	f.wal = nil
+	if snapErr != nil {
+		return snapErr
+	}
+	return err
+}
+
+func writeFileSync(name string, b []byte) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", name, err)
+	}
+	if _, err := file.Write(b); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("sync %s: %w", name, err)
+	}
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	return nil
+}
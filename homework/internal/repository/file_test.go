@@ -0,0 +1,287 @@
+package repository_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"homework/internal/domain"
+	"homework/internal/repository"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestFileRepoReopen(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+
+	d1 := domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"}
+	d2 := domain.Device{SerialNum: "2", Model: "b", IP: "10.0.0.2"}
+	require.NoError(t, errOf(repo.CreateDevice(context.Background(), d1)))
+	require.NoError(t, errOf(repo.CreateDevice(context.Background(), d2)))
+	d1.Model = "c"
+	require.NoError(t, errOf(repo.UpdateDevice(context.Background(), d1)))
+	require.NoError(t, repo.DeleteDevice(context.Background(), d2.SerialNum, 0))
+
+	// Simulate a crash: reopen without Close, so only the WAL is on disk.
+	reopened, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	want, err := repo.GetDevice(context.Background(), d1.SerialNum)
+	require.NoError(t, err)
+	assert.Equal(t, "c", want.Model)
+	assert.Equal(t, uint64(2), want.Revision)
+	assert.Equal(t, map[repository.Key]domain.Device{key("1"): want}, reopened.Devices)
+	assert.Zero(t, reopened.Truncated())
+
+	history, err := reopened.GetDeviceHistory(context.Background(), d2.SerialNum)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+	trash, err := reopened.ListTrash(context.Background())
+	require.NoError(t, err)
+	if assert.Len(t, trash, 1) {
+		assert.Equal(t, d2.SerialNum, trash[0].SerialNum)
+	}
+
+	// The trash is part of the snapshot too.
+	require.NoError(t, reopened.Close())
+	again, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	trash, err = again.ListTrash(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, trash, 1)
+	require.NoError(t, errOf(again.RestoreDevice(context.Background(), d2.SerialNum)))
+}
+
+func TestFileRepoSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := repository.NewFile(dir, 3)
+	require.NoError(t, err)
+
+	for i := 0; i < 7; i++ {
+		require.NoError(t, errOf(repo.CreateDevice(context.Background(), domain.Device{SerialNum: strconv.Itoa(i), Model: "a", IP: "10.0.0.1"})))
+	}
+	_, err = os.Stat(filepath.Join(dir, "devices.snapshot"))
+	require.NoError(t, err)
+
+	reopened, err := repository.NewFile(dir, 3)
+	require.NoError(t, err)
+	assert.Len(t, reopened.Devices, 7)
+
+	require.NoError(t, reopened.Close())
+	wal, err := os.Stat(filepath.Join(dir, "devices.wal"))
+	require.NoError(t, err)
+	assert.Zero(t, wal.Size())
+
+	reopened, err = repository.NewFile(dir, 3)
+	require.NoError(t, err)
+	assert.Len(t, reopened.Devices, 7)
+	for i := 0; i < 7; i++ {
+		history, err := reopened.GetDeviceHistory(context.Background(), strconv.Itoa(i))
+		require.NoError(t, err)
+		assert.Len(t, history, 1)
+	}
+}
+
+func TestFileRepoTornTail(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	d := domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"}
+	require.NoError(t, errOf(repo.CreateDevice(context.Background(), d)))
+	require.NoError(t, errOf(repo.CreateDevice(context.Background(), domain.Device{SerialNum: "2", Model: "a", IP: "10.0.0.2"})))
+
+	walPath := filepath.Join(dir, "devices.wal")
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	// Cut the second record in half, as a crash mid-write would.
+	require.NoError(t, os.Truncate(walPath, info.Size()-10))
+
+	reopened, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	want, err := repo.GetDevice(context.Background(), d.SerialNum)
+	require.NoError(t, err)
+	assert.Equal(t, map[repository.Key]domain.Device{key("1"): want}, reopened.Devices)
+	assert.NotZero(t, reopened.Truncated())
+
+	// New writes go after the last good record.
+	require.NoError(t, errOf(reopened.CreateDevice(context.Background(), domain.Device{SerialNum: "3", Model: "a", IP: "10.0.0.3"})))
+	again, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	assert.Len(t, again.Devices, 2)
+	assert.Zero(t, again.Truncated())
+}
+
+func TestFileRepoBadRecordInTheMiddle(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	for _, serial := range []string{"1", "2", "3"} {
+		require.NoError(t, errOf(repo.CreateDevice(context.Background(), domain.Device{SerialNum: serial, Model: "a", IP: "10.0.0." + serial})))
+	}
+
+	walPath := filepath.Join(dir, "devices.wal")
+	b, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	// Flip a byte in the payload of the second record: the third record
+	// after it is whole, so this is not a torn tail.
+	second := 8 + binary.BigEndian.Uint32(b[:4])
+	b[second+8] ^= 0xff
+	require.NoError(t, os.WriteFile(walPath, b, 0o644))
+
+	_, err = repository.NewFile(dir, 0)
+	assert.ErrorContains(t, err, "bad record followed by a whole one")
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(b)), info.Size())
+}
+
+func TestFileRepoFailedAppend(t *testing.T) {
+	ctx := context.Background()
+	device := func(serial string) domain.Device {
+		return domain.Device{SerialNum: serial, Model: "a", IP: "10.0.0." + serial}
+	}
+
+	t.Run("partial write is undone", func(t *testing.T) {
+		dir := t.TempDir()
+		repo, err := repository.NewFile(dir, 0)
+		require.NoError(t, err)
+		require.NoError(t, errOf(repo.CreateDevice(ctx, device("1"))))
+		repository.FailNextWALWrite(repo, 20, nil)
+		assert.ErrorIs(t, errOf(repo.CreateDevice(ctx, device("2"))), domain.ErrUnavailable)
+		require.NoError(t, errOf(repo.CreateDevice(ctx, device("3"))))
+
+		// Both acknowledged records replay; the failed one is gone.
+		reopened, err := repository.NewFile(dir, 0)
+		require.NoError(t, err)
+		assert.Zero(t, reopened.Truncated())
+		assert.Len(t, reopened.Devices, 2)
+		assert.Contains(t, reopened.Devices, key("1"))
+		assert.Contains(t, reopened.Devices, key("3"))
+	})
+
+	t.Run("undo fails", func(t *testing.T) {
+		dir := t.TempDir()
+		repo, err := repository.NewFile(dir, 0)
+		require.NoError(t, err)
+		require.NoError(t, errOf(repo.CreateDevice(ctx, device("1"))))
+		repository.FailNextWALWrite(repo, 20, errors.New("read-only file system"))
+		assert.ErrorIs(t, errOf(repo.CreateDevice(ctx, device("2"))), domain.ErrUnavailable)
+
+		// Nothing may follow the partial record.
+		_, err = repo.CreateDevice(ctx, device("3"))
+		assert.ErrorIs(t, err, domain.ErrUnavailable)
+		assert.ErrorContains(t, err, "wal ends in a partial record")
+		assert.ErrorIs(t, repo.Ping(ctx), domain.ErrUnavailable)
+		assert.Len(t, repo.Devices, 1)
+	})
+}
+
+func TestFileRepoCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, errOf(repo.CreateDevice(context.Background(), domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})))
+
+	// A record with a valid checksum whose payload does not decode was
+	// not torn by a crash; opening must not drop it and what follows.
+	payload := []byte(`{"seq":"two"}`)
+	record := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+	copy(record[8:], payload)
+	wal, err := os.OpenFile(filepath.Join(dir, "devices.wal"), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = wal.Write(record)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	_, err = repository.NewFile(dir, 0)
+	assert.ErrorContains(t, err, "decode wal record")
+}
+
+func TestFileRepoWatchAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := repository.NewFile(dir, 3)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, errOf(repo.CreateDevice(context.Background(), domain.Device{SerialNum: strconv.Itoa(i), IP: "10.0.0.1"})))
+	}
+	require.NoError(t, repo.Close())
+
+	reopened, err := repository.NewFile(dir, 3)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	// Changes from before the restart are not retained for watchers.
+	_, err = reopened.Watch(context.Background(), 2)
+	assert.ErrorIs(t, err, domain.ErrGone)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := reopened.Watch(ctx, 5)
+	require.NoError(t, err)
+	require.NoError(t, errOf(reopened.CreateDevice(ctx, domain.Device{SerialNum: "5", IP: "10.0.0.1"})))
+	assert.Equal(t, uint64(6), receive(t, ch, 1)[0].ResourceVersion)
+}
+
+func TestFileRepoTenants(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	isolateTenants(t, repo)
+
+	// Replaying the WAL restores tenants as well as loading a snapshot.
+	crashed, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	assert.Equal(t, repo.Devices, crashed.Devices)
+	require.NoError(t, crashed.Close())
+
+	reopened, err := repository.NewFile(dir, 0, repository.WithQuotas(quotas))
+	require.NoError(t, err)
+	defer reopened.Close()
+	globex := domain.WithTenant(context.Background(), "globex")
+	d, err := reopened.GetDevice(globex, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "g2", d.Model)
+	history, err := reopened.GetDeviceHistory(domain.WithTenant(context.Background(), "acme"), "1")
+	require.NoError(t, err)
+	assert.Len(t, history, 3)
+	// Live devices are counted again on open.
+	assert.ErrorIs(t, errOf(reopened.CreateDevice(domain.WithTenant(context.Background(), "acme"), domain.Device{SerialNum: "3"})),
+		domain.ErrQuotaExceeded)
+}
+
+func TestFileRepoSnapshotBeforeTenants(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := `{"seq":1,"version":1,"devices":[{"serial_num":"1","model":"a","ip":"10.0.0.1","revision":1}],
+		"history":{"1":[{"resource_version":1,"serial_num":"1","op":"create","revision":1,"at":"2024-01-01T00:00:00Z"}]}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "devices.snapshot"), []byte(snapshot), 0o644))
+
+	repo, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	defer repo.Close()
+	d, err := repo.GetDevice(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, "a", d.Model)
+	_, err = repo.GetDeviceHistory(context.Background(), "1")
+	assert.NoError(t, err)
+	_, err = repo.GetDevice(domain.WithTenant(context.Background(), "acme"), "1")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
+
+func TestFileRepoPing(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := repository.NewFile(dir, 0)
+	require.NoError(t, err)
+	assert.NoError(t, repo.Ping(context.Background()))
+
+	require.NoError(t, os.Rename(filepath.Join(dir, "devices.wal"), filepath.Join(dir, "moved.wal")))
+	assert.ErrorIs(t, repo.Ping(context.Background()), domain.ErrUnavailable)
+	require.NoError(t, repo.Close())
+	assert.ErrorIs(t, repo.Ping(context.Background()), domain.ErrUnavailable)
+}
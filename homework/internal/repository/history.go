@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"homework/internal/domain"
+)
+
+// newEntry builds the history record of a change in the tenant of ctx,
+// attributed to the actor of ctx.
+func newEntry(ctx context.Context, op domain.Operation, before, after *domain.Device) *domain.HistoryEntry {
+	e := &domain.HistoryEntry{
+		Op:     op,
+		Actor:  domain.ActorFrom(ctx),
+		Tenant: domain.TenantFrom(ctx),
+		At:     now(),
+	}
+	if before != nil {
+		b := before.Clone()
+		e.Before = &b
+		e.SerialNum = b.SerialNum
+		e.Revision = b.Revision
+	}
+	if after != nil {
+		a := after.Clone()
+		e.After = &a
+		e.SerialNum = a.SerialNum
+		e.Revision = a.Revision
+		e.At = a.UpdatedAt
+	}
+	return e
+}
+
+// GetDeviceHistory returns every recorded change of serialNum, oldest first,
+// including changes made before the device was deleted.
+func (r *Repo) GetDeviceHistory(ctx context.Context, serialNum string) ([]domain.HistoryEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries, ok := r.history[keyOf(ctx, serialNum)]
+	if !ok {
+		return nil, fmt.Errorf("%w: no history", domain.ErrNotFound)
+	}
+	out := make([]domain.HistoryEntry, len(entries))
+	for i, e := range entries {
+		if e.Before != nil {
+			b := e.Before.Clone()
+			e.Before = &b
+		}
+		if e.After != nil {
+			a := e.After.Clone()
+			e.After = &a
+		}
+		out[i] = e
+	}
+	return out, nil
+}
@@ -0,0 +1,153 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"homework/internal/domain"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// cursor points at the last device of the previous page. It is opaque for
+// clients: base64url-encoded JSON bound to the sort it was issued for.
+type cursor struct {
+	SortBy domain.SortField `json:"f"`
+	Desc   bool             `json:"d,omitempty"`
+	Key    string           `json:"k"`
+	Serial string           `json:"s"`
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string, f domain.DeviceFilter) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", domain.ErrInvalidCursor, err)
+	}
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%w: %v", domain.ErrInvalidCursor, err)
+	}
+	if c.SortBy != f.SortBy || c.Desc != f.Desc {
+		return nil, fmt.Errorf("%w: issued for a different sort order", domain.ErrInvalidCursor)
+	}
+	return &c, nil
+}
+
+func sortKey(d domain.Device, f domain.SortField) string {
+	switch f {
+	case domain.SortByModel:
+		return d.Model
+	case domain.SortByIP:
+		return d.IP
+	default:
+		return d.SerialNum
+	}
+}
+
+func compareKeys(f domain.SortField, a, b string) int {
+	if f == domain.SortByIP {
+		aa, errA := netip.ParseAddr(a)
+		ba, errB := netip.ParseAddr(b)
+		if errA == nil && errB == nil {
+			return aa.Compare(ba)
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// compareDevices orders devices by the requested key and breaks ties by
+// serial number, which is unique, so the order is total and stable across pages.
+func compareDevices(f domain.DeviceFilter, aKey, aSerial, bKey, bSerial string) int {
+	c := compareKeys(f.SortBy, aKey, bKey)
+	if c == 0 {
+		c = strings.Compare(aSerial, bSerial)
+	}
+	if f.Desc {
+		return -c
+	}
+	return c
+}
+
+// paginate filters, sorts and slices devices according to f.
+func paginate(devices []domain.Device, f domain.DeviceFilter) (domain.DevicePage, error) {
+	if f.SortBy == "" {
+		f.SortBy = domain.SortBySerialNum
+	}
+	after, err := decodeCursor(f.Cursor, f)
+	if err != nil {
+		return domain.DevicePage{}, err
+	}
+
+	matched := make([]domain.Device, 0, len(devices))
+	for _, d := range devices {
+		if !f.Match(d) {
+			continue
+		}
+		if after != nil && compareDevices(f, sortKey(d, f.SortBy), d.SerialNum, after.Key, after.Serial) <= 0 {
+			continue
+		}
+		matched = append(matched, d)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		return compareDevices(f, sortKey(a, f.SortBy), a.SerialNum, sortKey(b, f.SortBy), b.SerialNum) < 0
+	})
+	return pageOf(matched, f), nil
+}
+
+// pageOf cuts devices, sorted and past the cursor of f, to f.Limit and
+// points the next cursor at the last one kept.
+func pageOf(devices []domain.Device, f domain.DeviceFilter) domain.DevicePage {
+	page := domain.DevicePage{Devices: devices}
+	if f.Limit > 0 && len(devices) > f.Limit {
+		page.Devices = devices[:f.Limit]
+		last := page.Devices[f.Limit-1]
+		page.NextCursor = encodeCursor(cursor{
+			SortBy: f.SortBy,
+			Desc:   f.Desc,
+			Key:    sortKey(last, f.SortBy),
+			Serial: last.SerialNum,
+		})
+	}
+	return page
+}
+
+func (r *Repo) ListDevices(ctx context.Context, f domain.DeviceFilter) (domain.DevicePage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tenant := domain.TenantFrom(ctx)
+	var devices []domain.Device
+	for k, d := range r.Devices {
+		if k.Tenant == tenant {
+			devices = append(devices, d.Clone())
+		}
+	}
+	page, err := paginate(devices, f)
+	if err != nil {
+		return domain.DevicePage{}, err
+	}
+	page.ResourceVersion = r.version
+	return page, nil
+}
+
+// CountByModel returns how many devices there are of each model, across all
+// tenants. Deleted devices do not count.
+func (r *Repo) CountByModel(context.Context) (map[string]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	counts := make(map[string]int)
+	for _, d := range r.Devices {
+		counts[d.Model]++
+	}
+	return counts, nil
+}
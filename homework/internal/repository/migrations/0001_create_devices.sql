@@ -0,0 +1,8 @@
+CREATE TABLE devices (
+    serial_num TEXT NOT NULL PRIMARY KEY,
+    model      TEXT NOT NULL,
+    ip         TEXT NOT NULL
+);
+
+CREATE INDEX devices_model_idx ON devices (model);
+CREATE INDEX devices_ip_idx ON devices (ip);
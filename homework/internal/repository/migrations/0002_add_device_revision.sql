@@ -0,0 +1 @@
+ALTER TABLE devices ADD COLUMN revision INTEGER NOT NULL DEFAULT 1;
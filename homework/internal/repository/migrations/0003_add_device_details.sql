@@ -0,0 +1,9 @@
+ALTER TABLE devices ADD COLUMN firmware_version TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN mac TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN hostname TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN site TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN location TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN labels TEXT NOT NULL DEFAULT '{}';
+ALTER TABLE devices ADD COLUMN status TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN created_at TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN updated_at TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE devices ADD COLUMN transitions TEXT NOT NULL DEFAULT '[]';
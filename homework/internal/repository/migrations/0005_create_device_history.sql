@@ -0,0 +1,12 @@
+CREATE TABLE device_history (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    serial_num TEXT    NOT NULL,
+    op         TEXT    NOT NULL,
+    revision   INTEGER NOT NULL,
+    actor      TEXT    NOT NULL DEFAULT '',
+    at         TEXT    NOT NULL,
+    before     TEXT,
+    after      TEXT
+);
+
+CREATE INDEX device_history_serial_num_idx ON device_history (serial_num, id);
@@ -0,0 +1,3 @@
+ALTER TABLE devices ADD COLUMN deleted_at TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX devices_deleted_at_idx ON devices (deleted_at);
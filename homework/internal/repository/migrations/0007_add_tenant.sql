@@ -0,0 +1,40 @@
+-- Serial numbers are unique per tenant only. SQLite cannot change a primary
+-- key in place, so the devices table is rebuilt; existing rows belong to the
+-- default tenant.
+CREATE TABLE devices_new (
+    tenant           TEXT    NOT NULL DEFAULT 'default',
+    serial_num       TEXT    NOT NULL,
+    model            TEXT    NOT NULL,
+    ip               TEXT    NOT NULL,
+    revision         INTEGER NOT NULL DEFAULT 1,
+    firmware_version TEXT    NOT NULL DEFAULT '',
+    mac              TEXT    NOT NULL DEFAULT '',
+    hostname         TEXT    NOT NULL DEFAULT '',
+    site             TEXT    NOT NULL DEFAULT '',
+    location         TEXT    NOT NULL DEFAULT '',
+    labels           TEXT    NOT NULL DEFAULT '{}',
+    status           TEXT    NOT NULL DEFAULT '',
+    created_at       TEXT    NOT NULL DEFAULT '',
+    updated_at       TEXT    NOT NULL DEFAULT '',
+    transitions      TEXT    NOT NULL DEFAULT '[]',
+    deleted_at       TEXT    NOT NULL DEFAULT '',
+    PRIMARY KEY (tenant, serial_num)
+);
+
+INSERT INTO devices_new (serial_num, model, ip, revision, firmware_version, mac, hostname, site, location,
+                         labels, status, created_at, updated_at, transitions, deleted_at)
+SELECT serial_num, model, ip, revision, firmware_version, mac, hostname, site, location,
+       labels, status, created_at, updated_at, transitions, deleted_at
+FROM devices;
+
+DROP TABLE devices;
+ALTER TABLE devices_new RENAME TO devices;
+
+CREATE INDEX devices_model_idx ON devices (tenant, model);
+CREATE INDEX devices_ip_idx ON devices (tenant, ip);
+CREATE INDEX devices_deleted_at_idx ON devices (tenant, deleted_at);
+
+ALTER TABLE device_history ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+
+DROP INDEX device_history_serial_num_idx;
+CREATE INDEX device_history_serial_num_idx ON device_history (tenant, serial_num, id);
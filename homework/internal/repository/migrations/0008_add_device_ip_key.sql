@@ -0,0 +1,8 @@
+-- ip_key sorts addresses by value, which their text does not; existing rows
+-- are filled in by fillIPKeys. The sort indexes end in serial_num, the
+-- tie-breaker of every listing, so pages are read straight off them.
+ALTER TABLE devices ADD COLUMN ip_key TEXT NOT NULL DEFAULT '';
+
+DROP INDEX devices_model_idx;
+CREATE INDEX devices_model_idx ON devices (tenant, model, serial_num);
+CREATE INDEX devices_ip_key_idx ON devices (tenant, ip_key, serial_num);
@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"fmt"
+	"homework/internal/domain"
+)
+
+// Quotas limit how many devices a tenant may have. Only live devices count;
+// a device in the trash does not, but restoring it needs room again.
+type Quotas struct {
+	// Default applies to tenants missing from Tenants. 0 means no limit,
+	// here and in Tenants.
+	Default int
+	Tenants map[string]int
+}
+
+// Limit returns the most devices tenant may have, or 0 for no limit.
+func (q Quotas) Limit(tenant string) int {
+	if limit, ok := q.Tenants[tenant]; ok {
+		return limit
+	}
+	return q.Default
+}
+
+// checkQuota returns domain.ErrQuotaExceeded if tenant, which has live
+// devices, may not have another.
+func checkQuota(q Quotas, tenant string, live int) error {
+	if limit := q.Limit(tenant); limit > 0 && live >= limit {
+		return fmt.Errorf("%w: tenant %s may have at most %d devices", domain.ErrQuotaExceeded, tenant, limit)
+	}
+	return nil
+}
@@ -1,23 +1,182 @@
 package repository
 
 import (
+	"context"
 	"homework/internal/domain"
+	"homework/internal/events"
 	"sync"
+	"time"
 )
 
+// Key identifies a device. Serial numbers are only unique within a tenant,
+// so every map of the in-memory repository is keyed by both.
+type Key struct {
+	Tenant    string
+	SerialNum string
+}
+
+// keyOf returns the key of serialNum in the tenant of ctx.
+func keyOf(ctx context.Context, serialNum string) Key {
+	return Key{Tenant: domain.TenantFrom(ctx), SerialNum: serialNum}
+}
+
 type Repo struct {
-	Devices map[string]domain.Device
-	mu      sync.RWMutex
+	Devices map[Key]domain.Device
+	// trash holds deleted devices until they are restored or purged.
+	trash map[Key]domain.Device
+	// history is the append-only change log of every serial number, oldest
+	// first. It outlives deleted devices.
+	history map[Key][]domain.HistoryEntry
+	// live counts the devices in Devices by tenant, for quotas.
+	live   map[string]int
+	quotas Quotas
+	mu     sync.RWMutex
+	// journal, when set, durably records every change before it is applied
+	// to Devices. It is called with mu held for writing.
+	journal journal
+	// version is the resource version of the last change.
+	version uint64
+	feed    *events.Broadcaster
 }
+
+// Device is a device repository. Every method works on the devices of the
+// tenant of ctx (see domain.WithTenant) and never sees another tenant's,
+// except PurgeTrash, which empties the trash of every tenant. The methods
+// that write a device return it as stored by that write.
 type Device interface {
-	GetDevice(string) (domain.Device, error)
-	CreateDevice(d domain.Device) error
-	DeleteDevice(string) error
-	UpdateDevice(domain.Device) error
+	GetDevice(ctx context.Context, serialNum string) (domain.Device, error)
+	CreateDevice(ctx context.Context, d domain.Device) (domain.Device, error)
+	DeleteDevice(ctx context.Context, serialNum string, revision uint64) error
+	UpdateDevice(ctx context.Context, d domain.Device) (domain.Device, error)
+	ListDevices(ctx context.Context, f domain.DeviceFilter) (domain.DevicePage, error)
+	GetDeviceHistory(ctx context.Context, serialNum string) ([]domain.HistoryEntry, error)
+	ListTrash(ctx context.Context) ([]domain.Device, error)
+	RestoreDevice(ctx context.Context, serialNum string) (domain.Device, error)
+	PurgeTrash(ctx context.Context, deletedBefore time.Time) (int, error)
+	Watch(ctx context.Context, fromVersion uint64) (<-chan domain.HistoryEntry, error)
+	BatchDevices(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error)
 }
 
-func New() *Repo {
+type options struct {
+	quotas Quotas
+}
+
+type Option func(*options)
+
+// WithQuotas limits how many devices each tenant may have.
+func WithQuotas(q Quotas) Option {
+	return func(o *options) {
+		o.quotas = q
+	}
+}
+
+func New(opts ...Option) *Repo {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r := newState()
+	r.quotas = o.quotas
+	r.feed = events.NewBroadcaster(events.DefaultReplay, 0)
+	return r
+}
+
+func newState() *Repo {
 	return &Repo{
-		Devices: make(map[string]domain.Device),
+		Devices: make(map[Key]domain.Device),
+		trash:   make(map[Key]domain.Device),
+		history: make(map[Key][]domain.HistoryEntry),
+		live:    make(map[string]int),
+	}
+}
+
+// change is a single state transition of the repository: a device is
+// stored (Device != nil), moved to the trash (Trashed != nil) or removed for
+// good by serial number, all in Tenant. Entry is the history record of the
+// change.
+type change struct {
+	// Tenant is empty in changes logged before tenants existed, which
+	// belong to domain.DefaultTenant.
+	Tenant    string               `json:"tenant,omitempty"`
+	Device    *domain.Device       `json:"device,omitempty"`
+	Trashed   *domain.Device       `json:"trashed,omitempty"`
+	SerialNum string               `json:"serial_num,omitempty"`
+	Entry     *domain.HistoryEntry `json:"entry,omitempty"`
+}
+
+func (c change) key() Key {
+	k := Key{Tenant: c.Tenant, SerialNum: c.SerialNum}
+	if k.Tenant == "" {
+		k.Tenant = domain.DefaultTenant
+	}
+	switch {
+	case c.Device != nil:
+		k.SerialNum = c.Device.SerialNum
+	case c.Trashed != nil:
+		k.SerialNum = c.Trashed.SerialNum
+	}
+	return k
+}
+
+type journal interface {
+	append(changes []change) error
+}
+
+// apply assigns resource versions to changes, records them in the journal,
+// applies them to the map and publishes them to watchers. Callers must hold
+// r.mu for writing.
+func (r *Repo) apply(changes ...change) error {
+	version := r.version
+	for _, c := range changes {
+		if c.Entry != nil {
+			version++
+			c.Entry.ResourceVersion = version
+		}
+	}
+	if r.journal != nil {
+		if err := r.journal.append(changes); err != nil {
+			return err
+		}
+	}
+	for _, c := range changes {
+		r.applyLocked(c)
+	}
+	for _, c := range changes {
+		if c.Entry != nil {
+			r.feed.Notify(*c.Entry)
+		}
+	}
+	return nil
+}
+
+func (r *Repo) applyLocked(c change) {
+	k := c.key()
+	if c.Entry != nil {
+		if c.Entry.ResourceVersion == 0 {
+			// Written before changes were versioned.
+			c.Entry.ResourceVersion = r.version + 1
+		}
+		r.version = c.Entry.ResourceVersion
+		c.Entry.Tenant = k.Tenant
+		r.history[k] = append(r.history[k], *c.Entry)
+	}
+	_, wasLive := r.Devices[k]
+	switch {
+	case c.Device != nil:
+		delete(r.trash, k)
+		r.Devices[k] = c.Device.Clone()
+		if !wasLive {
+			r.live[k.Tenant]++
+		}
+		return
+	case c.Trashed != nil:
+		delete(r.Devices, k)
+		r.trash[k] = c.Trashed.Clone()
+	default:
+		delete(r.Devices, k)
+		delete(r.trash, k)
+	}
+	if wasLive {
+		r.live[k.Tenant]--
 	}
 }
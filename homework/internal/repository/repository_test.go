@@ -1,12 +1,17 @@
 package repository_test
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"homework/internal/domain"
+	"homework/internal/events"
 	"homework/internal/repository"
+	"net/netip"
 	"strconv"
 	"testing"
+	"time"
 )
 
 type RepoSuite struct {
@@ -14,6 +19,346 @@ type RepoSuite struct {
 	repo *repository.Repo
 }
 
+// key is the key of serialNum in the default tenant, where requests without
+// a tenant go.
+func key(serialNum string) repository.Key {
+	return repository.Key{Tenant: domain.DefaultTenant, SerialNum: serialNum}
+}
+
+// withoutTimestamps zeroes the repository-managed timestamps so devices can
+// be compared.
+func withoutTimestamps(devices ...domain.Device) []domain.Device {
+	out := make([]domain.Device, 0, len(devices))
+	for _, d := range devices {
+		d.CreatedAt = time.Time{}
+		d.UpdatedAt = time.Time{}
+		out = append(out, d)
+	}
+	return out
+}
+
+// errOf drops the device a write returns, so that its error can be checked
+// in place.
+func errOf(_ domain.Device, err error) error {
+	return err
+}
+
+// receive reads n changes from a watch channel, failing the test if they do
+// not arrive in time.
+func receive(t *testing.T, ch <-chan domain.HistoryEntry, n int) []domain.HistoryEntry {
+	t.Helper()
+	var out []domain.HistoryEntry
+	for len(out) < n {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				t.Fatalf("watch closed after %d of %d changes", len(out), n)
+			}
+			out = append(out, e)
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d changes", len(out), n)
+		}
+	}
+	return out
+}
+
+// watchDevices exercises Watch on any repository.
+func watchDevices(t *testing.T, repo repository.Device) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := repo.Watch(ctx, 0)
+	require.NoError(t, err)
+
+	device := domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"}
+	require.NoError(t, errOf(repo.CreateDevice(ctx, device)))
+	require.NoError(t, errOf(repo.UpdateDevice(ctx, device)))
+	require.Error(t, errOf(repo.UpdateDevice(ctx, domain.Device{SerialNum: "2"})))
+	require.NoError(t, repo.DeleteDevice(ctx, "1", 0))
+	require.NoError(t, errOf(repo.RestoreDevice(ctx, "1")))
+
+	changes := receive(t, ch, 4)
+	var ops []domain.Operation
+	for i, e := range changes {
+		ops = append(ops, e.Op)
+		if i > 0 {
+			assert.Greater(t, e.ResourceVersion, changes[i-1].ResourceVersion)
+		}
+	}
+	assert.Equal(t, []domain.Operation{domain.OpCreate, domain.OpUpdate, domain.OpDelete, domain.OpRestore}, ops)
+
+	// History carries the same versions the watch delivered.
+	history, err := repo.GetDeviceHistory(ctx, "1")
+	require.NoError(t, err)
+	require.Len(t, history, 4)
+	for i := range history {
+		assert.Equal(t, changes[i].ResourceVersion, history[i].ResourceVersion)
+	}
+
+	// Resuming replays everything after the given version.
+	resumed, err := repo.Watch(ctx, changes[1].ResourceVersion)
+	require.NoError(t, err)
+	assert.Equal(t, changes[2:], receive(t, resumed, 2))
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("watch not closed after cancel")
+	}
+}
+
+// watchFromList exercises watching from the resource version of a list on
+// any repository.
+func watchFromList(t *testing.T, repo repository.Device) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	page, err := repo.ListDevices(ctx, domain.DeviceFilter{})
+	require.NoError(t, err)
+	assert.Zero(t, page.ResourceVersion)
+
+	require.NoError(t, errOf(repo.CreateDevice(ctx, domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})))
+	require.NoError(t, errOf(repo.CreateDevice(ctx, domain.Device{SerialNum: "2", Model: "a", IP: "10.0.0.2"})))
+	page, err = repo.ListDevices(ctx, domain.DeviceFilter{Limit: 1})
+	require.NoError(t, err)
+	history, err := repo.GetDeviceHistory(ctx, "2")
+	require.NoError(t, err)
+	assert.Equal(t, history[len(history)-1].ResourceVersion, page.ResourceVersion)
+
+	// Changes between the list and the watch are not lost.
+	require.NoError(t, errOf(repo.CreateDevice(ctx, domain.Device{SerialNum: "3", Model: "a", IP: "10.0.0.3"})))
+	require.NoError(t, repo.DeleteDevice(ctx, "1", 0))
+	ch, err := repo.Watch(ctx, page.ResourceVersion)
+	require.NoError(t, err)
+	changes := receive(t, ch, 2)
+	assert.Equal(t, "3", changes[0].SerialNum)
+	assert.Equal(t, domain.OpCreate, changes[0].Op)
+	assert.Equal(t, "1", changes[1].SerialNum)
+	assert.Equal(t, domain.OpDelete, changes[1].Op)
+}
+
+// batchDevices exercises BatchDevices on any repository.
+func batchDevices(t *testing.T, repo repository.Device) {
+	ctx := context.Background()
+	d1 := domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"}
+	d2 := domain.Device{SerialNum: "2", Model: "a", IP: "10.0.0.2"}
+
+	results, err := repo.BatchDevices(ctx, []domain.BatchOperation{
+		{Op: domain.OpCreate, Device: d1},
+		{Op: domain.OpCreate, Device: d2},
+		{Op: domain.OpCreate, Device: d1},
+		{Op: domain.OpUpdate, Device: domain.Device{SerialNum: "1", Model: "b", IP: "10.0.0.1"}, Revision: 1},
+		{Op: domain.OpDelete, SerialNum: "2"},
+		{Op: domain.OpDelete, SerialNum: "3"},
+	}, false)
+	require.NoError(t, err)
+	require.Len(t, results, 6)
+	assert.NoError(t, results[0].Err)
+	assert.NoError(t, results[1].Err)
+	assert.ErrorIs(t, results[2].Err, domain.ErrAlreadyExists)
+	if assert.NoError(t, results[3].Err) {
+		assert.Equal(t, "b", results[3].Device.Model)
+		assert.Equal(t, uint64(2), results[3].Device.Revision)
+	}
+	assert.NoError(t, results[4].Err)
+	assert.Nil(t, results[4].Device)
+	assert.ErrorIs(t, results[5].Err, domain.ErrNotFound)
+
+	history, err := repo.GetDeviceHistory(ctx, "1")
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+
+	// An atomic batch sees its own changes.
+	d5 := domain.Device{SerialNum: "5", IP: "10.0.0.5"}
+	results, err = repo.BatchDevices(ctx, []domain.BatchOperation{
+		{Op: domain.OpCreate, Device: d5},
+		{Op: domain.OpUpdate, Device: d5, Revision: 1},
+		{Op: domain.OpDelete, SerialNum: "5", Revision: 2},
+	}, true)
+	require.NoError(t, err)
+	for _, r := range results {
+		assert.NoError(t, r.Err)
+	}
+	history, err = repo.GetDeviceHistory(ctx, "5")
+	require.NoError(t, err)
+	assert.Len(t, history, 3)
+
+	// The first failure of an atomic batch leaves everything as it was.
+	results, err = repo.BatchDevices(ctx, []domain.BatchOperation{
+		{Op: domain.OpCreate, Device: domain.Device{SerialNum: "4", IP: "10.0.0.4"}},
+		{Op: domain.OpCreate, Device: d2},
+		{Op: domain.OpDelete, SerialNum: "1"},
+	}, true)
+	require.NoError(t, err)
+	assert.ErrorIs(t, results[0].Err, domain.ErrAborted)
+	assert.ErrorIs(t, results[1].Err, domain.ErrAlreadyExists)
+	assert.ErrorIs(t, results[2].Err, domain.ErrAborted)
+	_, err = repo.GetDevice(ctx, "4")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+	_, err = repo.GetDevice(ctx, "1")
+	assert.NoError(t, err)
+	history, err = repo.GetDeviceHistory(ctx, "1")
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+// isolateTenants checks that no method of any repository reaches into
+// another tenant, even for the same serial number.
+func isolateTenants(t *testing.T, repo repository.Device) {
+	acme := domain.WithTenant(context.Background(), "acme")
+	globex := domain.WithTenant(context.Background(), "globex")
+	watchCtx, cancel := context.WithCancel(globex)
+	defer cancel()
+	ch, err := repo.Watch(watchCtx, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, errOf(repo.CreateDevice(acme, domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})))
+	require.NoError(t, errOf(repo.CreateDevice(globex, domain.Device{SerialNum: "1", Model: "g", IP: "10.0.0.1"})))
+	require.NoError(t, errOf(repo.CreateDevice(acme, domain.Device{SerialNum: "2", Model: "a", IP: "10.0.0.2"})))
+
+	t.Run("Read", func(t *testing.T) {
+		d, err := repo.GetDevice(globex, "1")
+		require.NoError(t, err)
+		assert.Equal(t, "g", d.Model)
+		_, err = repo.GetDevice(globex, "2")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		_, err = repo.GetDevice(context.Background(), "1")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+
+		page, err := repo.ListDevices(globex, domain.DeviceFilter{})
+		require.NoError(t, err)
+		if assert.Len(t, page.Devices, 1) {
+			assert.Equal(t, "g", page.Devices[0].Model)
+		}
+		page, err = repo.ListDevices(acme, domain.DeviceFilter{Model: "g"})
+		require.NoError(t, err)
+		assert.Empty(t, page.Devices)
+
+		history, err := repo.GetDeviceHistory(globex, "1")
+		require.NoError(t, err)
+		if assert.Len(t, history, 1) {
+			assert.Equal(t, "g", history[0].After.Model)
+		}
+		_, err = repo.GetDeviceHistory(globex, "2")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		_, err := repo.UpdateDevice(globex, domain.Device{SerialNum: "2", Model: "g", IP: "10.0.0.2"})
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		assert.ErrorIs(t, repo.DeleteDevice(globex, "2", 0), domain.ErrNotFound)
+		results, err := repo.BatchDevices(globex, []domain.BatchOperation{
+			{Op: domain.OpUpdate, Device: domain.Device{SerialNum: "2", IP: "10.0.0.2"}},
+			{Op: domain.OpDelete, SerialNum: "2"},
+		}, false)
+		require.NoError(t, err)
+		for _, r := range results {
+			assert.ErrorIs(t, r.Err, domain.ErrNotFound)
+		}
+		d, err := repo.GetDevice(acme, "2")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), d.Revision)
+	})
+
+	t.Run("Trash", func(t *testing.T) {
+		require.NoError(t, repo.DeleteDevice(acme, "1", 0))
+		_, err := repo.GetDevice(globex, "1")
+		assert.NoError(t, err)
+		trash, err := repo.ListTrash(globex)
+		require.NoError(t, err)
+		assert.Empty(t, trash)
+		assert.ErrorIs(t, errOf(repo.RestoreDevice(globex, "1")), domain.ErrNotFound)
+		trash, err = repo.ListTrash(acme)
+		require.NoError(t, err)
+		assert.Len(t, trash, 1)
+
+		// Purging is housekeeping across every tenant.
+		n, err := repo.PurgeTrash(context.Background(), time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		trash, err = repo.ListTrash(acme)
+		require.NoError(t, err)
+		assert.Empty(t, trash)
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		d := domain.Device{SerialNum: "1", Model: "g2", IP: "10.0.0.1"}
+		require.NoError(t, errOf(repo.UpdateDevice(globex, d)))
+		changes := receive(t, ch, 2)
+		assert.Equal(t, domain.OpCreate, changes[0].Op)
+		assert.Equal(t, domain.OpUpdate, changes[1].Op)
+		for _, e := range changes {
+			assert.Equal(t, "globex", e.Tenant)
+		}
+	})
+}
+
+// enforceQuotas checks a repository created with a quota of one device for
+// acme and two for everyone else.
+func enforceQuotas(t *testing.T, repo repository.Device) {
+	acme := domain.WithTenant(context.Background(), "acme")
+	globex := domain.WithTenant(context.Background(), "globex")
+	device := func(serialNum string) domain.Device {
+		return domain.Device{SerialNum: serialNum, IP: "10.0.0.1"}
+	}
+
+	require.NoError(t, errOf(repo.CreateDevice(acme, device("1"))))
+	assert.ErrorIs(t, errOf(repo.CreateDevice(acme, device("2"))), domain.ErrQuotaExceeded)
+	require.NoError(t, errOf(repo.CreateDevice(globex, device("1"))))
+	require.NoError(t, errOf(repo.CreateDevice(globex, device("2"))))
+	_, err := repo.CreateDevice(globex, device("3"))
+	assert.EqualError(t, err, "quota exceeded: tenant globex may have at most 2 devices")
+
+	// The trash does not count, but a restore has to fit again.
+	require.NoError(t, repo.DeleteDevice(acme, "1", 0))
+	require.NoError(t, errOf(repo.CreateDevice(acme, device("2"))))
+	assert.ErrorIs(t, errOf(repo.RestoreDevice(acme, "1")), domain.ErrQuotaExceeded)
+
+	// Batches count the devices they create and delete themselves.
+	results, err := repo.BatchDevices(globex, []domain.BatchOperation{
+		{Op: domain.OpDelete, SerialNum: "1"},
+		{Op: domain.OpCreate, Device: device("3")},
+		{Op: domain.OpCreate, Device: device("4")},
+	}, true)
+	require.NoError(t, err)
+	assert.ErrorIs(t, results[0].Err, domain.ErrAborted)
+	assert.ErrorIs(t, results[2].Err, domain.ErrQuotaExceeded)
+	results, err = repo.BatchDevices(globex, []domain.BatchOperation{
+		{Op: domain.OpDelete, SerialNum: "1"},
+		{Op: domain.OpCreate, Device: device("3")},
+		{Op: domain.OpCreate, Device: device("4")},
+	}, false)
+	require.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	assert.NoError(t, results[1].Err)
+	assert.ErrorIs(t, results[2].Err, domain.ErrQuotaExceeded)
+}
+
+// modelCounter is implemented by the repositories that back the devices
+// per model metric.
+type modelCounter interface {
+	repository.Device
+	CountByModel(ctx context.Context) (map[string]int, error)
+}
+
+// countByModel checks that devices of every tenant count, and deleted ones
+// do not.
+func countByModel(t *testing.T, repo modelCounter) {
+	acme := domain.WithTenant(context.Background(), "acme")
+	globex := domain.WithTenant(context.Background(), "globex")
+	require.NoError(t, errOf(repo.CreateDevice(acme, domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})))
+	require.NoError(t, errOf(repo.CreateDevice(acme, domain.Device{SerialNum: "2", Model: "b", IP: "10.0.0.2"})))
+	require.NoError(t, errOf(repo.CreateDevice(globex, domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})))
+	require.NoError(t, errOf(repo.CreateDevice(globex, domain.Device{SerialNum: "3", Model: "c", IP: "10.0.0.3"})))
+	require.NoError(t, repo.DeleteDevice(globex, "3", 0))
+
+	counts, err := repo.CountByModel(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, counts)
+}
+
+var quotas = repository.Quotas{Default: 2, Tenants: map[string]int{"acme": 1}}
+
 func (suite *RepoSuite) SetupTest() {
 	suite.repo = repository.New()
 }
@@ -29,16 +374,16 @@ func (suite *RepoSuite) TestGetDevice() {
 		Model:     "test_model",
 		IP:        "0.0.0.0",
 	}
-	suite.repo.Devices[serialNum] = device
+	suite.repo.Devices[key(serialNum)] = device
 
 	suite.Run("Existing Device", func() {
-		d, err := suite.repo.GetDevice(serialNum)
+		d, err := suite.repo.GetDevice(context.Background(), serialNum)
 		assert.NoError(suite.T(), err)
 		assert.Equal(suite.T(), device, d)
 	})
 
 	suite.Run("Unexisting Device", func() {
-		_, err := suite.repo.GetDevice("unexisting_serial")
+		_, err := suite.repo.GetDevice(context.Background(), "unexisting_serial")
 		assert.Error(suite.T(), err)
 		assert.EqualError(suite.T(), err, "not found: no device")
 	})
@@ -53,15 +398,21 @@ func (suite *RepoSuite) TestCreateDevice() {
 	}
 
 	suite.Run("New Device", func() {
-		err := suite.repo.CreateDevice(device)
+		got, err := suite.repo.CreateDevice(context.Background(), device)
 		assert.NoError(suite.T(), err)
-		assert.Equal(suite.T(), device, suite.repo.Devices[serialNum])
+		created := device
+		created.Revision = 1
+		stored := suite.repo.Devices[key(serialNum)]
+		assert.Equal(suite.T(), withoutTimestamps(created), withoutTimestamps(stored))
+		assert.Equal(suite.T(), stored, got)
+		assert.False(suite.T(), stored.CreatedAt.IsZero())
+		assert.Equal(suite.T(), stored.CreatedAt, stored.UpdatedAt)
 	})
 
 	suite.Run("Existing Device", func() {
-		err := suite.repo.CreateDevice(device)
+		_, err := suite.repo.CreateDevice(context.Background(), device)
 		assert.Error(suite.T(), err)
-		assert.EqualError(suite.T(), err, "device is already in repository")
+		assert.EqualError(suite.T(), err, "already exists: device is already in repository")
 	})
 }
 
@@ -72,17 +423,17 @@ func (suite *RepoSuite) TestDeleteDevice() {
 		Model:     "test_model",
 		IP:        "0.0.0.0",
 	}
-	suite.repo.Devices[serialNum] = device
+	suite.repo.Devices[key(serialNum)] = device
 
 	suite.Run("Existing Device", func() {
-		err := suite.repo.DeleteDevice(serialNum)
+		err := suite.repo.DeleteDevice(context.Background(), serialNum, 0)
 		assert.NoError(suite.T(), err)
-		_, ok := suite.repo.Devices[serialNum]
+		_, ok := suite.repo.Devices[key(serialNum)]
 		assert.False(suite.T(), ok)
 	})
 
 	suite.Run("Unexisting Device", func() {
-		err := suite.repo.DeleteDevice("unexisting_serial")
+		err := suite.repo.DeleteDevice(context.Background(), "unexisting_serial", 0)
 		assert.Error(suite.T(), err)
 		assert.EqualError(suite.T(), err, "not found: no device")
 	})
@@ -95,7 +446,7 @@ func (suite *RepoSuite) TestUpdateDevice() {
 		Model:     "test_model",
 		IP:        "0.0.0.0",
 	}
-	suite.repo.Devices[serialNum] = device
+	suite.repo.Devices[key(serialNum)] = device
 
 	suite.Run("Existing Device", func() {
 		updatedDevice := domain.Device{
@@ -103,9 +454,13 @@ func (suite *RepoSuite) TestUpdateDevice() {
 			Model:     "updated_model",
 			IP:        "updated_ip",
 		}
-		err := suite.repo.UpdateDevice(updatedDevice)
+		got, err := suite.repo.UpdateDevice(context.Background(), updatedDevice)
 		assert.NoError(suite.T(), err)
-		assert.Equal(suite.T(), updatedDevice, suite.repo.Devices[serialNum])
+		updatedDevice.Revision = 1
+		stored := suite.repo.Devices[key(serialNum)]
+		assert.Equal(suite.T(), withoutTimestamps(updatedDevice), withoutTimestamps(stored))
+		assert.Equal(suite.T(), stored, got)
+		assert.False(suite.T(), stored.UpdatedAt.IsZero())
 	})
 
 	suite.Run("Unexisting Device", func() {
@@ -114,12 +469,234 @@ func (suite *RepoSuite) TestUpdateDevice() {
 			Model:     "test_model",
 			IP:        "0.0.0.0",
 		}
-		err := suite.repo.UpdateDevice(nonExistingDevice)
+		_, err := suite.repo.UpdateDevice(context.Background(), nonExistingDevice)
 		assert.Error(suite.T(), err)
 		assert.EqualError(suite.T(), err, "not found: no device")
 	})
 }
 
+func (suite *RepoSuite) TestRevisions() {
+	device := domain.Device{SerialNum: "1", Model: "test_model", IP: "0.0.0.0"}
+	suite.Require().NoError(errOf(suite.repo.CreateDevice(context.Background(), device)))
+
+	suite.Run("Update With Current Revision", func() {
+		device.Revision = 1
+		assert.NoError(suite.T(), errOf(suite.repo.UpdateDevice(context.Background(), device)))
+		assert.Equal(suite.T(), uint64(2), suite.repo.Devices[key("1")].Revision)
+	})
+
+	suite.Run("Update With Stale Revision", func() {
+		device.Revision = 1
+		_, err := suite.repo.UpdateDevice(context.Background(), device)
+		assert.ErrorIs(suite.T(), err, domain.ErrPreconditionFailed)
+		assert.Equal(suite.T(), uint64(2), suite.repo.Devices[key("1")].Revision)
+	})
+
+	suite.Run("Delete With Stale Revision", func() {
+		err := suite.repo.DeleteDevice(context.Background(), "1", 1)
+		assert.ErrorIs(suite.T(), err, domain.ErrPreconditionFailed)
+		assert.Contains(suite.T(), suite.repo.Devices, key("1"))
+	})
+
+	suite.Run("Delete With Current Revision", func() {
+		assert.NoError(suite.T(), suite.repo.DeleteDevice(context.Background(), "1", 2))
+		assert.NotContains(suite.T(), suite.repo.Devices, key("1"))
+	})
+}
+
+func (suite *RepoSuite) TestHistory() {
+	ctx := domain.WithActor(context.Background(), "alice")
+	device := domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"}
+	suite.Require().NoError(errOf(suite.repo.CreateDevice(ctx, device)))
+	device.IP = "10.0.0.2"
+	suite.Require().NoError(errOf(suite.repo.UpdateDevice(context.Background(), device)))
+	suite.Require().NoError(suite.repo.DeleteDevice(ctx, "1", 0))
+
+	entries, err := suite.repo.GetDeviceHistory(context.Background(), "1")
+	suite.Require().NoError(err)
+	suite.Require().Len(entries, 3)
+
+	assert.Equal(suite.T(), domain.OpCreate, entries[0].Op)
+	assert.Equal(suite.T(), "alice", entries[0].Actor)
+	assert.Nil(suite.T(), entries[0].Before)
+	assert.Equal(suite.T(), "10.0.0.1", entries[0].After.IP)
+
+	assert.Equal(suite.T(), domain.OpUpdate, entries[1].Op)
+	assert.Empty(suite.T(), entries[1].Actor)
+	assert.Equal(suite.T(), uint64(2), entries[1].Revision)
+	assert.Equal(suite.T(), "10.0.0.1", entries[1].Before.IP)
+	assert.Equal(suite.T(), "10.0.0.2", entries[1].After.IP)
+	assert.Equal(suite.T(), entries[1].After.UpdatedAt, entries[1].At)
+
+	assert.Equal(suite.T(), domain.OpDelete, entries[2].Op)
+	assert.Equal(suite.T(), uint64(2), entries[2].Revision)
+	assert.Equal(suite.T(), "10.0.0.2", entries[2].Before.IP)
+	assert.Nil(suite.T(), entries[2].After)
+
+	// A failed write leaves no trace.
+	_, err = suite.repo.UpdateDevice(ctx, device)
+	assert.ErrorIs(suite.T(), err, domain.ErrNotFound)
+	entries, _ = suite.repo.GetDeviceHistory(context.Background(), "1")
+	assert.Len(suite.T(), entries, 3)
+
+	_, err = suite.repo.GetDeviceHistory(context.Background(), "2")
+	assert.ErrorIs(suite.T(), err, domain.ErrNotFound)
+}
+
+func (suite *RepoSuite) TestTrash() {
+	ctx := context.Background()
+	device := domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"}
+	suite.Require().NoError(errOf(suite.repo.CreateDevice(ctx, device)))
+	suite.Require().NoError(suite.repo.DeleteDevice(ctx, "1", 0))
+
+	_, err := suite.repo.GetDevice(ctx, "1")
+	assert.ErrorIs(suite.T(), err, domain.ErrNotFound)
+	page, err := suite.repo.ListDevices(ctx, domain.DeviceFilter{})
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), page.Devices)
+	assert.ErrorIs(suite.T(), errOf(suite.repo.UpdateDevice(ctx, device)), domain.ErrNotFound)
+	assert.ErrorIs(suite.T(), suite.repo.DeleteDevice(ctx, "1", 0), domain.ErrNotFound)
+	assert.ErrorIs(suite.T(), errOf(suite.repo.CreateDevice(ctx, device)), domain.ErrAlreadyExists)
+
+	trash, err := suite.repo.ListTrash(ctx)
+	suite.Require().NoError(err)
+	suite.Require().Len(trash, 1)
+	assert.Equal(suite.T(), "1", trash[0].SerialNum)
+	suite.Require().NotNil(trash[0].DeletedAt)
+
+	suite.Run("Restore", func() {
+		restored, err := suite.repo.RestoreDevice(ctx, "1")
+		suite.Require().NoError(err)
+		d, err := suite.repo.GetDevice(ctx, "1")
+		suite.Require().NoError(err)
+		assert.Equal(suite.T(), d, restored)
+		assert.Equal(suite.T(), uint64(2), d.Revision)
+		assert.Nil(suite.T(), d.DeletedAt)
+		assert.ErrorIs(suite.T(), errOf(suite.repo.RestoreDevice(ctx, "1")), domain.ErrNotFound)
+	})
+
+	suite.Run("Purge", func() {
+		suite.Require().NoError(suite.repo.DeleteDevice(ctx, "1", 0))
+		n, err := suite.repo.PurgeTrash(ctx, time.Now().Add(-time.Hour))
+		suite.Require().NoError(err)
+		assert.Zero(suite.T(), n)
+
+		n, err = suite.repo.PurgeTrash(ctx, time.Now().Add(time.Hour))
+		suite.Require().NoError(err)
+		assert.Equal(suite.T(), 1, n)
+		trash, err := suite.repo.ListTrash(ctx)
+		suite.Require().NoError(err)
+		assert.Empty(suite.T(), trash)
+
+		// The serial number is free again and its history is kept.
+		assert.NoError(suite.T(), errOf(suite.repo.CreateDevice(ctx, device)))
+		entries, err := suite.repo.GetDeviceHistory(ctx, "1")
+		suite.Require().NoError(err)
+		var ops []domain.Operation
+		for _, e := range entries {
+			ops = append(ops, e.Op)
+		}
+		assert.Equal(suite.T(), []domain.Operation{
+			domain.OpCreate, domain.OpDelete, domain.OpRestore, domain.OpDelete, domain.OpPurge, domain.OpCreate,
+		}, ops)
+	})
+}
+
+func (suite *RepoSuite) TestWatch() {
+	watchDevices(suite.T(), suite.repo)
+}
+
+func (suite *RepoSuite) TestWatchFromList() {
+	watchFromList(suite.T(), suite.repo)
+}
+
+func (suite *RepoSuite) TestBatch() {
+	batchDevices(suite.T(), suite.repo)
+}
+
+func (suite *RepoSuite) TestTenants() {
+	isolateTenants(suite.T(), suite.repo)
+}
+
+func (suite *RepoSuite) TestCountByModel() {
+	countByModel(suite.T(), suite.repo)
+}
+
+func (suite *RepoSuite) TestQuotas() {
+	enforceQuotas(suite.T(), repository.New(repository.WithQuotas(quotas)))
+}
+
+func (suite *RepoSuite) TestWatchGone() {
+	ctx := context.Background()
+	for i := 0; i < events.DefaultReplay+2; i++ {
+		suite.Require().NoError(errOf(suite.repo.CreateDevice(ctx, domain.Device{SerialNum: strconv.Itoa(i), IP: "10.0.0.1"})))
+	}
+	_, err := suite.repo.Watch(ctx, 1)
+	assert.ErrorIs(suite.T(), err, domain.ErrGone)
+	_, err = suite.repo.Watch(ctx, 2)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *RepoSuite) TestListDevices() {
+	devices := []domain.Device{
+		{SerialNum: "1", Model: "b", IP: "10.0.0.3"},
+		{SerialNum: "2", Model: "a", IP: "10.0.0.20"},
+		{SerialNum: "3", Model: "b", IP: "192.168.1.1"},
+		{SerialNum: "4", Model: "a", IP: "10.0.0.1"},
+	}
+	for _, d := range devices {
+		suite.repo.Devices[key(d.SerialNum)] = d
+	}
+
+	suite.Run("Filter By Model", func() {
+		page, err := suite.repo.ListDevices(context.Background(), domain.DeviceFilter{Model: "a"})
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), []domain.Device{devices[1], devices[3]}, page.Devices)
+		assert.Empty(suite.T(), page.NextCursor)
+	})
+
+	suite.Run("Filter By CIDR", func() {
+		page, err := suite.repo.ListDevices(context.Background(), domain.DeviceFilter{
+			Network: netip.MustParsePrefix("10.0.0.0/24"),
+			SortBy:  domain.SortByIP,
+		})
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), []domain.Device{devices[3], devices[0], devices[1]}, page.Devices)
+	})
+
+	suite.Run("Sort Desc With Ties", func() {
+		page, err := suite.repo.ListDevices(context.Background(), domain.DeviceFilter{SortBy: domain.SortByModel, Desc: true})
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), []domain.Device{devices[2], devices[0], devices[3], devices[1]}, page.Devices)
+	})
+
+	suite.Run("Cursor Pagination", func() {
+		filter := domain.DeviceFilter{SortBy: domain.SortByModel, Limit: 3}
+		page, err := suite.repo.ListDevices(context.Background(), filter)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), []domain.Device{devices[1], devices[3], devices[0]}, page.Devices)
+		assert.NotEmpty(suite.T(), page.NextCursor)
+
+		filter.Cursor = page.NextCursor
+		page, err = suite.repo.ListDevices(context.Background(), filter)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), []domain.Device{devices[2]}, page.Devices)
+		assert.Empty(suite.T(), page.NextCursor)
+	})
+
+	suite.Run("Cursor For Another Sort", func() {
+		page, err := suite.repo.ListDevices(context.Background(), domain.DeviceFilter{Limit: 1})
+		assert.NoError(suite.T(), err)
+		_, err = suite.repo.ListDevices(context.Background(), domain.DeviceFilter{SortBy: domain.SortByIP, Cursor: page.NextCursor})
+		assert.ErrorIs(suite.T(), err, domain.ErrInvalidCursor)
+	})
+
+	suite.Run("Malformed Cursor", func() {
+		_, err := suite.repo.ListDevices(context.Background(), domain.DeviceFilter{Cursor: "???"})
+		assert.ErrorIs(suite.T(), err, domain.ErrInvalidCursor)
+	})
+}
+
 func BenchmarkCreateDevice(b *testing.B) {
 	repo := repository.New()
 	var devices []domain.Device
@@ -133,7 +710,7 @@ func BenchmarkCreateDevice(b *testing.B) {
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		err := repo.CreateDevice(devices[i])
+		_, err := repo.CreateDevice(context.Background(), devices[i])
 		if err != nil {
 			b.Errorf("unexpected error: %v", err)
 		}
@@ -0,0 +1,840 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homework/internal/domain"
+	"homework/internal/events"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// SQLRepo stores devices in an embedded SQLite database. It returns the same
+// errors as the in-memory Repo, so use cases cannot tell the backends apart.
+type SQLRepo struct {
+	db *sql.DB
+	// mu serialises write transactions so watchers see changes in commit
+	// order.
+	mu     sync.Mutex
+	feed   *events.Broadcaster
+	quotas Quotas
+}
+
+// NewSQLite opens (creating if needed) the database at path and brings its
+// schema up to date. Use ":memory:" for a throwaway database.
+func NewSQLite(path string, opts ...Option) (*SQLRepo, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if path != ":memory:" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, fmt.Errorf("create data dir: %w", err)
+		}
+	}
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	// SQLite allows a single writer; one connection also keeps ":memory:"
+	// databases from being recreated per connection.
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	// Resource versions are history row ids, which AUTOINCREMENT never
+	// reuses.
+	var version uint64
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM device_history`).Scan(&version); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("read resource version: %w", err)
+	}
+	return &SQLRepo{db: db, feed: events.NewBroadcaster(events.DefaultReplay, version), quotas: o.quotas}, nil
+}
+
+// Ping checks that the database answers queries.
+func (r *SQLRepo) Ping(ctx context.Context) error {
+	var n int
+	if err := r.db.QueryRowContext(ctx, `SELECT 1`).Scan(&n); err != nil {
+		return fmt.Errorf("%w: ping: %w", domain.ErrUnavailable, err)
+	}
+	return nil
+}
+
+func (r *SQLRepo) Close() error {
+	return r.db.Close()
+}
+
+// SchemaVersion returns the version of the last applied migration.
+func (r *SQLRepo) SchemaVersion() (int, error) {
+	var v int
+	err := r.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&v)
+	if err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return v, nil
+}
+
+type migration struct {
+	version int
+	name    string
+}
+
+// dataMigrations run in the transaction of the migration with their
+// version, after its SQL, for changes SQL cannot express.
+var dataMigrations = map[int]func(tx *sql.Tx) error{
+	8: fillIPKeys,
+}
+
+// migrate applies every embedded migrations/NNNN_name.sql newer than the
+// recorded schema version, each in its own transaction.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER NOT NULL PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	entries, err := fs.ReadDir(migrations, "migrations")
+	if err != nil {
+		return fmt.Errorf("read migrations: %w", err)
+	}
+	var list []migration
+	for _, e := range entries {
+		prefix, _, ok := strings.Cut(e.Name(), "_")
+		v, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return fmt.Errorf("bad migration name %q", e.Name())
+		}
+		list = append(list, migration{version: v, name: e.Name()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	for _, m := range list {
+		if m.version <= current {
+			continue
+		}
+		body, err := migrations.ReadFile("migrations/" + m.name)
+		if err != nil {
+			return fmt.Errorf("read migration %s: %w", m.name, err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("begin migration %s: %w", m.name, err)
+		}
+		if _, err := tx.Exec(string(body)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("apply migration %s: %w", m.name, err)
+		}
+		if fn := dataMigrations[m.version]; fn != nil {
+			if err := fn(tx); err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("apply migration %s: %w", m.name, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, m.version); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("record migration %s: %w", m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("commit migration %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// fillIPKeys sets ip_key for the devices stored before it existed.
+func fillIPKeys(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT tenant, serial_num, ip FROM devices`)
+	if err != nil {
+		return err
+	}
+	var keys [][3]string
+	for rows.Next() {
+		var tenant, serialNum, ip string
+		if err := rows.Scan(&tenant, &serialNum, &ip); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		keys = append(keys, [3]string{ipKey(ip), tenant, serialNum})
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if _, err := tx.Exec(`UPDATE devices SET ip_key = ? WHERE tenant = ? AND serial_num = ?`, k[0], k[1], k[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ipKey is the ip_key of an address: text that sorts like compareKeys
+// orders addresses, IPv4 before IPv6 and then by value. An address that
+// does not parse gets an empty key.
+func ipKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	if addr.Is4() {
+		b := addr.As4()
+		return "4" + hex.EncodeToString(b[:])
+	}
+	b := addr.As16()
+	return "6" + hex.EncodeToString(b[:])
+}
+
+// deviceColumns are the columns of a domain.Device. Every query also names
+// the tenant, which is not part of the device.
+const deviceColumns = `serial_num, model, ip, firmware_version, mac, hostname, site, location,
+	labels, status, transitions, revision, created_at, updated_at, deleted_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// tenantScanner scans a tenant column in front of the ones asked for.
+type tenantScanner struct {
+	rowScanner
+	tenant *string
+}
+
+func (s tenantScanner) Scan(dest ...any) error {
+	return s.rowScanner.Scan(append([]any{s.tenant}, dest...)...)
+}
+
+func scanDevice(row rowScanner) (domain.Device, error) {
+	var d domain.Device
+	var labels, transitions, createdAt, updatedAt, deletedAt string
+	err := row.Scan(&d.SerialNum, &d.Model, &d.IP, &d.FirmwareVersion, &d.MAC, &d.Hostname, &d.Site,
+		&d.Location, &labels, &d.Status, &transitions, &d.Revision, &createdAt, &updatedAt, &deletedAt)
+	if err != nil {
+		return d, err
+	}
+	if err := json.Unmarshal([]byte(labels), &d.Labels); err != nil {
+		return d, fmt.Errorf("decode labels: %w", err)
+	}
+	if len(d.Labels) == 0 {
+		d.Labels = nil
+	}
+	if err := json.Unmarshal([]byte(transitions), &d.Transitions); err != nil {
+		return d, fmt.Errorf("decode transitions: %w", err)
+	}
+	if len(d.Transitions) == 0 {
+		d.Transitions = nil
+	}
+	if d.CreatedAt, err = parseTime(createdAt); err != nil {
+		return d, err
+	}
+	if d.UpdatedAt, err = parseTime(updatedAt); err != nil {
+		return d, err
+	}
+	if deletedAt != "" {
+		t, err := parseTime(deletedAt)
+		if err != nil {
+			return d, err
+		}
+		d.DeletedAt = &t
+	}
+	return d, nil
+}
+
+// deviceArgs returns the values for deviceColumns in order.
+func deviceArgs(d domain.Device) []any {
+	labels, _ := json.Marshal(d.Labels)
+	if d.Labels == nil {
+		labels = []byte("{}")
+	}
+	transitions, _ := json.Marshal(d.Transitions)
+	if d.Transitions == nil {
+		transitions = []byte("[]")
+	}
+	var deletedAt string
+	if d.DeletedAt != nil {
+		deletedAt = formatTime(*d.DeletedAt)
+	}
+	return []any{d.SerialNum, d.Model, d.IP, d.FirmwareVersion, d.MAC, d.Hostname, d.Site, d.Location,
+		string(labels), d.Status, string(transitions), d.Revision, formatTime(d.CreatedAt), formatTime(d.UpdatedAt),
+		deletedAt}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decode timestamp: %w", err)
+	}
+	return t, nil
+}
+
+// sqlTx is a write transaction that remembers the history it records, so
+// watchers can be told once it commits.
+type sqlTx struct {
+	*sql.Tx
+	quotas  Quotas
+	entries []domain.HistoryEntry
+}
+
+// withTx runs fn in a transaction and commits it if fn succeeds. The
+// transaction is rolled back if ctx is done before it commits.
+func (r *SQLRepo) withTx(ctx context.Context, fn func(tx *sqlTx) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	begun, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%w: begin: %w", domain.ErrUnavailable, err)
+	}
+	tx := &sqlTx{Tx: begun, quotas: r.quotas}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%w: commit: %w", domain.ErrUnavailable, err)
+	}
+	for _, e := range tx.entries {
+		r.feed.Notify(e)
+	}
+	return nil
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// getDevice returns the live device; devices in the trash are not found.
+func getDevice(ctx context.Context, q queryRower, k Key) (domain.Device, error) {
+	d, err := scanDevice(q.QueryRowContext(ctx, `SELECT `+deviceColumns+` FROM devices
+		WHERE tenant = ? AND serial_num = ? AND deleted_at = ''`, k.Tenant, k.SerialNum))
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Device{}, fmt.Errorf("%w: no device", domain.ErrNotFound)
+	}
+	if err != nil {
+		return domain.Device{}, fmt.Errorf("%w: get device: %w", domain.ErrUnavailable, err)
+	}
+	return d, nil
+}
+
+func (r *SQLRepo) GetDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	return getDevice(ctx, r.db, keyOf(ctx, serialNum))
+}
+
+func (r *SQLRepo) CreateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	var created domain.Device
+	err := r.withTx(ctx, func(tx *sqlTx) error {
+		var err error
+		created, err = tx.createDevice(ctx, d)
+		return err
+	})
+	if err != nil {
+		return domain.Device{}, err
+	}
+	return created, nil
+}
+
+func (r *SQLRepo) DeleteDevice(ctx context.Context, serialNum string, revision uint64) error {
+	return r.withTx(ctx, func(tx *sqlTx) error {
+		return tx.deleteDevice(ctx, serialNum, revision)
+	})
+}
+
+func (r *SQLRepo) UpdateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	var updated domain.Device
+	err := r.withTx(ctx, func(tx *sqlTx) error {
+		var err error
+		updated, err = tx.updateDevice(ctx, d)
+		return err
+	})
+	if err != nil {
+		return domain.Device{}, err
+	}
+	return updated, nil
+}
+
+// BatchDevices applies ops in order in one transaction, with the semantics
+// of Repo.BatchDevices. Without atomic each operation runs in a savepoint
+// that is rolled back if it fails.
+func (r *SQLRepo) BatchDevices(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	results := make([]domain.BatchResult, len(ops))
+	failed := -1
+	err := r.withTx(ctx, func(tx *sqlTx) error {
+		for i, op := range ops {
+			if atomic {
+				if results[i] = tx.batch(ctx, op); results[i].Err != nil {
+					failed = i
+					return results[i].Err
+				}
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `SAVEPOINT batch_op`); err != nil {
+				return fmt.Errorf("%w: batch: %w", domain.ErrUnavailable, err)
+			}
+			recorded := len(tx.entries)
+			if results[i] = tx.batch(ctx, op); results[i].Err != nil {
+				if _, err := tx.ExecContext(ctx, `ROLLBACK TO batch_op`); err != nil {
+					return fmt.Errorf("%w: batch: %w", domain.ErrUnavailable, err)
+				}
+				tx.entries = tx.entries[:recorded]
+			}
+			if _, err := tx.ExecContext(ctx, `RELEASE batch_op`); err != nil {
+				return fmt.Errorf("%w: batch: %w", domain.ErrUnavailable, err)
+			}
+		}
+		return nil
+	})
+	if failed >= 0 {
+		return domain.AbortBatch(len(ops), failed, err), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (tx *sqlTx) batch(ctx context.Context, op domain.BatchOperation) domain.BatchResult {
+	var d domain.Device
+	var err error
+	switch op.Op {
+	case domain.OpCreate:
+		d, err = tx.createDevice(ctx, op.Device)
+	case domain.OpUpdate:
+		d = op.Device
+		d.Revision = op.Revision
+		d, err = tx.updateDevice(ctx, d)
+	case domain.OpDelete:
+		return domain.BatchResult{Err: tx.deleteDevice(ctx, op.SerialNum, op.Revision)}
+	default:
+		err = errBatchOp(op.Op)
+	}
+	if err != nil {
+		return domain.BatchResult{Err: err}
+	}
+	return domain.BatchResult{Device: &d}
+}
+
+func (tx *sqlTx) createDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	k := keyOf(ctx, d.SerialNum)
+	var deletedAt string
+	err := tx.QueryRowContext(ctx, `SELECT deleted_at FROM devices WHERE tenant = ? AND serial_num = ?`, k.Tenant, k.SerialNum).Scan(&deletedAt)
+	switch {
+	case err == nil && deletedAt != "":
+		return d, errInTrash
+	case err == nil:
+		return d, fmt.Errorf("%w: device is already in repository", domain.ErrAlreadyExists)
+	case !errors.Is(err, sql.ErrNoRows):
+		return d, fmt.Errorf("%w: create device: %w", domain.ErrUnavailable, err)
+	}
+	if err := tx.quota(ctx, k.Tenant); err != nil {
+		return d, err
+	}
+
+	d.Revision = 1
+	d.DeletedAt = nil
+	d.CreatedAt = now()
+	d.UpdatedAt = d.CreatedAt
+	_, err = tx.ExecContext(ctx, `INSERT INTO devices (tenant, ip_key, `+deviceColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		append([]any{k.Tenant, ipKey(d.IP)}, deviceArgs(d)...)...)
+	if err != nil {
+		return d, fmt.Errorf("%w: create device: %w", domain.ErrUnavailable, err)
+	}
+	return d, tx.record(ctx, newEntry(ctx, domain.OpCreate, nil, &d))
+}
+
+// quota checks that tenant may have another live device. Writes are
+// serialised, so the count cannot change before the device is stored.
+func (tx *sqlTx) quota(ctx context.Context, tenant string) error {
+	if tx.quotas.Limit(tenant) == 0 {
+		return nil
+	}
+	var live int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM devices WHERE tenant = ? AND deleted_at = ''`, tenant).Scan(&live)
+	if err != nil {
+		return fmt.Errorf("%w: count devices: %w", domain.ErrUnavailable, err)
+	}
+	return checkQuota(tx.quotas, tenant, live)
+}
+
+func (tx *sqlTx) deleteDevice(ctx context.Context, serialNum string, revision uint64) error {
+	k := keyOf(ctx, serialNum)
+	current, err := getDevice(ctx, tx, k)
+	if err != nil {
+		return err
+	}
+	if err := checkRevision(current, revision); err != nil {
+		return err
+	}
+	trashed := tombstone(current)
+	_, err = tx.ExecContext(ctx, `UPDATE devices SET deleted_at = ? WHERE tenant = ? AND serial_num = ?`,
+		formatTime(*trashed.DeletedAt), k.Tenant, k.SerialNum)
+	if err != nil {
+		return fmt.Errorf("%w: delete device: %w", domain.ErrUnavailable, err)
+	}
+	return tx.record(ctx, newEntry(ctx, domain.OpDelete, &current, nil))
+}
+
+func (tx *sqlTx) updateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	k := keyOf(ctx, d.SerialNum)
+	current, err := getDevice(ctx, tx, k)
+	if err != nil {
+		return d, err
+	}
+	if err := checkRevision(current, d.Revision); err != nil {
+		return d, err
+	}
+	stampUpdate(&d, current)
+	_, err = tx.ExecContext(ctx, `UPDATE devices SET (`+deviceColumns+`) = (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?), ip_key = ?
+		WHERE tenant = ? AND serial_num = ?`, append(deviceArgs(d), ipKey(d.IP), k.Tenant, k.SerialNum)...)
+	if err != nil {
+		return d, fmt.Errorf("%w: update device: %w", domain.ErrUnavailable, err)
+	}
+	return d, tx.record(ctx, newEntry(ctx, domain.OpUpdate, &current, &d))
+}
+
+// sortColumns hold the keys of each sort order, in the order of compareKeys.
+var sortColumns = map[domain.SortField]string{
+	domain.SortBySerialNum: "serial_num",
+	domain.SortByModel:     "model",
+	domain.SortByIP:        "ip_key",
+}
+
+// ListDevices reads a page in the order of the in-memory Repo straight off
+// the sort indexes: the order, the cursor and the limit are all applied in
+// SQL. Only a subnet is matched here, in which case rows are read until the
+// page is full.
+func (r *SQLRepo) ListDevices(ctx context.Context, f domain.DeviceFilter) (domain.DevicePage, error) {
+	if f.SortBy == "" {
+		f.SortBy = domain.SortBySerialNum
+	}
+	after, err := decodeCursor(f.Cursor, f)
+	if err != nil {
+		return domain.DevicePage{}, err
+	}
+
+	where := []string{"tenant = ?", "deleted_at = ''"}
+	args := []any{domain.TenantFrom(ctx)}
+	if f.Model != "" {
+		where = append(where, "model = ?")
+		args = append(args, f.Model)
+	}
+	if f.Network.IsValid() && f.Network.IsSingleIP() {
+		where = append(where, "ip = ?")
+		args = append(args, f.Network.Addr().String())
+	}
+	column, op, dir := sortColumns[f.SortBy], ">", "ASC"
+	if f.Desc {
+		op, dir = "<", "DESC"
+	}
+	order := "serial_num " + dir
+	if f.SortBy != domain.SortBySerialNum {
+		order = column + " " + dir + ", " + order
+	}
+	switch {
+	case after == nil:
+	case f.SortBy == domain.SortBySerialNum:
+		where = append(where, "serial_num "+op+" ?")
+		args = append(args, after.Serial)
+	default:
+		key := after.Key
+		if f.SortBy == domain.SortByIP {
+			key = ipKey(key)
+		}
+		where = append(where, "("+column+", serial_num) "+op+" (?, ?)")
+		args = append(args, key, after.Serial)
+	}
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE ` + strings.Join(where, " AND ") + ` ORDER BY ` + order
+	subnet := f.Network.IsValid() && !f.Network.IsSingleIP()
+	if f.Limit > 0 && !subnet {
+		// One more than asked for tells whether there is a next page.
+		query += ` LIMIT ?`
+		args = append(args, f.Limit+1)
+	}
+
+	// The resource version is read in the same transaction as the devices,
+	// so it is the version of exactly the state they were read in.
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return domain.DevicePage{}, fmt.Errorf("%w: list devices: %w", domain.ErrUnavailable, err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	var version uint64
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM device_history`).Scan(&version); err != nil {
+		return domain.DevicePage{}, fmt.Errorf("%w: list devices: %w", domain.ErrUnavailable, err)
+	}
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return domain.DevicePage{}, fmt.Errorf("%w: list devices: %w", domain.ErrUnavailable, err)
+	}
+	defer rows.Close()
+	var devices []domain.Device
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return domain.DevicePage{}, fmt.Errorf("%w: list devices: %w", domain.ErrUnavailable, err)
+		}
+		if !f.Match(d) {
+			continue
+		}
+		devices = append(devices, d)
+		if f.Limit > 0 && len(devices) > f.Limit {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return domain.DevicePage{}, fmt.Errorf("%w: list devices: %w", domain.ErrUnavailable, err)
+	}
+	page := pageOf(devices, f)
+	page.ResourceVersion = version
+	return page, nil
+}
+
+func (r *SQLRepo) CountByModel(ctx context.Context) (map[string]int, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT model, COUNT(*) FROM devices
+		WHERE deleted_at = '' GROUP BY model`)
+	if err != nil {
+		return nil, fmt.Errorf("%w: count devices: %w", domain.ErrUnavailable, err)
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var model string
+		var n int
+		if err := rows.Scan(&model, &n); err != nil {
+			return nil, fmt.Errorf("%w: count devices: %w", domain.ErrUnavailable, err)
+		}
+		counts[model] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: count devices: %w", domain.ErrUnavailable, err)
+	}
+	return counts, nil
+}
+
+func (r *SQLRepo) ListTrash(ctx context.Context) ([]domain.Device, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+deviceColumns+` FROM devices
+		WHERE tenant = ? AND deleted_at != '' ORDER BY serial_num`, domain.TenantFrom(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%w: list trash: %w", domain.ErrUnavailable, err)
+	}
+	defer rows.Close()
+	devices := []domain.Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%w: list trash: %w", domain.ErrUnavailable, err)
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: list trash: %w", domain.ErrUnavailable, err)
+	}
+	return devices, nil
+}
+
+func (r *SQLRepo) RestoreDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	var restored domain.Device
+	err := r.withTx(ctx, func(tx *sqlTx) error {
+		k := keyOf(ctx, serialNum)
+		current, err := scanDevice(tx.QueryRowContext(ctx, `SELECT `+deviceColumns+` FROM devices
+			WHERE tenant = ? AND serial_num = ? AND deleted_at != ''`, k.Tenant, k.SerialNum))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: no device in trash", domain.ErrNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: restore device: %w", domain.ErrUnavailable, err)
+		}
+		if err := tx.quota(ctx, k.Tenant); err != nil {
+			return err
+		}
+		d := current.Clone()
+		stampUpdate(&d, current)
+		_, err = tx.ExecContext(ctx, `UPDATE devices SET (`+deviceColumns+`) = (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			WHERE tenant = ? AND serial_num = ?`, append(deviceArgs(d), k.Tenant, k.SerialNum)...)
+		if err != nil {
+			return fmt.Errorf("%w: restore device: %w", domain.ErrUnavailable, err)
+		}
+		restored = d
+		return tx.record(ctx, newEntry(ctx, domain.OpRestore, &current, &d))
+	})
+	if err != nil {
+		return domain.Device{}, err
+	}
+	return restored, nil
+}
+
+func (r *SQLRepo) PurgeTrash(ctx context.Context, deletedBefore time.Time) (int, error) {
+	var purged int
+	err := r.withTx(ctx, func(tx *sqlTx) error {
+		// RFC 3339 strings with trimmed fractions do not sort by time, so
+		// the cut-off is applied here rather than in SQL.
+		rows, err := tx.QueryContext(ctx, `SELECT tenant, ` + deviceColumns + ` FROM devices WHERE deleted_at != ''`)
+		if err != nil {
+			return fmt.Errorf("%w: purge trash: %w", domain.ErrUnavailable, err)
+		}
+		var expired []domain.Device
+		var tenants []string
+		for rows.Next() {
+			var tenant string
+			d, err := scanDevice(tenantScanner{rowScanner: rows, tenant: &tenant})
+			if err != nil {
+				_ = rows.Close()
+				return fmt.Errorf("%w: purge trash: %w", domain.ErrUnavailable, err)
+			}
+			if d.DeletedAt.Before(deletedBefore) {
+				expired = append(expired, d)
+				tenants = append(tenants, tenant)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("%w: purge trash: %w", domain.ErrUnavailable, err)
+		}
+		if err := rows.Close(); err != nil {
+			return fmt.Errorf("%w: purge trash: %w", domain.ErrUnavailable, err)
+		}
+		for i := range expired {
+			_, err := tx.ExecContext(ctx, `DELETE FROM devices WHERE tenant = ? AND serial_num = ?`, tenants[i], expired[i].SerialNum)
+			if err != nil {
+				return fmt.Errorf("%w: purge trash: %w", domain.ErrUnavailable, err)
+			}
+			e := newEntry(ctx, domain.OpPurge, &expired[i], nil)
+			e.Tenant = tenants[i]
+			if err := tx.record(ctx, e); err != nil {
+				return err
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// record adds e to the device history as part of the transaction.
+func (tx *sqlTx) record(ctx context.Context, e *domain.HistoryEntry) error {
+	before, err := encodeSnapshot(e.Before)
+	if err != nil {
+		return err
+	}
+	after, err := encodeSnapshot(e.After)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO device_history (tenant, serial_num, op, revision, actor, at, before, after)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, e.Tenant, e.SerialNum, e.Op, e.Revision, e.Actor, formatTime(e.At), before, after)
+	if err != nil {
+		return fmt.Errorf("%w: record history: %w", domain.ErrUnavailable, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("%w: record history: %w", domain.ErrUnavailable, err)
+	}
+	e.ResourceVersion = uint64(id)
+	tx.entries = append(tx.entries, *e)
+	return nil
+}
+
+func encodeSnapshot(d *domain.Device) (sql.NullString, error) {
+	if d == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("encode history snapshot: %w", err)
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+func decodeSnapshot(s sql.NullString) (*domain.Device, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	var d domain.Device
+	if err := json.Unmarshal([]byte(s.String), &d); err != nil {
+		return nil, fmt.Errorf("decode history snapshot: %w", err)
+	}
+	return &d, nil
+}
+
+func (r *SQLRepo) GetDeviceHistory(ctx context.Context, serialNum string) ([]domain.HistoryEntry, error) {
+	k := keyOf(ctx, serialNum)
+	rows, err := r.db.QueryContext(ctx, `SELECT id, serial_num, op, revision, actor, at, before, after
+		FROM device_history WHERE tenant = ? AND serial_num = ? ORDER BY id`, k.Tenant, k.SerialNum)
+	if err != nil {
+		return nil, fmt.Errorf("%w: get history: %w", domain.ErrUnavailable, err)
+	}
+	defer rows.Close()
+	var entries []domain.HistoryEntry
+	for rows.Next() {
+		e := domain.HistoryEntry{Tenant: k.Tenant}
+		var at string
+		var before, after sql.NullString
+		if err := rows.Scan(&e.ResourceVersion, &e.SerialNum, &e.Op, &e.Revision, &e.Actor, &at, &before, &after); err != nil {
+			return nil, fmt.Errorf("%w: get history: %w", domain.ErrUnavailable, err)
+		}
+		if e.At, err = parseTime(at); err != nil {
+			return nil, fmt.Errorf("%w: get history: %w", domain.ErrUnavailable, err)
+		}
+		if e.Before, err = decodeSnapshot(before); err != nil {
+			return nil, fmt.Errorf("%w: get history: %w", domain.ErrUnavailable, err)
+		}
+		if e.After, err = decodeSnapshot(after); err != nil {
+			return nil, fmt.Errorf("%w: get history: %w", domain.ErrUnavailable, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: get history: %w", domain.ErrUnavailable, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: no history", domain.ErrNotFound)
+	}
+	return entries, nil
+}
+
+// Watch behaves like Repo.Watch; resource versions survive restarts, but
+// only changes made since the database was opened can be replayed.
+func (r *SQLRepo) Watch(ctx context.Context, fromVersion uint64) (<-chan domain.HistoryEntry, error) {
+	return watch(ctx, r.feed, fromVersion)
+}
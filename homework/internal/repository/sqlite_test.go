@@ -0,0 +1,403 @@
+package repository_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"homework/internal/domain"
+	"homework/internal/repository"
+	"net/netip"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type SQLiteSuite struct {
+	suite.Suite
+	repo *repository.SQLRepo
+}
+
+func (suite *SQLiteSuite) SetupTest() {
+	repo, err := repository.NewSQLite(":memory:")
+	suite.Require().NoError(err)
+	suite.repo = repo
+}
+
+func (suite *SQLiteSuite) TearDownTest() {
+	suite.Require().NoError(suite.repo.Close())
+	suite.repo = nil
+}
+
+func (suite *SQLiteSuite) TestCRUD() {
+	device := domain.Device{SerialNum: "1", Model: "test_model", IP: "0.0.0.0", Revision: 1}
+
+	suite.Run("Create", func() {
+		created, err := suite.repo.CreateDevice(context.Background(), device)
+		assert.NoError(suite.T(), err)
+		d, err := suite.repo.GetDevice(context.Background(), "1")
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), d, created)
+		assert.Equal(suite.T(), withoutTimestamps(device), withoutTimestamps(d))
+		assert.False(suite.T(), d.CreatedAt.IsZero())
+	})
+
+	suite.Run("Create Duplicate", func() {
+		_, err := suite.repo.CreateDevice(context.Background(), device)
+		assert.EqualError(suite.T(), err, "already exists: device is already in repository")
+	})
+
+	suite.Run("Update", func() {
+		updated := domain.Device{SerialNum: "1", Model: "updated_model", IP: "1.1.1.1", Revision: 1}
+		got, err := suite.repo.UpdateDevice(context.Background(), updated)
+		assert.NoError(suite.T(), err)
+		d, err := suite.repo.GetDevice(context.Background(), "1")
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), d, got)
+		updated.Revision = 2
+		assert.Equal(suite.T(), withoutTimestamps(updated), withoutTimestamps(d))
+		assert.True(suite.T(), d.UpdatedAt.After(d.CreatedAt))
+	})
+
+	suite.Run("Delete", func() {
+		assert.NoError(suite.T(), suite.repo.DeleteDevice(context.Background(), "1", 0))
+		_, err := suite.repo.GetDevice(context.Background(), "1")
+		assert.ErrorIs(suite.T(), err, domain.ErrNotFound)
+	})
+
+	suite.Run("Unexisting Device", func() {
+		_, err := suite.repo.GetDevice(context.Background(), "unexisting_serial")
+		assert.EqualError(suite.T(), err, "not found: no device")
+		_, err = suite.repo.UpdateDevice(context.Background(), domain.Device{SerialNum: "unexisting_serial"})
+		assert.EqualError(suite.T(), err, "not found: no device")
+		err = suite.repo.DeleteDevice(context.Background(), "unexisting_serial", 0)
+		assert.EqualError(suite.T(), err, "not found: no device")
+	})
+}
+
+func (suite *SQLiteSuite) TestDetails() {
+	device := domain.Device{
+		SerialNum:       "1",
+		Model:           "m",
+		IP:              "10.0.0.1",
+		FirmwareVersion: "1.2.3",
+		MAC:             "00:1a:2b:3c:4d:5e",
+		Hostname:        "sw-1",
+		Site:            "msk",
+		Location:        "rack 4",
+		Labels:          map[string]string{"role": "edge"},
+		Status:          domain.StatusActive,
+		Transitions: []domain.Transition{
+			{From: domain.StatusProvisioned, To: domain.StatusActive, Actor: "alice", At: time.Unix(100, 0).UTC()},
+		},
+	}
+	suite.Require().NoError(errOf(suite.repo.CreateDevice(context.Background(), device)))
+	created, err := suite.repo.GetDevice(context.Background(), "1")
+	suite.Require().NoError(err)
+	device.Revision = 1
+	assert.Equal(suite.T(), withoutTimestamps(device), withoutTimestamps(created))
+
+	update := device
+	update.Labels = nil
+	update.Status = ""
+	update.Transitions = nil
+	update.Revision = 0
+	suite.Require().NoError(errOf(suite.repo.UpdateDevice(context.Background(), update)))
+	updated, err := suite.repo.GetDevice(context.Background(), "1")
+	suite.Require().NoError(err)
+	assert.Nil(suite.T(), updated.Labels)
+	assert.Equal(suite.T(), domain.StatusActive, updated.Status)
+	assert.Equal(suite.T(), device.Transitions, updated.Transitions)
+	assert.Equal(suite.T(), created.CreatedAt, updated.CreatedAt)
+}
+
+func (suite *SQLiteSuite) TestHistory() {
+	ctx := domain.WithActor(context.Background(), "alice")
+	device := domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1", Labels: map[string]string{"k": "v"}}
+	suite.Require().NoError(errOf(suite.repo.CreateDevice(ctx, device)))
+	device.IP = "10.0.0.2"
+	suite.Require().NoError(errOf(suite.repo.UpdateDevice(ctx, device)))
+	suite.Require().NoError(suite.repo.DeleteDevice(ctx, "1", 0))
+
+	entries, err := suite.repo.GetDeviceHistory(context.Background(), "1")
+	suite.Require().NoError(err)
+	suite.Require().Len(entries, 3)
+	ops := []domain.Operation{entries[0].Op, entries[1].Op, entries[2].Op}
+	assert.Equal(suite.T(), []domain.Operation{domain.OpCreate, domain.OpUpdate, domain.OpDelete}, ops)
+	for _, e := range entries {
+		assert.Equal(suite.T(), "alice", e.Actor)
+		assert.False(suite.T(), e.At.IsZero())
+	}
+	assert.Nil(suite.T(), entries[0].Before)
+	assert.Equal(suite.T(), map[string]string{"k": "v"}, entries[0].After.Labels)
+	assert.Equal(suite.T(), "10.0.0.1", entries[1].Before.IP)
+	assert.Equal(suite.T(), "10.0.0.2", entries[1].After.IP)
+	assert.Equal(suite.T(), uint64(2), entries[2].Revision)
+	assert.Nil(suite.T(), entries[2].After)
+
+	_, err = suite.repo.GetDeviceHistory(context.Background(), "2")
+	assert.ErrorIs(suite.T(), err, domain.ErrNotFound)
+}
+
+func (suite *SQLiteSuite) TestTrash() {
+	ctx := context.Background()
+	device := domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"}
+	suite.Require().NoError(errOf(suite.repo.CreateDevice(ctx, device)))
+	suite.Require().NoError(suite.repo.DeleteDevice(ctx, "1", 0))
+
+	_, err := suite.repo.GetDevice(ctx, "1")
+	assert.ErrorIs(suite.T(), err, domain.ErrNotFound)
+	page, err := suite.repo.ListDevices(ctx, domain.DeviceFilter{})
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), page.Devices)
+	assert.ErrorIs(suite.T(), errOf(suite.repo.UpdateDevice(ctx, device)), domain.ErrNotFound)
+	assert.ErrorIs(suite.T(), suite.repo.DeleteDevice(ctx, "1", 0), domain.ErrNotFound)
+	assert.ErrorIs(suite.T(), errOf(suite.repo.CreateDevice(ctx, device)), domain.ErrAlreadyExists)
+
+	trash, err := suite.repo.ListTrash(ctx)
+	suite.Require().NoError(err)
+	suite.Require().Len(trash, 1)
+	assert.Equal(suite.T(), "1", trash[0].SerialNum)
+	suite.Require().NotNil(trash[0].DeletedAt)
+
+	suite.Run("Restore", func() {
+		restored, err := suite.repo.RestoreDevice(ctx, "1")
+		suite.Require().NoError(err)
+		d, err := suite.repo.GetDevice(ctx, "1")
+		suite.Require().NoError(err)
+		assert.Equal(suite.T(), d, restored)
+		assert.Equal(suite.T(), uint64(2), d.Revision)
+		assert.Nil(suite.T(), d.DeletedAt)
+		assert.ErrorIs(suite.T(), errOf(suite.repo.RestoreDevice(ctx, "1")), domain.ErrNotFound)
+	})
+
+	suite.Run("Purge", func() {
+		suite.Require().NoError(suite.repo.DeleteDevice(ctx, "1", 0))
+		n, err := suite.repo.PurgeTrash(ctx, time.Now().Add(-time.Hour))
+		suite.Require().NoError(err)
+		assert.Zero(suite.T(), n)
+
+		n, err = suite.repo.PurgeTrash(ctx, time.Now().Add(time.Hour))
+		suite.Require().NoError(err)
+		assert.Equal(suite.T(), 1, n)
+		trash, err := suite.repo.ListTrash(ctx)
+		suite.Require().NoError(err)
+		assert.Empty(suite.T(), trash)
+
+		// The serial number is free again and its history is kept.
+		assert.NoError(suite.T(), errOf(suite.repo.CreateDevice(ctx, device)))
+		entries, err := suite.repo.GetDeviceHistory(ctx, "1")
+		suite.Require().NoError(err)
+		var ops []domain.Operation
+		for _, e := range entries {
+			ops = append(ops, e.Op)
+		}
+		assert.Equal(suite.T(), []domain.Operation{
+			domain.OpCreate, domain.OpDelete, domain.OpRestore, domain.OpDelete, domain.OpPurge, domain.OpCreate,
+		}, ops)
+	})
+}
+
+func (suite *SQLiteSuite) TestWatch() {
+	watchDevices(suite.T(), suite.repo)
+}
+
+func (suite *SQLiteSuite) TestWatchFromList() {
+	watchFromList(suite.T(), suite.repo)
+}
+
+func (suite *SQLiteSuite) TestBatch() {
+	batchDevices(suite.T(), suite.repo)
+}
+
+func (suite *SQLiteSuite) TestTenants() {
+	isolateTenants(suite.T(), suite.repo)
+}
+
+func (suite *SQLiteSuite) TestCountByModel() {
+	countByModel(suite.T(), suite.repo)
+}
+
+func (suite *SQLiteSuite) TestQuotas() {
+	repo, err := repository.NewSQLite(":memory:", repository.WithQuotas(quotas))
+	suite.Require().NoError(err)
+	defer repo.Close()
+	enforceQuotas(suite.T(), repo)
+}
+
+func (suite *SQLiteSuite) TestRevisions() {
+	device := domain.Device{SerialNum: "1", Model: "test_model", IP: "0.0.0.0"}
+	suite.Require().NoError(errOf(suite.repo.CreateDevice(context.Background(), device)))
+
+	device.Revision = 5
+	assert.ErrorIs(suite.T(), errOf(suite.repo.UpdateDevice(context.Background(), device)), domain.ErrPreconditionFailed)
+	assert.ErrorIs(suite.T(), suite.repo.DeleteDevice(context.Background(), "1", 5), domain.ErrPreconditionFailed)
+
+	device.Revision = 1
+	assert.NoError(suite.T(), errOf(suite.repo.UpdateDevice(context.Background(), device)))
+	assert.NoError(suite.T(), suite.repo.DeleteDevice(context.Background(), "1", 2))
+}
+
+func (suite *SQLiteSuite) TestListDevices() {
+	devices := []domain.Device{
+		{SerialNum: "1", Model: "b", IP: "10.0.0.3", Revision: 1},
+		{SerialNum: "2", Model: "a", IP: "10.0.0.20", Revision: 1},
+		{SerialNum: "3", Model: "b", IP: "192.168.1.1", Revision: 1},
+	}
+	for _, d := range devices {
+		suite.Require().NoError(errOf(suite.repo.CreateDevice(context.Background(), d)))
+	}
+
+	page, err := suite.repo.ListDevices(context.Background(), domain.DeviceFilter{
+		Network: netip.MustParsePrefix("10.0.0.0/8"),
+		SortBy:  domain.SortByIP,
+		Limit:   1,
+	})
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), withoutTimestamps(devices[0]), withoutTimestamps(page.Devices...))
+
+	page, err = suite.repo.ListDevices(context.Background(), domain.DeviceFilter{
+		Network: netip.MustParsePrefix("10.0.0.0/8"),
+		SortBy:  domain.SortByIP,
+		Cursor:  page.NextCursor,
+	})
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), withoutTimestamps(devices[1]), withoutTimestamps(page.Devices...))
+
+	page, err = suite.repo.ListDevices(context.Background(), domain.DeviceFilter{Model: "b", Network: netip.MustParsePrefix("192.168.1.1/32")})
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), withoutTimestamps(devices[2]), withoutTimestamps(page.Devices...))
+}
+
+func (suite *SQLiteSuite) TestListDevicesPagesLikeRepo() {
+	memory := repository.New()
+	for i, ip := range []string{"10.0.0.3", "10.0.0.20", "192.168.1.1", "::1", "10.0.0.3", "9.0.0.1", "10.0.0.100"} {
+		d := domain.Device{SerialNum: strconv.Itoa(i + 1), Model: []string{"b", "a", "c"}[i%3], IP: ip}
+		suite.Require().NoError(errOf(suite.repo.CreateDevice(context.Background(), d)))
+		suite.Require().NoError(errOf(memory.CreateDevice(context.Background(), d)))
+	}
+	serials := func(repo interface {
+		ListDevices(context.Context, domain.DeviceFilter) (domain.DevicePage, error)
+	}, f domain.DeviceFilter) []string {
+		var got []string
+		for {
+			page, err := repo.ListDevices(context.Background(), f)
+			suite.Require().NoError(err)
+			for _, d := range page.Devices {
+				got = append(got, d.SerialNum)
+			}
+			if page.NextCursor == "" {
+				return got
+			}
+			f.Cursor = page.NextCursor
+		}
+	}
+
+	for _, sortBy := range []domain.SortField{domain.SortBySerialNum, domain.SortByModel, domain.SortByIP} {
+		for _, desc := range []bool{false, true} {
+			for _, network := range []string{"", "10.0.0.0/8"} {
+				f := domain.DeviceFilter{SortBy: sortBy, Desc: desc, Limit: 2}
+				if network != "" {
+					f.Network = netip.MustParsePrefix(network)
+				}
+				want := serials(memory, f)
+				suite.NotEmpty(want)
+				suite.Equal(want, serials(suite.repo, f), "sort %s, desc %t, network %q", sortBy, desc, network)
+			}
+		}
+	}
+}
+
+func (suite *SQLiteSuite) TestCancelledWrite() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := suite.repo.CreateDevice(ctx, domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})
+	suite.ErrorIs(err, context.Canceled)
+	suite.ErrorIs(err, domain.ErrUnavailable)
+
+	_, err = suite.repo.GetDevice(context.Background(), "1")
+	suite.ErrorIs(err, domain.ErrNotFound)
+}
+
+func TestSQLiteSuite(t *testing.T) {
+	suite.Run(t, new(SQLiteSuite))
+}
+
+func TestSQLiteMigrationsAreIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db", "devices.db")
+	repo, err := repository.NewSQLite(path)
+	require.NoError(t, err)
+	require.NoError(t, errOf(repo.CreateDevice(context.Background(), domain.Device{SerialNum: "1", Model: "a", IP: "10.0.0.1"})))
+	version, err := repo.SchemaVersion()
+	require.NoError(t, err)
+	require.NoError(t, repo.Close())
+
+	reopened, err := repository.NewSQLite(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	again, err := reopened.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, version, again)
+	_, err = reopened.GetDevice(context.Background(), "1")
+	assert.NoError(t, err)
+}
+
+func TestSQLiteResourceVersionSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.db")
+	repo, err := repository.NewSQLite(path)
+	require.NoError(t, err)
+	require.NoError(t, errOf(repo.CreateDevice(context.Background(), domain.Device{SerialNum: "1", IP: "10.0.0.1"})))
+	require.NoError(t, repo.DeleteDevice(context.Background(), "1", 0))
+	require.NoError(t, repo.Close())
+
+	reopened, err := repository.NewSQLite(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	_, err = reopened.Watch(context.Background(), 1)
+	assert.ErrorIs(t, err, domain.ErrGone)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := reopened.Watch(ctx, 2)
+	require.NoError(t, err)
+	require.NoError(t, errOf(reopened.RestoreDevice(ctx, "1")))
+	assert.Equal(t, uint64(3), receive(t, ch, 1)[0].ResourceVersion)
+}
+
+func TestSQLiteFillsIPKeysOfExistingDevices(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.db")
+	repo, err := repository.NewSQLite(path)
+	require.NoError(t, err)
+	for i, ip := range []string{"10.0.0.20", "10.0.0.3"} {
+		require.NoError(t, errOf(repo.CreateDevice(context.Background(), domain.Device{SerialNum: strconv.Itoa(i + 1), IP: ip})))
+	}
+	require.NoError(t, repo.Close())
+
+	// Take the database back to before ip_key existed.
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`DROP INDEX devices_ip_key_idx;
+		ALTER TABLE devices DROP COLUMN ip_key;
+		DELETE FROM schema_migrations WHERE version = 8`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	reopened, err := repository.NewSQLite(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	page, err := reopened.ListDevices(context.Background(), domain.DeviceFilter{SortBy: domain.SortByIP, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, page.Devices, 1)
+	assert.Equal(t, "10.0.0.3", page.Devices[0].IP)
+}
+
+func TestSQLitePing(t *testing.T) {
+	repo, err := repository.NewSQLite(":memory:")
+	require.NoError(t, err)
+	assert.NoError(t, repo.Ping(context.Background()))
+	require.NoError(t, repo.Close())
+	assert.ErrorIs(t, repo.Ping(context.Background()), domain.ErrUnavailable)
+}
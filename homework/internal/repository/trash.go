@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"homework/internal/domain"
+	"sort"
+	"time"
+)
+
+// ListTrash returns the deleted devices that can still be restored, ordered
+// by serial number.
+func (r *Repo) ListTrash(ctx context.Context) ([]domain.Device, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tenant := domain.TenantFrom(ctx)
+	devices := []domain.Device{}
+	for k, d := range r.trash {
+		if k.Tenant == tenant {
+			devices = append(devices, d.Clone())
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].SerialNum < devices[j].SerialNum })
+	return devices, nil
+}
+
+// RestoreDevice takes the device out of the trash as a new revision. It
+// counts against the quota of the tenant like a new device.
+func (r *Repo) RestoreDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := keyOf(ctx, serialNum)
+	current, ok := r.trash[k]
+	if !ok {
+		return domain.Device{}, fmt.Errorf("%w: no device in trash", domain.ErrNotFound)
+	}
+	if err := r.quota(k.Tenant, 0); err != nil {
+		return domain.Device{}, err
+	}
+	d := current.Clone()
+	stampUpdate(&d, current)
+	return r.applyDevice(change{Tenant: k.Tenant, Device: &d, Entry: newEntry(ctx, domain.OpRestore, &current, &d)})
+}
+
+// PurgeTrash removes the devices of every tenant deleted before
+// deletedBefore for good and reports how many there were. Their history is
+// kept.
+func (r *Repo) PurgeTrash(ctx context.Context, deletedBefore time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var changes []change
+	for k, d := range r.trash {
+		if d.DeletedAt.Before(deletedBefore) {
+			d := d
+			e := newEntry(ctx, domain.OpPurge, &d, nil)
+			e.Tenant = k.Tenant
+			changes = append(changes, change{Tenant: k.Tenant, SerialNum: k.SerialNum, Entry: e})
+		}
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	if err := r.apply(changes...); err != nil {
+		return 0, err
+	}
+	return len(changes), nil
+}
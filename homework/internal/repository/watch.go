@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"homework/internal/domain"
+	"homework/internal/events"
+)
+
+// Watch streams every change of the tenant of ctx with a resource version
+// greater than fromVersion, starting with the retained ones; 0 means from now
+// on. If changes after fromVersion have been compacted away it returns
+// domain.ErrGone and the caller has to list the devices again, then watch
+// from the ResourceVersion of the list. Resource
+// versions are shared by all tenants, so a tenant sees gaps between them.
+//
+// The channel is closed when ctx is done, or earlier if the caller falls too
+// far behind; it may then watch again from the last version it received.
+func (r *Repo) Watch(ctx context.Context, fromVersion uint64) (<-chan domain.HistoryEntry, error) {
+	r.mu.RLock()
+	feed := r.feed
+	r.mu.RUnlock()
+	return watch(ctx, feed, fromVersion)
+}
+
+func watch(ctx context.Context, feed *events.Broadcaster, fromVersion uint64) (<-chan domain.HistoryEntry, error) {
+	var sub *events.Subscription
+	if fromVersion == 0 {
+		sub = feed.Subscribe()
+	} else {
+		var err error
+		if sub, err = feed.Resume(fromVersion); err != nil {
+			return nil, err
+		}
+	}
+	tenant := domain.TenantFrom(ctx)
+	out := make(chan domain.HistoryEntry)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				// A list can see a change that is committed but not yet
+				// published, so a watch from its version may get it again.
+				if e.Tenant != tenant || e.ResourceVersion <= fromVersion {
+					continue
+				}
+				select {
+				case out <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,68 @@
+// Package statuswriter records what a handler answered, for the
+// middlewares that log and measure requests.
+package statuswriter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Writer remembers the status and body size of a response. It passes
+// flushes and hijacks through for event streams and websockets.
+type Writer struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+// Wrap returns a Writer for w. Its status is 200 until the handler writes
+// another.
+func Wrap(w http.ResponseWriter) *Writer {
+	return &Writer{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Status is the status code of the response.
+func (w *Writer) Status() int { return w.status }
+
+// Bytes is how much of the body has been written.
+func (w *Writer) Bytes() int64 { return w.bytes }
+
+func (w *Writer) WriteHeader(status int) {
+	// 1xx responses are interim; the final status follows.
+	if !w.wroteHeader && status >= http.StatusOK {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *Writer) Flush() {
+	w.wroteHeader = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T cannot be hijacked", w.ResponseWriter)
+	}
+	// A websocket upgrade answers 101 on the hijacked connection.
+	w.status, w.wroteHeader = http.StatusSwitchingProtocols, true
+	return h.Hijack()
+}
+
+func (w *Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -1,12 +1,25 @@
 package usecase
 
 import (
+	"context"
 	"homework/internal/domain"
+	"time"
 )
 
 type DeviceUseCase interface {
-	GetDevice(string) (domain.Device, error)
-	CreateDevice(d domain.Device) error
-	DeleteDevice(string) error
-	UpdateDevice(domain.Device) error
+	GetDevice(ctx context.Context, serialNum string) (domain.Device, error)
+	CreateDevice(ctx context.Context, d domain.Device) (domain.Device, error)
+	DeleteDevice(ctx context.Context, serialNum string, revision uint64) error
+	UpdateDevice(ctx context.Context, d domain.Device) (domain.Device, error)
+	ListDevices(ctx context.Context, f domain.DeviceFilter) (domain.DevicePage, error)
+	PatchDevice(ctx context.Context, serialNum string, p domain.Patch, revision uint64) (domain.Device, error)
+	TransitionDevice(ctx context.Context, serialNum string, t domain.Transition, revision uint64) (domain.Device, error)
+	GetDeviceHistory(ctx context.Context, serialNum string) ([]domain.HistoryEntry, error)
+	RevertDevice(ctx context.Context, serialNum string, toRevision, revision uint64) (domain.Device, error)
+	ListTrash(ctx context.Context) ([]domain.Device, error)
+	RestoreDevice(ctx context.Context, serialNum string) (domain.Device, error)
+	PurgeTrash(ctx context.Context, retention time.Duration) (int, error)
+	WatchDevices(ctx context.Context, fromVersion uint64) (<-chan domain.HistoryEntry, error)
+	BatchDevices(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error)
+	ImportDevices(ctx context.Context, rows []domain.ImportRow, opts domain.ImportOptions) (domain.ImportReport, error)
 }
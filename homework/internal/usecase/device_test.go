@@ -1,26 +1,99 @@
 package usecase
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"homework/internal/auth"
 	"homework/internal/domain"
+	"homework/internal/rbac"
 	"homework/internal/repository"
 	"homework/internal/usecase/impl"
 	"homework/internal/usecase/mocks"
+	"reflect"
 	"testing"
+	"time"
 )
 
+// withoutTimestamps zeroes the repository-managed timestamps so devices can
+// be compared.
+func withoutTimestamps(d domain.Device) domain.Device {
+	d.CreatedAt = time.Time{}
+	d.UpdatedAt = time.Time{}
+	return d
+}
+
 func TestCreateDeviceMock(t *testing.T) {
 	mockRepo := new(mocks.Device)
 	useCase := &impl.UseCase{
 		Repo: mockRepo,
 	}
 
-	mockRepo.On("CreateDevice", mock.Anything).Return(nil)
-	err := useCase.CreateDevice(domain.Device{})
-	mockRepo.AssertCalled(t, "CreateDevice", mock.Anything)
+	stored := domain.Device{SerialNum: "1", IP: "0.0.0.0", Status: domain.DefaultStatus, Revision: 1}
+	mockRepo.On("CreateDevice", mock.Anything, mock.Anything).Return(stored, nil)
+	created, err := useCase.CreateDevice(context.Background(), domain.Device{SerialNum: "1", IP: "0.0.0.0"})
+	mockRepo.AssertCalled(t, "CreateDevice", mock.Anything, mock.Anything)
 	assert.NoError(t, err)
+	assert.Equal(t, stored, created)
+}
+
+func TestCreateDeviceValidation(t *testing.T) {
+	mockRepo := new(mocks.Device)
+	useCase := &impl.UseCase{
+		Repo: mockRepo,
+	}
+
+	_, err := useCase.CreateDevice(context.Background(), domain.Device{IP: "300.0.0.1"})
+	assert.ErrorIs(t, err, domain.ErrValidation)
+	var verr *domain.ValidationError
+	if assert.ErrorAs(t, err, &verr) {
+		assert.Equal(t, []domain.FieldError{
+			{Field: "serial_num", Message: "must not be empty"},
+			{Field: "ip", Message: "must be a valid IPv4 address"},
+		}, verr.Fields)
+	}
+	mockRepo.AssertNotCalled(t, "CreateDevice", mock.Anything, mock.Anything)
+}
+
+func TestCreateDeviceValidatesDetails(t *testing.T) {
+	testCases := []struct {
+		name          string
+		device        domain.Device
+		expectedField string
+	}{
+		{name: "mac", device: domain.Device{MAC: "00:zz"}, expectedField: "mac"},
+		{name: "hostname", device: domain.Device{Hostname: "-bad-.example"}, expectedField: "hostname"},
+		{name: "status", device: domain.Device{Status: "lost"}, expectedField: "status"},
+		{name: "labels", device: domain.Device{Labels: map[string]string{"": "x"}}, expectedField: "labels"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := impl.New(repository.New())
+			tc.device.SerialNum = "1"
+			tc.device.IP = "1.1.1.1"
+
+			_, err := service.CreateDevice(context.Background(), tc.device)
+			var verr *domain.ValidationError
+			if assert.ErrorAs(t, err, &verr) {
+				assert.Len(t, verr.Fields, 1)
+				assert.Equal(t, tc.expectedField, verr.Fields[0].Field)
+			}
+		})
+	}
+}
+
+func TestCreateDeviceKeepsErrorChain(t *testing.T) {
+	mockRepo := new(mocks.Device)
+	useCase := &impl.UseCase{
+		Repo: mockRepo,
+	}
+	mockRepo.On("CreateDevice", mock.Anything, mock.Anything).Return(domain.Device{}, fmt.Errorf("%w: device is already in repository", domain.ErrAlreadyExists))
+
+	_, err := useCase.CreateDevice(context.Background(), domain.Device{SerialNum: "1", IP: "0.0.0.0"})
+	assert.ErrorIs(t, err, domain.ErrAlreadyExists)
 }
 func TestGetDeviceMock(t *testing.T) {
 	testCases := []struct {
@@ -54,11 +127,11 @@ func TestGetDeviceMock(t *testing.T) {
 			Repo: mockRepo,
 		}
 
-		mockRepo.On("GetDevice", tc.serialNum).Return(tc.expectedDevice, tc.expectedError)
+		mockRepo.On("GetDevice", mock.Anything, tc.serialNum).Return(tc.expectedDevice, tc.expectedError)
 
-		device, err := useCase.GetDevice(tc.serialNum)
+		device, err := useCase.GetDevice(context.Background(), tc.serialNum)
 
-		mockRepo.AssertCalled(t, "GetDevice", tc.serialNum)
+		mockRepo.AssertCalled(t, "GetDevice", mock.Anything, tc.serialNum)
 
 		assert.Equal(t, tc.expectedDevice, device)
 		assert.Equal(t, tc.expectedError, err)
@@ -71,8 +144,8 @@ func TestDeleteDeviceMock(t *testing.T) {
 		Repo: mockRepo,
 	}
 	serialNum := "1"
-	mockRepo.On("DeleteDevice", serialNum).Return(errors.New("no device"))
-	err := useCase.DeleteDevice(serialNum)
+	mockRepo.On("DeleteDevice", mock.Anything, serialNum, uint64(0)).Return(errors.New("no device"))
+	err := useCase.DeleteDevice(context.Background(), serialNum, 0)
 	assert.Equal(t, errors.New("no device"), err)
 
 }
@@ -87,16 +160,43 @@ func TestUpdateDeviceMock(t *testing.T) {
 		Model:     "ppp",
 		IP:        "1.1.1.1",
 	}
-	mockRepo.On("UpdateDevice", device).Return(errors.New("no device"))
-	err := useCase.UpdateDevice(device)
+	mockRepo.On("UpdateDevice", mock.Anything, device).Return(domain.Device{}, errors.New("no device"))
+	_, err := useCase.UpdateDevice(context.Background(), device)
 	assert.Equal(t, errors.New("no device"), err)
 }
 
+func TestListDevicesMock(t *testing.T) {
+	testCases := []struct {
+		name          string
+		filter        domain.DeviceFilter
+		expectedLimit int
+	}{
+		{name: "default limit", filter: domain.DeviceFilter{}, expectedLimit: impl.DefaultPageSize},
+		{name: "custom limit", filter: domain.DeviceFilter{Limit: 10}, expectedLimit: 10},
+		{name: "clamped limit", filter: domain.DeviceFilter{Limit: impl.MaxPageSize + 1}, expectedLimit: impl.MaxPageSize},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockRepo := new(mocks.Device)
+			useCase := &impl.UseCase{
+				Repo: mockRepo,
+			}
+			expected := domain.DeviceFilter{SortBy: domain.SortBySerialNum, Limit: tc.expectedLimit}
+			mockRepo.On("ListDevices", mock.Anything, expected).Return(domain.DevicePage{}, nil)
+
+			_, err := useCase.ListDevices(context.Background(), tc.filter)
+			assert.NoError(t, err)
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
 func FuzzCreateDevice(f *testing.F) {
 	repo := repository.New()
 	service := impl.New(repo)
 	f.Fuzz(func(t *testing.T, serialNum string) {
-		if _, err := service.GetDevice(serialNum); err != nil {
+		if _, err := service.GetDevice(context.Background(), serialNum); err != nil {
 			return
 		}
 		d := domain.Device{
@@ -104,7 +204,10 @@ func FuzzCreateDevice(f *testing.F) {
 			Model:     "xxx",
 			IP:        "0.0.0.0",
 		}
-		err := service.CreateDevice(d)
+		_, err := service.CreateDevice(context.Background(), d)
+		if errors.Is(err, domain.ErrValidation) {
+			return
+		}
 		if err != nil {
 			t.Errorf("something wrong %v", err)
 		}
@@ -119,19 +222,22 @@ func TestCreateDevice(t *testing.T) {
 		Model:     "model1",
 		IP:        "1.1.1.1",
 	}
-	err := service.CreateDevice(wantDevice)
+	created, err := service.CreateDevice(context.Background(), wantDevice)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	gotDevice, err := service.GetDevice(wantDevice.SerialNum)
+	gotDevice, err := service.GetDevice(context.Background(), wantDevice.SerialNum)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	if wantDevice != gotDevice {
+	wantDevice.Revision = 1
+	wantDevice.Status = domain.DefaultStatus
+	if !reflect.DeepEqual(wantDevice, withoutTimestamps(gotDevice)) {
 		t.Errorf("want device %+#v not equal got %+#v", wantDevice, gotDevice)
 	}
+	assert.Equal(t, gotDevice, created)
 }
 
 func TestCreateMultipleDevices(t *testing.T) {
@@ -156,19 +262,21 @@ func TestCreateMultipleDevices(t *testing.T) {
 	}
 
 	for _, d := range devices {
-		err := service.CreateDevice(d)
+		_, err := service.CreateDevice(context.Background(), d)
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
 	}
 
 	for _, wantDevice := range devices {
-		gotDevice, err := service.GetDevice(wantDevice.SerialNum)
+		gotDevice, err := service.GetDevice(context.Background(), wantDevice.SerialNum)
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
 
-		if wantDevice != gotDevice {
+		wantDevice.Revision = 1
+		wantDevice.Status = domain.DefaultStatus
+		if !reflect.DeepEqual(wantDevice, withoutTimestamps(gotDevice)) {
 			t.Errorf("want device %+#v not equal got %+#v", wantDevice, gotDevice)
 		}
 	}
@@ -183,12 +291,12 @@ func TestCreateDuplicate(t *testing.T) {
 		IP:        "1.1.1.1",
 	}
 
-	err := service.CreateDevice(wantDevice)
+	_, err := service.CreateDevice(context.Background(), wantDevice)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	err = service.CreateDevice(wantDevice)
+	_, err = service.CreateDevice(context.Background(), wantDevice)
 	if err == nil {
 		t.Errorf("want error, but got nil")
 	}
@@ -204,12 +312,12 @@ func TestGetDeviceUnexisting(t *testing.T) {
 		IP:        "1.1.1.1",
 	}
 
-	err := service.CreateDevice(wantDevice)
+	_, err := service.CreateDevice(context.Background(), wantDevice)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	_, err = service.GetDevice("1")
+	_, err = service.GetDevice(context.Background(), "1")
 	if err == nil {
 		t.Error("want error, but got nil")
 	}
@@ -224,17 +332,17 @@ func TestDeleteDevice(t *testing.T) {
 		IP:        "1.1.1.1",
 	}
 
-	err := service.CreateDevice(newDevice)
+	_, err := service.CreateDevice(context.Background(), newDevice)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	err = service.DeleteDevice(newDevice.SerialNum)
+	err = service.DeleteDevice(context.Background(), newDevice.SerialNum, 0)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	_, err = service.GetDevice(newDevice.SerialNum)
+	_, err = service.GetDevice(context.Background(), newDevice.SerialNum)
 	if err == nil {
 		t.Error("want error, but got nil")
 	}
@@ -244,7 +352,7 @@ func TestDeleteDeviceUnexisting(t *testing.T) {
 	repo := repository.New()
 	service := impl.New(repo)
 
-	err := service.DeleteDevice("123")
+	err := service.DeleteDevice(context.Background(), "123", 0)
 	if err == nil {
 		t.Errorf("want error, but got nil")
 	}
@@ -259,7 +367,7 @@ func TestUpdateDevice(t *testing.T) {
 		IP:        "1.1.1.1",
 	}
 
-	err := service.CreateDevice(device)
+	_, err := service.CreateDevice(context.Background(), device)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -269,21 +377,51 @@ func TestUpdateDevice(t *testing.T) {
 		Model:     "model1",
 		IP:        "1.1.1.2",
 	}
-	err = service.UpdateDevice(newDevice)
+	_, err = service.UpdateDevice(context.Background(), newDevice)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	gotDevice, err := service.GetDevice(newDevice.SerialNum)
+	gotDevice, err := service.GetDevice(context.Background(), newDevice.SerialNum)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	if gotDevice != newDevice {
+	newDevice.Revision = 2
+	newDevice.Status = domain.DefaultStatus
+	if !reflect.DeepEqual(withoutTimestamps(gotDevice), newDevice) {
 		t.Errorf("new device %+#v not equal got device %+#v", newDevice, gotDevice)
 	}
 }
 
+func TestUpdateDeviceKeepsServerManagedFields(t *testing.T) {
+	service := impl.New(repository.New())
+	device := domain.Device{
+		SerialNum: "123",
+		Model:     "model1",
+		IP:        "1.1.1.1",
+		Labels:    map[string]string{"site": "a"},
+		Status:    domain.StatusActive,
+	}
+	created, err := service.CreateDevice(context.Background(), device)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	update := domain.Device{SerialNum: "123", Model: "model2", IP: "1.1.1.1", CreatedAt: time.Unix(0, 0)}
+	updated, err := service.UpdateDevice(context.Background(), update)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, _ := service.GetDevice(context.Background(), "123")
+	assert.Equal(t, stored, updated)
+
+	assert.Equal(t, created.CreatedAt, updated.CreatedAt)
+	assert.True(t, updated.UpdatedAt.After(created.UpdatedAt))
+	assert.Equal(t, domain.StatusActive, updated.Status)
+	assert.Nil(t, updated.Labels)
+}
+
 func TestUpdateDeviceUnexsting(t *testing.T) {
 	repo := repository.New()
 	service := impl.New(repo)
@@ -293,7 +431,7 @@ func TestUpdateDeviceUnexsting(t *testing.T) {
 		IP:        "1.1.1.1",
 	}
 
-	err := service.CreateDevice(device)
+	_, err := service.CreateDevice(context.Background(), device)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -303,8 +441,692 @@ func TestUpdateDeviceUnexsting(t *testing.T) {
 		Model:     "model1",
 		IP:        "1.1.1.2",
 	}
-	err = service.UpdateDevice(newDevice)
+	_, err = service.UpdateDevice(context.Background(), newDevice)
 	if err == nil {
 		t.Errorf("want err, but got nil")
 	}
 }
+
+func TestPatchDevice(t *testing.T) {
+	testCases := []struct {
+		name          string
+		patch         domain.Patch
+		revision      uint64
+		expected      domain.Device
+		expectedError error
+		// expectedMessage, when set, is part of the expected error message.
+		expectedMessage string
+	}{
+		{
+			name:     "merge patch keeps untouched fields",
+			patch:    domain.Patch{Type: domain.MergePatch, Document: []byte(`{"model":"model2"}`)},
+			expected: domain.Device{SerialNum: "123", Model: "model2", IP: "1.1.1.1", Status: domain.StatusOrdered, Revision: 2},
+		},
+		{
+			name: "json patch with passing test",
+			patch: domain.Patch{Type: domain.JSONPatch, Document: []byte(`[
+				{"op":"test","path":"/model","value":"model1"},
+				{"op":"replace","path":"/ip","value":"2.2.2.2"}
+			]`)},
+			revision: 1,
+			expected: domain.Device{SerialNum: "123", Model: "model1", IP: "2.2.2.2", Status: domain.StatusOrdered, Revision: 2},
+		},
+		{
+			name: "json patch with failing test",
+			patch: domain.Patch{Type: domain.JSONPatch, Document: []byte(`[
+				{"op":"test","path":"/model","value":"other"},
+				{"op":"replace","path":"/ip","value":"2.2.2.2"}
+			]`)},
+			expectedError: domain.ErrConflict,
+		},
+		{
+			name:          "result is re-validated",
+			patch:         domain.Patch{Type: domain.MergePatch, Document: []byte(`{"ip":"not-an-ip"}`)},
+			expectedError: domain.ErrValidation,
+		},
+		{
+			name:            "serial number is immutable",
+			patch:           domain.Patch{Type: domain.MergePatch, Document: []byte(`{"serial_num":"999"}`)},
+			expectedError:   domain.ErrValidation,
+			expectedMessage: "serial_num: is immutable",
+		},
+		{
+			name:          "unknown fields are rejected",
+			patch:         domain.Patch{Type: domain.MergePatch, Document: []byte(`{"Color":"red"}`)},
+			expectedError: domain.ErrValidation,
+		},
+		{
+			name:          "malformed patch",
+			patch:         domain.Patch{Type: domain.JSONPatch, Document: []byte(`{"op":"replace"}`)},
+			expectedError: domain.ErrValidation,
+		},
+		{
+			name:          "stale revision",
+			patch:         domain.Patch{Type: domain.MergePatch, Document: []byte(`{"model":"model2"}`)},
+			revision:      7,
+			expectedError: domain.ErrPreconditionFailed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := repository.New()
+			service := impl.New(repo)
+			original := domain.Device{SerialNum: "123", Model: "model1", IP: "1.1.1.1"}
+			if _, err := service.CreateDevice(context.Background(), original); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := service.PatchDevice(context.Background(), "123", tc.patch, tc.revision)
+			if tc.expectedError != nil {
+				assert.ErrorIs(t, err, tc.expectedError)
+				if tc.expectedMessage != "" {
+					assert.ErrorContains(t, err, tc.expectedMessage)
+				}
+				stored, _ := service.GetDevice(context.Background(), "123")
+				assert.Equal(t, uint64(1), stored.Revision)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, withoutTimestamps(got))
+			stored, _ := service.GetDevice(context.Background(), "123")
+			assert.Equal(t, got, stored)
+			assert.True(t, stored.UpdatedAt.After(stored.CreatedAt))
+		})
+	}
+}
+
+func TestPatchDeviceRetriesOnConcurrentUpdate(t *testing.T) {
+	mockRepo := new(mocks.Device)
+	useCase := &impl.UseCase{
+		Repo: mockRepo,
+	}
+	first := domain.Device{SerialNum: "1", Model: "a", IP: "1.1.1.1", Revision: 1}
+	second := domain.Device{SerialNum: "1", Model: "b", IP: "1.1.1.1", Revision: 2}
+	mockRepo.On("GetDevice", mock.Anything, "1").Return(first, nil).Once()
+	mockRepo.On("GetDevice", mock.Anything, "1").Return(second, nil).Once()
+	mockRepo.On("UpdateDevice", mock.Anything, domain.Device{SerialNum: "1", Model: "a", IP: "2.2.2.2", Revision: 1}).
+		Return(domain.Device{}, fmt.Errorf("%w: device is at revision 2, not 1", domain.ErrPreconditionFailed)).Once()
+	// The device the write stored is returned without reading it again.
+	stored := domain.Device{SerialNum: "1", Model: "b", IP: "2.2.2.2", Revision: 3}
+	mockRepo.On("UpdateDevice", mock.Anything, domain.Device{SerialNum: "1", Model: "b", IP: "2.2.2.2", Revision: 2}).
+		Return(stored, nil).Once()
+
+	got, err := useCase.PatchDevice(context.Background(), "1", domain.Patch{Type: domain.MergePatch, Document: []byte(`{"ip":"2.2.2.2"}`)}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, stored, got)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestTransitionDevice(t *testing.T) {
+	testCases := []struct {
+		name          string
+		from          domain.Status
+		transition    domain.Transition
+		revision      uint64
+		anonymous     bool
+		expectedError error
+	}{
+		{
+			name:       "legal transition",
+			from:       domain.StatusActive,
+			transition: domain.Transition{To: domain.StatusMaintenance, Reason: "fan replacement"},
+		},
+		{
+			name:       "legal transition with revision",
+			from:       domain.StatusMaintenance,
+			transition: domain.Transition{To: domain.StatusActive},
+			revision:   1,
+		},
+		{
+			name:          "skipping a state",
+			from:          domain.StatusOrdered,
+			transition:    domain.Transition{To: domain.StatusActive},
+			expectedError: domain.ErrConflict,
+		},
+		{
+			name:          "same state",
+			from:          domain.StatusActive,
+			transition:    domain.Transition{To: domain.StatusActive},
+			expectedError: domain.ErrConflict,
+		},
+		{
+			name:          "disposed is final",
+			from:          domain.StatusDisposed,
+			transition:    domain.Transition{To: domain.StatusOrdered},
+			expectedError: domain.ErrConflict,
+		},
+		{
+			name:          "unknown status",
+			from:          domain.StatusActive,
+			transition:    domain.Transition{To: "lost"},
+			expectedError: domain.ErrValidation,
+		},
+		{
+			name:          "actor is required",
+			from:          domain.StatusActive,
+			transition:    domain.Transition{To: domain.StatusMaintenance},
+			anonymous:     true,
+			expectedError: domain.ErrValidation,
+		},
+		{
+			name:          "stale revision",
+			from:          domain.StatusActive,
+			transition:    domain.Transition{To: domain.StatusMaintenance},
+			revision:      7,
+			expectedError: domain.ErrPreconditionFailed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := impl.New(repository.New())
+			device := domain.Device{SerialNum: "1", Model: "m", IP: "1.1.1.1", Status: tc.from}
+			if _, err := service.CreateDevice(context.Background(), device); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			ctx := context.Background()
+			if !tc.anonymous {
+				ctx = domain.WithActor(ctx, "alice")
+			}
+			got, err := service.TransitionDevice(ctx, "1", tc.transition, tc.revision)
+			if tc.expectedError != nil {
+				assert.ErrorIs(t, err, tc.expectedError)
+				stored, _ := service.GetDevice(context.Background(), "1")
+				assert.Equal(t, tc.from, stored.Status)
+				assert.Empty(t, stored.Transitions)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.transition.To, got.Status)
+			if assert.Len(t, got.Transitions, 1) {
+				recorded := got.Transitions[0]
+				assert.Equal(t, tc.from, recorded.From)
+				assert.Equal(t, tc.transition.To, recorded.To)
+				assert.Equal(t, "alice", recorded.Actor)
+				assert.Equal(t, tc.transition.Reason, recorded.Reason)
+				assert.False(t, recorded.At.IsZero())
+			}
+		})
+	}
+}
+
+func TestTransitionErrorListsAllowedStatuses(t *testing.T) {
+	service := impl.New(repository.New())
+	if _, err := service.CreateDevice(context.Background(), domain.Device{SerialNum: "1", IP: "1.1.1.1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := service.TransitionDevice(domain.WithActor(context.Background(), "alice"), "1", domain.Transition{To: domain.StatusDisposed}, 0)
+	var terr *domain.TransitionError
+	if assert.ErrorAs(t, err, &terr) {
+		assert.Equal(t, domain.StatusOrdered, terr.From)
+		assert.Equal(t, domain.StatusDisposed, terr.To)
+		assert.Equal(t, []domain.Status{domain.StatusProvisioned}, terr.Allowed)
+	}
+}
+
+func TestUpdateDeviceEnforcesLifecycle(t *testing.T) {
+	service := impl.New(repository.New())
+	if _, err := service.CreateDevice(context.Background(), domain.Device{SerialNum: "1", IP: "1.1.1.1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := service.UpdateDevice(context.Background(), domain.Device{SerialNum: "1", IP: "1.1.1.1", Status: domain.StatusDisposed})
+	assert.ErrorIs(t, err, domain.ErrConflict)
+
+	_, err = service.UpdateDevice(context.Background(), domain.Device{SerialNum: "1", IP: "1.1.1.1", Status: domain.StatusProvisioned})
+	assert.NoError(t, err)
+	_, err = service.PatchDevice(context.Background(), "1", domain.Patch{Type: domain.MergePatch, Document: []byte(`{"status":"active"}`)}, 0)
+	assert.NoError(t, err)
+
+	// Clients cannot rewrite the history.
+	_, err = service.UpdateDevice(context.Background(), domain.Device{SerialNum: "1", IP: "1.1.1.1", Transitions: []domain.Transition{{To: "x"}}})
+	assert.NoError(t, err)
+	_, err = service.PatchDevice(context.Background(), "1", domain.Patch{Type: domain.MergePatch, Document: []byte(`{"transitions":null}`)}, 0)
+	assert.NoError(t, err)
+
+	stored, _ := service.GetDevice(context.Background(), "1")
+	assert.Equal(t, domain.StatusActive, stored.Status)
+	if assert.Len(t, stored.Transitions, 2) {
+		assert.Equal(t, domain.StatusOrdered, stored.Transitions[0].From)
+		assert.Equal(t, domain.StatusProvisioned, stored.Transitions[1].From)
+		assert.Equal(t, domain.StatusActive, stored.Transitions[1].To)
+	}
+}
+
+func TestRevertDevice(t *testing.T) {
+	testCases := []struct {
+		name          string
+		toRevision    uint64
+		revision      uint64
+		expected      domain.Device
+		expectedError error
+	}{
+		{
+			name:       "restores the old fields",
+			toRevision: 1,
+			expected:   domain.Device{SerialNum: "1", Model: "a", IP: "1.1.1.1", Status: domain.StatusOrdered, Revision: 3},
+		},
+		{
+			name:       "with matching revision",
+			toRevision: 1,
+			revision:   2,
+			expected:   domain.Device{SerialNum: "1", Model: "a", IP: "1.1.1.1", Status: domain.StatusOrdered, Revision: 3},
+		},
+		{
+			name:          "stale revision",
+			toRevision:    1,
+			revision:      1,
+			expectedError: domain.ErrPreconditionFailed,
+		},
+		{
+			name:          "unknown revision",
+			toRevision:    9,
+			expectedError: domain.ErrNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := impl.New(repository.New())
+			ctx := context.Background()
+			if _, err := service.CreateDevice(ctx, domain.Device{SerialNum: "1", Model: "a", IP: "1.1.1.1"}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := service.UpdateDevice(ctx, domain.Device{SerialNum: "1", Model: "b", IP: "2.2.2.2"}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := service.RevertDevice(domain.WithActor(ctx, "alice"), "1", tc.toRevision, tc.revision)
+			if tc.expectedError != nil {
+				assert.ErrorIs(t, err, tc.expectedError)
+				stored, _ := service.GetDevice(ctx, "1")
+				assert.Equal(t, uint64(2), stored.Revision)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, withoutTimestamps(got))
+
+			entries, err := service.GetDeviceHistory(ctx, "1")
+			assert.NoError(t, err)
+			if assert.Len(t, entries, 3) {
+				assert.Equal(t, domain.OpUpdate, entries[2].Op)
+				assert.Equal(t, "alice", entries[2].Actor)
+				assert.Equal(t, "2.2.2.2", entries[2].Before.IP)
+			}
+		})
+	}
+}
+
+func TestRevertDeviceKeepsLifecycle(t *testing.T) {
+	service := impl.New(repository.New())
+	ctx := context.Background()
+	if _, err := service.CreateDevice(ctx, domain.Device{SerialNum: "1", IP: "1.1.1.1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := service.TransitionDevice(domain.WithActor(ctx, "alice"), "1", domain.Transition{To: domain.StatusProvisioned}, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// ordered is not reachable from provisioned, so neither is revision 1.
+	_, err := service.RevertDevice(ctx, "1", 1, 0)
+	assert.ErrorIs(t, err, domain.ErrConflict)
+}
+
+func TestTransitionDeviceRecordsActorFromContext(t *testing.T) {
+	service := impl.New(repository.New())
+	ctx := domain.WithActor(context.Background(), "bob")
+	if _, err := service.CreateDevice(ctx, domain.Device{SerialNum: "1", IP: "1.1.1.1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := service.TransitionDevice(ctx, "1", domain.Transition{To: domain.StatusProvisioned, Actor: "mallory"}, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, got.Transitions, 1) {
+		assert.Equal(t, "bob", got.Transitions[0].Actor)
+	}
+}
+
+func TestRestoreDevice(t *testing.T) {
+	service := impl.New(repository.New())
+	ctx := context.Background()
+	if _, err := service.CreateDevice(ctx, domain.Device{SerialNum: "1", IP: "1.1.1.1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := service.DeleteDevice(ctx, "1", 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	trash, err := service.ListTrash(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, trash, 1)
+
+	got, err := service.RestoreDevice(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.Device{SerialNum: "1", IP: "1.1.1.1", Status: domain.StatusOrdered, Revision: 2}, withoutTimestamps(got))
+
+	_, err = service.RestoreDevice(ctx, "2")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
+
+func TestPurgeTrashKeepsRecentDeletes(t *testing.T) {
+	service := impl.New(repository.New())
+	ctx := context.Background()
+	if _, err := service.CreateDevice(ctx, domain.Device{SerialNum: "1", IP: "1.1.1.1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := service.DeleteDevice(ctx, "1", 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n, err := service.PurgeTrash(ctx, time.Hour)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	n, err = service.PurgeTrash(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = service.RestoreDevice(ctx, "1")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
+
+func TestBatchDevices(t *testing.T) {
+	service := impl.New(repository.New())
+	ctx := domain.WithActor(context.Background(), "alice")
+
+	results, err := service.BatchDevices(ctx, []domain.BatchOperation{
+		{Op: domain.OpCreate, Device: domain.Device{SerialNum: "1", IP: "1.1.1.1"}},
+		{Op: domain.OpCreate, Device: domain.Device{SerialNum: "2", IP: "bad"}},
+		{Op: domain.OpUpdate, Device: domain.Device{SerialNum: "1", IP: "1.1.1.1", Status: domain.StatusActive}},
+		{Op: domain.OpUpdate, Device: domain.Device{SerialNum: "1", IP: "1.1.1.2"}},
+		{Op: "rename", SerialNum: "1"},
+	}, false)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 5) {
+		assert.Equal(t, domain.StatusOrdered, results[0].Device.Status)
+		assert.ErrorIs(t, results[1].Err, domain.ErrValidation)
+		// Checked against the device as it was before the batch.
+		assert.ErrorIs(t, results[2].Err, domain.ErrNotFound)
+		assert.Equal(t, "1.1.1.2", results[3].Device.IP)
+		assert.ErrorIs(t, results[4].Err, domain.ErrValidation)
+	}
+
+	results, err = service.BatchDevices(ctx, []domain.BatchOperation{
+		{Op: domain.OpUpdate, Device: domain.Device{SerialNum: "1", IP: "1.1.1.1", Status: domain.StatusProvisioned}},
+		{Op: domain.OpUpdate, Device: domain.Device{SerialNum: "1", IP: "1.1.1.1", Status: domain.StatusDisposed}},
+	}, false)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 2) && assert.NoError(t, results[0].Err) {
+		assert.Equal(t, domain.StatusProvisioned, results[0].Device.Status)
+		if assert.Len(t, results[0].Device.Transitions, 1) {
+			assert.Equal(t, "alice", results[0].Device.Transitions[0].Actor)
+		}
+	}
+	assert.ErrorIs(t, results[1].Err, domain.ErrConflict)
+
+	results, err = service.BatchDevices(ctx, []domain.BatchOperation{
+		{Op: domain.OpCreate, Device: domain.Device{SerialNum: "3", IP: "1.1.1.3"}},
+		{Op: domain.OpDelete},
+	}, true)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 2) {
+		assert.ErrorIs(t, results[0].Err, domain.ErrAborted)
+		assert.ErrorIs(t, results[1].Err, domain.ErrValidation)
+	}
+	_, err = service.GetDevice(ctx, "3")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+
+	_, err = service.BatchDevices(ctx, nil, false)
+	assert.ErrorIs(t, err, domain.ErrValidation)
+}
+
+func TestImportDevices(t *testing.T) {
+	ctx := context.Background()
+	rows := []domain.ImportRow{
+		{Row: 2, Device: domain.Device{SerialNum: "1", IP: "1.1.1.1", Model: "new"}},
+		{Row: 3, Device: domain.Device{SerialNum: "2", IP: "1.1.1.2"}},
+		{Row: 4, Device: domain.Device{SerialNum: "3", IP: "not an ip"}},
+		{Row: 5, Device: domain.Device{SerialNum: "2", IP: "1.1.1.2"}},
+		{Row: 6, Err: domain.NewValidationError(domain.FieldError{Field: "row", Message: "bad"})},
+	}
+	newService := func(t *testing.T) *impl.UseCase {
+		service := impl.New(repository.New())
+		if _, err := service.CreateDevice(ctx, domain.Device{SerialNum: "1", IP: "1.1.1.1", Model: "old"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return service
+	}
+	errorRows := func(report domain.ImportReport) []int {
+		var out []int
+		for _, e := range report.Errors {
+			out = append(out, e.Row)
+		}
+		return out
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		service := newService(t)
+		report, err := service.ImportDevices(ctx, rows, domain.ImportOptions{OnConflict: domain.ConflictSkip})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, report.Created)
+		assert.Equal(t, 1, report.Skipped)
+		assert.Equal(t, []int{4, 5, 6}, errorRows(report))
+		assert.ErrorIs(t, report.Errors[0].Err, domain.ErrValidation)
+		got, _ := service.GetDevice(ctx, "1")
+		assert.Equal(t, "old", got.Model)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		service := newService(t)
+		report, err := service.ImportDevices(ctx, rows, domain.ImportOptions{OnConflict: domain.ConflictOverwrite})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, report.Created)
+		assert.Equal(t, 1, report.Updated)
+		got, _ := service.GetDevice(ctx, "1")
+		assert.Equal(t, "new", got.Model)
+		assert.Equal(t, domain.StatusOrdered, got.Status)
+	})
+
+	t.Run("fail writes nothing", func(t *testing.T) {
+		service := newService(t)
+		report, err := service.ImportDevices(ctx, rows, domain.ImportOptions{})
+		assert.NoError(t, err)
+		assert.Zero(t, report.Created)
+		assert.Equal(t, []int{2, 4, 5, 6}, errorRows(report))
+		assert.ErrorIs(t, report.Errors[0].Err, domain.ErrAlreadyExists)
+		_, err = service.GetDevice(ctx, "2")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		service := newService(t)
+		report, err := service.ImportDevices(ctx, rows[:2], domain.ImportOptions{OnConflict: domain.ConflictOverwrite, DryRun: true})
+		assert.NoError(t, err)
+		assert.Equal(t, domain.ImportReport{DryRun: true, Created: 1, Updated: 1}, report)
+		_, err = service.GetDevice(ctx, "2")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		got, _ := service.GetDevice(ctx, "1")
+		assert.Equal(t, "old", got.Model)
+	})
+
+	t.Run("unknown conflict mode", func(t *testing.T) {
+		_, err := newService(t).ImportDevices(ctx, rows, domain.ImportOptions{OnConflict: "merge"})
+		assert.ErrorIs(t, err, domain.ErrValidation)
+	})
+}
+
+func TestAccessControl(t *testing.T) {
+	policy, err := rbac.Parse([]byte(`
+roles:
+  admin:
+    - permission: "*"
+  technician:
+    - permission: devices.read
+    - permission: devices.update
+      models: [X100]
+      labels: {site: ams}
+  auditor:
+    - permission: devices.read
+      models: [X200]
+  installer:
+    - permission: devices.read
+      models: [X200]
+    - permission: devices.update
+  registrar:
+    - permission: devices.create
+    - permission: devices.update
+      models: [X300]
+subjects:
+  ci: [admin]
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	service := impl.New(repository.New())
+	service.Policy = policy
+	// As the transports do, the principal is the actor too.
+	as := func(p auth.Principal) context.Context {
+		return auth.WithPrincipal(domain.WithActor(context.Background(), p.Subject), p)
+	}
+	admin := as(auth.Principal{Subject: "ci", Method: auth.MethodAPIKey})
+	technician := as(auth.Principal{Subject: "bob", Method: auth.MethodJWT, Roles: []string{"technician", "billing"}})
+	ams := map[string]string{"site": "ams"}
+
+	for _, d := range []domain.Device{
+		{SerialNum: "1", Model: "X100", IP: "1.1.1.1", Labels: ams},
+		{SerialNum: "2", Model: "X200", IP: "1.1.1.2", Labels: ams},
+	} {
+		_, err := service.CreateDevice(admin, d)
+		assert.NoError(t, err)
+	}
+
+	missing := func(permission, serialNum string) *domain.PermissionError {
+		return &domain.PermissionError{Permission: permission, SerialNum: serialNum}
+	}
+	assertDenied := func(t *testing.T, want *domain.PermissionError, err error) {
+		t.Helper()
+		assert.ErrorIs(t, err, domain.ErrForbidden)
+		var perr *domain.PermissionError
+		if assert.ErrorAs(t, err, &perr) {
+			assert.Equal(t, want, perr)
+		}
+	}
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		_, err := service.GetDevice(context.Background(), "1")
+		assertDenied(t, missing("devices.read", ""), err)
+	})
+
+	t.Run("technician reads everything", func(t *testing.T) {
+		page, err := service.ListDevices(technician, domain.DeviceFilter{})
+		assert.NoError(t, err)
+		assert.Len(t, page.Devices, 2)
+		_, err = service.GetDevice(technician, "2")
+		assert.NoError(t, err)
+	})
+
+	t.Run("scoped reads only see devices in scope", func(t *testing.T) {
+		auditor := as(auth.Principal{Subject: "eve", Method: auth.MethodJWT, Roles: []string{"auditor"}})
+		page, err := service.ListDevices(auditor, domain.DeviceFilter{})
+		assert.NoError(t, err)
+		if assert.Len(t, page.Devices, 1) {
+			assert.Equal(t, "2", page.Devices[0].SerialNum)
+		}
+		// Devices out of scope look like they do not exist at all.
+		_, err = service.GetDevice(auditor, "1")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		assert.NotErrorIs(t, err, domain.ErrForbidden)
+		_, err = service.GetDeviceHistory(auditor, "1")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+
+		ctx, cancel := context.WithCancel(auditor)
+		defer cancel()
+		changes, err := service.WatchDevices(ctx, 0)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = service.PatchDevice(admin, "1", domain.Patch{Type: domain.MergePatch, Document: []byte(`{"hostname":"a"}`)}, 0)
+		assert.NoError(t, err)
+		_, err = service.PatchDevice(admin, "2", domain.Patch{Type: domain.MergePatch, Document: []byte(`{"hostname":"b"}`)}, 0)
+		assert.NoError(t, err)
+		select {
+		case e := <-changes:
+			assert.Equal(t, "2", e.SerialNum)
+		case <-time.After(time.Second):
+			t.Fatal("no change")
+		}
+	})
+
+	t.Run("revert needs read scope", func(t *testing.T) {
+		installer := as(auth.Principal{Subject: "ida", Method: auth.MethodJWT, Roles: []string{"installer"}})
+		before, err := service.GetDevice(admin, "1")
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = service.RevertDevice(installer, "1", 1, 0)
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		after, err := service.GetDevice(admin, "1")
+		assert.NoError(t, err)
+		assert.Equal(t, before.Revision, after.Revision)
+	})
+
+	t.Run("writes return devices the caller cannot read", func(t *testing.T) {
+		registrar := as(auth.Principal{Subject: "rita", Method: auth.MethodJWT, Roles: []string{"registrar"}})
+		created, err := service.CreateDevice(registrar, domain.Device{SerialNum: "4", Model: "X300", IP: "1.1.1.4"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(1), created.Revision)
+		}
+		updated, err := service.UpdateDevice(registrar, domain.Device{SerialNum: "4", Model: "X300", IP: "1.1.1.5"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "1.1.1.5", updated.IP)
+			assert.Equal(t, uint64(2), updated.Revision)
+		}
+		_, err = service.GetDevice(registrar, "4")
+		assertDenied(t, missing("devices.read", ""), err)
+	})
+
+	t.Run("technician cannot create or delete", func(t *testing.T) {
+		_, err := service.CreateDevice(technician, domain.Device{SerialNum: "3", Model: "X100", IP: "1.1.1.3", Labels: ams})
+		assertDenied(t, missing("devices.create", ""), err)
+		assertDenied(t, missing("devices.delete", ""), service.DeleteDevice(technician, "1", 0))
+	})
+
+	t.Run("technician updates devices in scope", func(t *testing.T) {
+		d, err := service.TransitionDevice(technician, "1", domain.Transition{To: domain.StatusProvisioned}, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", d.Transitions[0].Actor)
+
+		_, err = service.UpdateDevice(technician, domain.Device{SerialNum: "1", Model: "X100", IP: "1.1.1.9", Labels: ams})
+		assert.NoError(t, err)
+		_, err = service.UpdateDevice(technician, domain.Device{SerialNum: "2", Model: "X200", IP: "1.1.1.9", Labels: ams})
+		assertDenied(t, missing("devices.update", "2"), err)
+		// A device cannot be moved out of the scope either.
+		_, err = service.UpdateDevice(technician, domain.Device{SerialNum: "1", Model: "X200", IP: "1.1.1.9", Labels: ams})
+		assertDenied(t, missing("devices.update", "1"), err)
+		_, err = service.PatchDevice(technician, "1", domain.Patch{Type: domain.MergePatch, Document: []byte(`{"labels":{"site":"fra"}}`)}, 0)
+		assertDenied(t, missing("devices.update", "1"), err)
+	})
+
+	t.Run("batch operations are checked one by one", func(t *testing.T) {
+		results, err := service.BatchDevices(technician, []domain.BatchOperation{
+			{Op: domain.OpUpdate, Device: domain.Device{SerialNum: "1", Model: "X100", IP: "1.1.1.1", Labels: ams}},
+			{Op: domain.OpUpdate, Device: domain.Device{SerialNum: "2", Model: "X200", IP: "1.1.1.2", Labels: ams}},
+			{Op: domain.OpDelete, SerialNum: "1"},
+		}, false)
+		assert.NoError(t, err)
+		if assert.Len(t, results, 3) {
+			assert.NoError(t, results[0].Err)
+			assertDenied(t, missing("devices.update", "2"), results[1].Err)
+			assertDenied(t, missing("devices.delete", ""), results[2].Err)
+		}
+	})
+
+	t.Run("purge needs an unscoped grant", func(t *testing.T) {
+		_, err := service.PurgeTrash(technician, 0)
+		assertDenied(t, missing("devices.purge", ""), err)
+		_, err = service.PurgeTrash(as(auth.Principal{Subject: "purge", Method: auth.MethodInternal}), 0)
+		assert.NoError(t, err)
+	})
+}
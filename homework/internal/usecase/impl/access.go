@@ -0,0 +1,82 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"homework/internal/domain"
+	"homework/internal/rbac"
+)
+
+// authorize checks that the caller may perm d.
+func (uc *UseCase) authorize(ctx context.Context, perm rbac.Permission, d domain.Device) error {
+	scope, err := uc.Policy.Scope(ctx, perm)
+	if err != nil {
+		return err
+	}
+	return scope.Check(d)
+}
+
+// authorizeStored checks that the caller may perm the stored device. The
+// device is only read when the permission is limited to some devices.
+func (uc *UseCase) authorizeStored(ctx context.Context, perm rbac.Permission, serialNum string) error {
+	scope, err := uc.Policy.Scope(ctx, perm)
+	if err != nil || scope.All() {
+		return err
+	}
+	current, err := uc.Repo.GetDevice(ctx, serialNum)
+	if err != nil {
+		return err
+	}
+	return scope.Check(current)
+}
+
+// authorizeBatchOp checks a prepared batch operation like the single-device
+// method it stands for.
+func (uc *UseCase) authorizeBatchOp(ctx context.Context, op domain.BatchOperation) error {
+	switch op.Op {
+	case domain.OpCreate:
+		return uc.authorize(ctx, rbac.DevicesCreate, op.Device)
+	case domain.OpUpdate:
+		if err := uc.authorizeStored(ctx, rbac.DevicesUpdate, op.Device.SerialNum); err != nil {
+			return err
+		}
+		return uc.authorize(ctx, rbac.DevicesUpdate, op.Device)
+	default:
+		return uc.authorizeStored(ctx, rbac.DevicesDelete, op.SerialNum)
+	}
+}
+
+// checkReadable is scope.Check for reads: a device the caller may not read
+// is reported as missing, so that a denial does not reveal it exists.
+func checkReadable(scope rbac.Scope, d domain.Device) error {
+	if scope.Covers(d) {
+		return nil
+	}
+	return fmt.Errorf("%w: no device", domain.ErrNotFound)
+}
+
+// visible keeps the devices scope covers.
+func visible(scope rbac.Scope, devices []domain.Device) []domain.Device {
+	if scope.All() {
+		return devices
+	}
+	out := devices[:0:0]
+	for _, d := range devices {
+		if scope.Covers(d) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// entryDevice is the device a history entry is about: its state after the
+// change, or before it for a delete.
+func entryDevice(e domain.HistoryEntry) domain.Device {
+	if e.After != nil {
+		return *e.After
+	}
+	if e.Before != nil {
+		return *e.Before
+	}
+	return domain.Device{SerialNum: e.SerialNum}
+}
@@ -0,0 +1,102 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"homework/internal/domain"
+)
+
+// MaxBatchSize bounds the number of operations of a single batch.
+const MaxBatchSize = 10000
+
+// BatchDevices validates ops and applies the valid ones in a single
+// repository call. Results are in the order of ops. With atomic an invalid
+// operation aborts the whole batch before anything is written.
+//
+// A status change in an update is checked against the stored device and the
+// update is made conditional on the revision it was checked against, so an
+// earlier operation of the same batch on that device makes it fail with
+// domain.ErrPreconditionFailed rather than skip the lifecycle check.
+func (uc *UseCase) BatchDevices(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	if len(ops) == 0 {
+		return nil, domain.NewValidationError(domain.FieldError{Field: "operations", Message: "must not be empty"})
+	}
+	if len(ops) > MaxBatchSize {
+		return nil, domain.NewValidationError(domain.FieldError{
+			Field:   "operations",
+			Message: fmt.Sprintf("at most %d operations per batch", MaxBatchSize),
+		})
+	}
+
+	results := make([]domain.BatchResult, len(ops))
+	prepared := make([]domain.BatchOperation, 0, len(ops))
+	indexes := make([]int, 0, len(ops))
+	for i, op := range ops {
+		op, err := uc.prepareBatchOp(ctx, op)
+		if err == nil {
+			err = uc.authorizeBatchOp(ctx, op)
+		}
+		if err != nil {
+			if atomic {
+				return domain.AbortBatch(len(ops), i, err), nil
+			}
+			results[i].Err = err
+			continue
+		}
+		prepared = append(prepared, op)
+		indexes = append(indexes, i)
+	}
+	if len(prepared) == 0 {
+		return results, nil
+	}
+
+	applied, err := uc.Repo.BatchDevices(ctx, prepared, atomic)
+	if err != nil {
+		return nil, err
+	}
+	for j, r := range applied {
+		results[indexes[j]] = r
+	}
+	return results, nil
+}
+
+// prepareBatchOp applies the rules of CreateDevice and UpdateDevice to a
+// single operation.
+func (uc *UseCase) prepareBatchOp(ctx context.Context, op domain.BatchOperation) (domain.BatchOperation, error) {
+	switch op.Op {
+	case domain.OpCreate:
+		if op.Device.Status == "" {
+			op.Device.Status = domain.DefaultStatus
+		}
+		op.Device.Transitions = nil
+		return op, op.Device.Validate()
+	case domain.OpUpdate:
+		if err := op.Device.Validate(); err != nil {
+			return op, err
+		}
+		op.Device.Transitions = nil
+		if op.Device.Status == "" {
+			return op, nil
+		}
+		current, err := uc.Repo.GetDevice(ctx, op.Device.SerialNum)
+		if err != nil {
+			return op, err
+		}
+		if op.Revision != 0 && op.Revision != current.Revision {
+			return op, fmt.Errorf("%w: device is at revision %d, not %d",
+				domain.ErrPreconditionFailed, current.Revision, op.Revision)
+		}
+		if err := recordTransition(current, &op.Device, domain.Transition{Actor: domain.ActorFrom(ctx)}); err != nil {
+			return op, err
+		}
+		op.Revision = current.Revision
+		return op, nil
+	case domain.OpDelete:
+		if op.SerialNum == "" {
+			return op, domain.NewValidationError(domain.FieldError{Field: "serial_num", Message: "must not be empty"})
+		}
+		return op, nil
+	default:
+		return op, domain.NewValidationError(domain.FieldError{Field: "op", Message: fmt.Sprintf("unsupported operation %q", op.Op)})
+	}
+}
@@ -1,44 +1,125 @@
 package impl
 
 import (
-	"fmt"
+	"context"
 	"homework/internal/domain"
+	"homework/internal/rbac"
 	"homework/internal/repository"
 )
 
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 1000
+
+	// maxModifyAttempts bounds how often an unconditional read-modify-write
+	// is retried when a concurrent writer bumps the revision in between.
+	maxModifyAttempts = 5
+)
+
 type UseCase struct {
 	Repo repository.Device
+	// Policy decides what the principal of the context may do; nil allows
+	// everything.
+	Policy *rbac.Policy
 }
 
-func (uc *UseCase) GetDevice(serialNum string) (domain.Device, error) {
-	device, err := uc.Repo.GetDevice(serialNum)
+func (uc *UseCase) GetDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	scope, err := uc.Policy.Scope(ctx, rbac.DevicesRead)
+	if err != nil {
+		return domain.Device{}, err
+	}
+	device, err := uc.Repo.GetDevice(ctx, serialNum)
 	if err != nil {
 		return device, err
 	}
+	if err := checkReadable(scope, device); err != nil {
+		return domain.Device{}, err
+	}
 	return device, nil
 }
 
-func (uc *UseCase) CreateDevice(d domain.Device) error {
-	err := uc.Repo.CreateDevice(d)
+// CreateDevice stores a new device and returns it as stored, with its
+// revision and timestamps.
+func (uc *UseCase) CreateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	scope, err := uc.Policy.Scope(ctx, rbac.DevicesCreate)
 	if err != nil {
-		return fmt.Errorf("usecase createDevice %v", err)
+		return domain.Device{}, err
 	}
-	return nil
+	if d.Status == "" {
+		d.Status = domain.DefaultStatus
+	}
+	d.Transitions = nil
+	if err := d.Validate(); err != nil {
+		return domain.Device{}, err
+	}
+	if err := scope.Check(d); err != nil {
+		return domain.Device{}, err
+	}
+	return uc.Repo.CreateDevice(ctx, d)
 }
-func (uc *UseCase) DeleteDevice(serialNum string) error {
-	err := uc.Repo.DeleteDevice(serialNum)
+func (uc *UseCase) DeleteDevice(ctx context.Context, serialNum string, revision uint64) error {
+	if err := uc.authorizeStored(ctx, rbac.DevicesDelete, serialNum); err != nil {
+		return err
+	}
+	err := uc.Repo.DeleteDevice(ctx, serialNum, revision)
 	if err != nil {
 		return err
 	}
 	return nil
 }
-func (uc *UseCase) UpdateDevice(d domain.Device) error {
-	err := uc.Repo.UpdateDevice(d)
+
+// UpdateDevice replaces the device. A status change must be a legal
+// lifecycle transition and is recorded in the device's history. It returns
+// the device as stored, like CreateDevice.
+func (uc *UseCase) UpdateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	if err := d.Validate(); err != nil {
+		return domain.Device{}, err
+	}
+	if d.Status != "" {
+		return uc.modify(ctx, d.SerialNum, d.Revision, func(current domain.Device) (domain.Device, error) {
+			next := d
+			if err := recordTransition(current, &next, domain.Transition{Actor: domain.ActorFrom(ctx)}); err != nil {
+				return domain.Device{}, err
+			}
+			return next, nil
+		})
+	}
+
+	if err := uc.authorizeStored(ctx, rbac.DevicesUpdate, d.SerialNum); err != nil {
+		return domain.Device{}, err
+	}
+	if err := uc.authorize(ctx, rbac.DevicesUpdate, d); err != nil {
+		return domain.Device{}, err
+	}
+	// The repository keeps the stored status and history.
+	d.Transitions = nil
+	return uc.Repo.UpdateDevice(ctx, d)
+}
+
+// ListDevices pages through devices. A caller allowed to read only some
+// devices gets only those, so a page may be shorter than the limit even
+// when more follow.
+func (uc *UseCase) ListDevices(ctx context.Context, f domain.DeviceFilter) (domain.DevicePage, error) {
+	scope, err := uc.Policy.Scope(ctx, rbac.DevicesRead)
 	if err != nil {
-		return err
+		return domain.DevicePage{}, err
 	}
-	return nil
+	if f.SortBy == "" {
+		f.SortBy = domain.SortBySerialNum
+	}
+	if f.Limit <= 0 {
+		f.Limit = DefaultPageSize
+	}
+	if f.Limit > MaxPageSize {
+		f.Limit = MaxPageSize
+	}
+	page, err := uc.Repo.ListDevices(ctx, f)
+	if err != nil {
+		return domain.DevicePage{}, err
+	}
+	page.Devices = visible(scope, page.Devices)
+	return page, nil
 }
-func New(r *repository.Repo) *UseCase {
+func New(r repository.Device) *UseCase {
 	return &UseCase{Repo: r}
 }
@@ -0,0 +1,84 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"homework/internal/domain"
+	"homework/internal/rbac"
+)
+
+func (uc *UseCase) GetDeviceHistory(ctx context.Context, serialNum string) ([]domain.HistoryEntry, error) {
+	scope, err := uc.Policy.Scope(ctx, rbac.DevicesRead)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := uc.Repo.GetDeviceHistory(ctx, serialNum)
+	if err != nil {
+		return nil, err
+	}
+	// The scope is judged by the latest state of the device, so its past
+	// is visible to whoever may read it now.
+	if len(entries) > 0 {
+		if err := checkReadable(scope, entryDevice(entries[len(entries)-1])); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// RevertDevice restores the fields the device had at toRevision. The restore
+// is an ordinary update: it is validated, its status change must be a legal
+// transition, and it gets a new revision and history entry of its own.
+// revision is the caller's expected current revision, 0 for unconditional.
+// The caller needs to be able to read the device as well as update it.
+func (uc *UseCase) RevertDevice(ctx context.Context, serialNum string, toRevision, revision uint64) (domain.Device, error) {
+	entries, err := uc.GetDeviceHistory(ctx, serialNum)
+	if err != nil {
+		return domain.Device{}, err
+	}
+	// A serial number can be deleted and created again, which restarts its
+	// revisions; the newest match is the one the client is looking at.
+	var target *domain.Device
+	for i := len(entries) - 1; i >= 0 && target == nil; i-- {
+		if after := entries[i].After; after != nil && after.Revision == toRevision {
+			target = after
+		}
+	}
+	if target == nil {
+		return domain.Device{}, fmt.Errorf("%w: no revision %d in history", domain.ErrNotFound, toRevision)
+	}
+
+	d := target.Clone()
+	d.Revision = revision
+	d.Transitions = nil
+	return uc.UpdateDevice(ctx, d)
+}
+
+// WatchDevices streams device changes; see repository.Device.Watch. A
+// caller allowed to read only some devices gets only their changes.
+func (uc *UseCase) WatchDevices(ctx context.Context, fromVersion uint64) (<-chan domain.HistoryEntry, error) {
+	scope, err := uc.Policy.Scope(ctx, rbac.DevicesRead)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := uc.Repo.Watch(ctx, fromVersion)
+	if err != nil || scope.All() {
+		return changes, err
+	}
+	out := make(chan domain.HistoryEntry)
+	go func() {
+		// Closing out when changes closes passes on both the end of ctx
+		// and a subscriber that fell behind.
+		defer close(out)
+		for e := range changes {
+			if !scope.Covers(entryDevice(e)) {
+				continue
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,129 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"homework/internal/domain"
+	"homework/internal/rbac"
+	"sort"
+)
+
+// ImportDevices creates the devices of rows; a serial number that already
+// exists is skipped, overwritten or rejected as opts.OnConflict says. Rows
+// are validated like CreateDevice and UpdateDevice and rejected rows are
+// reported by row number. With domain.ConflictFail any rejected row makes
+// the import write nothing.
+func (uc *UseCase) ImportDevices(ctx context.Context, rows []domain.ImportRow, opts domain.ImportOptions) (domain.ImportReport, error) {
+	if opts.OnConflict == "" {
+		opts.OnConflict = domain.ConflictFail
+	}
+	if !opts.OnConflict.Valid() {
+		return domain.ImportReport{}, domain.NewValidationError(domain.FieldError{
+			Field:   "on_conflict",
+			Message: fmt.Sprintf("unknown value %q; want fail, skip or overwrite", opts.OnConflict),
+		})
+	}
+
+	report := domain.ImportReport{DryRun: opts.DryRun}
+	reject := func(row domain.ImportRow, err error) {
+		report.Errors = append(report.Errors, domain.ImportError{Row: row.Row, SerialNum: row.Device.SerialNum, Err: err})
+	}
+	seen := make(map[string]int, len(rows))
+	ops := make([]domain.BatchOperation, 0, len(rows))
+	opRows := make([]domain.ImportRow, 0, len(rows))
+	for _, row := range rows {
+		if row.Err != nil {
+			reject(row, row.Err)
+			continue
+		}
+		if first, ok := seen[row.Device.SerialNum]; ok {
+			reject(row, domain.NewValidationError(domain.FieldError{
+				Field:   "serial_num",
+				Message: fmt.Sprintf("already imported from row %d", first),
+			}))
+			continue
+		}
+		op, err := uc.importOp(ctx, row.Device, opts.OnConflict)
+		if err != nil {
+			reject(row, err)
+			continue
+		}
+		seen[row.Device.SerialNum] = row.Row
+		if op == nil {
+			report.Skipped++
+			continue
+		}
+		ops = append(ops, *op)
+		opRows = append(opRows, row)
+	}
+
+	atomic := opts.OnConflict == domain.ConflictFail
+	if atomic && len(report.Errors) > 0 {
+		return report, nil
+	}
+	if opts.DryRun || len(ops) == 0 {
+		for _, op := range ops {
+			countImported(&report, op.Op)
+		}
+		return report, nil
+	}
+
+	// BatchDevices checks the operations again, which also keeps an import
+	// within MaxBatchSize.
+	results, err := uc.BatchDevices(ctx, ops, atomic)
+	if err != nil {
+		return domain.ImportReport{}, err
+	}
+	for i, r := range results {
+		switch {
+		case r.Err == nil:
+			countImported(&report, ops[i].Op)
+		case errors.Is(r.Err, domain.ErrAborted):
+		case opts.OnConflict == domain.ConflictSkip && errors.Is(r.Err, domain.ErrAlreadyExists):
+			// Created by someone else since it was looked up.
+			report.Skipped++
+		default:
+			reject(opRows[i], r.Err)
+		}
+	}
+	sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Row < report.Errors[j].Row })
+	return report, nil
+}
+
+// importOp turns d into a create, or into an update if it exists and
+// onConflict is overwrite. A nil op means the row is skipped.
+func (uc *UseCase) importOp(ctx context.Context, d domain.Device, onConflict domain.OnConflict) (*domain.BatchOperation, error) {
+	op, err := uc.prepareBatchOp(ctx, domain.BatchOperation{Op: domain.OpCreate, Device: d})
+	if err != nil {
+		return nil, err
+	}
+	current, err := uc.Repo.GetDevice(ctx, d.SerialNum)
+	if errors.Is(err, domain.ErrNotFound) {
+		return &op, uc.authorizeBatchOp(ctx, op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch onConflict {
+	case domain.ConflictSkip:
+		// Skipping tells that the device exists.
+		return nil, uc.authorize(ctx, rbac.DevicesRead, current)
+	case domain.ConflictOverwrite:
+		op, err := uc.prepareBatchOp(ctx, domain.BatchOperation{Op: domain.OpUpdate, Device: d})
+		if err != nil {
+			return nil, err
+		}
+		return &op, uc.authorizeBatchOp(ctx, op)
+	default:
+		return nil, fmt.Errorf("%w: device is already in repository", domain.ErrAlreadyExists)
+	}
+}
+
+func countImported(report *domain.ImportReport, op domain.Operation) {
+	if op == domain.OpCreate {
+		report.Created++
+	} else {
+		report.Updated++
+	}
+}
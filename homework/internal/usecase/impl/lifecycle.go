@@ -0,0 +1,132 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"homework/internal/domain"
+	"homework/internal/rbac"
+	"time"
+)
+
+// lifecycle lists the statuses a device may move to from each status.
+// Disposed is final.
+var lifecycle = map[domain.Status][]domain.Status{
+	domain.StatusOrdered:        {domain.StatusProvisioned},
+	domain.StatusProvisioned:    {domain.StatusActive, domain.StatusDecommissioned},
+	domain.StatusActive:         {domain.StatusMaintenance, domain.StatusDecommissioned},
+	domain.StatusMaintenance:    {domain.StatusActive, domain.StatusDecommissioned},
+	domain.StatusDecommissioned: {domain.StatusDisposed},
+	domain.StatusDisposed:       nil,
+}
+
+func checkTransition(from, to domain.Status) error {
+	for _, s := range lifecycle[from] {
+		if s == to {
+			return nil
+		}
+	}
+	return &domain.TransitionError{From: from, To: to, Allowed: lifecycle[from]}
+}
+
+// recordTransition carries the status history of current over to next and,
+// if next changes the status, checks the move and appends it to the history
+// with the actor and reason of t. An empty next.Status keeps the current one.
+func recordTransition(current domain.Device, next *domain.Device, t domain.Transition) error {
+	next.Transitions = current.Transitions
+	if next.Status == "" || next.Status == current.Status {
+		next.Status = current.Status
+		return nil
+	}
+	if err := checkTransition(current.Status, next.Status); err != nil {
+		return err
+	}
+	t.From = current.Status
+	t.To = next.Status
+	t.At = time.Now().UTC()
+	next.Transitions = append(next.Transitions, t)
+	return nil
+}
+
+// TransitionDevice moves the device to t.To and records who did it and why.
+// The actor is always the one of ctx; t.Actor is ignored so callers cannot
+// attribute the change to someone else. Staying in the same status is not a
+// transition and is rejected too.
+func (uc *UseCase) TransitionDevice(ctx context.Context, serialNum string, t domain.Transition, revision uint64) (domain.Device, error) {
+	t.Actor = domain.ActorFrom(ctx)
+	if err := validateTransition(t); err != nil {
+		return domain.Device{}, err
+	}
+	return uc.modify(ctx, serialNum, revision, func(current domain.Device) (domain.Device, error) {
+		if current.Status == t.To {
+			return domain.Device{}, &domain.TransitionError{From: current.Status, To: t.To, Allowed: lifecycle[current.Status]}
+		}
+		next := current
+		next.Status = t.To
+		if err := recordTransition(current, &next, t); err != nil {
+			return domain.Device{}, err
+		}
+		return next, nil
+	})
+}
+
+func validateTransition(t domain.Transition) error {
+	var fields []domain.FieldError
+	if !t.To.Valid() {
+		fields = append(fields, domain.FieldError{Field: "to", Message: fmt.Sprintf("unknown status %q", t.To)})
+	}
+	if t.Actor == "" {
+		fields = append(fields, domain.FieldError{Field: "actor", Message: "must not be empty"})
+	}
+	if len(fields) > 0 {
+		return domain.NewValidationError(fields...)
+	}
+	return nil
+}
+
+// modify runs a read-modify-write of the device, which the caller has to be
+// allowed to update. The write is conditional on the revision fn saw, so a
+// concurrent update is never overwritten: with revision != 0 the caller gets
+// ErrPreconditionFailed, otherwise fn is retried on fresh state. It returns
+// the stored result.
+func (uc *UseCase) modify(ctx context.Context, serialNum string, revision uint64, fn func(current domain.Device) (domain.Device, error)) (domain.Device, error) {
+	scope, err := uc.Policy.Scope(ctx, rbac.DevicesUpdate)
+	if err != nil {
+		return domain.Device{}, err
+	}
+	for attempt := 1; ; attempt++ {
+		current, err := uc.Repo.GetDevice(ctx, serialNum)
+		if err != nil {
+			return domain.Device{}, err
+		}
+		if revision != 0 && current.Revision != revision {
+			return domain.Device{}, fmt.Errorf("%w: device is at revision %d, not %d",
+				domain.ErrPreconditionFailed, current.Revision, revision)
+		}
+		// Neither the device before nor after the change may be out of
+		// reach, so a device cannot be moved out of the caller's scope.
+		if err := scope.Check(current); err != nil {
+			return domain.Device{}, err
+		}
+
+		next, err := fn(current)
+		if err != nil {
+			return domain.Device{}, err
+		}
+		if err := next.Validate(); err != nil {
+			return domain.Device{}, err
+		}
+		if err := scope.Check(next); err != nil {
+			return domain.Device{}, err
+		}
+
+		next.Revision = current.Revision
+		updated, err := uc.Repo.UpdateDevice(ctx, next)
+		if err == nil {
+			return updated, nil
+		}
+		if revision != 0 || !errors.Is(err, domain.ErrPreconditionFailed) || attempt == maxModifyAttempts {
+			return domain.Device{}, err
+		}
+	}
+}
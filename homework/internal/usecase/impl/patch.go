@@ -0,0 +1,78 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"homework/internal/domain"
+)
+
+// PatchDevice applies p to the current state of the device and stores the
+// result through the same validation and lifecycle checks as UpdateDevice.
+// A patch is applied to the revision it was read at; see modify for how
+// concurrent updates are handled.
+func (uc *UseCase) PatchDevice(ctx context.Context, serialNum string, p domain.Patch, revision uint64) (domain.Device, error) {
+	return uc.modify(ctx, serialNum, revision, func(current domain.Device) (domain.Device, error) {
+		next, err := applyPatch(current, p)
+		if err != nil {
+			return domain.Device{}, err
+		}
+		if err := recordTransition(current, &next, domain.Transition{Actor: domain.ActorFrom(ctx)}); err != nil {
+			return domain.Device{}, err
+		}
+		return next, nil
+	})
+}
+
+func applyPatch(current domain.Device, p domain.Patch) (domain.Device, error) {
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return domain.Device{}, fmt.Errorf("encode device: %w", err)
+	}
+
+	switch p.Type {
+	case domain.MergePatch:
+		doc, err = jsonpatch.MergePatch(doc, p.Document)
+		if err != nil {
+			return domain.Device{}, patchError(err)
+		}
+	case domain.JSONPatch:
+		ops, err := jsonpatch.DecodePatch(p.Document)
+		if err != nil {
+			return domain.Device{}, patchError(err)
+		}
+		doc, err = ops.Apply(doc)
+		if errors.Is(err, jsonpatch.ErrTestFailed) {
+			return domain.Device{}, fmt.Errorf("%w: %v", domain.ErrConflict, err)
+		}
+		if err != nil {
+			return domain.Device{}, patchError(err)
+		}
+	default:
+		return domain.Device{}, domain.NewValidationError(domain.FieldError{
+			Field:   "Content-Type",
+			Message: fmt.Sprintf("unsupported patch type %q", p.Type),
+		})
+	}
+
+	var next domain.Device
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&next); err != nil {
+		return domain.Device{}, patchError(err)
+	}
+	if next.SerialNum != current.SerialNum {
+		return domain.Device{}, domain.NewValidationError(domain.FieldError{
+			Field:   "serial_num",
+			Message: "is immutable",
+		})
+	}
+	return next, nil
+}
+
+func patchError(err error) error {
+	return domain.NewValidationError(domain.FieldError{Field: "patch", Message: err.Error()})
+}
@@ -0,0 +1,55 @@
+package impl
+
+import (
+	"context"
+	"homework/internal/domain"
+	"homework/internal/rbac"
+	"time"
+)
+
+func (uc *UseCase) ListTrash(ctx context.Context) ([]domain.Device, error) {
+	scope, err := uc.Policy.Scope(ctx, rbac.DevicesRead)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := uc.Repo.ListTrash(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return visible(scope, devices), nil
+}
+
+func (uc *UseCase) RestoreDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	scope, err := uc.Policy.Scope(ctx, rbac.DevicesRestore)
+	if err != nil {
+		return domain.Device{}, err
+	}
+	if !scope.All() {
+		trash, err := uc.Repo.ListTrash(ctx)
+		if err != nil {
+			return domain.Device{}, err
+		}
+		for _, d := range trash {
+			if d.SerialNum == serialNum {
+				if err := scope.Check(d); err != nil {
+					return domain.Device{}, err
+				}
+			}
+		}
+	}
+	return uc.Repo.RestoreDevice(ctx, serialNum)
+}
+
+// PurgeTrash removes devices that have been in the trash for longer than
+// retention and reports how many were removed. It needs the permission for
+// every device.
+func (uc *UseCase) PurgeTrash(ctx context.Context, retention time.Duration) (int, error) {
+	scope, err := uc.Policy.Scope(ctx, rbac.DevicesPurge)
+	if err != nil {
+		return 0, err
+	}
+	if !scope.All() {
+		return 0, &domain.PermissionError{Permission: string(rbac.DevicesPurge)}
+	}
+	return uc.Repo.PurgeTrash(ctx, time.Now().Add(-retention))
+}
@@ -3,9 +3,12 @@
 package mocks
 
 import (
+	context "context"
 	domain "homework/internal/domain"
 
 	mock "github.com/stretchr/testify/mock"
+
+	time "time"
 )
 
 // Device is an autogenerated mock type for the Device type
@@ -13,27 +16,63 @@ type Device struct {
 	mock.Mock
 }
 
-// CreateDevice provides a mock function with given fields: d
-func (_m *Device) CreateDevice(d domain.Device) error {
-	ret := _m.Called(d)
+// BatchDevices provides a mock function with given fields: ctx, ops, atomic
+func (_m *Device) BatchDevices(ctx context.Context, ops []domain.BatchOperation, atomic bool) ([]domain.BatchResult, error) {
+	ret := _m.Called(ctx, ops, atomic)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(domain.Device) error); ok {
-		r0 = rf(d)
+	var r0 []domain.BatchResult
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, []domain.BatchOperation, bool) ([]domain.BatchResult, error)); ok {
+		return rf(ctx, ops, atomic)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, []domain.BatchOperation, bool) []domain.BatchResult); ok {
+		r0 = rf(ctx, ops, atomic)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.BatchResult)
+		}
 	}
 
-	return r0
+	if rf, ok := ret.Get(1).(func(context.Context, []domain.BatchOperation, bool) error); ok {
+		r1 = rf(ctx, ops, atomic)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CreateDevice provides a mock function with given fields: ctx, d
+func (_m *Device) CreateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	ret := _m.Called(ctx, d)
+
+	var r0 domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, domain.Device) (domain.Device, error)); ok {
+		return rf(ctx, d)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, domain.Device) domain.Device); ok {
+		r0 = rf(ctx, d)
+	} else {
+		r0 = ret.Get(0).(domain.Device)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, domain.Device) error); ok {
+		r1 = rf(ctx, d)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
-// DeleteDevice provides a mock function with given fields: _a0
-func (_m *Device) DeleteDevice(_a0 string) error {
-	ret := _m.Called(_a0)
+// DeleteDevice provides a mock function with given fields: ctx, serialNum, revision
+func (_m *Device) DeleteDevice(ctx context.Context, serialNum string, revision uint64) error {
+	ret := _m.Called(ctx, serialNum, revision)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint64) error); ok {
+		r0 = rf(ctx, serialNum, revision)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -41,23 +80,23 @@ func (_m *Device) DeleteDevice(_a0 string) error {
 	return r0
 }
 
-// GetDevice provides a mock function with given fields: _a0
-func (_m *Device) GetDevice(_a0 string) (domain.Device, error) {
-	ret := _m.Called(_a0)
+// GetDevice provides a mock function with given fields: ctx, serialNum
+func (_m *Device) GetDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	ret := _m.Called(ctx, serialNum)
 
 	var r0 domain.Device
 	var r1 error
-	if rf, ok := ret.Get(0).(func(string) (domain.Device, error)); ok {
-		return rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string) (domain.Device, error)); ok {
+		return rf(ctx, serialNum)
 	}
-	if rf, ok := ret.Get(0).(func(string) domain.Device); ok {
-		r0 = rf(_a0)
+	if rf, ok := ret.Get(0).(func(context.Context, string) domain.Device); ok {
+		r0 = rf(ctx, serialNum)
 	} else {
 		r0 = ret.Get(0).(domain.Device)
 	}
 
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(_a0)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, serialNum)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -65,18 +104,178 @@ func (_m *Device) GetDevice(_a0 string) (domain.Device, error) {
 	return r0, r1
 }
 
-// UpdateDevice provides a mock function with given fields: _a0
-func (_m *Device) UpdateDevice(_a0 domain.Device) error {
-	ret := _m.Called(_a0)
+// GetDeviceHistory provides a mock function with given fields: ctx, serialNum
+func (_m *Device) GetDeviceHistory(ctx context.Context, serialNum string) ([]domain.HistoryEntry, error) {
+	ret := _m.Called(ctx, serialNum)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(domain.Device) error); ok {
-		r0 = rf(_a0)
+	var r0 []domain.HistoryEntry
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) ([]domain.HistoryEntry, error)); ok {
+		return rf(ctx, serialNum)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string) []domain.HistoryEntry); ok {
+		r0 = rf(ctx, serialNum)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.HistoryEntry)
+		}
 	}
 
-	return r0
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, serialNum)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListDevices provides a mock function with given fields: ctx, f
+func (_m *Device) ListDevices(ctx context.Context, f domain.DeviceFilter) (domain.DevicePage, error) {
+	ret := _m.Called(ctx, f)
+
+	var r0 domain.DevicePage
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, domain.DeviceFilter) (domain.DevicePage, error)); ok {
+		return rf(ctx, f)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, domain.DeviceFilter) domain.DevicePage); ok {
+		r0 = rf(ctx, f)
+	} else {
+		r0 = ret.Get(0).(domain.DevicePage)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, domain.DeviceFilter) error); ok {
+		r1 = rf(ctx, f)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListTrash provides a mock function with given fields: ctx
+func (_m *Device) ListTrash(ctx context.Context) ([]domain.Device, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context) ([]domain.Device, error)); ok {
+		return rf(ctx)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context) []domain.Device); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.Device)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// PurgeTrash provides a mock function with given fields: ctx, deletedBefore
+func (_m *Device) PurgeTrash(ctx context.Context, deletedBefore time.Time) (int, error) {
+	ret := _m.Called(ctx, deletedBefore)
+
+	var r0 int
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) (int, error)); ok {
+		return rf(ctx, deletedBefore)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) int); ok {
+		r0 = rf(ctx, deletedBefore)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time) error); ok {
+		r1 = rf(ctx, deletedBefore)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RestoreDevice provides a mock function with given fields: ctx, serialNum
+func (_m *Device) RestoreDevice(ctx context.Context, serialNum string) (domain.Device, error) {
+	ret := _m.Called(ctx, serialNum)
+
+	var r0 domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) (domain.Device, error)); ok {
+		return rf(ctx, serialNum)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string) domain.Device); ok {
+		r0 = rf(ctx, serialNum)
+	} else {
+		r0 = ret.Get(0).(domain.Device)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, serialNum)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpdateDevice provides a mock function with given fields: ctx, d
+func (_m *Device) UpdateDevice(ctx context.Context, d domain.Device) (domain.Device, error) {
+	ret := _m.Called(ctx, d)
+
+	var r0 domain.Device
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, domain.Device) (domain.Device, error)); ok {
+		return rf(ctx, d)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, domain.Device) domain.Device); ok {
+		r0 = rf(ctx, d)
+	} else {
+		r0 = ret.Get(0).(domain.Device)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, domain.Device) error); ok {
+		r1 = rf(ctx, d)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Watch provides a mock function with given fields: ctx, fromVersion
+func (_m *Device) Watch(ctx context.Context, fromVersion uint64) (<-chan domain.HistoryEntry, error) {
+	ret := _m.Called(ctx, fromVersion)
+
+	var r0 <-chan domain.HistoryEntry
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, uint64) (<-chan domain.HistoryEntry, error)); ok {
+		return rf(ctx, fromVersion)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, uint64) <-chan domain.HistoryEntry); ok {
+		r0 = rf(ctx, fromVersion)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(<-chan domain.HistoryEntry)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, uint64) error); ok {
+		r1 = rf(ctx, fromVersion)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
 // NewDevice creates a new instance of Device. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.